@@ -0,0 +1,196 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// error codes sent back for accounts that can't log in because of their status
+const (
+	errAccountSuspended = "account_suspended"
+	errAccountLocked    = "account_locked"
+)
+
+// maxReasonLength is the longest reason we record for a status change
+const maxReasonLength = 500
+
+// statusRefusal says why an account that isn't active can't log in or refresh its
+// tokens: the error code, the HTTP status and the error to send
+func statusRefusal(status string) (string, int, error) {
+	switch status {
+	case data.StatusPendingVerification:
+		return errAccountInactive, http.StatusForbidden, errors.New("account has not been verified")
+	case data.StatusSuspended:
+		return errAccountSuspended, http.StatusForbidden, errors.New("account has been suspended")
+	case data.StatusLocked:
+		return errAccountLocked, http.StatusForbidden, errors.New("account has been locked, contact support to restore it")
+	}
+
+	// deleted accounts look like they don't exist
+	return "", http.StatusUnauthorized, errors.New("invalid credentials")
+}
+
+// changeStatus moves a user to another status, acting as the user making the request;
+// r is nil for changes the service makes itself. An account that stops being active
+// is logged out everywhere. Every change is published, so other services can react to
+// it, and the user is updated in place.
+func (app *Config) changeStatus(r *http.Request, user *data.User, to, reason string) (*data.StatusChange, error) {
+	ctx := context.Background()
+	actorID := 0
+	if r != nil {
+		ctx = r.Context()
+		actorID = userIDFromContext(ctx)
+	}
+
+	change, err := app.Models.User.Transition(ctx, user.ID, to, reason, actorID)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Status = change.To
+	if change.To == data.StatusActive {
+		user.Active = 1
+	} else {
+		user.Active = 0
+	}
+
+	if change.From == data.StatusActive {
+		err = app.Models.Session.RevokeAllForUser(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	severity := event.SeverityInfo
+	if change.To == data.StatusSuspended || change.To == data.StatusLocked {
+		severity = event.SeverityWarning
+	}
+
+	app.audit(r, event.Event{
+		Name:     eventAccountStatusChanged,
+		Data:     fmt.Sprintf("account %s changed from %s to %s: %s", user.Email, change.From, change.To, reason),
+		Severity: severity,
+		UserID:   user.ID,
+		Email:    user.Email,
+		Attributes: map[string]string{
+			"from":   change.From,
+			"to":     change.To,
+			"reason": reason,
+		},
+	})
+
+	return change, nil
+}
+
+// SuspendUser shuts an account off until an admin restores it. The user is logged out
+// everywhere straight away.
+func (app *Config) SuspendUser(w http.ResponseWriter, r *http.Request) {
+	app.setStatus(w, r, data.StatusSuspended)
+}
+
+// RestoreUser makes a suspended or locked account active again
+func (app *Config) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	app.setStatus(w, r, data.StatusActive)
+}
+
+// setStatus moves the user named in the URL to status, for the reason given in the
+// request
+func (app *Config) setStatus(w http.ResponseWriter, r *http.Request, status string) {
+	var requestPayload struct {
+		Reason string `json:"reason"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	reason := strings.TrimSpace(requestPayload.Reason)
+	if reason == "" {
+		app.errorJSON(w, errors.New("a reason is required"), http.StatusBadRequest)
+		return
+	}
+	if len(reason) > maxReasonLength {
+		app.errorJSON(w, fmt.Errorf("reason must be at most %d characters", maxReasonLength), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.userFromURL(w, r)
+	if !ok || !app.soleOrganization(w, r, user) {
+		return
+	}
+
+	if user.ID == userIDFromContext(r.Context()) {
+		app.errorJSON(w, errors.New("you can't change the status of your own account"), http.StatusBadRequest)
+		return
+	}
+
+	change, err := app.changeStatus(r, user, status, reason)
+	if err != nil {
+		app.statusChangeError(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Account %s is now %s", user.Email, change.To),
+		Data:    change,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// GetStatusHistory lists every status change of the user named in the URL
+func (app *Config) GetStatusHistory(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	changes, err := app.Models.User.StatusHistory(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Account %s is %s", user.Email, user.Status),
+		Data:    changes,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// statusForActive is the status the legacy active flag asks for: 1 makes an account
+// active, and 0 suspends an active one. Accounts that already can't log in stay as
+// they are.
+func statusForActive(current string, active int) string {
+	if active == 1 {
+		return data.StatusActive
+	}
+	if current == data.StatusActive {
+		return data.StatusSuspended
+	}
+
+	return current
+}
+
+// statusChangeError sends the right response for an error from changeStatus
+func (app *Config) statusChangeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, data.ErrInvalidTransition):
+		app.errorJSON(w, err, http.StatusConflict)
+	case errors.Is(err, sql.ErrNoRows):
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+	default:
+		app.errorJSON(w, err, http.StatusInternalServerError)
+	}
+}
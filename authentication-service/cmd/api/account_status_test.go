@@ -0,0 +1,129 @@
+package main
+
+import (
+	"authentication/data"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSuspendUserRequests(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser(t, "user@example.com")
+	admin := app.createUser(t, "admin@example.com", "admin")
+	app.createUser(t, "other@example.com")
+	adminToken := app.mfaLogin(t, "admin@example.com").AccessToken
+	otherToken := app.mfaLogin(t, "other@example.com").AccessToken
+
+	reason := map[string]string{"reason": "chargeback"}
+
+	tests := []struct {
+		name   string
+		token  string
+		userID int
+		body   map[string]string
+		status int
+	}{
+		{"without the permission", otherToken, user.ID, reason, http.StatusForbidden},
+		{"without a reason", adminToken, user.ID, map[string]string{"reason": "  "}, http.StatusBadRequest},
+		{"with a reason too long", adminToken, user.ID, map[string]string{"reason": strings.Repeat("x", maxReasonLength+1)}, http.StatusBadRequest},
+		{"their own account", adminToken, admin.ID, reason, http.StatusBadRequest},
+		{"someone who doesn't exist", adminToken, 999, reason, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := fmt.Sprintf("/admin/users/%d/suspend", tt.userID)
+			status, response := app.do(t, http.MethodPost, path, tt.token, tt.body)
+			if status != tt.status {
+				t.Errorf("got %d %q, want %d", status, response.Message, tt.status)
+			}
+		})
+	}
+
+	if n := len(app.events.named(eventAccountStatusChanged)); n != 0 {
+		t.Errorf("got %d status changes from refused requests", n)
+	}
+}
+
+func TestSuspendAndRestore(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser(t, "user@example.com")
+	admin := app.createUser(t, "admin@example.com", "admin")
+	token := app.mfaLogin(t, "admin@example.com").AccessToken
+	refresh := app.login(t, "user@example.com").RefreshToken
+
+	suspend := fmt.Sprintf("/admin/users/%d/suspend", user.ID)
+	restore := fmt.Sprintf("/admin/users/%d/restore", user.ID)
+
+	status, response := app.do(t, http.MethodPost, suspend, token, map[string]string{"reason": "chargeback"})
+	if status != http.StatusAccepted {
+		t.Fatalf("suspending got %d %q", status, response.Message)
+	}
+	var change data.StatusChange
+	decodeData(t, response, &change)
+	if change.From != data.StatusActive || change.To != data.StatusSuspended || change.ActorID != admin.ID {
+		t.Errorf("got change %+v", change)
+	}
+
+	// the user is logged out and can't log back in
+	status, _ = app.do(t, http.MethodPost, "/refresh", "", map[string]string{"refresh_token": refresh})
+	if status != http.StatusUnauthorized {
+		t.Errorf("refresh got %d, want %d", status, http.StatusUnauthorized)
+	}
+	status, response = app.do(t, http.MethodPost, "/login", "", map[string]string{
+		"email":    "user@example.com",
+		"password": testPassword,
+	})
+	if status != http.StatusForbidden || response.Code != errAccountSuspended {
+		t.Errorf("login got %d %q, want %d %s", status, response.Code, http.StatusForbidden, errAccountSuspended)
+	}
+
+	// the state machine has no move from suspended to suspended
+	status, _ = app.do(t, http.MethodPost, suspend, token, map[string]string{"reason": "again"})
+	if status != http.StatusConflict {
+		t.Errorf("suspending twice got %d, want %d", status, http.StatusConflict)
+	}
+
+	status, response = app.do(t, http.MethodPost, restore, token, map[string]string{"reason": "paid up"})
+	if status != http.StatusAccepted {
+		t.Fatalf("restoring got %d %q", status, response.Message)
+	}
+	app.login(t, "user@example.com")
+
+	status, _ = app.do(t, http.MethodPost, restore, token, map[string]string{"reason": "again"})
+	if status != http.StatusConflict {
+		t.Errorf("restoring twice got %d, want %d", status, http.StatusConflict)
+	}
+
+	// each change is published and kept in the history, with its reason and actor
+	published := app.events.named(eventAccountStatusChanged)
+	if len(published) != 2 {
+		t.Fatalf("got %d status change events, want 2", len(published))
+	}
+	for i, want := range []map[string]string{
+		{"from": data.StatusActive, "to": data.StatusSuspended, "reason": "chargeback"},
+		{"from": data.StatusSuspended, "to": data.StatusActive, "reason": "paid up"},
+	} {
+		e := published[i]
+		if e.UserID != user.ID || e.Attributes["from"] != want["from"] || e.Attributes["to"] != want["to"] || e.Attributes["reason"] != want["reason"] {
+			t.Errorf("event %d: got %+v, want %v", i+1, e, want)
+		}
+	}
+
+	status, response = app.do(t, http.MethodGet, fmt.Sprintf("/admin/users/%d/status-history", user.ID), token, nil)
+	if status != http.StatusAccepted {
+		t.Fatalf("status history got %d %q", status, response.Message)
+	}
+	var history []data.StatusChange
+	decodeData(t, response, &history)
+	if len(history) != 2 {
+		t.Fatalf("got history %+v, want 2 changes", history)
+	}
+	for _, change := range history {
+		if change.ActorID != admin.ID {
+			t.Errorf("change %+v wasn't made by the admin", change)
+		}
+	}
+}
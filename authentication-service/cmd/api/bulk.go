@@ -0,0 +1,712 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"authentication/policy"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	// maxImportBytes is the largest import we accept over HTTP; bigger files can be
+	// loaded with the import command
+	maxImportBytes = 64 << 20
+	// maxImportLine is the longest NDJSON line we read
+	maxImportLine = 64 << 10
+)
+
+// errImportPassword is returned for an import row that sets the password of a user
+// who already exists
+var errImportPassword = errors.New("an import can't change the password of an existing user")
+
+// importColumns are the CSV columns an import understands. id, status, created_at and
+// updated_at are accepted so an export can be imported again, but they are ignored.
+var importColumns = map[string]bool{
+	"email":      true,
+	"first_name": true,
+	"last_name":  true,
+	"password":   true,
+	"active":     true,
+	"id":         false,
+	"status":     false,
+	"created_at": false,
+	"updated_at": false,
+}
+
+// importRow is one user read from an import. Fields that are nil were left out, and
+// an existing user keeps their current value for them.
+type importRow struct {
+	Email     string  `json:"email"`
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Password  *string `json:"password"`
+	Active    *int    `json:"active"`
+
+	line int
+	// errors found while reading the row, before it is validated
+	errors []string
+}
+
+// importResult is what happened to one row
+type importResult struct {
+	Line   int      `json:"line"`
+	Email  string   `json:"email,omitempty"`
+	Action string   `json:"action"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// importSummary reports an import. Only rows that failed are listed, so the summary
+// of a large import stays small.
+type importSummary struct {
+	DryRun  bool           `json:"dry_run"`
+	Total   int            `json:"total"`
+	Created int            `json:"created"`
+	Updated int            `json:"updated"`
+	Failed  int            `json:"failed"`
+	Errors  []importResult `json:"errors"`
+}
+
+// ImportUsers creates or updates users from a CSV or NDJSON body, matching existing
+// users by email address. The format comes from the format query parameter or the
+// Content-Type. Each row succeeds or fails on its own, and the failures are reported
+// with their line numbers. With dry_run=true every row is checked but nothing is saved.
+// Callers acting in an organization add new users to it, and can only update its
+// members.
+func (app *Config) ImportUsers(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatFromContentType(r.Header.Get("Content-Type"))
+	}
+	if format != formatCSV && format != formatNDJSON {
+		app.errorJSON(w, errors.New("format must be csv or ndjson"), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			app.errorJSON(w, errors.New("dry_run must be true or false"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	summary, err := app.importUsers(r.Context(), body, format, dryRun, organizationIDFromContext(r.Context()))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !dryRun {
+		app.audit(r, event.Event{
+			Name: eventUsersImported,
+			Data: fmt.Sprintf("user %d imported users: %d created, %d updated, %d failed",
+				userIDFromContext(r.Context()), summary.Created, summary.Updated, summary.Failed),
+		})
+	}
+
+	message := fmt.Sprintf("Imported %d users", summary.Created+summary.Updated)
+	if dryRun {
+		message = fmt.Sprintf("Checked %d users, nothing was saved", summary.Total)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: message,
+		Data:    summary,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// ExportUsers streams every user as CSV (the default) or NDJSON, in ID order. Callers
+// acting in an organization only get its members.
+func (app *Config) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatCSV
+	}
+
+	var contentType string
+	switch format {
+	case formatCSV:
+		contentType = "text/csv"
+	case formatNDJSON:
+		contentType = "application/x-ndjson"
+	default:
+		app.errorJSON(w, errors.New("format must be csv or ndjson"), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+
+	count, err := app.exportUsers(r.Context(), w, format, organizationIDFromContext(r.Context()))
+	if err != nil {
+		// the status has gone out already, so all we can do is stop and log
+		log.Printf("user export stopped after %d users: %v", count, err)
+		return
+	}
+
+	app.audit(r, event.Event{
+		Name: eventUsersExported,
+		Data: fmt.Sprintf("user %d exported %d users", userIDFromContext(r.Context()), count),
+	})
+}
+
+// formatFromContentType picks an import format from a Content-Type header
+func formatFromContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch mediaType {
+	case "text/csv":
+		return formatCSV
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return formatNDJSON
+	}
+
+	return ""
+}
+
+// importUsers reads users from r and saves them, unless dryRun is set. Rows are
+// checked and saved by a pool of workers, since hashing each password is slow. It
+// only returns an error if the input can't be read at all, like a CSV header with an
+// unknown column; problems with single rows are in the summary. When orgID is set new
+// users join that organization, and only users who belong to it alone are updated.
+func (app *Config) importUsers(ctx context.Context, r io.Reader, format string, dryRun bool, orgID int) (*importSummary, error) {
+	rows := make(chan importRow)
+	readErr := make(chan error, 1)
+
+	switch format {
+	case formatCSV:
+		reader, err := newCSVImport(r)
+		if err != nil {
+			return nil, err
+		}
+		go func() { readErr <- reader.read(rows) }()
+	case formatNDJSON:
+		go func() { readErr <- readNDJSONImport(r, rows) }()
+	default:
+		return nil, fmt.Errorf("unknown import format %q", format)
+	}
+
+	results := make(chan importResult)
+	workers := runtime.NumCPU()
+	done := make(chan struct{})
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for row := range rows {
+				results <- app.importRow(ctx, row, dryRun, orgID)
+			}
+			done <- struct{}{}
+		}()
+	}
+
+	go func() {
+		for i := 0; i < workers; i++ {
+			<-done
+		}
+		close(results)
+	}()
+
+	summary := importSummary{
+		DryRun: dryRun,
+		Errors: []importResult{},
+	}
+
+	for result := range results {
+		summary.Total++
+		switch result.Action {
+		case "created":
+			summary.Created++
+		case "updated":
+			summary.Updated++
+		default:
+			summary.Failed++
+			summary.Errors = append(summary.Errors, result)
+		}
+	}
+
+	sort.Slice(summary.Errors, func(i, j int) bool {
+		return summary.Errors[i].Line < summary.Errors[j].Line
+	})
+
+	err := <-readErr
+	if err != nil {
+		// rows before the one we couldn't read have been handled already, so the
+		// failure is reported like any other row
+		stopped := importResult{
+			Action: "failed",
+			Errors: []string{"import stopped: " + err.Error()},
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			stopped.Line = parseErr.StartLine
+		}
+
+		summary.Total++
+		summary.Failed++
+		summary.Errors = append(summary.Errors, stopped)
+	}
+
+	return &summary, nil
+}
+
+// importRow checks one row and, unless dryRun is set, creates or updates the user it
+// describes
+func (app *Config) importRow(ctx context.Context, row importRow, dryRun bool, orgID int) importResult {
+	result := importResult{
+		Line:   row.line,
+		Email:  row.Email,
+		Action: "failed",
+		Errors: row.errors,
+	}
+
+	// a row that couldn't be read has nothing worth checking
+	if len(result.Errors) > 0 {
+		return result
+	}
+
+	email, err := normalizeEmail(row.Email)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+	result.Email = email
+
+	for _, name := range []*string{row.FirstName, row.LastName} {
+		if name != nil {
+			*name = strings.TrimSpace(*name)
+			if len(*name) > maxNameLength {
+				result.Errors = append(result.Errors, fmt.Sprintf("names must be at most %d characters", maxNameLength))
+			}
+		}
+	}
+
+	if row.Active != nil && *row.Active != 0 && *row.Active != 1 {
+		result.Errors = append(result.Errors, "active must be 0 or 1")
+	}
+
+	if row.Password != nil && *row.Password != "" {
+		err := app.PasswordPolicy.Check(*row.Password)
+		var violations policy.Violations
+		if errors.As(err, &violations) {
+			for _, violation := range violations {
+				result.Errors = append(result.Errors, violation.Message)
+			}
+		} else if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		}
+	}
+
+	if len(result.Errors) > 0 {
+		return result
+	}
+
+	existing, err := app.Models.User.GetByEmail(ctx, email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	if existing == nil {
+		err = app.importCreate(ctx, email, row, dryRun, orgID)
+		result.Action = "created"
+	} else {
+		err = app.importableUser(ctx, existing, orgID)
+		if err == nil {
+			err = app.importUpdate(ctx, existing, row, dryRun)
+		}
+		result.Action = "updated"
+	}
+
+	if err != nil {
+		result.Action = "failed"
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	return result
+}
+
+// importCreate adds a user from an import. Imported users are active unless the row
+// says otherwise. A user imported without a password gets a random one nobody knows,
+// and has to set their own with the forgot password flow. With orgID set the user
+// becomes a member of that organization.
+func (app *Config) importCreate(ctx context.Context, email string, row importRow, dryRun bool, orgID int) error {
+	if dryRun {
+		return nil
+	}
+
+	user := data.User{
+		Email:  email,
+		Active: 1,
+	}
+	if row.FirstName != nil {
+		user.FirstName = *row.FirstName
+	}
+	if row.LastName != nil {
+		user.LastName = *row.LastName
+	}
+	if row.Active != nil {
+		user.Active = *row.Active
+	}
+
+	if row.Password != nil && *row.Password != "" {
+		user.Password = *row.Password
+	} else {
+		password, err := unguessablePassword()
+		if err != nil {
+			return err
+		}
+		user.Password = password
+	}
+
+	id, err := app.Models.User.Insert(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	err = app.Models.Role.Grant(ctx, id, defaultRole)
+	if err != nil {
+		return err
+	}
+
+	if orgID != 0 {
+		return app.Models.Organization.SetMember(ctx, orgID, id, data.MemberRole)
+	}
+
+	return nil
+}
+
+// importableUser checks that an import into organization orgID may update an existing
+// user: they have to belong to it and to no other organization, and hold no global role
+func (app *Config) importableUser(ctx context.Context, user *data.User, orgID int) error {
+	if orgID == 0 {
+		return nil
+	}
+
+	memberships, err := app.Models.Organization.ForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	member := false
+	for _, membership := range memberships {
+		if membership.OrganizationID == orgID {
+			member = true
+		}
+	}
+
+	// someone outside the organization is reported like a clash with a registered
+	// address, which is all the importer needs to know
+	if !member {
+		return data.ErrDuplicateEmail
+	}
+	if len(memberships) > 1 {
+		return errShared
+	}
+
+	global, err := app.holdsGlobalRole(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if global {
+		return errGlobalRole
+	}
+
+	return nil
+}
+
+// importUpdate applies an import row to an existing user. As with UpdateUser, active
+// moves the account through the status state machine, and a user who is suspended is
+// logged out everywhere. A password is refused: a file that replaces someone's
+// password would leave their sessions running and nothing in the audit log, so they
+// have to use the forgot password flow instead.
+func (app *Config) importUpdate(ctx context.Context, user *data.User, row importRow, dryRun bool) error {
+	if row.Password != nil && *row.Password != "" {
+		return errImportPassword
+	}
+
+	status := user.Status
+	if row.Active != nil {
+		status = statusForActive(user.Status, *row.Active)
+		if status != user.Status && !data.CanTransition(user.Status, status) {
+			return fmt.Errorf("%w: %s to %s", data.ErrInvalidTransition, user.Status, status)
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	if row.FirstName != nil {
+		user.FirstName = *row.FirstName
+	}
+	if row.LastName != nil {
+		user.LastName = *row.LastName
+	}
+
+	err := app.Models.User.Update(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	if status != user.Status {
+		_, err = app.changeStatus(nil, user, status, fmt.Sprintf("active set to %d by import", *row.Active))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unguessablePassword returns a random password for accounts that don't have one yet
+func unguessablePassword() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// csvImport reads import rows from CSV with a header line naming the columns
+type csvImport struct {
+	reader  *csv.Reader
+	columns []string
+	seen    map[string]int
+}
+
+// newCSVImport reads and checks the header of a CSV import
+func newCSVImport(r io.Reader) (*csvImport, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the CSV header: %w", err)
+	}
+
+	columns := make([]string, len(header))
+	hasEmail := false
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if _, ok := importColumns[column]; !ok {
+			return nil, fmt.Errorf("unknown CSV column %q", column)
+		}
+		if column == "email" {
+			hasEmail = true
+		}
+		columns[i] = column
+	}
+
+	if !hasEmail {
+		return nil, errors.New("the CSV header needs an email column")
+	}
+
+	// every row has to have as many fields as the header
+	reader.FieldsPerRecord = len(header)
+
+	return &csvImport{
+		reader:  reader,
+		columns: columns,
+		seen:    make(map[string]int),
+	}, nil
+}
+
+// read sends every row to rows and closes it. Rows with the wrong number of fields
+// are sent with an error; other CSV errors can't be recovered from and stop the read.
+func (c *csvImport) read(rows chan<- importRow) error {
+	defer close(rows)
+
+	for {
+		record, err := c.reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) || !errors.Is(err, csv.ErrFieldCount) {
+				return err
+			}
+			rows <- importRow{
+				line:   parseErr.StartLine,
+				errors: []string{fmt.Sprintf("expected %d fields, got %d", len(c.columns), len(record))},
+			}
+			continue
+		}
+
+		line, _ := c.reader.FieldPos(0)
+		row := importRow{line: line}
+
+		for i, value := range record {
+			value := value
+			switch c.columns[i] {
+			case "email":
+				row.Email = value
+			case "first_name":
+				row.FirstName = &value
+			case "last_name":
+				row.LastName = &value
+			case "password":
+				row.Password = &value
+			case "active":
+				if value == "" {
+					continue
+				}
+				active, err := strconv.Atoi(value)
+				if err != nil {
+					row.errors = append(row.errors, "active must be 0 or 1")
+					continue
+				}
+				row.Active = &active
+			}
+		}
+
+		checkDuplicate(c.seen, &row)
+		rows <- row
+	}
+}
+
+// readNDJSONImport sends every line of an NDJSON import to rows as a row and closes
+// it. Lines that aren't a valid user object are sent with an error.
+func readNDJSONImport(r io.Reader, rows chan<- importRow) error {
+	defer close(rows)
+
+	seen := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxImportLine)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		row := importRow{line: line}
+
+		dec := json.NewDecoder(bytes.NewReader(text))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&row)
+		if err != nil {
+			row = importRow{line: line, errors: []string{"invalid JSON: " + err.Error()}}
+			rows <- row
+			continue
+		}
+
+		checkDuplicate(seen, &row)
+		rows <- row
+	}
+
+	return scanner.Err()
+}
+
+// checkDuplicate flags a row whose email address appeared earlier in the same import.
+// Rows are saved concurrently, so a second row for the same user could otherwise
+// race the first.
+func checkDuplicate(seen map[string]int, row *importRow) {
+	key := data.FoldEmail(row.Email)
+	if key == "" {
+		return
+	}
+
+	if first, ok := seen[key]; ok {
+		row.errors = append(row.errors, fmt.Sprintf("duplicate of line %d", first))
+		return
+	}
+	seen[key] = row.line
+}
+
+// exportUsers writes every user to w in the given format, a page at a time, and
+// returns how many it wrote. Passwords are never exported. When orgID is set only
+// members of that organization are written.
+func (app *Config) exportUsers(ctx context.Context, w io.Writer, format string, orgID int) (int, error) {
+	var csvWriter *csv.Writer
+	var enc *json.Encoder
+
+	switch format {
+	case formatCSV:
+		csvWriter = csv.NewWriter(w)
+		err := csvWriter.Write([]string{"id", "email", "first_name", "last_name", "active", "status", "created_at", "updated_at"})
+		if err != nil {
+			return 0, err
+		}
+	case formatNDJSON:
+		enc = json.NewEncoder(w)
+	default:
+		return 0, fmt.Errorf("unknown export format %q", format)
+	}
+
+	count := 0
+	filter := data.UserFilter{OrganizationID: orgID, Sort: "id", Limit: data.MaxPageSize}
+
+	for {
+		page, err := app.Models.User.Page(ctx, filter)
+		if err != nil {
+			return count, err
+		}
+
+		for _, user := range page.Users {
+			if csvWriter != nil {
+				err = csvWriter.Write([]string{
+					strconv.Itoa(user.ID),
+					user.Email,
+					user.FirstName,
+					user.LastName,
+					strconv.Itoa(user.Active),
+					user.Status,
+					user.CreatedAt.Format(time.RFC3339),
+					user.UpdatedAt.Format(time.RFC3339),
+				})
+			} else {
+				err = enc.Encode(user)
+			}
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		if csvWriter != nil {
+			csvWriter.Flush()
+			err = csvWriter.Error()
+			if err != nil {
+				return count, err
+			}
+		}
+
+		if page.NextCursor == "" {
+			return count, nil
+		}
+		filter.Cursor = page.NextCursor
+	}
+}
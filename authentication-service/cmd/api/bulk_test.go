@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// importCSV posts a CSV import as token and returns the summary
+func (app *testApp) importCSV(t *testing.T, token, path, csv string) importSummary {
+	t.Helper()
+
+	status, response := app.do(t, http.MethodPost, path, token, csv)
+	if status != http.StatusAccepted {
+		t.Fatalf("import got %d %q", status, response.Message)
+	}
+
+	var summary importSummary
+	decodeData(t, response, &summary)
+
+	return summary
+}
+
+func TestImportPassword(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		app := newTestApp(t)
+		app.createUser(t, "admin@example.com", "admin")
+		target := app.createUser(t, "user@example.com")
+		refresh := app.login(t, "user@example.com").RefreshToken
+		token := app.mfaLogin(t, "admin@example.com").AccessToken
+
+		path := "/user/import?format=csv"
+		if dryRun {
+			path += "&dry_run=true"
+		}
+		summary := app.importCSV(t, token, path,
+			"email,first_name,password\nuser@example.com,Changed,Replaced-Password-99\nnew@example.com,New,Replaced-Password-99\n")
+
+		if summary.Created != 1 || summary.Updated != 0 || summary.Failed != 1 {
+			t.Fatalf("dry run %v: got %+v, want one created and one failed", dryRun, summary)
+		}
+		if summary.Errors[0].Errors[0] != errImportPassword.Error() {
+			t.Errorf("dry run %v: got errors %v", dryRun, summary.Errors[0].Errors)
+		}
+
+		// nothing about the existing user changed, and they are still logged in
+		got, err := app.users.GetOne(context.Background(), target.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.FirstName != target.FirstName {
+			t.Errorf("dry run %v: first name changed to %q", dryRun, got.FirstName)
+		}
+		if ok, _ := got.PasswordMatches(testPassword); !ok {
+			t.Errorf("dry run %v: password was replaced", dryRun)
+		}
+		status, _ := app.do(t, http.MethodPost, "/refresh", "", map[string]string{"refresh_token": refresh})
+		if status != http.StatusAccepted {
+			t.Errorf("dry run %v: refresh got %d, want %d", dryRun, status, http.StatusAccepted)
+		}
+	}
+}
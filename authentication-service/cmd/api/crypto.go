@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+)
+
+var errNoEncryptionKey = errors.New("encryption key is not configured")
+
+// loadEncryptionKey reads the AES-256 key used to protect secrets at rest. The key
+// is 32 random bytes, base64 encoded.
+func loadEncryptionKey() []byte {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("ENCRYPTION_KEY"))
+	if err != nil || len(key) != 32 {
+		return nil
+	}
+
+	return key
+}
+
+// encrypt seals plainText with AES-GCM. The random nonce is prepended to the result.
+func (app *Config) encrypt(plainText []byte) ([]byte, error) {
+	gcm, err := app.gcm()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plainText, nil), nil
+}
+
+// decrypt opens something sealed by encrypt
+func (app *Config) decrypt(cipherText []byte) ([]byte, error) {
+	gcm, err := app.gcm()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cipherText) < gcm.NonceSize() {
+		return nil, errors.New("cipher text too short")
+	}
+
+	nonce, sealed := cipherText[:gcm.NonceSize()], cipherText[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+func (app *Config) gcm() (cipher.AEAD, error) {
+	if len(app.EncryptionKey) == 0 {
+		return nil, errNoEncryptionKey
+	}
+
+	block, err := aes.NewCipher(app.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
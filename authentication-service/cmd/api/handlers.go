@@ -2,11 +2,18 @@ package main
 
 import (
 	"authentication/data"
-	"bytes"
-	"encoding/json"
+	"authentication/event"
+	"database/sql"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"userevents"
+
+	"github.com/go-chi/chi/v5"
 )
 
 func (app *Config) Register(w http.ResponseWriter, r *http.Request) {
@@ -23,29 +30,66 @@ func (app *Config) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	email, err := normalizeEmail(requestPayload.Email)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !app.checkPassword(w, requestPayload.Password) {
+		return
+	}
+
 	user := data.User{
 		FirstName: requestPayload.FirstName,
 		LastName:  requestPayload.LastName,
-		Email:     requestPayload.Email,
+		Email:     email,
 		Password:  requestPayload.Password,
 	}
 
 	// first check if the user already exists
-	_, err = app.Models.User.GetByEmail(user.Email)
+	_, err = app.Models.User.GetByEmail(r.Context(), user.Email)
 	if err == nil {
 		app.errorJSON(w, errors.New("user already exists"), http.StatusConflict)
 		return
 	}
 
-	_, err = app.Models.User.Insert(user)
+	// new accounts stay inactive until the email address has been verified
+	user.Active = 0
+
+	user.ID, err = app.Models.User.Insert(r.Context(), user)
+	if errors.Is(err, data.ErrDuplicateEmail) {
+		app.errorJSON(w, errors.New("user already exists"), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.Models.Role.Grant(r.Context(), user.ID, defaultRole)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	app.audit(r, event.Event{
+		Name:   eventRegistered,
+		Data:   fmt.Sprintf("user %s registered", user.Email),
+		UserID: user.ID,
+		Email:  user.Email,
+	})
+
+	err = app.sendVerificationEmail(&user)
+	if err != nil {
+		// the account exists at this point, so don't fail the request; the user can
+		// ask for another verification email
+		log.Println("could not send verification email:", err)
+	}
+
 	payload := jsonResponse{
 		Error:   false,
-		Message: fmt.Sprintf("Registered user %s", user.Email),
+		Message: fmt.Sprintf("Registered user %s, check your email to verify your account", user.Email),
 		Data:    user,
 	}
 
@@ -64,38 +108,282 @@ func (app *Config) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !app.checkThrottle(w, r, requestPayload.Email) {
+		return
+	}
+
 	// validate the user against the database
-	user, err := app.Models.User.GetByEmail(requestPayload.Email)
+	user, err := app.Models.User.GetByEmail(r.Context(), requestPayload.Email)
 	if err != nil {
-		app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+		app.loginFailed(w, r, requestPayload.Email, "unknown email")
 		return
 	}
 
 	valid, err := user.PasswordMatches(requestPayload.Password)
 	if err != nil || !valid {
-		app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+		app.loginFailed(w, r, requestPayload.Email, "wrong password")
 		return
 	}
 
-	// Log a successful login
-	err = app.logLoginRequest("login", fmt.Sprintf("user %s logged in", user.Email))
+	app.rehashPassword(r.Context(), user, requestPayload.Password)
+
+	err = app.Models.LoginThrottle.Reset(r.Context(), accountKey(user.Email))
 	if err != nil {
-		app.errorJSON(w, err)
+		log.Println("could not reset failed logins:", err)
+	}
+
+	app.firstFactorPassed(w, r, user, []string{amrPassword})
+}
+
+// firstFactorPassed carries on a login once the user has proved who they are with
+// the methods in amr: a password, a magic link or a passkey that didn't verify them.
+// Inactive accounts are turned away, users with two factor authentication get a
+// challenge, and everyone else gets their tokens.
+func (app *Config) firstFactorPassed(w http.ResponseWriter, r *http.Request, user *data.User, amr []string) {
+	if !app.accountActive(w, r, user) {
 		return
 	}
 
+	// users with two factor authentication get a challenge instead of tokens, which
+	// they exchange for tokens at /login/2fa
+	tf, err := app.Models.TwoFactor.GetForUser(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if tf != nil && tf.Confirmed {
+		challenge, err := app.signToken(user, challengeAudience, challengeTTL, amr)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		payload := jsonResponse{
+			Error:   false,
+			Message: "Two factor authentication required",
+			Data: mfaChallenge{
+				MFARequired:    true,
+				ChallengeToken: challenge,
+				ExpiresIn:      int(challengeTTL.Seconds()),
+			},
+		}
+
+		app.writeJSON(w, http.StatusAccepted, payload)
+		return
+	}
+
+	app.completeLogin(w, r, user, amr)
+}
+
+// accountActive turns away a user who just proved who they are if their account isn't
+// active: unverified, suspended, locked or deleted. It writes the error and returns
+// false.
+func (app *Config) accountActive(w http.ResponseWriter, r *http.Request, user *data.User) bool {
+	if user.Status != data.StatusActive {
+		app.audit(r, event.Event{
+			Name:       eventLoginFailed,
+			Data:       fmt.Sprintf("login refused for %s account %s", user.Status, user.Email),
+			Severity:   event.SeverityWarning,
+			UserID:     user.ID,
+			Email:      user.Email,
+			Attributes: map[string]string{"reason": user.Status},
+		})
+		code, status, err := statusRefusal(user.Status)
+		app.errorCodeJSON(w, code, err, status)
+		return false
+	}
+
+	return true
+}
+
+// completeLogin records a successful login with the methods in amr and sends the user
+// their tokens
+func (app *Config) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User, amr []string) {
+	mfa := passedMFA(amr)
+
+	tokens, err := app.issueTokens(r, user, amr)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	login := userevents.Login{UserID: user.ID, MFA: mfa}
+	if tokens.Organization != nil {
+		login.OrganizationID = tokens.Organization.OrganizationID
+	}
+
+	// the user has their session by now, so a login event we couldn't record
+	// doesn't undo it
+	err = app.Models.Outbox.Add(r.Context(), user.ID, userevents.TypeLogin, login)
+	if err != nil {
+		log.Println("could not record login event:", err)
+	}
+
+	app.audit(r, event.Event{
+		Name:       eventLoginSucceeded,
+		Data:       fmt.Sprintf("user %s logged in", user.Email),
+		UserID:     user.ID,
+		Email:      user.Email,
+		Attributes: map[string]string{"mfa": strconv.FormatBool(mfa), "amr": strings.Join(amr, " ")},
+	})
+
 	payload := jsonResponse{
 		Error:   false,
 		Message: fmt.Sprintf("Logged in user %s", user.Email),
-		Data:    user,
+		Data:    tokens,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) Refresh(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	refresh, err := app.Models.Token.Rotate(r.Context(), requestPayload.RefreshToken, app.JWT.RefreshTTL)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidToken) || errors.Is(err, data.ErrTokenReused) {
+			app.errorJSON(w, err, http.StatusUnauthorized)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), refresh.UserID)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+		return
+	}
+
+	// sessions end when an account stops being active, but a refresh racing the
+	// change could still get through
+	if user.Status != data.StatusActive {
+		code, status, err := statusRefusal(user.Status)
+		app.errorCodeJSON(w, code, err, status)
+		return
+	}
+
+	tokens, err := app.tokenPair(r.Context(), user, refresh)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Refreshed tokens",
+		Data:    tokens,
 	}
 
 	app.writeJSON(w, http.StatusAccepted, payload)
 }
 
+func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = app.Models.Token.Revoke(r.Context(), requestPayload.RefreshToken)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Logged out",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// GetAll lists users a page at a time. It takes these query parameters, all optional:
+//
+//	limit          page size, up to data.MaxPageSize
+//	cursor         next_cursor or prev_cursor from an earlier page
+//	sort           last_name, email, created_at or id; prefix with - to reverse
+//	active         0 or 1
+//	created_after  RFC 3339 time, inclusive
+//	created_before RFC 3339 time, exclusive
+//	email_domain   e.g. example.com
+//
+// Callers acting in an organization only see its members.
 func (app *Config) GetAll(w http.ResponseWriter, r *http.Request) {
-	users, err := app.Models.User.GetAll()
+	query := r.URL.Query()
+
+	filter := data.UserFilter{
+		OrganizationID: organizationIDFromContext(r.Context()),
+		Cursor:         query.Get("cursor"),
+		Sort:           query.Get("sort"),
+		EmailDomain:    query.Get("email_domain"),
+	}
+
+	if filter.Sort != "" && !data.ValidUserSort(filter.Sort) {
+		app.errorJSON(w, errors.New("sort must be one of last_name, email, created_at or id, optionally prefixed with -"), http.StatusBadRequest)
+		return
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > data.MaxPageSize {
+			app.errorJSON(w, fmt.Errorf("limit must be between 1 and %d", data.MaxPageSize), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	if v := query.Get("active"); v != "" {
+		active, err := strconv.Atoi(v)
+		if err != nil || (active != 0 && active != 1) {
+			app.errorJSON(w, errors.New("active must be 0 or 1"), http.StatusBadRequest)
+			return
+		}
+		filter.Active = &active
+	}
+
+	if v := query.Get("status"); v != "" {
+		if !data.ValidStatus(v) {
+			app.errorJSON(w, fmt.Errorf("%w: %s", data.ErrUnknownStatus, v), http.StatusBadRequest)
+			return
+		}
+		filter.Status = v
+	}
+
+	for name, target := range map[string]**time.Time{
+		"created_after":  &filter.CreatedAfter,
+		"created_before": &filter.CreatedBefore,
+	} {
+		if v := query.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				app.errorJSON(w, fmt.Errorf("%s must be an RFC 3339 time", name), http.StatusBadRequest)
+				return
+			}
+			*target = &t
+		}
+	}
+
+	page, err := app.Models.User.Page(r.Context(), filter)
 	if err != nil {
+		if errors.Is(err, data.ErrInvalidCursor) {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
 		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
@@ -103,35 +391,180 @@ func (app *Config) GetAll(w http.ResponseWriter, r *http.Request) {
 	payload := jsonResponse{
 		Error:   false,
 		Message: "All users",
-		Data:    users,
+		Data:    page,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) GetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("User %d", user.ID),
+		Data:    user,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// UpdateUser changes the fields given in the request and leaves the others alone
+func (app *Config) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email     *string `json:"email"`
+		FirstName *string `json:"first_name"`
+		LastName  *string `json:"last_name"`
+		Active    *int    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.userFromURL(w, r)
+	if !ok || !app.soleOrganization(w, r, user) {
+		return
+	}
+
+	if requestPayload.Email != nil {
+		email, err := normalizeEmail(*requestPayload.Email)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if !strings.EqualFold(email, user.Email) {
+			existing, err := app.Models.User.GetByEmail(r.Context(), email)
+			if err == nil && existing.ID != user.ID {
+				app.errorJSON(w, errors.New("email address already registered"), http.StatusConflict)
+				return
+			}
+		}
+		user.Email = email
+	}
+
+	if requestPayload.FirstName != nil {
+		user.FirstName = strings.TrimSpace(*requestPayload.FirstName)
+	}
+
+	if requestPayload.LastName != nil {
+		user.LastName = strings.TrimSpace(*requestPayload.LastName)
+	}
+
+	// active is kept for older clients: 1 activates the account and 0 suspends it,
+	// through the same state machine as the suspend and restore endpoints
+	status := user.Status
+	if requestPayload.Active != nil {
+		if *requestPayload.Active != 0 && *requestPayload.Active != 1 {
+			app.errorJSON(w, errors.New("active must be 0 or 1"), http.StatusBadRequest)
+			return
+		}
+		status = statusForActive(user.Status, *requestPayload.Active)
+		if status != user.Status && !data.CanTransition(user.Status, status) {
+			app.errorJSON(w, fmt.Errorf("%w: %s to %s", data.ErrInvalidTransition, user.Status, status), http.StatusConflict)
+			return
+		}
+	}
+
+	if len(user.FirstName) > maxNameLength || len(user.LastName) > maxNameLength {
+		app.errorJSON(w, fmt.Errorf("names must be at most %d characters", maxNameLength), http.StatusBadRequest)
+		return
+	}
+
+	err = app.Models.User.Update(r.Context(), user)
+	if errors.Is(err, data.ErrDuplicateEmail) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if status != user.Status {
+		_, err = app.changeStatus(r, user, status, fmt.Sprintf("active set to %d", *requestPayload.Active))
+		if err != nil {
+			app.statusChangeError(w, err)
+			return
+		}
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Updated user %d", user.ID),
+		Data:    user,
 	}
 
 	app.writeJSON(w, http.StatusAccepted, payload)
 }
 
-func (app *Config) logLoginRequest(name, data string) error {
-	var entry struct {
-		Name string `json:"name"`
-		Data string `json:"data"`
+func (app *Config) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok || !app.soleOrganization(w, r, user) {
+		return
 	}
 
-	entry.Name = name
-	entry.Data = data
+	if user.ID == userIDFromContext(r.Context()) {
+		app.errorJSON(w, errors.New("you can't delete your own account here"), http.StatusBadRequest)
+		return
+	}
+
+	err := app.Models.User.DeleteByID(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
 
-	jsonData, _ := json.MarshalIndent(entry, "", "\t")
-	// comes from docker-compose.yml
-	logServiceUrl := "http://logger-service/log"
+	app.audit(r, event.Event{
+		Name:   eventUserDeleted,
+		Data:   fmt.Sprintf("user %d deleted user %s", userIDFromContext(r.Context()), user.Email),
+		UserID: user.ID,
+		Email:  user.Email,
+	})
 
-	request, err := http.NewRequest("POST", logServiceUrl, bytes.NewBuffer(jsonData))
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Deleted user %d", user.ID),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// userFromURL loads the user whose ID is in the {id} URL parameter, writing a 400 or
+// 404 and returning false if there isn't one. Callers acting in an organization can
+// only load its members.
+func (app *Config) userFromURL(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		app.errorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), id)
 	if err != nil {
-		return err
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+			return nil, false
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return nil, false
 	}
 
-	client := &http.Client{}
-	_, err = client.Do(request)
+	member, err := app.inOrganization(r, user)
 	if err != nil {
-		return err
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	if !member {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return nil, false
 	}
 
-	return nil
+	return user, true
 }
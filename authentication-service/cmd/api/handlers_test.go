@@ -0,0 +1,1099 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"authentication/policy"
+	"authentication/totp"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testPassword satisfies the default password policy
+const testPassword = "Correct-Horse-Battery-9"
+
+// testApp is the service wired to the in-memory stores, along with what it sent out
+type testApp struct {
+	*Config
+	users    *data.MemoryUserRepository
+	sessions *data.MemorySessionRepository
+	roles    *data.MemoryRoleRepository
+	apiKeys  *data.MemoryAPIKeyRepository
+	groups   *data.MemoryGroupRepository
+	events   *recordedEvents
+	mail     *mailbox
+	handler  http.Handler
+}
+
+// recordedEvents keeps the audit events the service published
+type recordedEvents struct {
+	mu     sync.Mutex
+	events []event.Event
+}
+
+func (r *recordedEvents) Publish(e event.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, e)
+}
+
+// names returns the names of the events published so far
+func (r *recordedEvents) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var names []string
+	for _, e := range r.events {
+		names = append(names, e.Name)
+	}
+
+	return names
+}
+
+// sentMail is one message handed to the mail service
+type sentMail struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+}
+
+// mailbox stands in for the mail service and keeps what it was sent
+type mailbox struct {
+	mu       sync.Mutex
+	messages []sentMail
+}
+
+func (m *mailbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var msg sentMail
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	m.messages = append(m.messages, msg)
+	m.mu.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// to returns the messages sent to an address
+func (m *mailbox) to(address string) []sentMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var messages []sentMail
+	for _, msg := range m.messages {
+		if msg.To == address {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages
+}
+
+// newTestApp returns the service running against empty in-memory stores, seeded with
+// the roles the migrations create
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	// the cheapest bcrypt cost keeps the tests fast
+	data.SetPasswordHasher(data.BcryptHasher{Cost: 4})
+
+	users := data.NewMemoryUserRepository()
+	sessions := data.NewMemorySessionRepository()
+	roles := data.NewMemoryRoleRepository()
+	roles.AddRole(data.Role{Name: "admin", Permissions: []string{
+		"users:read", "users:write", "roles:manage", "accounts:unlock", "accounts:suspend",
+		"mail:send", "logs:write", "sessions:revoke", "privacy:manage", "organizations:manage",
+	}})
+	roles.AddRole(data.Role{Name: defaultRole, Permissions: []string{"mail:send", "logs:write"}})
+	roles.AddRole(data.Role{Name: data.OwnerRole, Scope: "organization", Permissions: []string{
+		"organizations:manage", "users:read", "users:write", "mail:send", "logs:write",
+	}})
+	roles.AddRole(data.Role{Name: data.MemberRole, Scope: "organization", Permissions: []string{"mail:send", "logs:write"}})
+
+	apiKeys := data.NewMemoryAPIKeyRepository()
+	groups := data.NewMemoryGroupRepository(users)
+
+	mail := &mailbox{}
+	mailServer := httptest.NewServer(mail)
+	t.Cleanup(mailServer.Close)
+
+	jwtConfig := createJWTConfig()
+	jwtConfig.Secret = []byte("test-secret")
+
+	app := &testApp{
+		Config: &Config{
+			Models: data.Models{
+				User:          users,
+				Token:         data.NewMemoryTokenRepository(sessions),
+				PasswordReset: data.NewMemoryPasswordResetRepository(users),
+				MagicLink:     data.NewMemoryMagicLinkRepository(),
+				Session:       sessions,
+				Role:          roles,
+				TwoFactor:     data.NewMemoryTwoFactorRepository(),
+				LoginThrottle: data.NewMemoryLoginThrottleRepository(),
+				Organization:  data.NewMemoryOrganizationRepository(users, roles, sessions),
+				Outbox:        data.NewMemoryOutbox(),
+				APIKey:        apiKeys,
+				Group:         groups,
+				Provisioning:  data.NewMemoryProvisioning(users, groups),
+			},
+			JWT:            jwtConfig,
+			AppURL:         "http://localhost",
+			EncryptionKey:  bytes.Repeat([]byte{7}, 32),
+			Clock:          time.Now,
+			MailURL:        mailServer.URL,
+			PasswordPolicy: policy.Default(),
+			InternalSecret: []byte("internal-secret"),
+		},
+		users:    users,
+		sessions: sessions,
+		roles:    roles,
+		apiKeys:  apiKeys,
+		groups:   groups,
+		events:   &recordedEvents{},
+		mail:     mail,
+	}
+	app.Events = app.events
+	app.handler = app.routes()
+
+	return app
+}
+
+// do sends a request with body as JSON, and an access token when token isn't empty,
+// and decodes the response
+func (app *testApp) do(t *testing.T, method, path, token string, body any) (int, jsonResponse) {
+	t.Helper()
+
+	var reader *bytes.Reader
+	if s, ok := body.(string); ok {
+		reader = bytes.NewReader([]byte(s))
+	} else {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	r := httptest.NewRequest(method, path, reader)
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	app.handler.ServeHTTP(w, r)
+
+	var response jsonResponse
+	if w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s %s: response isn't JSON: %s", method, path, w.Body.String())
+		}
+	}
+
+	return w.Code, response
+}
+
+// createUser stores an active user with testPassword and the given roles
+func (app *testApp) createUser(t *testing.T, email string, roles ...string) *data.User {
+	t.Helper()
+
+	id, err := app.users.Insert(context.Background(), data.User{
+		Email:     email,
+		FirstName: "Test",
+		LastName:  strings.Split(email, "@")[0],
+		Password:  testPassword,
+		Active:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, role := range append([]string{defaultRole}, roles...) {
+		if err := app.roles.Grant(context.Background(), id, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	user, err := app.users.GetOne(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// login logs a user in with testPassword and returns their tokens
+func (app *testApp) login(t *testing.T, email string) TokenPair {
+	t.Helper()
+
+	status, response := app.do(t, http.MethodPost, "/login", "", map[string]string{
+		"email":    email,
+		"password": testPassword,
+	})
+	if status != http.StatusAccepted {
+		t.Fatalf("logging in %s: got %d %q", email, status, response.Message)
+	}
+
+	var tokens TokenPair
+	decodeData(t, response, &tokens)
+
+	return tokens
+}
+
+// mfaLogin turns on two factor authentication for a user and logs them in with
+// testPassword and a TOTP code, as admin routes require, and returns their tokens
+func (app *testApp) mfaLogin(t *testing.T, email string) TokenPair {
+	t.Helper()
+
+	secret := app.enrollTOTP(t, email)
+
+	status, response := app.do(t, http.MethodPost, "/login/2fa", "", map[string]string{
+		"challenge_token": challenge(t, app, email),
+		"code":            totpCode(t, secret, app.Clock()),
+	})
+	if status != http.StatusAccepted {
+		t.Fatalf("logging in %s with a second factor: got %d %q", email, status, response.Message)
+	}
+
+	var tokens TokenPair
+	decodeData(t, response, &tokens)
+
+	return tokens
+}
+
+// enrollTOTP gives a user a confirmed authenticator app and returns its secret
+func (app *testApp) enrollTOTP(t *testing.T, email string) string {
+	t.Helper()
+
+	user, err := app.users.GetByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := app.encrypt([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.Models.TwoFactor.Enroll(context.Background(), user.ID, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Models.TwoFactor.Confirm(context.Background(), user.ID, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return secret
+}
+
+// decodeData decodes the data of a response into v
+func decodeData(t *testing.T, response jsonResponse, v any) {
+	t.Helper()
+
+	encoded, err := json.Marshal(response.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, v); err != nil {
+		t.Fatalf("decoding %s: %v", encoded, err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   any
+		status int
+		code   string
+	}{
+		{
+			name:   "new account",
+			body:   map[string]string{"email": "new@example.com", "password": testPassword, "firstName": "New", "lastName": "User"},
+			status: http.StatusAccepted,
+		},
+		{
+			name:   "address already registered",
+			body:   map[string]string{"email": "taken@example.com", "password": testPassword},
+			status: http.StatusConflict,
+		},
+		{
+			name:   "address registered in another case",
+			body:   map[string]string{"email": "Taken@Example.com", "password": testPassword},
+			status: http.StatusConflict,
+		},
+		{
+			name:   "invalid address",
+			body:   map[string]string{"email": "Someone <someone@example.com>", "password": testPassword},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "address with surrounding space",
+			body:   map[string]string{"email": " new@example.com ", "password": testPassword},
+			status: http.StatusAccepted,
+		},
+		{
+			name:   "weak password",
+			body:   map[string]string{"email": "weak@example.com", "password": "password"},
+			status: http.StatusUnprocessableEntity,
+			code:   errPasswordPolicy,
+		},
+		{
+			name:   "not JSON",
+			body:   "{",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.createUser(t, "taken@example.com")
+
+			status, response := app.do(t, http.MethodPost, "/register", "", tt.body)
+			if status != tt.status {
+				t.Fatalf("got status %d (%s), want %d", status, response.Message, tt.status)
+			}
+			if response.Code != tt.code {
+				t.Errorf("got code %q, want %q", response.Code, tt.code)
+			}
+		})
+	}
+
+	t.Run("address is stored folded", func(t *testing.T) {
+		app := newTestApp(t)
+
+		status, _ := app.do(t, http.MethodPost, "/register", "", map[string]string{
+			"email":    " New.User@Example.COM ",
+			"password": testPassword,
+		})
+		if status != http.StatusAccepted {
+			t.Fatalf("got status %d", status)
+		}
+
+		user, err := app.users.GetByEmail(context.Background(), "new.user@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Email != "new.user@example.com" {
+			t.Errorf("got email %q, want %q", user.Email, "new.user@example.com")
+		}
+	})
+
+	t.Run("account waits for verification", func(t *testing.T) {
+		app := newTestApp(t)
+
+		status, _ := app.do(t, http.MethodPost, "/register", "", map[string]string{
+			"email":    "new@example.com",
+			"password": testPassword,
+		})
+		if status != http.StatusAccepted {
+			t.Fatalf("got status %d", status)
+		}
+
+		user, err := app.users.GetByEmail(context.Background(), "new@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Status != data.StatusPendingVerification {
+			t.Errorf("got status %q, want %q", user.Status, data.StatusPendingVerification)
+		}
+
+		roles, _, err := app.roles.ForUser(context.Background(), user.ID)
+		if err != nil || len(roles) != 1 || roles[0] != defaultRole {
+			t.Errorf("got roles %v (%v), want [%s]", roles, err, defaultRole)
+		}
+
+		if messages := app.mail.to(user.Email); len(messages) != 1 || !strings.Contains(messages[0].Message, "/verify?token=") {
+			t.Errorf("got mail %+v, want one verification link", messages)
+		}
+
+		// and can't log in yet
+		status, response := app.do(t, http.MethodPost, "/login", "", map[string]string{
+			"email":    user.Email,
+			"password": testPassword,
+		})
+		if status != http.StatusForbidden || response.Code != errAccountInactive {
+			t.Errorf("login got %d %q, want %d %q", status, response.Code, http.StatusForbidden, errAccountInactive)
+		}
+	})
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		status   int
+	}{
+		{"right password", "user@example.com", testPassword, http.StatusAccepted},
+		{"address in another case", " User@Example.com ", testPassword, http.StatusAccepted},
+		{"wrong password", "user@example.com", testPassword + "x", http.StatusUnauthorized},
+		{"unknown email", "nobody@example.com", testPassword, http.StatusUnauthorized},
+		{"suspended account", "suspended@example.com", testPassword, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.createUser(t, "user@example.com")
+			suspended := app.createUser(t, "suspended@example.com")
+			_, err := app.users.Transition(context.Background(), suspended.ID, data.StatusSuspended, "test", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status, response := app.do(t, http.MethodPost, "/login", "", map[string]string{
+				"email":    tt.email,
+				"password": tt.password,
+			})
+			if status != tt.status {
+				t.Fatalf("got status %d (%s), want %d", status, response.Message, tt.status)
+			}
+			if status != http.StatusAccepted {
+				return
+			}
+
+			var tokens TokenPair
+			decodeData(t, response, &tokens)
+			if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+				t.Fatalf("got tokens %+v", tokens)
+			}
+
+			sessions, err := app.sessions.ForUser(context.Background(), tokens.User.ID)
+			if err != nil || len(sessions) != 1 {
+				t.Errorf("got sessions %v (%v), want one", sessions, err)
+			}
+
+			if names := app.events.names(); len(names) != 1 || names[0] != eventLoginSucceeded {
+				t.Errorf("got events %v, want [%s]", names, eventLoginSucceeded)
+			}
+		})
+	}
+
+	t.Run("throttled after repeated failures", func(t *testing.T) {
+		app := newTestApp(t)
+		app.createUser(t, "user@example.com")
+
+		for i := 0; i <= accountThrottle.FreeAttempts; i++ {
+			status, _ := app.do(t, http.MethodPost, "/login", "", map[string]string{
+				"email":    "user@example.com",
+				"password": "wrong",
+			})
+			if status != http.StatusUnauthorized {
+				t.Fatalf("attempt %d got %d", i+1, status)
+			}
+		}
+
+		status, response := app.do(t, http.MethodPost, "/login", "", map[string]string{
+			"email":    "user@example.com",
+			"password": testPassword,
+		})
+		if status != http.StatusTooManyRequests || response.Code != errTooManyAttempts {
+			t.Errorf("got %d %q, want %d", status, response.Code, http.StatusTooManyRequests)
+		}
+	})
+
+	t.Run("refresh token rotates once", func(t *testing.T) {
+		app := newTestApp(t)
+		app.createUser(t, "user@example.com")
+		tokens := app.login(t, "user@example.com")
+
+		status, response := app.do(t, http.MethodPost, "/refresh", "", map[string]string{"refresh_token": tokens.RefreshToken})
+		if status != http.StatusAccepted {
+			t.Fatalf("first refresh got %d", status)
+		}
+		var rotated TokenPair
+		decodeData(t, response, &rotated)
+
+		status, _ = app.do(t, http.MethodPost, "/refresh", "", map[string]string{"refresh_token": tokens.RefreshToken})
+		if status != http.StatusUnauthorized {
+			t.Errorf("reused refresh token got %d, want %d", status, http.StatusUnauthorized)
+		}
+
+		// reuse revokes every token of the user, including the one it was rotated to
+		status, _ = app.do(t, http.MethodPost, "/refresh", "", map[string]string{"refresh_token": rotated.RefreshToken})
+		if status != http.StatusUnauthorized {
+			t.Errorf("rotated refresh token after reuse got %d, want %d", status, http.StatusUnauthorized)
+		}
+
+		// and logs the user out everywhere, so the access token stops working too
+		status, _ = app.do(t, http.MethodGet, "/sessions", tokens.AccessToken, nil)
+		if status != http.StatusUnauthorized {
+			t.Errorf("access token after reuse got %d, want %d", status, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("logout revokes the refresh token", func(t *testing.T) {
+		app := newTestApp(t)
+		app.createUser(t, "user@example.com")
+		tokens := app.login(t, "user@example.com")
+
+		status, _ := app.do(t, http.MethodPost, "/logout", "", map[string]string{"refresh_token": tokens.RefreshToken})
+		if status != http.StatusAccepted {
+			t.Fatalf("logout got %d", status)
+		}
+
+		status, _ = app.do(t, http.MethodPost, "/refresh", "", map[string]string{"refresh_token": tokens.RefreshToken})
+		if status != http.StatusUnauthorized {
+			t.Errorf("refresh after logout got %d, want %d", status, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestGetAll(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []string
+	}{
+		{"sorted by last name", "", http.StatusAccepted, []string{"admin@example.com", "ann@example.com", "bob@other.com"}},
+		{"sorted by email descending", "?sort=-email", http.StatusAccepted, []string{"bob@other.com", "ann@example.com", "admin@example.com"}},
+		{"by domain", "?email_domain=other.com", http.StatusAccepted, []string{"bob@other.com"}},
+		{"inactive only", "?active=0", http.StatusAccepted, []string{"ann@example.com"}},
+		{"unknown sort", "?sort=password", http.StatusBadRequest, nil},
+		{"limit too large", fmt.Sprintf("?limit=%d", data.MaxPageSize+1), http.StatusBadRequest, nil},
+		{"invalid cursor", "?cursor=abc", http.StatusBadRequest, nil},
+		{"invalid time", "?created_after=yesterday", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.createUser(t, "admin@example.com", "admin")
+			ann := app.createUser(t, "ann@example.com")
+			_, err := app.users.Transition(context.Background(), ann.ID, data.StatusSuspended, "test", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.createUser(t, "bob@other.com")
+			token := app.mfaLogin(t, "admin@example.com").AccessToken
+
+			status, response := app.do(t, http.MethodGet, "/user/"+tt.query, token, nil)
+			if status != tt.status {
+				t.Fatalf("got status %d (%s), want %d", status, response.Message, tt.status)
+			}
+			if status != http.StatusAccepted {
+				return
+			}
+
+			var page data.UserPage
+			decodeData(t, response, &page)
+
+			var got []string
+			for _, user := range page.Users {
+				got = append(got, user.Email)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("pages follow each other", func(t *testing.T) {
+		app := newTestApp(t)
+		app.createUser(t, "admin@example.com", "admin")
+		for i := 0; i < 4; i++ {
+			app.createUser(t, fmt.Sprintf("user%d@example.com", i))
+		}
+		token := app.mfaLogin(t, "admin@example.com").AccessToken
+
+		var emails []string
+		path := "/user/?sort=email&limit=2"
+		for pages := 0; path != ""; pages++ {
+			if pages > 3 {
+				t.Fatal("pages never ended")
+			}
+
+			status, response := app.do(t, http.MethodGet, path, token, nil)
+			if status != http.StatusAccepted {
+				t.Fatalf("got status %d (%s)", status, response.Message)
+			}
+
+			var page data.UserPage
+			decodeData(t, response, &page)
+			for _, user := range page.Users {
+				emails = append(emails, user.Email)
+			}
+
+			path = ""
+			if page.NextCursor != "" {
+				path = "/user/?sort=email&limit=2&cursor=" + page.NextCursor
+			}
+		}
+
+		want := "admin@example.com,user0@example.com,user1@example.com,user2@example.com,user3@example.com"
+		if strings.Join(emails, ",") != want {
+			t.Errorf("got %v", emails)
+		}
+	})
+}
+
+func TestGetUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller string
+		path   string
+		status int
+	}{
+		{"admin", "admin@example.com", "/user/%d", http.StatusAccepted},
+		{"without permission", "user@example.com", "/user/%d", http.StatusForbidden},
+		{"not logged in", "", "/user/%d", http.StatusUnauthorized},
+		{"unknown user", "admin@example.com", "/user/9999", http.StatusNotFound},
+		{"invalid id", "admin@example.com", "/user/abc", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.createUser(t, "admin@example.com", "admin")
+			target := app.createUser(t, "user@example.com")
+
+			var token string
+			if tt.caller != "" {
+				token = app.mfaLogin(t, tt.caller).AccessToken
+			}
+
+			path := tt.path
+			if strings.Contains(path, "%d") {
+				path = fmt.Sprintf(path, target.ID)
+			}
+
+			status, response := app.do(t, http.MethodGet, path, token, nil)
+			if status != tt.status {
+				t.Fatalf("got status %d (%s), want %d", status, response.Message, tt.status)
+			}
+			if status != http.StatusAccepted {
+				return
+			}
+
+			var user map[string]any
+			decodeData(t, response, &user)
+			if user["email"] != target.Email {
+				t.Errorf("got user %v, want %s", user, target.Email)
+			}
+			if _, ok := user["password"]; ok {
+				t.Error("the password hash was sent back")
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   any
+		status int
+		want   data.User
+	}{
+		{
+			name:   "names",
+			body:   map[string]string{"first_name": " Ada ", "last_name": "Lovelace"},
+			status: http.StatusAccepted,
+			want:   data.User{Email: "user@example.com", FirstName: "Ada", LastName: "Lovelace", Status: data.StatusActive},
+		},
+		{
+			name:   "email",
+			body:   map[string]string{"email": "changed@example.com"},
+			status: http.StatusAccepted,
+			want:   data.User{Email: "changed@example.com", FirstName: "Test", LastName: "user", Status: data.StatusActive},
+		},
+		{
+			name:   "email of another user",
+			body:   map[string]string{"email": "other@example.com"},
+			status: http.StatusConflict,
+			want:   data.User{Email: "user@example.com", FirstName: "Test", LastName: "user", Status: data.StatusActive},
+		},
+		{
+			name:   "invalid email",
+			body:   map[string]string{"email": "not an address"},
+			status: http.StatusBadRequest,
+			want:   data.User{Email: "user@example.com", FirstName: "Test", LastName: "user", Status: data.StatusActive},
+		},
+		{
+			name:   "suspend through active",
+			body:   map[string]int{"active": 0},
+			status: http.StatusAccepted,
+			want:   data.User{Email: "user@example.com", FirstName: "Test", LastName: "user", Status: data.StatusSuspended},
+		},
+		{
+			name:   "invalid active",
+			body:   map[string]int{"active": 2},
+			status: http.StatusBadRequest,
+			want:   data.User{Email: "user@example.com", FirstName: "Test", LastName: "user", Status: data.StatusActive},
+		},
+		{
+			name:   "name too long",
+			body:   map[string]string{"last_name": strings.Repeat("x", maxNameLength+1)},
+			status: http.StatusBadRequest,
+			want:   data.User{Email: "user@example.com", FirstName: "Test", LastName: "user", Status: data.StatusActive},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.createUser(t, "admin@example.com", "admin")
+			app.createUser(t, "other@example.com")
+			target := app.createUser(t, "user@example.com")
+			token := app.mfaLogin(t, "admin@example.com").AccessToken
+
+			status, response := app.do(t, http.MethodPut, fmt.Sprintf("/user/%d", target.ID), token, tt.body)
+			if status != tt.status {
+				t.Fatalf("got status %d (%s), want %d", status, response.Message, tt.status)
+			}
+
+			got, err := app.users.GetOne(context.Background(), target.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Email != tt.want.Email || got.FirstName != tt.want.FirstName ||
+				got.LastName != tt.want.LastName || got.Status != tt.want.Status {
+				t.Errorf("got %s %q %q %s, want %s %q %q %s", got.Email, got.FirstName, got.LastName, got.Status,
+					tt.want.Email, tt.want.FirstName, tt.want.LastName, tt.want.Status)
+			}
+		})
+	}
+
+	t.Run("suspending revokes refresh tokens", func(t *testing.T) {
+		app := newTestApp(t)
+		app.createUser(t, "admin@example.com", "admin")
+		target := app.createUser(t, "user@example.com")
+		refresh := app.login(t, "user@example.com").RefreshToken
+		token := app.mfaLogin(t, "admin@example.com").AccessToken
+
+		status, _ := app.do(t, http.MethodPut, fmt.Sprintf("/user/%d", target.ID), token, map[string]int{"active": 0})
+		if status != http.StatusAccepted {
+			t.Fatalf("got status %d", status)
+		}
+
+		status, _ = app.do(t, http.MethodPost, "/refresh", "", map[string]string{"refresh_token": refresh})
+		if status != http.StatusUnauthorized {
+			t.Errorf("refresh got %d, want %d", status, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestDeleteUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		caller  string
+		target  string
+		status  int
+		deleted bool
+	}{
+		{"admin deletes a user", "admin@example.com", "user@example.com", http.StatusAccepted, true},
+		{"admin deletes themselves", "admin@example.com", "admin@example.com", http.StatusBadRequest, false},
+		{"user without permission", "other@example.com", "user@example.com", http.StatusForbidden, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.createUser(t, "admin@example.com", "admin")
+			app.createUser(t, "other@example.com")
+			app.createUser(t, "user@example.com")
+
+			target, err := app.users.GetByEmail(context.Background(), tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token := app.mfaLogin(t, tt.caller).AccessToken
+
+			status, response := app.do(t, http.MethodDelete, fmt.Sprintf("/user/%d", target.ID), token, nil)
+			if status != tt.status {
+				t.Fatalf("got status %d (%s), want %d", status, response.Message, tt.status)
+			}
+
+			_, err = app.users.GetOne(context.Background(), target.ID)
+			if deleted := errors.Is(err, sql.ErrNoRows); deleted != tt.deleted {
+				t.Errorf("deleted is %v, want %v", deleted, tt.deleted)
+			}
+
+			if tt.deleted {
+				events := app.users.Events()
+				if last := events[len(events)-1]; last.Type != "user.deleted" {
+					t.Errorf("last user event is %s, want user.deleted", last.Type)
+				}
+
+				names := app.events.names()
+				if names[len(names)-1] != eventUserDeleted {
+					t.Errorf("last audit event is %s, want %s", names[len(names)-1], eventUserDeleted)
+				}
+			}
+		})
+	}
+}
+
+func TestInternalRoutes(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		sent       string
+		allowed    bool
+	}{
+		{"right secret", "internal-secret", "internal-secret", true},
+		{"no secret", "internal-secret", "", false},
+		{"wrong secret", "internal-secret", "internal-secreT", false},
+		{"none configured", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.InternalSecret = []byte(tt.configured)
+
+			app.apiKeys.AddServiceAccount(1, "ci")
+			key, err := app.apiKeys.Create(context.Background(), 1, "deploy", []string{"mail:send"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routes := []struct {
+				method string
+				path   string
+				body   string
+			}{
+				{http.MethodPost, "/api-keys/verify", fmt.Sprintf(`{"key": %q}`, key.PlainText)},
+				{http.MethodGet, "/sessions/revoked", ""},
+				{http.MethodGet, "/debug/vars", ""},
+			}
+
+			for _, route := range routes {
+				r := httptest.NewRequest(route.method, route.path, strings.NewReader(route.body))
+				if tt.sent != "" {
+					r.Header.Set(internalSecretHeader, tt.sent)
+				}
+
+				w := httptest.NewRecorder()
+				app.handler.ServeHTTP(w, r)
+
+				if allowed := w.Code < 300; allowed != tt.allowed {
+					t.Errorf("%s %s: got status %d, want allowed %v", route.method, route.path, w.Code, tt.allowed)
+				}
+				if !tt.allowed && w.Code != http.StatusUnauthorized {
+					t.Errorf("%s %s: got status %d, want %d", route.method, route.path, w.Code, http.StatusUnauthorized)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionLastSeen(t *testing.T) {
+	app := newTestApp(t)
+	clock := &fakeClock{now: time.Now()}
+	app.Clock = clock.Now
+	app.sessions.Now = clock.Now
+
+	app.createUser(t, "user@example.com")
+	tokens := app.login(t, "user@example.com")
+
+	lastSeen := func() time.Time {
+		t.Helper()
+
+		sessions, err := app.sessions.ForUser(context.Background(), tokens.User.ID)
+		if err != nil || len(sessions) != 1 {
+			t.Fatalf("got sessions %v (%v), want one", sessions, err)
+		}
+		return sessions[0].LastSeenAt
+	}
+	loggedIn := lastSeen()
+
+	// a session used again within sessionTouchInterval isn't written to
+	clock.Advance(sessionTouchInterval / 2)
+	if status, _ := app.do(t, http.MethodGet, "/sessions", tokens.AccessToken, nil); status != http.StatusAccepted {
+		t.Fatalf("got status %d", status)
+	}
+	if got := lastSeen(); !got.Equal(loggedIn) {
+		t.Errorf("last seen moved to %v within the interval", got)
+	}
+
+	clock.Advance(sessionTouchInterval)
+	if status, _ := app.do(t, http.MethodGet, "/sessions", tokens.AccessToken, nil); status != http.StatusAccepted {
+		t.Fatalf("got status %d", status)
+	}
+	if got := lastSeen(); !got.Equal(clock.Now()) {
+		t.Errorf("got last seen %v, want %v", got, clock.Now())
+	}
+}
+
+func TestEmailRequestThrottle(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"password reset", "/password/forgot"},
+		{"login link", "/login/magic/request"},
+		{"verification email", "/verify/resend"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.createUser(t, "known@example.com")
+
+			// registered and unknown addresses run into the limit alike: the free
+			// requests and the first delayed one go through, and the next is refused
+			for _, email := range []string{"known@example.com", "nobody@example.com"} {
+				for i := 0; i <= emailRequestThrottle.FreeAttempts; i++ {
+					status, _ := app.do(t, http.MethodPost, tt.path, "", map[string]string{"email": email})
+					if status != http.StatusAccepted {
+						t.Fatalf("%s: request %d got status %d", email, i+1, status)
+					}
+				}
+
+				status, response := app.do(t, http.MethodPost, tt.path, "", map[string]string{"email": email})
+				if status != http.StatusTooManyRequests || response.Code != errTooManyAttempts {
+					t.Errorf("%s: got %d %q, want %d %q", email, status, response.Code, http.StatusTooManyRequests, errTooManyAttempts)
+				}
+			}
+			app.tasks.Wait()
+		})
+	}
+}
+
+func TestAdminRoutesNeedMFA(t *testing.T) {
+	app := newTestApp(t)
+	admin := app.createUser(t, "admin@example.com", "admin")
+
+	routes := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/user"},
+		{http.MethodGet, fmt.Sprintf("/user/%d", admin.ID)},
+		{http.MethodGet, "/admin/roles"},
+		{http.MethodGet, fmt.Sprintf("/admin/users/%d/sessions", admin.ID)},
+	}
+
+	password := app.login(t, "admin@example.com").AccessToken
+	for _, route := range routes {
+		status, response := app.do(t, route.method, route.path, password, nil)
+		if status != http.StatusForbidden {
+			t.Errorf("%s %s without a second factor: got %d (%s), want %d", route.method, route.path, status, response.Message, http.StatusForbidden)
+		}
+	}
+
+	mfa := app.mfaLogin(t, "admin@example.com").AccessToken
+	for _, route := range routes {
+		status, response := app.do(t, route.method, route.path, mfa, nil)
+		if status >= 300 {
+			t.Errorf("%s %s with a second factor: got %d (%s)", route.method, route.path, status, response.Message)
+		}
+	}
+}
+
+func TestAPIKeyLastUsed(t *testing.T) {
+	app := newTestApp(t)
+	clock := &fakeClock{now: time.Now()}
+	app.apiKeys.Now = clock.Now
+
+	app.apiKeys.AddServiceAccount(1, "ci")
+	key, err := app.apiKeys.Create(context.Background(), 1, "deploy", []string{"mail:send"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func() time.Time {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodPost, "/api-keys/verify", strings.NewReader(fmt.Sprintf(`{"key": %q}`, key.PlainText)))
+		r.Header.Set(internalSecretHeader, "internal-secret")
+		w := httptest.NewRecorder()
+		app.handler.ServeHTTP(w, r)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("got status %d", w.Code)
+		}
+
+		keys, err := app.apiKeys.ForAccount(context.Background(), 1)
+		if err != nil || len(keys) != 1 || keys[0].LastUsedAt == nil {
+			t.Fatalf("got keys %+v (%v), want one that has been used", keys, err)
+		}
+		return *keys[0].LastUsedAt
+	}
+
+	first := verify()
+
+	// the broker checks the key on every request, which mustn't mean a write each time
+	clock.Advance(30 * time.Second)
+	if got := verify(); !got.Equal(first) {
+		t.Errorf("last used moved to %v within a minute", got)
+	}
+
+	clock.Advance(time.Minute)
+	if got := verify(); !got.Equal(clock.Now()) {
+		t.Errorf("got last used %v, want %v", got, clock.Now())
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"Mozilla/5.0", 20, "Mozilla/5.0"},
+		{"Mozilla/5.0", 7, "Mozilla"},
+		{"héllo", 2, "h"},
+		{"héllo", 3, "hé"},
+		{"日本語", 4, "日"},
+		{"ok\xffthen", 20, "okthen"},
+		{"", 5, ""},
+	}
+
+	for _, tt := range tests {
+		got := truncate(tt.s, tt.n)
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestAccessTokenWithoutSession(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser(t, "user@example.com")
+
+	// a token that is valid in every other way, but names no session to check
+	claims := Claims{
+		Email:       user.Email,
+		Permissions: []string{"mail:send"},
+		AMR:         []string{"pwd"},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(user.ID),
+			Issuer:    app.JWT.Issuer,
+			Audience:  jwt.ClaimStrings{app.JWT.Audience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(app.JWT.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := app.do(t, http.MethodGet, "/sessions", token, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
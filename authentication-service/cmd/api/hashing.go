@@ -0,0 +1,55 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"log"
+	"os"
+	"strconv"
+)
+
+// createPasswordHasher picks the hasher for new passwords from the environment.
+// PASSWORD_HASHER is argon2id (the default) or bcrypt; BCRYPT_COST, ARGON2_MEMORY_KIB,
+// ARGON2_ITERATIONS and ARGON2_PARALLELISM override the matching cost. Raising a cost
+// doesn't lock anyone out: old hashes still verify and are replaced at next login.
+func createPasswordHasher() data.PasswordHasher {
+	switch os.Getenv("PASSWORD_HASHER") {
+	case "bcrypt":
+		h := data.BcryptHasher{Cost: 12}
+		if cost, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err == nil && cost > 0 {
+			h.Cost = cost
+		}
+		return h
+
+	case "", "argon2id":
+		h := data.DefaultArgon2id()
+		if memory, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY_KIB"), 10, 32); err == nil && memory > 0 {
+			h.Memory = uint32(memory)
+		}
+		if iterations, err := strconv.ParseUint(os.Getenv("ARGON2_ITERATIONS"), 10, 32); err == nil && iterations > 0 {
+			h.Iterations = uint32(iterations)
+		}
+		if parallelism, err := strconv.ParseUint(os.Getenv("ARGON2_PARALLELISM"), 10, 8); err == nil && parallelism > 0 {
+			h.Parallelism = uint8(parallelism)
+		}
+		return h
+
+	default:
+		log.Panicf("unknown PASSWORD_HASHER %q", os.Getenv("PASSWORD_HASHER"))
+		return nil
+	}
+}
+
+// rehashPassword replaces the user's stored hash if it was made with older settings.
+// It is only called once the password has been checked, and failing here shouldn't
+// fail the login, so errors are just logged.
+func (app *Config) rehashPassword(ctx context.Context, user *data.User, password string) {
+	if !user.PasswordNeedsRehash() {
+		return
+	}
+
+	err := app.Models.User.ResetPassword(ctx, user.ID, password)
+	if err != nil {
+		log.Println("could not rehash password:", err)
+	}
+}
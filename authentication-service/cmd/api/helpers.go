@@ -1,16 +1,21 @@
 package main
 
 import (
+	"authentication/data"
 	"encoding/json"
 	"errors"
 	"io"
+	"log"
 	"net/http"
+	"net/mail"
 )
 
 // Helper functions for reading and writing JSON
 
 type jsonResponse struct {
 	Error bool `json:"error"`
+	// Code is a machine readable reason for an error, for clients that need to react to it
+	Code string `json:"code,omitempty"`
 	Message string `json:"message"`
 	Data any `json:"data,omitempty"`
 }
@@ -73,4 +78,45 @@ func (app *Config) errorJSON(w http.ResponseWriter,err error, status ...int) err
 	return app.writeJSON(w, statusCode, payload)
 }
 
+// Write JSON error with a machine readable code
+func (app *Config) errorCodeJSON(w http.ResponseWriter, code string, err error, status int) error {
+	var payload jsonResponse
+	payload.Error = true
+	payload.Code = code
+	payload.Message = err.Error()
+
+	return app.writeJSON(w, status, payload)
+}
+
+// maxNameLength is the longest first or last name we accept
+const maxNameLength = 255
 
+// normalizeEmail folds an email address with data.FoldEmail and checks that it is a
+// bare address, like "user@example.com", rather than a display name form
+func normalizeEmail(email string) (string, error) {
+	email = data.FoldEmail(email)
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || len(email) > 255 {
+		return "", errors.New("invalid email address")
+	}
+
+	return email, nil
+}
+
+// background runs fn after the handler has responded, so slow work like sending mail
+// doesn't hold up the response or show in how long it took
+func (app *Config) background(fn func()) {
+	app.tasks.Add(1)
+
+	go func() {
+		defer app.tasks.Done()
+		defer func() {
+			if err := recover(); err != nil {
+				log.Println("background task failed:", err)
+			}
+		}()
+
+		fn()
+	}()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const magicLinkTTL = 15 * time.Minute
+
+func magicLinkKey(email string) string {
+	return "magic:" + data.FoldEmail(email)
+}
+
+// RequestMagicLink emails a single use login link to a registered, active user
+func (app *Config) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(requestPayload.Email) == "" {
+		app.errorJSON(w, errors.New("email is required"), http.StatusBadRequest)
+		return
+	}
+
+	if !app.throttleRequest(w, r, magicLinkKey(requestPayload.Email)) {
+		return
+	}
+
+	// the account is looked up and the link sent after we respond, so neither the
+	// response nor how long it takes gives away whether the address is registered
+	email := requestPayload.Email
+	ip := app.clientIP(r)
+	app.background(func() {
+		app.sendMagicLink(context.Background(), email, ip)
+	})
+
+	app.writeJSON(w, http.StatusAccepted, jsonResponse{
+		Error:   false,
+		Message: "If that address is registered, a login link has been sent",
+	})
+}
+
+// sendMagicLink emails a login link to the active account registered with email, if
+// there is one. ip is the address the request came from, for the audit event. Failures
+// can only be logged, since the caller already has its answer.
+func (app *Config) sendMagicLink(ctx context.Context, email, ip string) {
+	user, err := app.Models.User.GetByEmail(ctx, email)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("Error looking up login link address:", err)
+		}
+		return
+	}
+	if user.Status != data.StatusActive {
+		return
+	}
+
+	link, err := app.Models.MagicLink.New(ctx, user.ID, magicLinkTTL)
+	if err != nil {
+		log.Println("Error creating login link:", err)
+		return
+	}
+
+	loginURL := fmt.Sprintf("%s/magic-login?token=%s", app.AppURL, url.QueryEscape(link.PlainText))
+	message := fmt.Sprintf("Someone asked for a link to log in to your account. "+
+		"If it was you, follow this link within the next %d minutes: %s\n\n"+
+		"If you didn't ask for this you can ignore this email.", int(magicLinkTTL.Minutes()), loginURL)
+
+	err = app.sendMail(user.Email, "Your login link", message)
+	if err != nil {
+		log.Println("Error sending login link email:", err)
+		return
+	}
+
+	app.audit(nil, event.Event{
+		Name:   eventMagicLinkSent,
+		Data:   fmt.Sprintf("login link sent to %s", user.Email),
+		UserID: user.ID,
+		Email:  user.Email,
+		IP:     ip,
+	})
+}
+
+// MagicLinkLogin exchanges a login link token for the same response Login gives: a
+// two factor challenge for users who have it enabled, otherwise tokens
+func (app *Config) MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := app.Models.MagicLink.Consume(r.Context(), requestPayload.Token)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidToken) {
+			app.errorJSON(w, err, http.StatusUnauthorized)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, data.ErrInvalidToken, http.StatusUnauthorized)
+		return
+	}
+
+	// using the link proves the user can read their email, which is all a link request
+	// needed
+	err = app.Models.LoginThrottle.Reset(r.Context(), magicLinkKey(user.Email))
+	if err != nil {
+		log.Println("could not reset login link requests:", err)
+	}
+
+	app.firstFactorPassed(w, r, user, []string{amrEmail})
+}
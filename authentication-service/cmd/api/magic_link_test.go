@@ -0,0 +1,110 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestMagicLink(t *testing.T) {
+	app := newTestApp(t)
+	app.createUser(t, "known@example.com")
+	suspended := app.createUser(t, "suspended@example.com")
+	if _, err := app.users.Transition(context.Background(), suspended.ID, data.StatusSuspended, "test", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the address is found whatever its case, and every address gets the same answer
+	var responses []jsonResponse
+	for _, email := range []string{"Known@Example.com", "suspended@example.com", "nobody@example.com"} {
+		status, response := app.do(t, http.MethodPost, "/login/magic/request", "", map[string]string{"email": email})
+		if status != http.StatusAccepted {
+			t.Fatalf("%s: got status %d, want %d", email, status, http.StatusAccepted)
+		}
+		responses = append(responses, response)
+	}
+	app.tasks.Wait()
+
+	if responses[0] != responses[1] || responses[0] != responses[2] {
+		t.Errorf("addresses got different responses: %+v", responses)
+	}
+	for _, email := range []string{"suspended@example.com", "nobody@example.com"} {
+		if n := len(app.mail.to(email)); n != 0 {
+			t.Errorf("sent %d messages to %s", n, email)
+		}
+	}
+
+	sent := app.mail.to("known@example.com")
+	if len(sent) != 1 {
+		t.Fatalf("got %d login link messages, want 1", len(sent))
+	}
+
+	found := false
+	for _, name := range app.events.names() {
+		if name == eventMagicLinkSent {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("got events %v, want %s among them", app.events.names(), eventMagicLinkSent)
+	}
+}
+
+// magicLinkToken requests a login link for email and returns the token in it
+func (app *testApp) magicLinkToken(t *testing.T, email string) string {
+	t.Helper()
+
+	before := len(app.mail.to(email))
+	status, _ := app.do(t, http.MethodPost, "/login/magic/request", "", map[string]string{"email": email})
+	app.tasks.Wait()
+	if status != http.StatusAccepted {
+		t.Fatalf("requesting a login link: got status %d", status)
+	}
+
+	sent := app.mail.to(email)
+	if len(sent) != before+1 {
+		t.Fatalf("got %d new login link messages, want 1", len(sent)-before)
+	}
+
+	_, link, _ := strings.Cut(sent[len(sent)-1].Message, "magic-login?token=")
+	token, err := url.QueryUnescape(strings.Fields(link)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	app := newTestApp(t)
+	app.createUser(t, "known@example.com")
+
+	older := app.magicLinkToken(t, "known@example.com")
+	token := app.magicLinkToken(t, "known@example.com")
+
+	// only the newest link works
+	status, _ := app.do(t, http.MethodPost, "/login/magic", "", map[string]string{"token": older})
+	if status != http.StatusUnauthorized {
+		t.Errorf("older link: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	status, response := app.do(t, http.MethodPost, "/login/magic", "", map[string]string{"token": token})
+	if status != http.StatusAccepted {
+		t.Fatalf("logging in with the link: got %d %q", status, response.Message)
+	}
+
+	var tokens TokenPair
+	decodeData(t, response, &tokens)
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Errorf("got tokens %+v", tokens)
+	}
+
+	// each link works once
+	status, _ = app.do(t, http.MethodPost, "/login/magic", "", map[string]string{"token": token})
+	if status != http.StatusUnauthorized {
+		t.Errorf("reusing the link: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// mailServiceURL is where mail is sent unless Config.MailURL says otherwise; the host
+// comes from docker-compose.yml
+const mailServiceURL = "http://mailer-service/send"
+
+// sendMail asks the mail service to deliver a message. The sender is left empty so
+// the mail service uses its configured from address.
+func (app *Config) sendMail(to, subject, message string) error {
+	var msg struct {
+		To      string `json:"to"`
+		Subject string `json:"subject"`
+		Message string `json:"message"`
+	}
+
+	msg.To = to
+	msg.Subject = subject
+	msg.Message = message
+
+	jsonData, _ := json.Marshal(msg)
+	url := app.MailURL
+	if url == "" {
+		url = mailServiceURL
+	}
+
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		return errors.New("error calling mail service")
+	}
+
+	return nil
+}
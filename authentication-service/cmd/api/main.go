@@ -2,11 +2,14 @@ package main
 
 import (
 	"authentication/data"
+	"authentication/policy"
+	"authentication/webauthn"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
@@ -20,6 +23,27 @@ var counts int64
 type Config struct {
 	DB *sql.DB
 	Models data.Models
+	JWT JWTConfig
+	// base URL of the front end, used to build links we send by email
+	AppURL string
+	// key used to encrypt secrets we store, like TOTP seeds
+	EncryptionKey []byte
+	// where audit events go
+	Events EventPublisher
+	// what new passwords have to satisfy
+	PasswordPolicy *policy.Password
+	// this site as passkeys see it
+	WebAuthn *webauthn.RelyingParty
+	// Clock returns the current time; replace it with a fake clock to control TOTP codes
+	Clock func() time.Time
+	// proxies whose X-Real-IP header we believe
+	TrustedProxies *trustedProxies
+	// where mail is sent; empty means the mail service
+	MailURL string
+	// shared with the broker, which sends it on the routes only it may call
+	InternalSecret []byte
+	// work handlers left running after they responded, like sending mail
+	tasks sync.WaitGroup
 }
 
 func main(){
@@ -31,12 +55,72 @@ func main(){
 		log.Panic("could not connect to db")
 	}
 
+	// "api migrate ..." manages the schema and exits without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := migrateCommand(conn, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err := runMigrations(conn)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// query deadlines and metrics for the data layer
+	configureDatabase()
+
+	// "api import ..." and "api export ..." load or dump users in bulk and exit
+	if len(os.Args) > 1 && (os.Args[1] == "import" || os.Args[1] == "export") {
+		command := importCommand
+		if os.Args[1] == "export" {
+			command = exportCommand
+		}
+
+		err = command(conn, os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// set up config
 	app := Config{
 		DB: conn,
 		Models: data.New(conn),
+		JWT: createJWTConfig(),
+		AppURL: os.Getenv("APP_URL"),
+		EncryptionKey: loadEncryptionKey(),
+		Events: createEventPublisher(),
+		PasswordPolicy: createPasswordPolicy(),
+		Clock: time.Now,
+		TrustedProxies: createTrustedProxies(),
+		InternalSecret: []byte(os.Getenv("INTERNAL_API_SECRET")),
+	}
+
+	if app.AppURL == "" {
+		app.AppURL = "http://localhost"
+	}
+
+	app.WebAuthn = createRelyingParty(app.AppURL)
+
+	if len(app.JWT.Secret) == 0 {
+		log.Panic("JWT_SECRET must be set")
+	}
+
+	if len(app.InternalSecret) == 0 {
+		log.Println("INTERNAL_API_SECRET is not set; the broker won't be able to verify API keys or revoked sessions, and the logger service will refuse exports and erasures")
 	}
 
+	data.SetPasswordHasher(createPasswordHasher())
+
+	app.bootstrapAdmins()
+
+	// user lifecycle events wait in the outbox until the relay has published them
+	startOutboxRelay(app.Models.Outbox)
+
 	// set up Web Server
 	srv := &http.Server{
 		Addr: fmt.Sprintf(":%s", webPort),
@@ -44,7 +128,7 @@ func main(){
 	}
 
 	// start Web Server
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if err != nil {
 		log.Panic(err)
 	}
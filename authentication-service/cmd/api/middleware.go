@@ -0,0 +1,240 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/scim"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type contextKey string
+
+const (
+	userIDKey      contextKey = "userID"
+	permissionsKey contextKey = "permissions"
+	sessionIDKey   contextKey = "sessionID"
+	orgIDKey       contextKey = "organizationID"
+	amrKey         contextKey = "amr"
+	// serviceAccountKey holds the name of the service account requireSCIMToken
+	// authenticated; permissionsKey holds its key's scopes
+	serviceAccountKey contextKey = "serviceAccount"
+)
+
+// sessionTouchInterval is how stale a session's last seen time can get before a
+// request updates it
+const sessionTouchInterval = time.Minute
+
+// internalSecretHeader carries the secret the broker shares with us on the routes only
+// it may call. We send it the same way to the logger service, which shares it too.
+const internalSecretHeader = "X-Internal-Secret"
+
+// requireUser only lets requests through that carry a valid access token, which the
+// broker passes on from its own clients, from a session that is still active. The
+// user's ID, session, active organization and the methods they logged in with are put
+// in the request context.
+func (app *Config) requireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			app.errorJSON(w, errors.New("authentication required"), http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := app.parseToken(strings.TrimSpace(token), app.JWT.Audience)
+		if err != nil {
+			app.errorJSON(w, errors.New("invalid or expired token"), http.StatusUnauthorized)
+			return
+		}
+
+		userID, err := strconv.Atoi(claims.Subject)
+		if err != nil {
+			app.errorJSON(w, errors.New("invalid or expired token"), http.StatusUnauthorized)
+			return
+		}
+
+		// every access token names its session, which has to still be active
+		sessionID, err := strconv.Atoi(claims.SessionID)
+		if err != nil {
+			app.errorJSON(w, errors.New("invalid or expired token"), http.StatusUnauthorized)
+			return
+		}
+
+		lastSeen, err := app.Models.Session.LastSeen(r.Context(), sessionID)
+		if errors.Is(err, data.ErrSessionNotFound) {
+			app.errorJSON(w, errors.New("session has been revoked"), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		// last seen only needs to be roughly right, so a busy session is written at
+		// most once every sessionTouchInterval, and a failed write doesn't fail the
+		// request
+		if app.Clock().Sub(lastSeen) >= sessionTouchInterval {
+			err = app.Models.Session.Touch(r.Context(), sessionID)
+			if err != nil && !errors.Is(err, data.ErrSessionNotFound) {
+				log.Println("could not record session use:", err)
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		ctx = context.WithValue(ctx, permissionsKey, claims.Permissions)
+		ctx = context.WithValue(ctx, sessionIDKey, sessionID)
+		ctx = context.WithValue(ctx, orgIDKey, claims.OrganizationID)
+		ctx = context.WithValue(ctx, amrKey, claims.AMR)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireInternal only lets requests through that carry the secret shared with the
+// broker in internalSecretHeader. Our port is published, so being inside the Docker
+// network can't be what keeps others out. Without a secret configured, every request
+// is refused.
+func (app *Config) requireInternal(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := []byte(r.Header.Get(internalSecretHeader))
+		if len(app.InternalSecret) == 0 || subtle.ConstantTimeCompare(secret, app.InternalSecret) != 1 {
+			app.errorJSON(w, errors.New("authentication required"), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requirePermission only lets through users whose access token carries permission.
+// It has to be used after requireUser.
+func (app *Config) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			permissions, _ := r.Context().Value(permissionsKey).([]string)
+			for _, granted := range permissions {
+				if granted == permission {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			app.errorJSON(w, errors.New("you are not allowed to perform this action"), http.StatusForbidden)
+		})
+	}
+}
+
+// requireMFA only lets requests through from users who passed a second factor when
+// they logged in. The broker asks the same of admin actions, but our port is published,
+// so we can't count on every request coming through it. It goes after requireUser.
+func (app *Config) requireMFA(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mfaFromContext(r.Context()) {
+			app.errorJSON(w, errors.New("two factor authentication is required for this action"), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireSCIMToken only lets requests through that carry, as a bearer token, an API
+// key with the scim:provision scope. Identity providers call the SCIM API directly,
+// so failures are sent as SCIM errors. The service account is put in the request
+// context.
+func (app *Config) requireSCIMToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			app.scimError(w, scim.NewError(http.StatusUnauthorized, "", "authentication required"))
+			return
+		}
+
+		key, err := app.Models.APIKey.Authenticate(r.Context(), strings.TrimSpace(token))
+		if err != nil {
+			if errors.Is(err, data.ErrInvalidAPIKey) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="scim", error="invalid_token"`)
+				app.scimError(w, scim.NewError(http.StatusUnauthorized, "", err.Error()))
+				return
+			}
+			app.scimError(w, err)
+			return
+		}
+
+		allowed := false
+		for _, scope := range key.Scopes {
+			if scope == scimPermission {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			app.scimError(w, scim.NewError(http.StatusForbidden, "", "API key does not have the "+scimPermission+" scope"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), serviceAccountKey, key.ServiceAccount)
+		ctx = context.WithValue(ctx, permissionsKey, key.Scopes)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// serviceAccountFromContext returns the name of the service account requireSCIMToken
+// authenticated
+func serviceAccountFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(serviceAccountKey).(string)
+	return name
+}
+
+// userIDFromContext returns the ID of the user requireUser authenticated
+func userIDFromContext(ctx context.Context) int {
+	id, _ := ctx.Value(userIDKey).(int)
+	return id
+}
+
+// sessionIDFromContext returns the session of the access token requireUser accepted
+func sessionIDFromContext(ctx context.Context) int {
+	id, _ := ctx.Value(sessionIDKey).(int)
+	return id
+}
+
+// organizationIDFromContext returns the organization the user is acting in, or 0 when
+// they aren't acting in one
+func organizationIDFromContext(ctx context.Context) int {
+	id, _ := ctx.Value(orgIDKey).(int)
+	return id
+}
+
+// passedMFA reports whether a login with the methods in amr used a second factor: a
+// one time code after the first factor, or a passkey that also verified the user
+func passedMFA(amr []string) bool {
+	var hardwareKey, user bool
+	for _, method := range amr {
+		switch method {
+		case amrOTP:
+			return true
+		case amrHardwareKey:
+			hardwareKey = true
+		case amrUser:
+			user = true
+		}
+	}
+
+	return hardwareKey && user
+}
+
+// amrFromContext returns the methods the user logged in with
+func amrFromContext(ctx context.Context) []string {
+	amr, _ := ctx.Value(amrKey).([]string)
+	return amr
+}
+
+// mfaFromContext reports whether the user passed a second factor when they logged in
+func mfaFromContext(ctx context.Context) bool {
+	return passedMFA(amrFromContext(ctx))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// migrateTimeout bounds how long a migrate run may take, including waiting for another
+// instance that holds the migration lock
+const migrateTimeout = 5 * time.Minute
+
+const migrateUsage = `usage: api migrate <command>
+
+commands:
+  up            apply every pending migration
+  down [n]      roll back the last n migrations (default 1)
+  status        list migrations and whether they have been applied
+  to <version>  migrate up or down to the given version`
+
+// runMigrations brings the schema up to date when the service starts
+func runMigrations(conn *sql.DB) error {
+	migrator, err := data.NewMigrator(conn)
+	if err != nil {
+		return err
+	}
+	migrator.Log = log.Printf
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	return migrator.Up(ctx)
+}
+
+// migrateCommand runs the migrate subcommand with the arguments that follow it
+func migrateCommand(conn *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	migrator, err := data.NewMigrator(conn)
+	if err != nil {
+		return err
+	}
+	migrator.Log = log.Printf
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	switch args[0] {
+	case "up":
+		return migrator.Up(ctx)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		return migrator.Down(ctx, steps)
+
+	case "to":
+		if len(args) < 2 {
+			return errors.New(migrateUsage)
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		return migrator.To(ctx, version)
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(os.Stdout, "%06d  %-30s  %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+
+	default:
+		return errors.New(migrateUsage)
+	}
+}
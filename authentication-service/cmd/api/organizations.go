@@ -0,0 +1,468 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxSlugLength = 63
+
+// errShared is returned when a user shared by several organizations is changed from
+// inside one of them
+var errShared = errors.New("this user belongs to other organizations too and can only be changed by an administrator")
+
+// errGlobalRole is returned when a user who holds a global role, such as an admin, is
+// changed from inside an organization
+var errGlobalRole = errors.New("this user holds a global role and can only be changed by an administrator")
+
+// slugPattern is what an organization slug may look like: lowercase words joined by
+// single hyphens
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// slugify makes a slug out of an organization's name
+func slugify(name string) string {
+	var b strings.Builder
+	hyphen := false
+
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+			hyphen = false
+			continue
+		}
+		if !hyphen && b.Len() > 0 {
+			b.WriteByte('-')
+			hyphen = true
+		}
+	}
+
+	return strings.TrimSuffix(truncate(b.String(), maxSlugLength), "-")
+}
+
+// GetOrganizations lists the organizations the logged in user belongs to, with their
+// role in each
+func (app *Config) GetOrganizations(w http.ResponseWriter, r *http.Request) {
+	memberships, err := app.Models.Organization.ForUser(r.Context(), userIDFromContext(r.Context()))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Your organizations",
+		Data:    memberships,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// CreateOrganization creates an organization and makes owner_id, or the caller if it
+// is left out, its first owner. Only users whose global roles grant
+// organizations:manage can do this; owning an organization isn't enough.
+func (app *Config) CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Name    string `json:"name"`
+		Slug    string `json:"slug"`
+		OwnerID int    `json:"owner_id"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !app.globalPermission(w, r, "organizations:manage") {
+		return
+	}
+
+	org := data.Organization{
+		Name: strings.TrimSpace(requestPayload.Name),
+		Slug: strings.TrimSpace(requestPayload.Slug),
+	}
+
+	if org.Name == "" || len(org.Name) > maxNameLength {
+		app.errorJSON(w, fmt.Errorf("name is required and must be at most %d characters", maxNameLength), http.StatusBadRequest)
+		return
+	}
+
+	if org.Slug == "" {
+		org.Slug = slugify(org.Name)
+	}
+	if len(org.Slug) > maxSlugLength || !slugPattern.MatchString(org.Slug) {
+		app.errorJSON(w, errors.New("slug must be lowercase letters and digits separated by hyphens"), http.StatusBadRequest)
+		return
+	}
+
+	ownerID := requestPayload.OwnerID
+	if ownerID == 0 {
+		ownerID = userIDFromContext(r.Context())
+	}
+
+	owner, err := app.Models.User.GetOne(r.Context(), ownerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("owner not found"), http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	org.ID, err = app.Models.Organization.Insert(r.Context(), org, owner.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateSlug) {
+			app.errorJSON(w, err, http.StatusConflict)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, event.Event{
+		Name:           eventOrganizationCreated,
+		Data:           fmt.Sprintf("user %d created organization %s owned by %s", userIDFromContext(r.Context()), org.Slug, owner.Email),
+		OrganizationID: org.ID,
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Created organization %s", org.Slug),
+		Data:    org,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// SwitchOrganization changes the organization the caller's session is acting in and
+// returns an access token for it. organization_id 0 leaves the session without one.
+// The refresh token stays the same and keeps the new organization.
+func (app *Config) SwitchOrganization(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		OrganizationID int `json:"organization_id"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID := userIDFromContext(r.Context())
+	sessionID := sessionIDFromContext(r.Context())
+
+	if requestPayload.OrganizationID != 0 {
+		member, err := app.Models.Organization.IsMember(r.Context(), requestPayload.OrganizationID, userID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !member {
+			app.errorJSON(w, data.ErrNotMember, http.StatusForbidden)
+			return
+		}
+	}
+
+	err = app.Models.Session.SetOrganization(r.Context(), userID, sessionID, requestPayload.OrganizationID)
+	if err != nil {
+		if errors.Is(err, data.ErrSessionNotFound) {
+			app.errorJSON(w, errors.New("session has been revoked"), http.StatusUnauthorized)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := app.accessToken(r.Context(), user, sessionID, requestPayload.OrganizationID, amrFromContext(r.Context()))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	message := "Switched to no organization"
+	if tokens.Organization != nil {
+		message = fmt.Sprintf("Switched to organization %s", tokens.Organization.Slug)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: message,
+		Data:    tokens,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// GetMembers lists everyone in an organization with their role there
+func (app *Config) GetMembers(w http.ResponseWriter, r *http.Request) {
+	org, ok := app.organizationFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	members, err := app.Models.Organization.Members(r.Context(), org.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Members of %s", org.Slug),
+		Data:    members,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// SetMember gives a member of an organization a new role. Adding someone who isn't a
+// member yet needs organizations:manage from a global role, so an owner can't pull
+// other organizations' users into their own.
+func (app *Config) SetMember(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Role string `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	org, ok := app.organizationFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	user, ok := app.memberFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	member, err := app.Models.Organization.IsMember(r.Context(), org.ID, user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !member && !app.globalPermission(w, r, "organizations:manage") {
+		return
+	}
+
+	err = app.Models.Organization.SetMember(r.Context(), org.ID, user.ID, requestPayload.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRoleNotFound):
+			app.errorJSON(w, err, http.StatusNotFound)
+		case errors.Is(err, data.ErrLastOwner):
+			app.errorJSON(w, err, http.StatusConflict)
+		default:
+			app.errorJSON(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	app.audit(r, event.Event{
+		Name:           eventMemberChanged,
+		Data:           fmt.Sprintf("user %d made %s %s of %s", userIDFromContext(r.Context()), user.Email, requestPayload.Role, org.Slug),
+		UserID:         user.ID,
+		Email:          user.Email,
+		OrganizationID: org.ID,
+		Attributes:     map[string]string{"role": requestPayload.Role},
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%s is now %s of %s", user.Email, requestPayload.Role, org.Slug),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// RemoveMember takes a user out of an organization. Their account is left alone.
+func (app *Config) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	org, ok := app.organizationFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	user, ok := app.memberFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Organization.RemoveMember(r.Context(), org.ID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotMember):
+			app.errorJSON(w, err, http.StatusNotFound)
+		case errors.Is(err, data.ErrLastOwner):
+			app.errorJSON(w, err, http.StatusConflict)
+		default:
+			app.errorJSON(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	app.audit(r, event.Event{
+		Name:           eventMemberRemoved,
+		Data:           fmt.Sprintf("user %d removed %s from %s", userIDFromContext(r.Context()), user.Email, org.Slug),
+		UserID:         user.ID,
+		Email:          user.Email,
+		OrganizationID: org.ID,
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Removed %s from %s", user.Email, org.Slug),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// organizationFromURL loads the organization whose ID is in the {orgID} URL parameter.
+// A user acting in an organization can only reach that one, since the permissions in
+// their token may come from their role there; without an active organization their
+// permissions are all global and every organization can be reached.
+func (app *Config) organizationFromURL(w http.ResponseWriter, r *http.Request) (*data.Organization, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "orgID"))
+	if err != nil || id < 1 {
+		app.errorJSON(w, errors.New("invalid organization id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if active := organizationIDFromContext(r.Context()); active != 0 && active != id {
+		app.errorJSON(w, data.ErrOrganizationNotFound, http.StatusNotFound)
+		return nil, false
+	}
+
+	org, err := app.Models.Organization.GetOne(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, data.ErrOrganizationNotFound) {
+			app.errorJSON(w, err, http.StatusNotFound)
+			return nil, false
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return org, true
+}
+
+// memberFromURL loads the user whose ID is in the {userID} URL parameter
+func (app *Config) memberFromURL(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil || id < 1 {
+		app.errorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+			return nil, false
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// globalPermission checks that the caller's global roles grant permission, not just
+// their role in the organization they are acting in. It writes a 403 and returns
+// false if they don't.
+func (app *Config) globalPermission(w http.ResponseWriter, r *http.Request, permission string) bool {
+	_, permissions, err := app.Models.Role.ForUser(r.Context(), userIDFromContext(r.Context()))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	for _, granted := range permissions {
+		if granted == permission {
+			return true
+		}
+	}
+
+	app.errorJSON(w, errors.New("you are not allowed to perform this action"), http.StatusForbidden)
+	return false
+}
+
+// inOrganization reports whether user can be reached by a caller acting in their
+// active organization: everyone can when there is none, otherwise only its members
+func (app *Config) inOrganization(r *http.Request, user *data.User) (bool, error) {
+	orgID := organizationIDFromContext(r.Context())
+	if orgID == 0 {
+		return true, nil
+	}
+
+	return app.Models.Organization.IsMember(r.Context(), orgID, user.ID)
+}
+
+// soleOrganization checks, for a caller acting in an organization, that user belongs
+// to no other organization and holds no global role, so changes made there can't reach
+// another tenant's users or the administrators. It writes a 403 and returns false if
+// they do.
+func (app *Config) soleOrganization(w http.ResponseWriter, r *http.Request, user *data.User) bool {
+	if organizationIDFromContext(r.Context()) == 0 {
+		return true
+	}
+
+	memberships, err := app.Models.Organization.ForUser(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	if len(memberships) > 1 {
+		app.errorJSON(w, errShared, http.StatusForbidden)
+		return false
+	}
+
+	global, err := app.holdsGlobalRole(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return false
+	}
+	if global {
+		app.errorJSON(w, errGlobalRole, http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// holdsGlobalRole reports whether a user has been granted a global role beyond the
+// default one every user gets
+func (app *Config) holdsGlobalRole(ctx context.Context, userID int) (bool, error) {
+	roles, _, err := app.Models.Role.ForUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, role := range roles {
+		if role != defaultRole {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// createOrganization stores an organization owned by owner, with the other users as
+// members, and returns its ID
+func (app *testApp) createOrganization(t *testing.T, slug string, owner *data.User, members ...*data.User) int {
+	t.Helper()
+
+	ctx := context.Background()
+	id, err := app.Models.Organization.Insert(ctx, data.Organization{Name: slug, Slug: slug}, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, member := range members {
+		if err := app.Models.Organization.SetMember(ctx, id, member.ID, data.MemberRole); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return id
+}
+
+// switchOrganization switches the session of token to orgID and returns the new tokens
+func (app *testApp) switchOrganization(t *testing.T, token string, orgID int) TokenPair {
+	t.Helper()
+
+	status, response := app.do(t, http.MethodPost, "/organizations/switch", token, map[string]int{"organization_id": orgID})
+	if status != http.StatusAccepted {
+		t.Fatalf("switching to organization %d: got %d %q", orgID, status, response.Message)
+	}
+
+	var tokens TokenPair
+	decodeData(t, response, &tokens)
+
+	return tokens
+}
+
+func TestSwitchOrganization(t *testing.T) {
+	app := newTestApp(t)
+	first := app.createUser(t, "first@example.com")
+	second := app.createUser(t, "second@example.com")
+	user := app.createUser(t, "user@example.com")
+	firstID := app.createOrganization(t, "first", first, user)
+	secondID := app.createOrganization(t, "second", second, user)
+	otherID := app.createOrganization(t, "other", first)
+
+	// a session starts out in the first organization the user joined
+	tokens := app.login(t, "user@example.com")
+	claims, err := app.parseToken(tokens.AccessToken, app.JWT.Audience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.OrganizationID != firstID {
+		t.Errorf("logged in acting in organization %d, want %d", claims.OrganizationID, firstID)
+	}
+
+	switched := app.switchOrganization(t, tokens.AccessToken, secondID)
+	if switched.Organization == nil || switched.Organization.OrganizationID != secondID {
+		t.Fatalf("switched to %+v, want organization %d", switched.Organization, secondID)
+	}
+	claims, err = app.parseToken(switched.AccessToken, app.JWT.Audience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.OrganizationID != secondID || claims.SessionID != fmt.Sprint(app.sessionOf(t, user.ID)) {
+		t.Errorf("got organization %d in session %s", claims.OrganizationID, claims.SessionID)
+	}
+
+	// the refresh token carries on in the organization switched to
+	status, response := app.do(t, http.MethodPost, "/refresh", "", map[string]string{"refresh_token": tokens.RefreshToken})
+	if status != http.StatusAccepted {
+		t.Fatalf("refresh got %d %q", status, response.Message)
+	}
+	var refreshed TokenPair
+	decodeData(t, response, &refreshed)
+	if refreshed.Organization == nil || refreshed.Organization.OrganizationID != secondID {
+		t.Errorf("refreshed into %+v, want organization %d", refreshed.Organization, secondID)
+	}
+
+	// only organizations the user belongs to can be switched to
+	status, _ = app.do(t, http.MethodPost, "/organizations/switch", switched.AccessToken, map[string]int{"organization_id": otherID})
+	if status != http.StatusForbidden {
+		t.Errorf("switching to another organization got %d, want %d", status, http.StatusForbidden)
+	}
+
+	none := app.switchOrganization(t, switched.AccessToken, 0)
+	if none.Organization != nil {
+		t.Errorf("switched to no organization, got %+v", none.Organization)
+	}
+}
+
+// sessionOf returns the ID of the only active session of a user
+func (app *testApp) sessionOf(t *testing.T, userID int) int {
+	t.Helper()
+
+	sessions, err := app.sessions.ForUser(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("user %d has %d sessions, want 1", userID, len(sessions))
+	}
+
+	return sessions[0].ID
+}
+
+func TestOrganizationScoping(t *testing.T) {
+	app := newTestApp(t)
+	owner := app.createUser(t, "owner@example.com")
+	member := app.createUser(t, "member@example.com")
+	shared := app.createUser(t, "shared@example.com")
+	admin := app.createUser(t, "admin@example.com", "admin")
+	outsider := app.createUser(t, "outsider@example.com")
+	app.createOrganization(t, "acme", owner, member, shared, admin)
+	app.createOrganization(t, "globex", outsider, shared)
+
+	// the owner acts in acme, the only organization they belong to
+	token := app.mfaLogin(t, "owner@example.com").AccessToken
+
+	tests := []struct {
+		name   string
+		method string
+		user   *data.User
+		body   any
+		status int
+	}{
+		{"read a member", http.MethodGet, member, nil, http.StatusAccepted},
+		{"read someone outside", http.MethodGet, outsider, nil, http.StatusNotFound},
+		{"update a member", http.MethodPut, member, map[string]string{"first_name": "Changed"}, http.StatusAccepted},
+		{"update someone outside", http.MethodPut, outsider, map[string]string{"first_name": "Changed"}, http.StatusNotFound},
+		{"update a member of another organization too", http.MethodPut, shared, map[string]string{"first_name": "Changed"}, http.StatusForbidden},
+		{"update an admin", http.MethodPut, admin, map[string]string{"email": "owned@example.com"}, http.StatusForbidden},
+		{"delete an admin", http.MethodDelete, admin, nil, http.StatusForbidden},
+		{"delete a member of another organization too", http.MethodDelete, shared, nil, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, response := app.do(t, tt.method, fmt.Sprintf("/user/%d", tt.user.ID), token, tt.body)
+			if status != tt.status {
+				t.Errorf("got %d %q, want %d", status, response.Message, tt.status)
+			}
+		})
+	}
+
+	got, err := app.users.GetOne(context.Background(), admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != admin.Email || got.Status != data.StatusActive {
+		t.Errorf("admin became %s %s", got.Email, got.Status)
+	}
+
+	// an import into the organization can't reach them either
+	summary := app.importCSV(t, token, "/user/import?format=csv",
+		"email,first_name\nmember@example.com,Imported\nshared@example.com,Imported\nadmin@example.com,Imported\n")
+	if summary.Updated != 1 || summary.Failed != 2 {
+		t.Fatalf("got %+v, want one updated and two failed", summary)
+	}
+	if summary.Errors[0].Errors[0] != errShared.Error() || summary.Errors[1].Errors[0] != errGlobalRole.Error() {
+		t.Errorf("got errors %+v", summary.Errors)
+	}
+}
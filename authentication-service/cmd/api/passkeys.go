@@ -0,0 +1,429 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"authentication/webauthn"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// passkeyChallengeTTL gives the user as long to finish a ceremony as the browser does
+const passkeyChallengeTTL = webauthn.Timeout
+
+// passkeyCeremony is what the begin endpoints send back: the options to pass to
+// navigator.credentials, and the token to send with the result
+type passkeyCeremony struct {
+	Session string `json:"session"`
+	Options any    `json:"options"`
+}
+
+// createRelyingParty describes this site to authenticators. WEBAUTHN_RP_ID and
+// WEBAUTHN_ORIGINS (comma separated) default to the host and origin of appURL, which is
+// all a single front end needs.
+func createRelyingParty(appURL string) *webauthn.RelyingParty {
+	rp := &webauthn.RelyingParty{
+		ID:                      os.Getenv("WEBAUTHN_RP_ID"),
+		Name:                    os.Getenv("WEBAUTHN_RP_NAME"),
+		RequireUserVerification: os.Getenv("WEBAUTHN_REQUIRE_USER_VERIFICATION") == "true",
+	}
+
+	if rp.Name == "" {
+		rp.Name = totpIssuer
+	}
+
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			rp.Origins = append(rp.Origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+
+	u, err := url.Parse(appURL)
+	if err != nil || u.Host == "" {
+		log.Panicf("APP_URL %q is not a valid URL", appURL)
+	}
+	if rp.ID == "" {
+		rp.ID = u.Hostname()
+	}
+	if len(rp.Origins) == 0 {
+		rp.Origins = []string{u.Scheme + "://" + u.Host}
+	}
+
+	return rp
+}
+
+// userHandle is the opaque ID authenticators keep for a user with their passkeys
+func userHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+func passkeyDescriptors(passkeys []*data.Passkey) []webauthn.CredentialDescriptor {
+	descriptors := make([]webauthn.CredentialDescriptor, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		descriptors = append(descriptors, webauthn.CredentialDescriptor{
+			Type:       "public-key",
+			ID:         passkey.CredentialID,
+			Transports: passkey.Transports,
+		})
+	}
+
+	return descriptors
+}
+
+// BeginPasskeyRegistration starts adding a passkey to the current user's account
+func (app *Config) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user, err := app.Models.User.GetOne(r.Context(), userIDFromContext(r.Context()))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+		return
+	}
+
+	// listing the passkeys the user already has stops them registering the same
+	// authenticator twice
+	existing, err := app.Models.Passkey.ForUser(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	pending, err := app.Models.PasskeyChallenge.New(r.Context(), user.ID, challenge, data.PasskeyRegistration, passkeyChallengeTTL)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	displayName := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if displayName == "" {
+		displayName = user.Email
+	}
+
+	options := app.WebAuthn.CreationOptions(challenge, webauthn.UserEntity{
+		ID:          userHandle(user.ID),
+		Name:        user.Email,
+		DisplayName: displayName,
+	}, passkeyDescriptors(existing))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Create a passkey with these options, then send the result to finish registration",
+		Data:    passkeyCeremony{Session: pending.PlainText, Options: options},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// FinishPasskeyRegistration checks the authenticator's response and saves the new passkey
+func (app *Config) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Session    string                        `json:"session"`
+		Name       string                        `json:"name"`
+		Credential webauthn.RegistrationResponse `json:"credential"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID := userIDFromContext(r.Context())
+
+	pending, err := app.Models.PasskeyChallenge.Consume(r.Context(), requestPayload.Session, data.PasskeyRegistration)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidToken) {
+			app.errorJSON(w, errors.New("passkey registration has expired, start again"), http.StatusBadRequest)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if pending.UserID != userID {
+		app.errorJSON(w, errors.New("passkey registration was started by another user"), http.StatusForbidden)
+		return
+	}
+
+	credential, err := app.WebAuthn.VerifyRegistration(pending.Challenge, requestPayload.Credential)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(requestPayload.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	passkey := data.Passkey{
+		UserID:         userID,
+		CredentialID:   credential.ID,
+		PublicKey:      credential.PublicKey,
+		SignCount:      credential.SignCount,
+		AAGUID:         credential.AAGUID,
+		Transports:     credential.Transports,
+		Name:           name,
+		BackupEligible: credential.BackupEligible,
+	}
+
+	passkey.ID, err = app.Models.Passkey.Insert(r.Context(), passkey)
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicatePasskey) {
+			app.errorJSON(w, err, http.StatusConflict)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, event.Event{
+		Name:   eventPasskeyAdded,
+		Data:   fmt.Sprintf("passkey %q added", name),
+		UserID: userID,
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Added passkey %s", name),
+		Data:    passkey,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// GetPasskeys lists the current user's passkeys
+func (app *Config) GetPasskeys(w http.ResponseWriter, r *http.Request) {
+	passkeys, err := app.Models.Passkey.ForUser(r.Context(), userIDFromContext(r.Context()))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Found %d passkeys", len(passkeys)),
+		Data:    passkeys,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// DeletePasskey removes one of the current user's passkeys
+func (app *Config) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid passkey id"), http.StatusBadRequest)
+		return
+	}
+
+	userID := userIDFromContext(r.Context())
+
+	err = app.Models.Passkey.Delete(r.Context(), userID, id)
+	if err != nil {
+		if errors.Is(err, data.ErrPasskeyNotFound) {
+			app.errorJSON(w, err, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, event.Event{
+		Name:   eventPasskeyRemoved,
+		Data:   fmt.Sprintf("passkey %d removed", id),
+		UserID: userID,
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Removed passkey %d", id),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// BeginPasskeyLogin starts signing in with a passkey. With an email address the
+// browser is told which passkeys the account has; without one the user picks from the
+// passkeys their device holds for this site. Unknown addresses are treated like no
+// address, so the response doesn't reveal who is registered.
+func (app *Config) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	var allow []webauthn.CredentialDescriptor
+
+	if strings.TrimSpace(requestPayload.Email) != "" {
+		user, err := app.Models.User.GetByEmail(r.Context(), requestPayload.Email)
+		if err == nil {
+			passkeys, err := app.Models.Passkey.ForUser(r.Context(), user.ID)
+			if err != nil {
+				app.errorJSON(w, err, http.StatusInternalServerError)
+				return
+			}
+			if len(passkeys) > 0 {
+				userID = user.ID
+				allow = passkeyDescriptors(passkeys)
+			}
+		}
+	}
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	pending, err := app.Models.PasskeyChallenge.New(r.Context(), userID, challenge, data.PasskeyAuthentication, passkeyChallengeTTL)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Sign with a passkey using these options, then send the result to log in",
+		Data:    passkeyCeremony{Session: pending.PlainText, Options: app.WebAuthn.RequestOptions(challenge, allow)},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// FinishPasskeyLogin checks a passkey assertion and logs the user in. A passkey that
+// verified the user counts as two factors on its own; otherwise the login carries on
+// like a password login, with a two factor challenge for users who have it enabled.
+func (app *Config) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Session    string                     `json:"session"`
+		Credential webauthn.AssertionResponse `json:"credential"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	pending, err := app.Models.PasskeyChallenge.Consume(r.Context(), requestPayload.Session, data.PasskeyAuthentication)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidToken) {
+			app.errorJSON(w, errors.New("passkey login has expired, start again"), http.StatusUnauthorized)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	passkey, err := app.Models.Passkey.GetByCredentialID(r.Context(), requestPayload.Credential.RawID)
+	if err != nil {
+		if errors.Is(err, data.ErrPasskeyNotFound) {
+			app.passkeyLoginFailed(w, r, "unknown passkey")
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	handle := requestPayload.Credential.Response.UserHandle
+	if (pending.UserID != 0 && pending.UserID != passkey.UserID) ||
+		(len(handle) > 0 && !bytes.Equal(handle, userHandle(passkey.UserID))) {
+		app.passkeyLoginFailed(w, r, "passkey belongs to another user")
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), passkey.UserID)
+	if err != nil {
+		app.passkeyLoginFailed(w, r, "unknown user")
+		return
+	}
+
+	if !app.checkThrottle(w, r, user.Email) {
+		return
+	}
+
+	assertion, err := app.WebAuthn.VerifyAssertion(pending.Challenge, passkey.PublicKey, passkey.SignCount,
+		requestPayload.Credential)
+	if err != nil {
+		if errors.Is(err, webauthn.ErrClonedAuthenticator) {
+			app.audit(r, event.Event{
+				Name:       eventPasskeyCloned,
+				Data:       fmt.Sprintf("passkey %d of %s reported signature counter %d", passkey.ID, user.Email, passkey.SignCount),
+				Severity:   event.SeverityWarning,
+				UserID:     user.ID,
+				Email:      user.Email,
+				Attributes: map[string]string{"passkey_id": strconv.Itoa(passkey.ID)},
+			})
+
+			// someone may hold a copy of the key, so nobody gets in until an admin has
+			// looked into it
+			if user.Status == data.StatusActive {
+				_, err := app.changeStatus(r, user, data.StatusLocked, "passkey signature counter went backwards")
+				if err != nil {
+					log.Println("could not lock account:", err)
+				}
+			}
+		}
+		app.loginFailed(w, r, user.Email, "passkey: "+err.Error())
+		return
+	}
+
+	err = app.Models.Passkey.Use(r.Context(), passkey.ID, assertion.SignCount)
+	if err != nil {
+		if errors.Is(err, data.ErrSignCountReplayed) {
+			app.loginFailed(w, r, user.Email, "passkey: "+err.Error())
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.Models.LoginThrottle.Reset(r.Context(), accountKey(user.Email))
+	if err != nil {
+		log.Println("could not reset failed logins:", err)
+	}
+
+	if !assertion.UserVerified {
+		app.firstFactorPassed(w, r, user, []string{amrHardwareKey})
+		return
+	}
+
+	if !app.accountActive(w, r, user) {
+		return
+	}
+
+	app.completeLogin(w, r, user, []string{amrHardwareKey, amrUser})
+}
+
+// passkeyLoginFailed turns away a passkey login we can't tie to an account. There's
+// no email to throttle, so only the attempt is recorded.
+func (app *Config) passkeyLoginFailed(w http.ResponseWriter, r *http.Request, reason string) {
+	app.audit(r, event.Event{
+		Name:       eventLoginFailed,
+		Data:       "failed passkey login: " + reason,
+		Severity:   event.SeverityWarning,
+		Attributes: map[string]string{"reason": reason},
+	})
+
+	app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+}
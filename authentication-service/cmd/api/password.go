@@ -0,0 +1,136 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const passwordResetTTL = time.Hour
+
+func passwordResetKey(email string) string {
+	return "reset:" + data.FoldEmail(email)
+}
+
+func (app *Config) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(requestPayload.Email) == "" {
+		app.errorJSON(w, errors.New("email is required"), http.StatusBadRequest)
+		return
+	}
+
+	if !app.throttleRequest(w, r, passwordResetKey(requestPayload.Email)) {
+		return
+	}
+
+	// the account is looked up and the link sent after we respond, so neither the
+	// response nor how long it takes gives away whether the address is registered
+	email := requestPayload.Email
+	app.background(func() {
+		app.sendPasswordReset(context.Background(), email)
+	})
+
+	app.writeJSON(w, http.StatusAccepted, jsonResponse{
+		Error:   false,
+		Message: "If that address is registered, a password reset link has been sent",
+	})
+}
+
+// sendPasswordReset emails a reset link to the account registered with email, if
+// there is one. Failures can only be logged, since the caller already has its answer.
+func (app *Config) sendPasswordReset(ctx context.Context, email string) {
+	user, err := app.Models.User.GetByEmail(ctx, email)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("Error looking up password reset address:", err)
+		}
+		return
+	}
+
+	reset, err := app.Models.PasswordReset.New(ctx, user.ID, passwordResetTTL)
+	if err != nil {
+		log.Println("Error creating password reset:", err)
+		return
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", app.AppURL, url.QueryEscape(reset.PlainText))
+	message := fmt.Sprintf("Someone asked to reset the password for your account. "+
+		"If it was you, follow this link within the next hour: %s\n\n"+
+		"If you didn't ask for this you can ignore this email.", link)
+
+	err = app.sendMail(user.Email, "Reset your password", message)
+	if err != nil {
+		log.Println("Error sending password reset email:", err)
+	}
+}
+
+func (app *Config) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !app.checkPassword(w, requestPayload.Password) {
+		return
+	}
+
+	userID, err := app.Models.PasswordReset.Redeem(r.Context(), requestPayload.Token, requestPayload.Password)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidToken) {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// a new password should lock out anyone still holding the old credentials
+	err = app.Models.Session.RevokeAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, event.Event{
+		Name:   eventPasswordReset,
+		Data:   fmt.Sprintf("user %s reset their password", user.Email),
+		UserID: user.ID,
+		Email:  user.Email,
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Password has been reset",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
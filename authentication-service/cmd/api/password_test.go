@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestForgotPassword(t *testing.T) {
+	app := newTestApp(t)
+	app.createUser(t, "known@example.com")
+
+	// the address is found whatever its case
+	knownStatus, known := app.do(t, http.MethodPost, "/password/forgot", "", map[string]string{"email": "Known@Example.com"})
+	unknownStatus, unknown := app.do(t, http.MethodPost, "/password/forgot", "", map[string]string{"email": "nobody@example.com"})
+	app.tasks.Wait()
+
+	if knownStatus != http.StatusAccepted || unknownStatus != http.StatusAccepted {
+		t.Fatalf("got statuses %d and %d, want %d", knownStatus, unknownStatus, http.StatusAccepted)
+	}
+	if known != unknown {
+		t.Errorf("registered and unknown addresses got different responses: %+v and %+v", known, unknown)
+	}
+	if n := len(app.mail.to("nobody@example.com")); n != 0 {
+		t.Errorf("sent %d messages to an unknown address", n)
+	}
+
+	sent := app.mail.to("known@example.com")
+	if len(sent) != 1 {
+		t.Fatalf("got %d reset messages, want 1", len(sent))
+	}
+
+	// the link in the message resets the password
+	_, link, _ := strings.Cut(sent[0].Message, "reset-password?token=")
+	token, err := url.QueryUnescape(strings.Fields(link)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := app.do(t, http.MethodPost, "/password/reset", "", map[string]string{
+		"token":    token,
+		"password": "Another-Battery-Staple-7",
+	})
+	if status != http.StatusAccepted {
+		t.Fatalf("resetting the password: got status %d", status)
+	}
+
+	status, _ = app.do(t, http.MethodPost, "/login", "", map[string]string{
+		"email":    "known@example.com",
+		"password": "Another-Battery-Staple-7",
+	})
+	if status != http.StatusAccepted {
+		t.Errorf("logging in with the new password: got status %d", status)
+	}
+
+	status, _ = app.do(t, http.MethodPost, "/password/reset", "", map[string]string{
+		"token":    token,
+		"password": "Yet-Another-Battery-5",
+	})
+	if status != http.StatusBadRequest {
+		t.Errorf("reusing the token: got status %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestForgotPasswordMailFailure(t *testing.T) {
+	app := newTestApp(t)
+	app.createUser(t, "known@example.com")
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+	app.MailURL = failing.URL
+
+	status, response := app.do(t, http.MethodPost, "/password/forgot", "", map[string]string{"email": "known@example.com"})
+	app.tasks.Wait()
+
+	if status != http.StatusAccepted || response.Error {
+		t.Errorf("got status %d and %+v, want the usual %d", status, response, http.StatusAccepted)
+	}
+}
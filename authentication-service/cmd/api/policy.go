@@ -0,0 +1,92 @@
+package main
+
+import (
+	"authentication/policy"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// errPasswordPolicy is the error code sent back with the rules a new password broke
+	errPasswordPolicy = "password_policy"
+)
+
+// createPasswordPolicy builds the password policy from the environment, starting
+// from policy.Default. PASSWORD_MIN_LENGTH and PASSWORD_MAX_LENGTH set the limits;
+// with PASSWORD_HASHER=bcrypt the maximum can't be raised past what bcrypt uses, while
+// argon2id has no such limit. PASSWORD_CHARACTER_CLASSES is a
+// comma separated list of lower, upper, digit and symbol, or "none". BREACHED_PASSWORDS
+// points at a local breached password list to use instead of the bundled one.
+func createPasswordPolicy() *policy.Password {
+	p := policy.Default()
+
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n > 0 {
+		p.MinLength = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MAX_LENGTH")); err == nil && n > 0 {
+		p.MaxLength = n
+	}
+	if os.Getenv("PASSWORD_HASHER") == "bcrypt" && p.MaxLength > policy.MaxBcryptLength {
+		p.MaxLength = policy.MaxBcryptLength
+	}
+	if p.MinLength > p.MaxLength {
+		log.Panicf("PASSWORD_MIN_LENGTH %d is more than the maximum of %d", p.MinLength, p.MaxLength)
+	}
+
+	if classes := os.Getenv("PASSWORD_CHARACTER_CLASSES"); classes != "" {
+		p.RequireLowercase, p.RequireUppercase, p.RequireDigit, p.RequireSymbol = false, false, false, false
+		for _, class := range strings.Split(classes, ",") {
+			switch strings.TrimSpace(class) {
+			case "lower":
+				p.RequireLowercase = true
+			case "upper":
+				p.RequireUppercase = true
+			case "digit":
+				p.RequireDigit = true
+			case "symbol":
+				p.RequireSymbol = true
+			case "none":
+			default:
+				log.Panicf("unknown password character class %q", class)
+			}
+		}
+	}
+
+	if path := os.Getenv("BREACHED_PASSWORDS"); path != "" {
+		list, err := policy.LoadBreachList(path)
+		if err != nil {
+			log.Panic("could not load breached passwords: ", err)
+		}
+		p.Breached = list
+	}
+
+	return p
+}
+
+// checkPassword tests a new password against the policy. If it fails, every broken
+// rule goes back to the client in the response data and checkPassword returns false.
+func (app *Config) checkPassword(w http.ResponseWriter, password string) bool {
+	err := app.PasswordPolicy.Check(password)
+	if err == nil {
+		return true
+	}
+
+	var violations policy.Violations
+	if errors.As(err, &violations) {
+		payload := jsonResponse{
+			Error:   true,
+			Code:    errPasswordPolicy,
+			Message: violations.Error(),
+			Data:    violations,
+		}
+		app.writeJSON(w, http.StatusUnprocessableEntity, payload)
+		return false
+	}
+
+	app.errorJSON(w, err, http.StatusInternalServerError)
+	return false
+}
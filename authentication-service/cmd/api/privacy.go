@@ -0,0 +1,507 @@
+package main
+
+import (
+	"archive/zip"
+	"authentication/data"
+	"authentication/event"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// loggerServiceURL comes from docker-compose.yml
+const loggerServiceURL = "http://logger-service"
+
+// userExport is everything we hold about a user, as handed over for a subject access
+// request
+type userExport struct {
+	ExportedAt      time.Time              `json:"exported_at"`
+	User            *data.User             `json:"user"`
+	Roles           []string               `json:"roles"`
+	Organizations   []*data.Membership     `json:"organizations"`
+	Provisioning    *userProvisioning      `json:"provisioning"`
+	TwoFactor       *data.TwoFactor        `json:"two_factor"`
+	Passkeys        []*data.Passkey        `json:"passkeys"`
+	StatusHistory   []*data.StatusChange   `json:"status_history"`
+	Sessions        []*data.Session        `json:"sessions"`
+	Logs            json.RawMessage        `json:"logs"`
+	PrivacyRequests []*data.PrivacyRequest `json:"privacy_requests"`
+}
+
+// userProvisioning is what an identity provider has told us about a user over SCIM
+type userProvisioning struct {
+	ExternalID string        `json:"external_id,omitempty"`
+	Groups     []*data.Group `json:"groups"`
+}
+
+// ExportUser gathers everything we hold about a user: their account, roles,
+// organizations, SCIM groups and external id, two factor enrollment, passkeys,
+// account status history, sessions, log entries and earlier privacy requests. The
+// bundle is sent
+// as JSON, or as a ZIP with one file per section when the format query parameter is
+// zip. Each step is recorded against a privacy request.
+func (app *Config) ExportUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "zip" {
+		app.errorJSON(w, errors.New("format must be json or zip"), http.StatusBadRequest)
+		return
+	}
+
+	request, err := app.Models.PrivacyRequest.Start(r.Context(), user.ID, userIDFromContext(r.Context()), data.PrivacyExport)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	export := userExport{
+		ExportedAt: time.Now(),
+		User:       user,
+	}
+
+	steps := []struct {
+		name string
+		run  func() (string, error)
+	}{
+		{"roles", func() (string, error) {
+			roles, _, err := app.Models.Role.ForUser(r.Context(), user.ID)
+			export.Roles = roles
+			return fmt.Sprintf("%d roles", len(roles)), err
+		}},
+		{"organizations", func() (string, error) {
+			memberships, err := app.Models.Organization.ForUser(r.Context(), user.ID)
+			export.Organizations = memberships
+			return fmt.Sprintf("%d organizations", len(memberships)), err
+		}},
+		{"provisioning", func() (string, error) {
+			provisioning := userProvisioning{}
+			provisioned, err := app.Models.Provisioning.User(r.Context(), user.ID)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return "", err
+			}
+			if provisioned != nil {
+				provisioning.ExternalID = provisioned.ExternalID
+			}
+			provisioning.Groups, err = app.Models.Group.ForUser(r.Context(), user.ID)
+			export.Provisioning = &provisioning
+			return fmt.Sprintf("%d groups", len(provisioning.Groups)), err
+		}},
+		{"two_factor", func() (string, error) {
+			twoFactor, err := app.Models.TwoFactor.GetForUser(r.Context(), user.ID)
+			if errors.Is(err, sql.ErrNoRows) {
+				return "not enrolled", nil
+			}
+			export.TwoFactor = twoFactor
+			return "enrolled", err
+		}},
+		{"passkeys", func() (string, error) {
+			passkeys, err := app.Models.Passkey.ForUser(r.Context(), user.ID)
+			export.Passkeys = passkeys
+			return fmt.Sprintf("%d passkeys", len(passkeys)), err
+		}},
+		{"status_history", func() (string, error) {
+			changes, err := app.Models.User.StatusHistory(r.Context(), user.ID)
+			export.StatusHistory = changes
+			return fmt.Sprintf("%d status changes", len(changes)), err
+		}},
+		{"sessions", func() (string, error) {
+			sessions, err := app.Models.Session.History(r.Context(), user.ID)
+			export.Sessions = sessions
+			return fmt.Sprintf("%d sessions", len(sessions)), err
+		}},
+		{"logs", func() (string, error) {
+			logs, count, err := app.fetchUserLogs(user.ID, user.Email)
+			export.Logs = logs
+			return fmt.Sprintf("%d log entries", count), err
+		}},
+		{"privacy_requests", func() (string, error) {
+			requests, err := app.Models.PrivacyRequest.ForUser(r.Context(), user.ID)
+			export.PrivacyRequests = requests
+			return fmt.Sprintf("%d privacy requests", len(requests)), err
+		}},
+	}
+
+	for _, step := range steps {
+		err = app.privacyStep(r, request, step.name, step.run)
+		if err != nil {
+			app.failPrivacyRequest(w, r, request, err)
+			return
+		}
+	}
+
+	app.finishPrivacyRequest(r, request)
+
+	if format == "zip" {
+		app.writeExportZip(w, &export)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Exported user %d", user.ID),
+		Data:    export,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// EraseUser carries out a right to erasure request. The user is logged out, their
+// two factor enrollment, reset tokens, roles, organization memberships, SCIM groups
+// and external id and failed login records are removed,
+// the logger service is asked to redact their log entries, and finally the user row
+// is anonymized. Each step is recorded against a privacy request; if one fails the
+// request is marked failed and can be retried, as every step is safe to repeat.
+func (app *Config) EraseUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == userIDFromContext(r.Context()) {
+		app.errorJSON(w, errors.New("you can't erase your own account"), http.StatusBadRequest)
+		return
+	}
+
+	erased, err := app.Models.PrivacyRequest.Erased(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if erased {
+		app.errorJSON(w, fmt.Errorf("user %d has already been erased", user.ID), http.StatusConflict)
+		return
+	}
+
+	request, err := app.Models.PrivacyRequest.Start(r.Context(), user.ID, userIDFromContext(r.Context()), data.PrivacyErase)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// the logs are redacted before the user row, since finding them needs the real
+	// email address
+	steps := []struct {
+		name string
+		run  func() (string, error)
+	}{
+		{"sessions", func() (string, error) {
+			return "revoked and scrubbed", app.Models.Session.Scrub(r.Context(), user.ID)
+		}},
+		{"two_factor", func() (string, error) {
+			return "removed", app.Models.TwoFactor.Delete(r.Context(), user.ID)
+		}},
+		{"passkeys", func() (string, error) {
+			return "removed", app.Models.Passkey.DeleteAllForUser(r.Context(), user.ID)
+		}},
+		{"password_resets", func() (string, error) {
+			return "removed", app.Models.PasswordReset.DeleteForUser(r.Context(), user.ID)
+		}},
+		{"roles", func() (string, error) {
+			return "revoked", app.Models.Role.RevokeAll(r.Context(), user.ID)
+		}},
+		{"organizations", func() (string, error) {
+			return "left", app.Models.Organization.RemoveAllForUser(r.Context(), user.ID)
+		}},
+		{"provisioning", func() (string, error) {
+			return "removed from groups", app.Models.Provisioning.Forget(r.Context(), user.ID)
+		}},
+		{"login_throttles", func() (string, error) {
+			// the keys hold the address, so every one kept for it goes
+			keys := []string{
+				accountKey(user.Email), magicLinkKey(user.Email),
+				passwordResetKey(user.Email), verificationKey(user.Email),
+			}
+			for _, key := range keys {
+				if err := app.Models.LoginThrottle.Reset(r.Context(), key); err != nil {
+					return "", err
+				}
+			}
+			return "removed", nil
+		}},
+		{"logs", func() (string, error) {
+			redacted, err := app.redactUserLogs(user.ID, user.Email)
+			return fmt.Sprintf("%d log entries redacted", redacted), err
+		}},
+		{"status", func() (string, error) {
+			// a retried erasure finds the account deleted already
+			if user.Status == data.StatusDeleted {
+				return "already deleted", nil
+			}
+			// the event names the placeholder address, so it doesn't put the real one
+			// back into the logs we just redacted
+			erased := *user
+			erased.Email = data.ErasedEmail(user.ID)
+			_, err := app.changeStatus(r, &erased, data.StatusDeleted, "erased on request")
+			return "deleted", err
+		}},
+		{"user", func() (string, error) {
+			return "anonymized", app.Models.User.Anonymize(r.Context(), user.ID)
+		}},
+	}
+
+	for _, step := range steps {
+		err = app.privacyStep(r, request, step.name, step.run)
+		if err != nil {
+			app.failPrivacyRequest(w, r, request, err)
+			return
+		}
+	}
+
+	app.finishPrivacyRequest(r, request)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Erased user %d", user.ID),
+		Data:    request,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// GetPrivacyRequests returns the audit trail of export and erasure requests for a user.
+// It works after the user has been erased, as long as the anonymized row is there.
+func (app *Config) GetPrivacyRequests(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	requests, err := app.Models.PrivacyRequest.ForUser(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Privacy requests for user %d", user.ID),
+		Data:    requests,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// privacyStep runs one step of a privacy request and records the outcome, in the
+// request's trail and as an audit event. A step that can't be recorded counts as
+// failed, so the trail never misses something that was done.
+func (app *Config) privacyStep(r *http.Request, request *data.PrivacyRequest, step string, run func() (string, error)) error {
+	detail, err := run()
+
+	status := data.StepDone
+	if err != nil {
+		status = data.StepFailed
+		detail = err.Error()
+	}
+
+	recordErr := app.Models.PrivacyRequest.RecordStep(r.Context(), request.ID, step, status, detail)
+	if err == nil {
+		err = recordErr
+	}
+
+	request.Steps = append(request.Steps, data.PrivacyStep{
+		Step:      step,
+		Status:    status,
+		Detail:    detail,
+		CreatedAt: time.Now(),
+	})
+
+	// the user is named in the text only, so the logger doesn't redact the trail
+	// of their own erasure
+	app.audit(r, event.Event{
+		Name:     eventPrivacyStep,
+		Data:     fmt.Sprintf("%s request %d for user %d: %s %s", request.Kind, request.ID, request.UserID, step, status),
+		Severity: privacySeverity(status),
+	})
+
+	return err
+}
+
+// finishPrivacyRequest marks a request completed. The work is done by now, so a
+// failure to record that is only logged.
+func (app *Config) finishPrivacyRequest(r *http.Request, request *data.PrivacyRequest) {
+	err := app.Models.PrivacyRequest.Finish(r.Context(), request.ID, data.PrivacyCompleted)
+	if err != nil {
+		log.Printf("could not complete privacy request %d: %v", request.ID, err)
+	}
+	request.Status = data.PrivacyCompleted
+
+	app.audit(r, event.Event{
+		Name: eventPrivacyCompleted,
+		Data: fmt.Sprintf("user %d completed %s request %d for user %d",
+			userIDFromContext(r.Context()), request.Kind, request.ID, request.UserID),
+	})
+}
+
+// failPrivacyRequest marks a request failed and tells the client which step broke
+func (app *Config) failPrivacyRequest(w http.ResponseWriter, r *http.Request, request *data.PrivacyRequest, err error) {
+	finishErr := app.Models.PrivacyRequest.Finish(r.Context(), request.ID, data.PrivacyFailed)
+	if finishErr != nil {
+		log.Printf("could not mark privacy request %d failed: %v", request.ID, finishErr)
+	}
+
+	app.audit(r, event.Event{
+		Name:     eventPrivacyFailed,
+		Data:     fmt.Sprintf("%s request %d for user %d failed: %v", request.Kind, request.ID, request.UserID, err),
+		Severity: event.SeverityWarning,
+	})
+
+	app.errorJSON(w, fmt.Errorf("%s request %d failed: %w", request.Kind, request.ID, err), http.StatusInternalServerError)
+}
+
+func privacySeverity(status string) string {
+	if status == data.StepFailed {
+		return event.SeverityWarning
+	}
+
+	return event.SeverityInfo
+}
+
+// writeExportZip sends an export as a ZIP archive holding one JSON file per section
+func (app *Config) writeExportZip(w http.ResponseWriter, export *userExport) {
+	files := []struct {
+		name    string
+		content any
+	}{
+		{"user.json", export.User},
+		{"roles.json", export.Roles},
+		{"organizations.json", export.Organizations},
+		{"provisioning.json", export.Provisioning},
+		{"two_factor.json", export.TwoFactor},
+		{"passkeys.json", export.Passkeys},
+		{"status_history.json", export.StatusHistory},
+		{"sessions.json", export.Sessions},
+		{"logs.json", export.Logs},
+		{"privacy_requests.json", export.PrivacyRequests},
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(file.content)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err := archive.Close()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d-export.zip"`, export.User.ID))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// fetchUserLogs asks the logger service for every entry about a user. The entries
+// are passed through as they come, along with how many there are.
+func (app *Config) fetchUserLogs(userID int, email string) (json.RawMessage, int, error) {
+	v := url.Values{}
+	v.Set("user_id", strconv.Itoa(userID))
+	v.Set("email", email)
+
+	request, err := http.NewRequest("GET", loggerServiceURL+"/logs/subject?"+v.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	request.Header.Set(internalSecretHeader, string(app.InternalSecret))
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		return nil, 0, fmt.Errorf("logger service returned %d", response.StatusCode)
+	}
+
+	var jsonFromService struct {
+		Data json.RawMessage `json:"data"`
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var entries []json.RawMessage
+	err = json.Unmarshal(jsonFromService.Data, &entries)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return jsonFromService.Data, len(entries), nil
+}
+
+// redactUserLogs asks the logger service to redact every entry about a user and
+// returns how many it changed. The logger also redacts entries about them that arrive
+// later, such as the audit events of this erasure still on their way.
+func (app *Config) redactUserLogs(userID int, email string) (int, error) {
+	var msg struct {
+		UserID int    `json:"user_id"`
+		Email  string `json:"email"`
+	}
+
+	msg.UserID = userID
+	msg.Email = email
+
+	jsonData, _ := json.Marshal(msg)
+
+	request, err := http.NewRequest("POST", loggerServiceURL+"/logs/redact", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(internalSecretHeader, string(app.InternalSecret))
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		return 0, fmt.Errorf("logger service returned %d", response.StatusCode)
+	}
+
+	var jsonFromService struct {
+		Data int `json:"data"`
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		return 0, err
+	}
+
+	return jsonFromService.Data, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyLookupInterval is how long the addresses of trusted proxies given by host name
+// are kept before they are looked up again. Containers get a new address when they
+// restart, so they can't be looked up once at startup.
+const proxyLookupInterval = 30 * time.Second
+
+// trustedProxies are the callers allowed to tell us, with X-Real-IP, whose request
+// they are passing on. Anyone else could set the header to anything, so for them we
+// go by the address the request came from.
+type trustedProxies struct {
+	nets  []*net.IPNet
+	hosts []string
+
+	mu       sync.Mutex
+	resolved []net.IP
+	expires  time.Time
+}
+
+// createTrustedProxies reads TRUSTED_PROXIES, a comma separated list of addresses,
+// CIDR ranges and host names, like "broker-service". With none set, X-Real-IP is
+// never trusted.
+func createTrustedProxies() *trustedProxies {
+	proxies := &trustedProxies{}
+
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			proxies.nets = append(proxies.nets, network)
+			continue
+		}
+
+		if ip := net.ParseIP(entry); ip != nil {
+			proxies.nets = append(proxies.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+
+		proxies.hosts = append(proxies.hosts, entry)
+	}
+
+	return proxies
+}
+
+// contains reports whether ip is one of the trusted proxies
+func (p *trustedProxies) contains(ip net.IP) bool {
+	if p == nil || ip == nil {
+		return false
+	}
+
+	for _, network := range p.nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	for _, resolved := range p.lookup() {
+		if resolved.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookup returns the addresses of the proxies given by host name, looking them up
+// again once the last lookup is older than proxyLookupInterval
+func (p *trustedProxies) lookup() []net.IP {
+	if len(p.hosts) == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Now().Before(p.expires) {
+		return p.resolved
+	}
+
+	var resolved []net.IP
+	for _, host := range p.hosts {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			log.Printf("could not look up trusted proxy %s: %v", host, err)
+			continue
+		}
+		resolved = append(resolved, ips...)
+	}
+
+	p.resolved = resolved
+	p.expires = time.Now().Add(proxyLookupInterval)
+
+	return p.resolved
+}
+
+// clientIP returns the address of the client that made the request. When the request
+// comes through a trusted proxy, like the broker, that is the address the proxy puts
+// in X-Real-IP.
+func (app *Config) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	forwarded := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+	if forwarded != nil && app.TrustedProxies.contains(net.ParseIP(host)) {
+		return forwarded.String()
+	}
+
+	return host
+}
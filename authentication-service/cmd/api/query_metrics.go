@@ -0,0 +1,97 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultSlowQuery is how long a query can take before it is logged as slow
+const defaultSlowQuery = 500 * time.Millisecond
+
+// queryMetrics keeps count of the queries each model method runs: how many, how many
+// failed and how long they took. It is published with expvar as db_queries, and
+// failed or slow queries are logged.
+type queryMetrics struct {
+	slow time.Duration
+
+	mu      sync.Mutex
+	methods map[string]*methodMetrics
+}
+
+// methodMetrics are the query counts and timings of one model method
+type methodMetrics struct {
+	Queries     int64   `json:"queries"`
+	Errors      int64   `json:"errors"`
+	TotalMillis float64 `json:"total_ms"`
+	MaxMillis   float64 `json:"max_ms"`
+}
+
+// configureDatabase applies DB_QUERY_TIMEOUT_MS, the default deadline of model
+// methods, and starts observing queries. DB_SLOW_QUERY_MS sets how long a query can
+// take before it is logged.
+func configureDatabase() {
+	if ms, err := strconv.Atoi(os.Getenv("DB_QUERY_TIMEOUT_MS")); err == nil && ms > 0 {
+		data.SetQueryTimeout(time.Duration(ms) * time.Millisecond)
+	}
+
+	metrics := &queryMetrics{
+		slow:    defaultSlowQuery,
+		methods: make(map[string]*methodMetrics),
+	}
+	if ms, err := strconv.Atoi(os.Getenv("DB_SLOW_QUERY_MS")); err == nil && ms > 0 {
+		metrics.slow = time.Duration(ms) * time.Millisecond
+	}
+
+	expvar.Publish("db_queries", expvar.Func(metrics.snapshot))
+	data.SetQueryObserver(metrics.observe)
+}
+
+// observe records one query. Queries cut short because the client went away aren't
+// counted as errors, since nothing is wrong with the database.
+func (m *queryMetrics) observe(method string, duration time.Duration, err error) {
+	failed := err != nil && !errors.Is(err, context.Canceled)
+	millis := float64(duration) / float64(time.Millisecond)
+
+	m.mu.Lock()
+	stats, ok := m.methods[method]
+	if !ok {
+		stats = &methodMetrics{}
+		m.methods[method] = stats
+	}
+	stats.Queries++
+	if failed {
+		stats.Errors++
+	}
+	stats.TotalMillis += millis
+	if millis > stats.MaxMillis {
+		stats.MaxMillis = millis
+	}
+	m.mu.Unlock()
+
+	switch {
+	case failed:
+		log.Printf("query in %s failed after %s: %v", method, duration, err)
+	case duration >= m.slow:
+		log.Printf("slow query in %s took %s", method, duration)
+	}
+}
+
+// snapshot copies the metrics for expvar
+func (m *queryMetrics) snapshot() any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string]methodMetrics, len(m.methods))
+	for method, stats := range m.methods {
+		out[method] = *stats
+	}
+
+	return out
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// defaultRole is granted to every user when they register
+const defaultRole = "user"
+
+// bootstrapAdmins grants the admin role to the users listed in ADMIN_EMAILS, so a
+// fresh install has someone who can manage roles. Users that don't exist yet are skipped.
+func (app *Config) bootstrapAdmins() {
+	// this runs at startup, outside any request
+	ctx := context.Background()
+
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+
+		user, err := app.Models.User.GetByEmail(ctx, email)
+		if err != nil {
+			continue
+		}
+
+		err = app.Models.Role.Grant(ctx, user.ID, "admin")
+		if err != nil {
+			log.Println("could not grant admin role to", email, err)
+		}
+	}
+}
+
+func (app *Config) GetRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.Models.Role.GetAll(r.Context())
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "All roles",
+		Data:    roles,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) GetUserRoles(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	roles, permissions, err := app.Models.Role.ForUser(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var out struct {
+		Roles       []string `json:"roles"`
+		Permissions []string `json:"permissions"`
+	}
+	out.Roles = roles
+	out.Permissions = permissions
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Roles for user %s", user.Email),
+		Data:    out,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) GrantRole(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Role string `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	err = app.Models.Role.Grant(r.Context(), user.ID, requestPayload.Role)
+	if err != nil {
+		if errors.Is(err, data.ErrRoleNotFound) {
+			app.errorJSON(w, err, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logRoleChange(r, eventRoleGranted, requestPayload.Role, user)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Granted %s to %s", requestPayload.Role, user.Email),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) RevokeRole(w http.ResponseWriter, r *http.Request) {
+	role := chi.URLParam(r, "role")
+
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Role.Revoke(r.Context(), user.ID, role)
+	if err != nil {
+		if errors.Is(err, data.ErrRoleNotFound) {
+			app.errorJSON(w, err, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logRoleChange(r, eventRoleRevoked, role, user)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Revoked %s from %s", role, user.Email),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) logRoleChange(r *http.Request, name, role string, user *data.User) {
+	action := "granted"
+	if name == eventRoleRevoked {
+		action = "revoked"
+	}
+
+	app.audit(r, event.Event{
+		Name:       name,
+		Data:       fmt.Sprintf("user %d %s role %s for user %s", userIDFromContext(r.Context()), action, role, user.Email),
+		UserID:     user.ID,
+		Email:      user.Email,
+		Attributes: map[string]string{"role": role},
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -24,8 +25,152 @@ func (app *Config) routes() http.Handler {
 	router.Use(middleware.Heartbeat("/ping"))
 
 	router.Post("/login", app.Login)
+	router.Post("/login/2fa", app.LoginTwoFactor)
+	router.Post("/login/magic", app.MagicLinkLogin)
+	router.Post("/login/magic/request", app.RequestMagicLink)
+	router.Post("/login/webauthn/begin", app.BeginPasskeyLogin)
+	router.Post("/login/webauthn/finish", app.FinishPasskeyLogin)
 	router.Post("/register", app.Register)
-	router.Get("/user", app.GetAll)
+	router.Post("/refresh", app.Refresh)
+	router.Post("/logout", app.Logout)
+	router.Post("/password/forgot", app.ForgotPassword)
+	router.Post("/password/reset", app.ResetPassword)
+	router.Post("/verify", app.Verify)
+	router.Post("/verify/resend", app.ResendVerification)
+
+	// called by the broker to resolve API keys and keep up with revoked sessions, and
+	// runtime and per method query metrics, for monitoring
+	router.Group(func(r chi.Router) {
+		r.Use(app.requireInternal)
+
+		r.Post("/api-keys/verify", app.VerifyAPIKey)
+		r.Get("/sessions/revoked", app.RevokedSessions)
+		r.Handle("/debug/vars", expvar.Handler())
+	})
+
+	// SCIM 2.0 provisioning, called by identity providers with a service account's
+	// API key
+	router.Route("/scim/v2", func(r chi.Router) {
+		r.Use(app.requireSCIMToken)
+
+		r.Get("/ServiceProviderConfig", app.GetSCIMServiceProviderConfig)
+		r.Get("/ResourceTypes", app.GetSCIMResourceTypes)
+		r.Get("/ResourceTypes/{id}", app.GetSCIMResourceType)
+		r.Get("/Schemas", app.GetSCIMSchemas)
+		r.Get("/Schemas/{id}", app.GetSCIMSchema)
+
+		r.Get("/Users", app.GetSCIMUsers)
+		r.Post("/Users", app.CreateSCIMUser)
+		r.Get("/Users/{id}", app.GetSCIMUser)
+		r.Put("/Users/{id}", app.ReplaceSCIMUser)
+		r.Patch("/Users/{id}", app.PatchSCIMUser)
+		r.Delete("/Users/{id}", app.DeleteSCIMUser)
+
+		r.Get("/Groups", app.GetSCIMGroups)
+		r.Post("/Groups", app.CreateSCIMGroup)
+		r.Get("/Groups/{id}", app.GetSCIMGroup)
+		r.Put("/Groups/{id}", app.ReplaceSCIMGroup)
+		r.Patch("/Groups/{id}", app.PatchSCIMGroup)
+		r.Delete("/Groups/{id}", app.DeleteSCIMGroup)
+	})
+
+	// routes for the logged in user
+	router.Group(func(r chi.Router) {
+		r.Use(app.requireUser)
+
+		r.Post("/2fa/enroll", app.EnrollTwoFactor)
+		r.Post("/2fa/confirm", app.ConfirmTwoFactor)
+		r.Post("/2fa/disable", app.DisableTwoFactor)
+
+		r.Get("/sessions", app.GetSessions)
+		r.Delete("/sessions/{id}", app.RevokeSession)
+		r.Post("/sessions/revoke-others", app.RevokeOtherSessions)
+
+		r.Post("/webauthn/register/begin", app.BeginPasskeyRegistration)
+		r.Post("/webauthn/register/finish", app.FinishPasskeyRegistration)
+		r.Get("/webauthn/credentials", app.GetPasskeys)
+		r.Delete("/webauthn/credentials/{id}", app.DeletePasskey)
+	})
+
+	// organizations the logged in user belongs to, and managing their members
+	router.Route("/organizations", func(r chi.Router) {
+		r.Use(app.requireUser)
+
+		r.Get("/", app.GetOrganizations)
+		r.Post("/switch", app.SwitchOrganization)
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.requirePermission("organizations:manage"))
+			r.Use(app.requireMFA)
+
+			r.Post("/", app.CreateOrganization)
+			r.Get("/{orgID}/members", app.GetMembers)
+			r.Put("/{orgID}/members/{userID}", app.SetMember)
+			r.Delete("/{orgID}/members/{userID}", app.RemoveMember)
+		})
+	})
+
+	// user management, each route guarded by a permission and, as in the broker, a
+	// second factor
+	router.Route("/user", func(r chi.Router) {
+		r.Use(app.requireUser)
+		r.Use(app.requireMFA)
+
+		r.With(app.requirePermission("users:read")).Get("/", app.GetAll)
+		r.With(app.requirePermission("users:read")).Get("/export", app.ExportUsers)
+		r.With(app.requirePermission("users:write")).Post("/import", app.ImportUsers)
+		r.With(app.requirePermission("users:read")).Get("/{id}", app.GetUser)
+		r.With(app.requirePermission("users:write")).Put("/{id}", app.UpdateUser)
+		r.With(app.requirePermission("users:write")).Delete("/{id}", app.DeleteUser)
+	})
+
+	// admin routes, each guarded by a permission and a second factor
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(app.requireUser)
+		r.Use(app.requireMFA)
+
+		r.With(app.requirePermission("accounts:unlock")).Post("/unlock", app.UnlockAccount)
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.requirePermission("accounts:suspend"))
+
+			r.Post("/users/{id}/suspend", app.SuspendUser)
+			r.Post("/users/{id}/restore", app.RestoreUser)
+			r.Get("/users/{id}/status-history", app.GetStatusHistory)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.requirePermission("roles:manage"))
+
+			r.Get("/roles", app.GetRoles)
+			r.Get("/users/{id}/roles", app.GetUserRoles)
+			r.Post("/users/{id}/roles", app.GrantRole)
+			r.Delete("/users/{id}/roles/{role}", app.RevokeRole)
+		})
+
+		r.With(app.requirePermission("sessions:revoke")).Get("/users/{id}/sessions", app.GetUserSessions)
+		r.With(app.requirePermission("sessions:revoke")).Post("/users/{id}/logout", app.ForceLogout)
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.requirePermission("privacy:manage"))
+
+			r.Get("/users/{id}/export", app.ExportUser)
+			r.Post("/users/{id}/erase", app.EraseUser)
+			r.Get("/users/{id}/privacy-requests", app.GetPrivacyRequests)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.requirePermission("service_accounts:manage"))
+
+			r.Get("/service-accounts", app.GetServiceAccounts)
+			r.Post("/service-accounts", app.CreateServiceAccount)
+			r.Delete("/service-accounts/{id}", app.DeleteServiceAccount)
+			r.Get("/service-accounts/{id}/keys", app.GetAPIKeys)
+			r.Post("/service-accounts/{id}/keys", app.CreateAPIKey)
+			r.Post("/service-accounts/{id}/keys/{keyID}/rotate", app.RotateAPIKey)
+			r.Delete("/service-accounts/{id}/keys/{keyID}", app.RevokeAPIKey)
+		})
+	})
 
 	return router
 
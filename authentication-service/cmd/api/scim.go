@@ -0,0 +1,1029 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"authentication/scim"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// scimPermission is the scope an API key needs to use the SCIM API
+	scimPermission = "scim:provision"
+	// scimDefaultCount is how many resources a query returns when the client doesn't
+	// say, and scimMaxCount the most it can ask for
+	scimDefaultCount = 100
+	scimMaxCount     = 200
+	// scimStatusReason is recorded for account status changes made over SCIM
+	scimStatusReason = "set by SCIM provisioning"
+)
+
+// GetSCIMUsers lists users, filtered and paged as RFC 7644 section 3.4.2 describes.
+// Erased accounts are left out.
+func (app *Config) GetSCIMUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	start, count, err := scim.Page(query.Get("startIndex"), query.Get("count"), scimDefaultCount, scimMaxCount)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	filter, err := scimFilter(query.Get("filter"))
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	users, total, err := app.Models.Provisioning.Users(r.Context(), filter, start-1, count)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	attributes, excluded := query.Get("attributes"), query.Get("excludedAttributes")
+	withGroups := scim.Requested(attributes, excluded, "groups")
+	base := scimBaseURL(r)
+
+	resources := []any{}
+	for _, user := range users {
+		resource, _, err := app.scimUser(r.Context(), base, user, withGroups)
+		if err != nil {
+			app.scimError(w, err)
+			return
+		}
+
+		projected, err := scim.Project(resource, attributes, excluded)
+		if err != nil {
+			app.scimError(w, err)
+			return
+		}
+		resources = append(resources, projected)
+	}
+
+	app.scimJSON(w, http.StatusOK, scim.NewListResponse(total, start, resources), "")
+}
+
+// GetSCIMUser returns one user. A request whose If-None-Match names the user's
+// current version gets a 304.
+func (app *Config) GetSCIMUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.scimUserFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	resource, etag, err := app.scimUser(r.Context(), scimBaseURL(r), user, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.scimResource(w, r, resource, etag)
+}
+
+// CreateSCIMUser provisions a user. userName is their email address, which needs no
+// verification as the identity provider vouches for it, and they get a random
+// password, so they log in through the identity provider or a passwordless method.
+// A user created with active false starts suspended.
+func (app *Config) CreateSCIMUser(w http.ResponseWriter, r *http.Request) {
+	var resource scim.User
+	err := app.readSCIM(w, r, &resource)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	user, err := userFromSCIM(resource)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	user.Password, err = unguessablePassword()
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	err = app.checkUserName(r.Context(), user.Email, 0)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	user.Status = data.StatusActive
+	if resource.Active != nil && !*resource.Active {
+		user.Status = data.StatusSuspended
+	}
+
+	user.ID, err = app.Models.User.Insert(r.Context(), user)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	err = app.Models.Role.Grant(r.Context(), user.ID, defaultRole)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	// this marks the user as provisioned, with or without an external id
+	err = app.Models.Provisioning.SetExternalID(r.Context(), user.ID, resource.ExternalID)
+	if err != nil {
+		// don't leave behind a user the identity provider thinks wasn't created
+		if deleteErr := app.Models.User.DeleteByID(r.Context(), user.ID); deleteErr != nil {
+			log.Println("Error removing user after a failed SCIM create:", deleteErr)
+		}
+		app.scimError(w, err)
+		return
+	}
+
+	app.auditSCIM(r, "User", "create", user.ID, user.Email)
+
+	created, err := app.Models.Provisioning.User(r.Context(), user.ID)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	out, etag, err := app.scimUser(r.Context(), scimBaseURL(r), created, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", out.Meta.Location)
+	app.scimJSON(w, http.StatusCreated, out, etag)
+}
+
+// ReplaceSCIMUser replaces a user's attributes with the ones sent. Leaving out
+// externalId clears it, and leaving out active keeps the current status.
+func (app *Config) ReplaceSCIMUser(w http.ResponseWriter, r *http.Request) {
+	current, ok := app.scimManagedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	_, etag, err := app.scimUser(r.Context(), scimBaseURL(r), current, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+	if !app.checkIfMatch(w, r, etag) {
+		return
+	}
+
+	var resource scim.User
+	err = app.readSCIM(w, r, &resource)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.replaceSCIMUser(w, r, current, resource, "replace")
+}
+
+// PatchSCIMUser changes some of a user's attributes, as RFC 7644 section 3.5.2
+// describes
+func (app *Config) PatchSCIMUser(w http.ResponseWriter, r *http.Request) {
+	current, ok := app.scimManagedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	resource, etag, err := app.scimUser(r.Context(), scimBaseURL(r), current, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+	if !app.checkIfMatch(w, r, etag) {
+		return
+	}
+
+	var patch scim.PatchRequest
+	err = app.readSCIM(w, r, &patch)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	var patched scim.User
+	err = applyPatch(patch, resource, &patched)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.replaceSCIMUser(w, r, current, patched, "patch")
+}
+
+// replaceSCIMUser saves resource over current and sends the result. Changes to active
+// go through the account state machine, so making a user inactive logs them out.
+func (app *Config) replaceSCIMUser(w http.ResponseWriter, r *http.Request, current *data.ProvisionedUser, resource scim.User, operation string) {
+	if resource.ID != "" && resource.ID != strconv.Itoa(current.ID) {
+		app.scimError(w, scim.NewError(http.StatusBadRequest, scim.ErrorMutability, "id can't be changed"))
+		return
+	}
+
+	updated, err := userFromSCIM(resource)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	user := current.User
+	if updated.Email != user.Email || updated.FirstName != user.FirstName || updated.LastName != user.LastName {
+		if !strings.EqualFold(updated.Email, user.Email) {
+			err = app.checkUserName(r.Context(), updated.Email, user.ID)
+			if err != nil {
+				app.scimError(w, err)
+				return
+			}
+		}
+
+		user.Email = updated.Email
+		user.FirstName = updated.FirstName
+		user.LastName = updated.LastName
+
+		err = app.Models.User.Update(r.Context(), &user)
+		if err != nil {
+			app.scimError(w, err)
+			return
+		}
+	}
+
+	if resource.ExternalID != current.ExternalID {
+		err = app.Models.Provisioning.SetExternalID(r.Context(), user.ID, resource.ExternalID)
+		if err != nil {
+			app.scimError(w, err)
+			return
+		}
+	}
+
+	if resource.Active != nil {
+		active := 0
+		if *resource.Active {
+			active = 1
+		}
+
+		status := statusForActive(user.Status, active)
+		if status != user.Status {
+			_, err = app.changeStatus(r, &user, status, scimStatusReason)
+			if err != nil {
+				app.scimError(w, err)
+				return
+			}
+		}
+	}
+
+	app.auditSCIM(r, "User", operation, user.ID, user.Email)
+
+	saved, err := app.Models.Provisioning.User(r.Context(), user.ID)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	out, etag, err := app.scimUser(r.Context(), scimBaseURL(r), saved, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.scimJSON(w, http.StatusOK, out, etag)
+}
+
+// DeleteSCIMUser deletes a user for good, along with their group memberships
+func (app *Config) DeleteSCIMUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.scimManagedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	_, etag, err := app.scimUser(r.Context(), scimBaseURL(r), user, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+	if !app.checkIfMatch(w, r, etag) {
+		return
+	}
+
+	err = app.Models.User.DeleteByID(r.Context(), user.ID)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.auditSCIM(r, "User", "delete", user.ID, user.Email)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSCIMGroups lists groups, filtered and paged. Members are left out when the
+// client excludes them, which identity providers do to keep pages of large groups
+// small.
+func (app *Config) GetSCIMGroups(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	start, count, err := scim.Page(query.Get("startIndex"), query.Get("count"), scimDefaultCount, scimMaxCount)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	filter, err := scimFilter(query.Get("filter"))
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	attributes, excluded := query.Get("attributes"), query.Get("excludedAttributes")
+	withMembers := scim.Requested(attributes, excluded, "members")
+
+	groups, total, err := app.Models.Group.Search(r.Context(), filter, start-1, count, withMembers)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	base := scimBaseURL(r)
+
+	resources := []any{}
+	for _, group := range groups {
+		resource, _, err := scimGroup(base, group, withMembers)
+		if err != nil {
+			app.scimError(w, err)
+			return
+		}
+
+		projected, err := scim.Project(resource, attributes, excluded)
+		if err != nil {
+			app.scimError(w, err)
+			return
+		}
+		resources = append(resources, projected)
+	}
+
+	app.scimJSON(w, http.StatusOK, scim.NewListResponse(total, start, resources), "")
+}
+
+// GetSCIMGroup returns one group with its members
+func (app *Config) GetSCIMGroup(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.scimGroupFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	resource, etag, err := scimGroup(scimBaseURL(r), group, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.scimResource(w, r, resource, etag)
+}
+
+// CreateSCIMGroup creates a group. Members that aren't users we know are skipped.
+func (app *Config) CreateSCIMGroup(w http.ResponseWriter, r *http.Request) {
+	var resource scim.Group
+	err := app.readSCIM(w, r, &resource)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	group, err := groupFromSCIM(resource)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	group.ID, err = app.Models.Group.Insert(r.Context(), group)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.auditSCIM(r, "Group", "create", 0, group.DisplayName)
+
+	created, err := app.Models.Group.GetOne(r.Context(), group.ID)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	out, etag, err := scimGroup(scimBaseURL(r), created, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", out.Meta.Location)
+	app.scimJSON(w, http.StatusCreated, out, etag)
+}
+
+// ReplaceSCIMGroup replaces a group's name, external id and members
+func (app *Config) ReplaceSCIMGroup(w http.ResponseWriter, r *http.Request) {
+	current, ok := app.scimGroupFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	_, etag, err := scimGroup(scimBaseURL(r), current, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+	if !app.checkIfMatch(w, r, etag) {
+		return
+	}
+
+	var resource scim.Group
+	err = app.readSCIM(w, r, &resource)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.replaceSCIMGroup(w, r, current, resource, "replace")
+}
+
+// PatchSCIMGroup changes some of a group's attributes, most often adding or removing
+// members
+func (app *Config) PatchSCIMGroup(w http.ResponseWriter, r *http.Request) {
+	current, ok := app.scimGroupFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	resource, etag, err := scimGroup(scimBaseURL(r), current, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+	if !app.checkIfMatch(w, r, etag) {
+		return
+	}
+
+	var patch scim.PatchRequest
+	err = app.readSCIM(w, r, &patch)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	var patched scim.Group
+	err = applyPatch(patch, resource, &patched)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.replaceSCIMGroup(w, r, current, patched, "patch")
+}
+
+// replaceSCIMGroup saves resource over current and sends the result
+func (app *Config) replaceSCIMGroup(w http.ResponseWriter, r *http.Request, current *data.Group, resource scim.Group, operation string) {
+	if resource.ID != "" && resource.ID != strconv.Itoa(current.ID) {
+		app.scimError(w, scim.NewError(http.StatusBadRequest, scim.ErrorMutability, "id can't be changed"))
+		return
+	}
+
+	group, err := groupFromSCIM(resource)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+	group.ID = current.ID
+
+	err = app.Models.Group.Update(r.Context(), group)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.auditSCIM(r, "Group", operation, 0, group.DisplayName)
+
+	saved, err := app.Models.Group.GetOne(r.Context(), group.ID)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	out, etag, err := scimGroup(scimBaseURL(r), saved, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.scimJSON(w, http.StatusOK, out, etag)
+}
+
+// DeleteSCIMGroup deletes a group; its members are left alone
+func (app *Config) DeleteSCIMGroup(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.scimGroupFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	_, etag, err := scimGroup(scimBaseURL(r), group, true)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+	if !app.checkIfMatch(w, r, etag) {
+		return
+	}
+
+	err = app.Models.Group.Delete(r.Context(), group.ID)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.auditSCIM(r, "Group", "delete", 0, group.DisplayName)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSCIMServiceProviderConfig says which parts of SCIM we support
+func (app *Config) GetSCIMServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	config := scim.NewServiceProviderConfig(scimMaxCount)
+	config.Meta.Location = scimBaseURL(r) + "/ServiceProviderConfig"
+
+	app.scimJSON(w, http.StatusOK, config, "")
+}
+
+// GetSCIMResourceTypes lists the resource types we serve
+func (app *Config) GetSCIMResourceTypes(w http.ResponseWriter, r *http.Request) {
+	base := scimBaseURL(r)
+
+	resources := []any{}
+	for _, resourceType := range scim.ResourceTypes {
+		resources = append(resources, located(resourceType, base))
+	}
+
+	app.scimJSON(w, http.StatusOK, scim.NewListResponse(len(resources), 1, resources), "")
+}
+
+// GetSCIMResourceType returns the resource type named in the URL
+func (app *Config) GetSCIMResourceType(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	for _, resourceType := range scim.ResourceTypes {
+		if resourceType.ID == id {
+			app.scimJSON(w, http.StatusOK, located(resourceType, scimBaseURL(r)), "")
+			return
+		}
+	}
+
+	app.scimError(w, scim.NewError(http.StatusNotFound, "", fmt.Sprintf("no resource type %s", id)))
+}
+
+// GetSCIMSchemas lists the schemas of the resources we serve
+func (app *Config) GetSCIMSchemas(w http.ResponseWriter, r *http.Request) {
+	base := scimBaseURL(r)
+
+	resources := []any{}
+	for _, schema := range scim.Schemas {
+		schema.Meta = &scim.Meta{ResourceType: "Schema", Location: base + "/Schemas/" + schema.ID}
+		resources = append(resources, schema)
+	}
+
+	app.scimJSON(w, http.StatusOK, scim.NewListResponse(len(resources), 1, resources), "")
+}
+
+// GetSCIMSchema returns the schema whose URN is in the URL
+func (app *Config) GetSCIMSchema(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	schema, ok := scim.FindSchema(id)
+	if !ok {
+		app.scimError(w, scim.NewError(http.StatusNotFound, "", fmt.Sprintf("no schema %s", id)))
+		return
+	}
+
+	schema.Meta = &scim.Meta{ResourceType: "Schema", Location: scimBaseURL(r) + "/Schemas/" + schema.ID}
+	app.scimJSON(w, http.StatusOK, schema, "")
+}
+
+// located returns a copy of a resource type with its location set
+func located(resourceType scim.ResourceType, base string) scim.ResourceType {
+	resourceType.Meta = &scim.Meta{ResourceType: "ResourceType", Location: base + "/ResourceTypes/" + resourceType.ID}
+	return resourceType
+}
+
+// scimUser builds the SCIM resource for a user, and its ETag. Groups are only loaded
+// when withGroups is set; a resource without them has no version, as it isn't the
+// whole user.
+func (app *Config) scimUser(ctx context.Context, base string, user *data.ProvisionedUser, withGroups bool) (scim.User, string, error) {
+	id := strconv.Itoa(user.ID)
+	active := scim.Bool(user.Status == data.StatusActive)
+	displayName := strings.TrimSpace(user.FirstName + " " + user.LastName)
+
+	resource := scim.User{
+		Schemas:     []string{scim.SchemaUser},
+		ID:          id,
+		ExternalID:  user.ExternalID,
+		UserName:    user.Email,
+		DisplayName: displayName,
+		Emails:      []scim.Email{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &scim.Meta{
+			ResourceType: "User",
+			Created:      &user.CreatedAt,
+			LastModified: &user.UpdatedAt,
+			Location:     base + "/Users/" + id,
+		},
+	}
+
+	if user.FirstName != "" || user.LastName != "" {
+		resource.Name = &scim.Name{
+			Formatted:  displayName,
+			GivenName:  user.FirstName,
+			FamilyName: user.LastName,
+		}
+	}
+
+	if !withGroups {
+		return resource, "", nil
+	}
+
+	groups, err := app.Models.Group.ForUser(ctx, user.ID)
+	if err != nil {
+		return scim.User{}, "", err
+	}
+
+	for _, group := range groups {
+		groupID := strconv.Itoa(group.ID)
+		resource.Groups = append(resource.Groups, scim.GroupRef{
+			Value:   groupID,
+			Ref:     base + "/Groups/" + groupID,
+			Display: group.DisplayName,
+		})
+	}
+
+	etag, err := scim.ETag(resource)
+	if err != nil {
+		return scim.User{}, "", err
+	}
+	resource.Meta.Version = etag
+
+	return resource, etag, nil
+}
+
+// scimGroup builds the SCIM resource for a group, and its ETag. Like scimUser, a group
+// built without its members has no version.
+func scimGroup(base string, group *data.Group, withMembers bool) (scim.Group, string, error) {
+	id := strconv.Itoa(group.ID)
+
+	resource := scim.Group{
+		Schemas:     []string{scim.SchemaGroup},
+		ID:          id,
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Meta: &scim.Meta{
+			ResourceType: "Group",
+			Created:      &group.CreatedAt,
+			LastModified: &group.UpdatedAt,
+			Location:     base + "/Groups/" + id,
+		},
+	}
+
+	if !withMembers {
+		return resource, "", nil
+	}
+
+	for _, member := range group.Members {
+		userID := strconv.Itoa(member.UserID)
+		resource.Members = append(resource.Members, scim.Member{
+			Value:   userID,
+			Ref:     base + "/Users/" + userID,
+			Display: member.Email,
+			Type:    "User",
+		})
+	}
+
+	etag, err := scim.ETag(resource)
+	if err != nil {
+		return scim.Group{}, "", err
+	}
+	resource.Meta.Version = etag
+
+	return resource, etag, nil
+}
+
+// userFromSCIM checks the attributes of a SCIM user we keep and returns them as a
+// user. userName has to be an email address, as that is what users log in with.
+func userFromSCIM(resource scim.User) (data.User, error) {
+	email, err := normalizeEmail(resource.UserName)
+	if err != nil {
+		return data.User{}, scim.NewError(http.StatusBadRequest, scim.ErrorInvalidValue, "userName must be an email address")
+	}
+
+	user := data.User{Email: email}
+	if resource.Name != nil {
+		user.FirstName = strings.TrimSpace(resource.Name.GivenName)
+		user.LastName = strings.TrimSpace(resource.Name.FamilyName)
+	}
+
+	if len(user.FirstName) > maxNameLength || len(user.LastName) > maxNameLength {
+		return data.User{}, scim.NewError(http.StatusBadRequest, scim.ErrorInvalidValue, fmt.Sprintf("names must be at most %d characters", maxNameLength))
+	}
+
+	return user, nil
+}
+
+// groupFromSCIM checks a SCIM group and returns it as a group. Members have to be
+// users, named by their id.
+func groupFromSCIM(resource scim.Group) (data.Group, error) {
+	group := data.Group{
+		DisplayName: strings.TrimSpace(resource.DisplayName),
+		ExternalID:  resource.ExternalID,
+	}
+
+	if group.DisplayName == "" {
+		return data.Group{}, scim.NewError(http.StatusBadRequest, scim.ErrorInvalidValue, "displayName is required")
+	}
+	if len(group.DisplayName) > maxNameLength {
+		return data.Group{}, scim.NewError(http.StatusBadRequest, scim.ErrorInvalidValue, fmt.Sprintf("displayName must be at most %d characters", maxNameLength))
+	}
+
+	for _, member := range resource.Members {
+		if member.Type != "" && member.Type != "User" {
+			return data.Group{}, scim.NewError(http.StatusBadRequest, scim.ErrorInvalidValue, "only users can be group members")
+		}
+
+		userID, err := strconv.Atoi(member.Value)
+		if err != nil || userID < 1 {
+			return data.Group{}, scim.NewError(http.StatusBadRequest, scim.ErrorInvalidValue, fmt.Sprintf("%q is not a user id", member.Value))
+		}
+
+		group.Members = append(group.Members, data.GroupMember{UserID: userID})
+	}
+
+	return group, nil
+}
+
+// applyPatch applies a PATCH request to a resource and decodes the result into out
+func applyPatch(patch scim.PatchRequest, resource, out any) error {
+	body, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+
+	var m map[string]any
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		return err
+	}
+
+	err = patch.Apply(m)
+	if err != nil {
+		return err
+	}
+
+	body, err = json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(body, out)
+	if err != nil {
+		var scimErr *scim.Error
+		if errors.As(err, &scimErr) {
+			return err
+		}
+		return scim.NewError(http.StatusBadRequest, scim.ErrorInvalidValue, err.Error())
+	}
+
+	return nil
+}
+
+// scimUserFromURL loads the user whose ID is in the {id} URL parameter, writing a
+// SCIM error and returning false if there isn't one. IDs are opaque to clients, so
+// one that isn't a number is simply not found.
+func (app *Config) scimUserFromURL(w http.ResponseWriter, r *http.Request) (*data.ProvisionedUser, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		app.scimError(w, sql.ErrNoRows)
+		return nil, false
+	}
+
+	user, err := app.Models.Provisioning.User(r.Context(), id)
+	if err != nil {
+		app.scimError(w, err)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// scimManagedUserFromURL loads the user in the {id} URL parameter for a change, as
+// scimUserFromURL does, refusing with a 403 a user who has since been given a global
+// role. Only an administrator changes those, or an identity provider could take over
+// an admin account by changing its email address.
+func (app *Config) scimManagedUserFromURL(w http.ResponseWriter, r *http.Request) (*data.ProvisionedUser, bool) {
+	user, ok := app.scimUserFromURL(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	global, err := app.holdsGlobalRole(r.Context(), user.ID)
+	if err != nil {
+		app.scimError(w, err)
+		return nil, false
+	}
+	if global {
+		app.scimError(w, errGlobalRole)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// scimGroupFromURL loads the group whose ID is in the {id} URL parameter, with its
+// members, writing a SCIM error and returning false if there isn't one
+func (app *Config) scimGroupFromURL(w http.ResponseWriter, r *http.Request) (*data.Group, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		app.scimError(w, data.ErrGroupNotFound)
+		return nil, false
+	}
+
+	group, err := app.Models.Group.GetOne(r.Context(), id)
+	if err != nil {
+		app.scimError(w, err)
+		return nil, false
+	}
+
+	return group, true
+}
+
+// checkUserName returns ErrDuplicateEmail if a user other than id has userName in any
+// case. Every account is checked, not only the provisioned ones the identity
+// provider can see, so it is told about the clash instead of getting a server error.
+func (app *Config) checkUserName(ctx context.Context, userName string, id int) error {
+	user, err := app.Models.User.GetByEmail(ctx, userName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.ID != id {
+		return data.ErrDuplicateEmail
+	}
+
+	return nil
+}
+
+// scimFilter parses the filter query parameter; no filter is nil
+func scimFilter(filter string) (*scim.Filter, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+
+	return scim.ParseFilter(filter)
+}
+
+// scimBaseURL is the root of the SCIM API as the client reached it, which resource
+// locations are built on
+func scimBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+
+	return scheme + "://" + r.Host + "/scim/v2"
+}
+
+// checkIfMatch writes a 412 and returns false if the request has an If-Match header
+// that doesn't name the resource's current version, so a client doesn't overwrite a
+// change it hasn't seen
+func (app *Config) checkIfMatch(w http.ResponseWriter, r *http.Request, etag string) bool {
+	match := r.Header.Get("If-Match")
+	if match == "" || scim.MatchesETag(match, etag) {
+		return true
+	}
+
+	app.scimError(w, scim.NewError(http.StatusPreconditionFailed, "", "resource has changed since it was read"))
+	return false
+}
+
+// scimResource sends one resource, applying the attributes and excludedAttributes
+// query parameters, or a 304 if the request's If-None-Match names its version
+func (app *Config) scimResource(w http.ResponseWriter, r *http.Request, resource any, etag string) {
+	if match := r.Header.Get("If-None-Match"); match != "" && scim.MatchesETag(match, etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	query := r.URL.Query()
+	projected, err := scim.Project(resource, query.Get("attributes"), query.Get("excludedAttributes"))
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	app.scimJSON(w, http.StatusOK, projected, etag)
+}
+
+// readSCIM reads a SCIM request body. Bodies that aren't valid JSON are turned into
+// invalidSyntax errors.
+func (app *Config) readSCIM(w http.ResponseWriter, r *http.Request, v any) error {
+	err := app.readJSON(w, r, v)
+	if err != nil {
+		var scimErr *scim.Error
+		if errors.As(err, &scimErr) {
+			return err
+		}
+		return scim.NewError(http.StatusBadRequest, scim.ErrorInvalidSyntax, err.Error())
+	}
+
+	return nil
+}
+
+// scimJSON sends v as a SCIM response, with an ETag header when etag is set
+func (app *Config) scimJSON(w http.ResponseWriter, status int, v any, etag string) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		app.scimError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", scim.ContentType)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// scimError sends err as a SCIM error response. Errors that aren't a *scim.Error are
+// mapped to one by what went wrong.
+func (app *Config) scimError(w http.ResponseWriter, err error) {
+	var scimErr *scim.Error
+	switch {
+	case errors.As(err, &scimErr):
+	case errors.Is(err, data.ErrDuplicateEmail):
+		scimErr = scim.NewError(http.StatusConflict, scim.ErrorUniqueness, "userName is already taken")
+	case errors.Is(err, data.ErrDuplicateExternalID):
+		scimErr = scim.NewError(http.StatusConflict, scim.ErrorUniqueness, "externalId is already taken")
+	case errors.Is(err, data.ErrDuplicateGroup):
+		scimErr = scim.NewError(http.StatusConflict, scim.ErrorUniqueness, err.Error())
+	case errors.Is(err, data.ErrInvalidTransition):
+		scimErr = scim.NewError(http.StatusConflict, "", err.Error())
+	case errors.Is(err, errGlobalRole):
+		scimErr = scim.NewError(http.StatusForbidden, "", err.Error())
+	case errors.Is(err, sql.ErrNoRows):
+		scimErr = scim.NewError(http.StatusNotFound, "", "user not found")
+	case errors.Is(err, data.ErrGroupNotFound):
+		scimErr = scim.NewError(http.StatusNotFound, "", err.Error())
+	default:
+		scimErr = scim.NewError(http.StatusInternalServerError, "", err.Error())
+	}
+
+	out, _ := json.Marshal(scimErr)
+
+	w.Header().Set("Content-Type", scim.ContentType)
+	w.WriteHeader(scimErr.Code)
+	w.Write(out)
+}
+
+// auditSCIM publishes an audit event for a change an identity provider made. userID
+// is 0 for changes to groups.
+func (app *Config) auditSCIM(r *http.Request, resource, operation string, userID int, name string) {
+	account := serviceAccountFromContext(r.Context())
+
+	e := event.Event{
+		Name: eventSCIMChange,
+		Data: fmt.Sprintf("service account %s: %s %s %s over SCIM", account, operation, strings.ToLower(resource), name),
+		Attributes: map[string]string{
+			"service_account": account,
+			"resource":        resource,
+			"operation":       operation,
+		},
+	}
+	if userID != 0 {
+		e.UserID = userID
+		e.Email = name
+	}
+
+	app.audit(r, e)
+}
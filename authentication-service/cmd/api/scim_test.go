@@ -0,0 +1,295 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/scim"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// update rewrites the responses in the SCIM fixtures with what the handlers send now:
+//
+//	go test ./cmd/api -run TestSCIMFixtures -update
+var update = flag.Bool("update", false, "rewrite the recorded responses in testdata/scim")
+
+// scimClock is the time the fixtures were recorded at. Every store is stopped there,
+// so the dates and versions in the responses don't change from run to run.
+var scimClock = time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+
+// scimRecordedHeaders are the response headers the fixtures keep
+var scimRecordedHeaders = []string{"Content-Type", "ETag", "Location", "WWW-Authenticate"}
+
+// scimFixture is a conversation with the SCIM API, as an identity provider would have
+// it, starting from an empty service
+type scimFixture struct {
+	Description string         `json:"description"`
+	Exchanges   []scimExchange `json:"exchanges"`
+}
+
+// scimExchange is one request and the response recorded for it. In request headers,
+// $etag stands for the ETag of the latest response that had one. A request without
+// an Authorization header is sent with a valid API key.
+type scimExchange struct {
+	Request struct {
+		Method  string            `json:"method"`
+		Path    string            `json:"path"`
+		Headers map[string]string `json:"headers,omitempty"`
+		Body    json.RawMessage   `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		Status  int               `json:"status"`
+		Headers map[string]string `json:"headers,omitempty"`
+		Body    json.RawMessage   `json:"body,omitempty"`
+	} `json:"response"`
+}
+
+func TestSCIMFixtures(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "scim", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no fixtures in testdata/scim")
+	}
+
+	for _, file := range files {
+		file := file
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			replaySCIMFixture(t, file)
+		})
+	}
+}
+
+// replaySCIMFixture sends the requests in a fixture through the router in order and
+// compares each response with the recorded one
+func replaySCIMFixture(t *testing.T, file string) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fixture scimFixture
+	if err := json.Unmarshal(raw, &fixture); err != nil {
+		t.Fatalf("reading %s: %v", file, err)
+	}
+
+	app, apiKey := newSCIMTestApp(t)
+
+	etag := ""
+	for i := range fixture.Exchanges {
+		exchange := &fixture.Exchanges[i]
+		req := exchange.Request
+
+		r := httptest.NewRequest(req.Method, req.Path, bytes.NewReader(req.Body))
+		r.Header.Set("Content-Type", scim.ContentType)
+		r.Header.Set("Authorization", "Bearer "+apiKey)
+		for name, value := range req.Headers {
+			r.Header.Set(name, strings.ReplaceAll(value, "$etag", etag))
+		}
+
+		w := httptest.NewRecorder()
+		app.handler.ServeHTTP(w, r)
+
+		if got := w.Header().Get("ETag"); got != "" {
+			etag = got
+		}
+
+		headers := map[string]string{}
+		for _, name := range scimRecordedHeaders {
+			if value := w.Header().Get(name); value != "" {
+				headers[name] = value
+			}
+		}
+
+		if *update {
+			exchange.Response.Status = w.Code
+			exchange.Response.Headers = headers
+			exchange.Response.Body = nil
+			if w.Body.Len() > 0 {
+				exchange.Response.Body = json.RawMessage(w.Body.Bytes())
+			}
+			continue
+		}
+
+		want := exchange.Response
+		name := req.Method + " " + req.Path
+		if w.Code != want.Status {
+			t.Errorf("exchange %d, %s: got status %d, want %d\n%s", i+1, name, w.Code, want.Status, w.Body.String())
+		}
+		if len(want.Headers) == 0 {
+			want.Headers = map[string]string{}
+		}
+		if !reflect.DeepEqual(headers, want.Headers) {
+			t.Errorf("exchange %d, %s: got headers %v, want %v", i+1, name, headers, want.Headers)
+		}
+		if !sameJSON(t, w.Body.Bytes(), want.Body) {
+			t.Errorf("exchange %d, %s: got body\n%s\nwant\n%s", i+1, name, w.Body.String(), want.Body)
+		}
+	}
+
+	if *update {
+		out, err := json.MarshalIndent(fixture, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, append(out, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newSCIMTestApp returns the service with every store stopped at scimClock, and an
+// API key of a service account allowed to use the SCIM API
+func newSCIMTestApp(t *testing.T) (*testApp, string) {
+	t.Helper()
+
+	app := newTestApp(t)
+
+	now := func() time.Time { return scimClock }
+	app.Clock = now
+	app.users.Now = now
+	app.sessions.Now = now
+	app.groups.Now = now
+	app.apiKeys.Now = now
+
+	app.apiKeys.AddServiceAccount(1, "identity-provider")
+	key, err := app.apiKeys.Create(context.Background(), 1, "scim", []string{scimPermission}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return app, key.PlainText
+}
+
+// sameJSON reports whether two JSON documents hold the same values; an empty document
+// is the same as another empty one
+func sameJSON(t *testing.T, got, want []byte) bool {
+	t.Helper()
+
+	if len(bytes.TrimSpace(got)) == 0 || len(bytes.TrimSpace(want)) == 0 {
+		return len(bytes.TrimSpace(got)) == len(bytes.TrimSpace(want))
+	}
+
+	var g, w any
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Errorf("response isn't JSON: %s", got)
+		return false
+	}
+	if err := json.Unmarshal(want, &w); err != nil {
+		t.Errorf("recorded response isn't JSON: %s", want)
+		return false
+	}
+
+	return reflect.DeepEqual(g, w)
+}
+
+// scimDo sends a SCIM request with apiKey and returns the status and body
+func (app *testApp) scimDo(t *testing.T, apiKey, method, path, body string) (int, string) {
+	t.Helper()
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", scim.ContentType)
+	r.Header.Set("Authorization", "Bearer "+apiKey)
+
+	w := httptest.NewRecorder()
+	app.handler.ServeHTTP(w, r)
+
+	return w.Code, w.Body.String()
+}
+
+func TestSCIMReach(t *testing.T) {
+	app, apiKey := newSCIMTestApp(t)
+	local := app.createUser(t, "local@example.com")
+	admin := app.createUser(t, "admin@example.com", "admin")
+
+	status, body := app.scimDo(t, apiKey, http.MethodPost, "/scim/v2/Users",
+		`{"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],"userName":"ada@example.com"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("creating a user got %d %s", status, body)
+	}
+	var created scim.User
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	// a provisioned user later made an admin
+	status, body = app.scimDo(t, apiKey, http.MethodPost, "/scim/v2/Users",
+		`{"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],"userName":"promoted@example.com","externalId":"p-1"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("creating a user got %d %s", status, body)
+	}
+	var promoted scim.User
+	if err := json.Unmarshal([]byte(body), &promoted); err != nil {
+		t.Fatal(err)
+	}
+	promotedID, _ := strconv.Atoi(promoted.ID)
+	if err := app.roles.Grant(context.Background(), promotedID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the users created over SCIM are listed
+	status, body = app.scimDo(t, apiKey, http.MethodGet, "/scim/v2/Users", "")
+	var list struct {
+		TotalResults int `json:"totalResults"`
+	}
+	if err := json.Unmarshal([]byte(body), &list); err != nil || status != http.StatusOK || list.TotalResults != 2 {
+		t.Errorf("listing users got %d %s, want the 2 created over SCIM", status, body)
+	}
+
+	replace := `{"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],"userName":"taken@example.com"}`
+	patch := `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"userName","value":"taken@example.com"}]}`
+
+	tests := []struct {
+		name   string
+		method string
+		id     string
+		body   string
+		status int
+	}{
+		{"read a local user", http.MethodGet, strconv.Itoa(local.ID), "", http.StatusNotFound},
+		{"replace a local user", http.MethodPut, strconv.Itoa(local.ID), replace, http.StatusNotFound},
+		{"patch a local user", http.MethodPatch, strconv.Itoa(local.ID), patch, http.StatusNotFound},
+		{"delete a local user", http.MethodDelete, strconv.Itoa(local.ID), "", http.StatusNotFound},
+		{"replace an admin", http.MethodPut, strconv.Itoa(admin.ID), replace, http.StatusNotFound},
+		{"patch an admin", http.MethodPatch, strconv.Itoa(admin.ID), patch, http.StatusNotFound},
+		{"delete an admin", http.MethodDelete, strconv.Itoa(admin.ID), "", http.StatusNotFound},
+		{"replace a provisioned admin", http.MethodPut, promoted.ID, replace, http.StatusForbidden},
+		{"patch a provisioned admin", http.MethodPatch, promoted.ID, patch, http.StatusForbidden},
+		{"delete a provisioned admin", http.MethodDelete, promoted.ID, "", http.StatusForbidden},
+		{"take a local user's address", http.MethodPatch, created.ID,
+			`{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"userName","value":"LOCAL@example.com"}]}`, http.StatusConflict},
+		{"patch a user created without an external id", http.MethodPatch, created.ID, patch, http.StatusOK},
+		{"replace them, leaving the external id out", http.MethodPut, created.ID, replace, http.StatusOK},
+		{"and still reach them", http.MethodGet, created.ID, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := app.scimDo(t, apiKey, tt.method, "/scim/v2/Users/"+tt.id, tt.body)
+			if status != tt.status {
+				t.Errorf("got %d %s, want %d", status, body, tt.status)
+			}
+		})
+	}
+
+	for _, user := range []*data.User{local, admin} {
+		got, err := app.users.GetOne(context.Background(), user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Email != user.Email || got.Status != data.StatusActive {
+			t.Errorf("%s became %s %s", user.Email, got.Email, got.Status)
+		}
+	}
+}
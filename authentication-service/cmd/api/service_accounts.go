@@ -0,0 +1,308 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (app *Config) GetServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	accounts, err := app.Models.ServiceAccount.GetAll(r.Context())
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "All service accounts",
+		Data:    accounts,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) CreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	account := data.ServiceAccount{
+		Name:        strings.TrimSpace(requestPayload.Name),
+		Description: strings.TrimSpace(requestPayload.Description),
+	}
+
+	if account.Name == "" || len(account.Name) > maxNameLength {
+		app.errorJSON(w, fmt.Errorf("name is required and must be at most %d characters", maxNameLength), http.StatusBadRequest)
+		return
+	}
+
+	account.ID, err = app.Models.ServiceAccount.Insert(r.Context(), account)
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateName) {
+			app.errorJSON(w, err, http.StatusConflict)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logServiceAccountChange(r, fmt.Sprintf("created service account %s", account.Name))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Created service account %s", account.Name),
+		Data:    account,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) DeleteServiceAccount(w http.ResponseWriter, r *http.Request) {
+	account, ok := app.serviceAccountFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.Models.ServiceAccount.Delete(r.Context(), account.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logServiceAccountChange(r, fmt.Sprintf("deleted service account %s", account.Name))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Deleted service account %s", account.Name),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	account, ok := app.serviceAccountFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := app.Models.APIKey.ForAccount(r.Context(), account.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("API keys for %s", account.Name),
+		Data:    keys,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// CreateAPIKey makes a new key for a service account. The plain text key is in the
+// response and can't be fetched again.
+func (app *Config) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	account, ok := app.serviceAccountFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(requestPayload.Name)
+	if name == "" || len(name) > maxNameLength {
+		app.errorJSON(w, fmt.Errorf("name is required and must be at most %d characters", maxNameLength), http.StatusBadRequest)
+		return
+	}
+
+	if len(requestPayload.Scopes) == 0 {
+		app.errorJSON(w, errors.New("an api key needs at least one scope"), http.StatusBadRequest)
+		return
+	}
+
+	if requestPayload.ExpiresAt != nil && !requestPayload.ExpiresAt.After(time.Now()) {
+		app.errorJSON(w, errors.New("expires_at must be in the future"), http.StatusBadRequest)
+		return
+	}
+
+	key, err := app.Models.APIKey.Create(r.Context(), account.ID, name, requestPayload.Scopes, requestPayload.ExpiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateName):
+			app.errorJSON(w, err, http.StatusConflict)
+		case errors.Is(err, data.ErrUnknownScope):
+			app.errorJSON(w, err, http.StatusBadRequest)
+		default:
+			app.errorJSON(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	app.logServiceAccountChange(r, fmt.Sprintf("created api key %s (%s) for %s with scopes %s",
+		key.Name, key.Prefix, account.Name, strings.Join(key.Scopes, ",")))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Created API key %s", key.Name),
+		Data:    key,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// RotateAPIKey gives a key a new secret. The old one stops working immediately.
+func (app *Config) RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	account, keyID, ok := app.apiKeyFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	key, err := app.Models.APIKey.Rotate(r.Context(), account.ID, keyID)
+	if err != nil {
+		if errors.Is(err, data.ErrAPIKeyNotFound) {
+			app.errorJSON(w, err, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logServiceAccountChange(r, fmt.Sprintf("rotated api key %s for %s, new prefix %s", key.Name, account.Name, key.Prefix))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Rotated API key %s", key.Name),
+		Data:    key,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	account, keyID, ok := app.apiKeyFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.Models.APIKey.Revoke(r.Context(), account.ID, keyID)
+	if err != nil {
+		if errors.Is(err, data.ErrAPIKeyNotFound) {
+			app.errorJSON(w, err, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.logServiceAccountChange(r, fmt.Sprintf("revoked api key %d for %s", keyID, account.Name))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Revoked API key %d", keyID),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// VerifyAPIKey is called by the broker to resolve an API key to the service account
+// behind it and the scopes it may use
+func (app *Config) VerifyAPIKey(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Key string `json:"key"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	key, err := app.Models.APIKey.Authenticate(r.Context(), requestPayload.Key)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidAPIKey) {
+			app.errorJSON(w, err, http.StatusUnauthorized)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("API key %s is valid", key.Prefix),
+		Data:    key,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// serviceAccountFromURL loads the service account named by the {id} URL parameter,
+// writing an error response and returning false if it can't
+func (app *Config) serviceAccountFromURL(w http.ResponseWriter, r *http.Request) (*data.ServiceAccount, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid service account id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	account, err := app.Models.ServiceAccount.GetOne(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, data.ErrServiceAccountNotFound) {
+			app.errorJSON(w, err, http.StatusNotFound)
+			return nil, false
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return account, true
+}
+
+// apiKeyFromURL loads the service account from the URL and parses the {keyID} parameter
+func (app *Config) apiKeyFromURL(w http.ResponseWriter, r *http.Request) (*data.ServiceAccount, int, bool) {
+	account, ok := app.serviceAccountFromURL(w, r)
+	if !ok {
+		return nil, 0, false
+	}
+
+	keyID, err := strconv.Atoi(chi.URLParam(r, "keyID"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid api key id"), http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	return account, keyID, true
+}
+
+func (app *Config) logServiceAccountChange(r *http.Request, change string) {
+	app.audit(r, event.Event{
+		Name: eventServiceAccountEdit,
+		Data: fmt.Sprintf("user %d %s", userIDFromContext(r.Context()), change),
+	})
+}
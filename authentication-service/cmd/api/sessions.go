@@ -0,0 +1,194 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxUserAgentLength is how much of a client's User-Agent header we keep
+const maxUserAgentLength = 512
+
+// GetSessions lists the current user's active sessions, marking the one making the
+// request
+func (app *Config) GetSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := app.Models.Session.ForUser(r.Context(), userIDFromContext(r.Context()))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	current := sessionIDFromContext(r.Context())
+	for _, session := range sessions {
+		session.Current = session.ID == current
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Active sessions",
+		Data:    sessions,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// RevokeSession logs out one of the current user's sessions
+func (app *Config) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid session id"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.Models.Session.Revoke(r.Context(), userIDFromContext(r.Context()), id)
+	if err != nil {
+		if errors.Is(err, data.ErrSessionNotFound) {
+			app.errorJSON(w, err, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Revoked session %d", id),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// RevokeOtherSessions logs out every session of the current user except the one making
+// the request
+func (app *Config) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	revoked, err := app.Models.Session.RevokeOthers(r.Context(), userIDFromContext(r.Context()), sessionIDFromContext(r.Context()))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Revoked %d other sessions", revoked),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// GetUserSessions lets an admin see another user's active sessions
+func (app *Config) GetUserSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := app.Models.Session.ForUser(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Active sessions for %s", user.Email),
+		Data:    sessions,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// ForceLogout lets an admin end every session of a user
+func (app *Config) ForceLogout(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Session.RevokeAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, event.Event{
+		Name:   eventSessionsRevoked,
+		Data:   fmt.Sprintf("user %d logged out user %s everywhere", userIDFromContext(r.Context()), user.Email),
+		UserID: user.ID,
+		Email:  user.Email,
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Logged out %s everywhere", user.Email),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// RevokedSessions is polled by the broker so it can turn away access tokens from
+// revoked sessions before they expire. It returns the sessions revoked after the since
+// query parameter, going back no further than the access token lifetime, since older
+// revocations no longer matter. Callers pass the returned now back as since.
+func (app *Config) RevokedSessions(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	oldest := now.Add(-app.JWT.AccessTTL)
+
+	since := oldest
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			app.errorJSON(w, errors.New("since must be an RFC 3339 time"), http.StatusBadRequest)
+			return
+		}
+		if t.After(since) {
+			since = t
+		}
+	}
+
+	revoked, err := app.Models.Session.RevokedSince(r.Context(), since)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var out struct {
+		Revoked []data.SessionRevocation `json:"revoked"`
+		Now     time.Time                `json:"now"`
+		// RetainSeconds is how long a revocation matters: the access token lifetime
+		RetainSeconds int `json:"retain_seconds"`
+	}
+	out.Revoked = revoked
+	out.Now = now
+	out.RetainSeconds = int(app.JWT.AccessTTL.Seconds())
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d revoked sessions", len(revoked)),
+		Data:    out,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// truncate cuts s down to at most n bytes without splitting a character, dropping any
+// bytes that aren't valid UTF-8 first, since Postgres refuses to store them
+func truncate(s string, n int) string {
+	s = strings.ToValidUTF8(s, "")
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// errTooManyAttempts is the error code sent back while a login is being throttled
+	errTooManyAttempts = "too_many_attempts"
+)
+
+// accountThrottle applies to each email address that fails to log in
+var accountThrottle = data.ThrottlePolicy{
+	FreeAttempts:    3,
+	MaxFailures:     10,
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Minute,
+	LockoutDuration: 15 * time.Minute,
+	Window:          time.Hour,
+}
+
+// ipThrottle applies to each source address. It is looser than accountThrottle since
+// many users can share an address, but it catches credential stuffing across accounts.
+var ipThrottle = data.ThrottlePolicy{
+	FreeAttempts:    20,
+	MaxFailures:     100,
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Minute,
+	LockoutDuration: time.Hour,
+	Window:          time.Hour,
+}
+
+// emailRequestThrottle limits how often one address can be sent a password reset,
+// login link or verification email. Every request counts, whether or not the address
+// is registered, so the limit doesn't reveal who has an account.
+var emailRequestThrottle = data.ThrottlePolicy{
+	FreeAttempts:    3,
+	MaxFailures:     10,
+	BaseDelay:       30 * time.Second,
+	MaxDelay:        15 * time.Minute,
+	LockoutDuration: time.Hour,
+	Window:          time.Hour,
+}
+
+func accountKey(email string) string {
+	return "email:" + data.FoldEmail(email)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkThrottle writes a 429 and returns false if the account or the client address
+// is currently blocked. We check before touching the password so throttled requests
+// never cost a bcrypt comparison.
+func (app *Config) checkThrottle(w http.ResponseWriter, r *http.Request, email string) bool {
+	until, err := app.Models.LoginThrottle.BlockedUntil(r.Context(), accountKey(email), ipKey(app.clientIP(r)))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	wait := time.Until(until)
+	if wait <= 0 {
+		return true
+	}
+
+	seconds := int(wait.Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	app.errorCodeJSON(w, errTooManyAttempts,
+		fmt.Errorf("too many failed login attempts, try again in %d seconds", seconds),
+		http.StatusTooManyRequests)
+
+	return false
+}
+
+// throttleRequest counts a request to email an address against key, under
+// emailRequestThrottle. It writes a 429 and returns false if the address has had too
+// many already.
+func (app *Config) throttleRequest(w http.ResponseWriter, r *http.Request, key string) bool {
+	until, err := app.Models.LoginThrottle.BlockedUntil(r.Context(), key)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	if wait := time.Until(until); wait > 0 {
+		seconds := int(wait.Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		app.errorCodeJSON(w, errTooManyAttempts,
+			fmt.Errorf("too many emails requested for this address, try again in %d seconds", seconds),
+			http.StatusTooManyRequests)
+		return false
+	}
+
+	_, err = app.Models.LoginThrottle.RecordFailure(r.Context(), key, emailRequestThrottle)
+	if err != nil {
+		log.Println("could not record email request:", err)
+	}
+
+	return true
+}
+
+// loginFailed counts a failed login against the account and the client address,
+// records it and any lockout it causes, and tells the client their credentials were
+// wrong. reason is only recorded; the client always gets the same answer.
+func (app *Config) loginFailed(w http.ResponseWriter, r *http.Request, email, reason string) {
+	ip := app.clientIP(r)
+
+	app.audit(r, event.Event{
+		Name:       eventLoginFailed,
+		Data:       fmt.Sprintf("failed login for %s: %s", email, reason),
+		Severity:   event.SeverityWarning,
+		Email:      email,
+		Attributes: map[string]string{"reason": reason},
+	})
+
+	for _, failure := range []struct {
+		key    string
+		policy data.ThrottlePolicy
+	}{
+		{accountKey(email), accountThrottle},
+		{ipKey(ip), ipThrottle},
+	} {
+		throttle, err := app.Models.LoginThrottle.RecordFailure(r.Context(), failure.key, failure.policy)
+		if err != nil {
+			log.Println("could not record failed login:", err)
+			continue
+		}
+
+		if throttle.Locked {
+			app.audit(r, event.Event{
+				Name: eventLockedOut,
+				Data: fmt.Sprintf("locked out %s until %s after %d failed logins (email %s, ip %s)",
+					throttle.Key, throttle.LockedUntil.Format(time.RFC3339), throttle.Failures, email, ip),
+				Severity: event.SeverityWarning,
+				Email:    email,
+				Attributes: map[string]string{
+					"key":          throttle.Key,
+					"failures":     strconv.Itoa(throttle.Failures),
+					"locked_until": throttle.LockedUntil.Format(time.RFC3339),
+				},
+			})
+		}
+	}
+
+	app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+}
+
+// UnlockAccount lets an admin clear the failed logins for an account, and optionally
+// for a source address, ending any lockout early
+func (app *Config) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+		IP    string `json:"ip"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if requestPayload.Email == "" && requestPayload.IP == "" {
+		app.errorJSON(w, errors.New("email or ip is required"), http.StatusBadRequest)
+		return
+	}
+
+	var unlocked []string
+	if requestPayload.Email != "" {
+		unlocked = append(unlocked, accountKey(requestPayload.Email))
+	}
+	if requestPayload.IP != "" {
+		unlocked = append(unlocked, ipKey(requestPayload.IP))
+	}
+
+	for _, key := range unlocked {
+		err = app.Models.LoginThrottle.Reset(r.Context(), key)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	app.audit(r, event.Event{
+		Name:       eventAccountUnlocked,
+		Data:       fmt.Sprintf("user %d unlocked %s", userIDFromContext(r.Context()), strings.Join(unlocked, ", ")),
+		Email:      requestPayload.Email,
+		Attributes: map[string]string{"keys": strings.Join(unlocked, ",")},
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Unlocked " + strings.Join(unlocked, ", "),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
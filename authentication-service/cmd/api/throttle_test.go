@@ -0,0 +1,129 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// named returns the events published so far with the given name
+func (r *recordedEvents) named(name string) []event.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var events []event.Event
+	for _, e := range r.events {
+		if e.Name == name {
+			events = append(events, e)
+		}
+	}
+
+	return events
+}
+
+// lockOut fails to log in as email until the account is locked. The failures before
+// the last are recorded half an hour back, so the delays between them have already
+// run out, and the last one locks the account from now on.
+func (app *testApp) lockOut(t *testing.T, email string) {
+	t.Helper()
+
+	throttle := app.Models.LoginThrottle.(*data.MemoryLoginThrottleRepository)
+	for i := 1; i <= accountThrottle.MaxFailures; i++ {
+		offset := time.Duration(i)*time.Minute - 30*time.Minute
+		if i == accountThrottle.MaxFailures {
+			offset = 0
+		}
+		throttle.Now = func() time.Time { return time.Now().Add(offset) }
+
+		status, response := app.do(t, http.MethodPost, "/login", "", map[string]string{
+			"email":    email,
+			"password": "wrong",
+		})
+		if status != http.StatusUnauthorized {
+			t.Fatalf("failure %d got %d %q", i, status, response.Message)
+		}
+	}
+	throttle.Now = time.Now
+}
+
+func TestLockout(t *testing.T) {
+	app := newTestApp(t)
+	app.createUser(t, "user@example.com")
+
+	app.lockOut(t, "user@example.com")
+
+	locked := app.events.named(eventLockedOut)
+	if len(locked) != 1 {
+		t.Fatalf("got %d lockout events, want 1", len(locked))
+	}
+	if locked[0].Email != "user@example.com" || locked[0].Attributes["key"] != accountKey("user@example.com") {
+		t.Errorf("got lockout event %+v", locked[0])
+	}
+	if n := len(app.events.named(eventLoginFailed)); n != accountThrottle.MaxFailures {
+		t.Errorf("got %d failed login events, want %d", n, accountThrottle.MaxFailures)
+	}
+
+	// the right password doesn't help, in any case of the address
+	status, response := app.do(t, http.MethodPost, "/login", "", map[string]string{
+		"email":    "User@Example.com",
+		"password": testPassword,
+	})
+	if status != http.StatusTooManyRequests || response.Code != errTooManyAttempts {
+		t.Errorf("got %d %q, want %d", status, response.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestUnlockAccount(t *testing.T) {
+	app := newTestApp(t)
+	app.createUser(t, "user@example.com")
+	app.createUser(t, "other@example.com")
+	app.createUser(t, "admin@example.com", "admin")
+	admin := app.mfaLogin(t, "admin@example.com").AccessToken
+	other := app.mfaLogin(t, "other@example.com").AccessToken
+
+	app.lockOut(t, "user@example.com")
+
+	tests := []struct {
+		name   string
+		token  string
+		body   map[string]string
+		status int
+	}{
+		{"without a token", "", map[string]string{"email": "user@example.com"}, http.StatusUnauthorized},
+		{"without the permission", other, map[string]string{"email": "user@example.com"}, http.StatusForbidden},
+		{"with nothing to unlock", admin, map[string]string{}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, response := app.do(t, http.MethodPost, "/admin/unlock", tt.token, tt.body)
+			if status != tt.status {
+				t.Errorf("got %d %q, want %d", status, response.Message, tt.status)
+			}
+		})
+	}
+	if n := len(app.events.named(eventAccountUnlocked)); n != 0 {
+		t.Fatalf("got %d unlock events before unlocking", n)
+	}
+
+	status, response := app.do(t, http.MethodPost, "/admin/unlock", admin, map[string]string{
+		"email": "User@Example.com",
+		"ip":    "192.0.2.1",
+	})
+	if status != http.StatusAccepted {
+		t.Fatalf("unlocking got %d %q", status, response.Message)
+	}
+
+	unlocked := app.events.named(eventAccountUnlocked)
+	if len(unlocked) != 1 {
+		t.Fatalf("got %d unlock events, want 1", len(unlocked))
+	}
+	want := accountKey("user@example.com") + "," + ipKey("192.0.2.1")
+	if got := unlocked[0].Attributes["keys"]; got != want {
+		t.Errorf("unlock event has keys %q, want %q", got, want)
+	}
+
+	app.login(t, "user@example.com")
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTConfig holds everything we need to sign access tokens and hand out refresh tokens
+type JWTConfig struct {
+	Secret     []byte
+	Issuer     string
+	Audience   string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// authentication methods, as put in the amr claim. They are the values RFC 8176
+// registers, except for a link sent by email, which it has none for.
+const (
+	amrPassword = "pwd"
+	amrOTP      = "otp"
+	// amrHardwareKey is a passkey, and amrUser says it verified the user with a PIN or
+	// biometric as well
+	amrHardwareKey = "hwk"
+	amrUser        = "user"
+	amrEmail       = "email"
+)
+
+// Claims are the claims carried by every access token we sign. The subject is the
+// user's ID.
+type Claims struct {
+	Email       string   `json:"email"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions,omitempty"`
+	// AMR lists the authentication methods used at login, e.g. "pwd" and "otp"
+	AMR []string `json:"amr,omitempty"`
+	// SessionID lets the broker reject access tokens from sessions that were revoked
+	SessionID string `json:"sid,omitempty"`
+	// OrganizationID is the organization the user is acting in, and OrganizationRole
+	// their role there. Permissions include what that role grants.
+	OrganizationID   int    `json:"org_id,omitempty"`
+	OrganizationRole string `json:"org_role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// TokenPair is what we hand back to a client after a successful login or refresh.
+// RefreshToken is left out when only the access token changes, like when switching
+// organizations.
+type TokenPair struct {
+	AccessToken  string           `json:"access_token"`
+	TokenType    string           `json:"token_type"`
+	ExpiresIn    int              `json:"expires_in"`
+	RefreshToken string           `json:"refresh_token,omitempty"`
+	User         *data.User       `json:"user,omitempty"`
+	Roles        []string         `json:"roles"`
+	Organization *data.Membership `json:"organization,omitempty"`
+}
+
+func createJWTConfig() JWTConfig {
+	c := JWTConfig{
+		Secret:     []byte(os.Getenv("JWT_SECRET")),
+		Issuer:     "authentication-service",
+		Audience:   "broker-service",
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: 7 * 24 * time.Hour,
+	}
+
+	if ttl, err := strconv.Atoi(os.Getenv("ACCESS_TOKEN_TTL_SECONDS")); err == nil && ttl > 0 {
+		c.AccessTTL = time.Duration(ttl) * time.Second
+	}
+
+	if ttl, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_TTL_SECONDS")); err == nil && ttl > 0 {
+		c.RefreshTTL = time.Duration(ttl) * time.Second
+	}
+
+	return c
+}
+
+// newAccessToken signs a short lived HS256 access token for the given user, carrying
+// their roles and permissions, the session it belongs to and, if membership is set,
+// their active organization. amr lists the methods the user logged in with.
+func (app *Config) newAccessToken(user *data.User, sessionID int, roles, permissions []string, membership *data.Membership, amr []string) (string, error) {
+	if len(app.JWT.Secret) == 0 {
+		return "", errors.New("token signing key is not configured")
+	}
+
+	now := time.Now()
+	claims := Claims{
+		Email:       user.Email,
+		Roles:       roles,
+		Permissions: permissions,
+		AMR:         amr,
+		SessionID:   strconv.Itoa(sessionID),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(user.ID),
+			Issuer:    app.JWT.Issuer,
+			Audience:  jwt.ClaimStrings{app.JWT.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(app.JWT.AccessTTL)),
+		},
+	}
+
+	if membership != nil {
+		claims.OrganizationID = membership.OrganizationID
+		claims.OrganizationRole = membership.Role
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(app.JWT.Secret)
+}
+
+// issueTokens starts a new session for user, recording the device and address the
+// request came from, and mints an access token and a brand new refresh token for it.
+// The session starts out in the first organization the user joined, if any. amr lists
+// the methods the user logged in with, and is kept with the refresh token.
+func (app *Config) issueTokens(r *http.Request, user *data.User, amr []string) (*TokenPair, error) {
+	mfa := passedMFA(amr)
+
+	refresh, err := app.Models.Token.GenerateToken(user.ID, mfa, app.JWT.RefreshTTL)
+	if err != nil {
+		return nil, err
+	}
+	refresh.AMR = amr
+
+	memberships, err := app.Models.Organization.ForUser(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(memberships) > 0 {
+		refresh.OrganizationID = memberships[0].OrganizationID
+	}
+
+	refresh.SessionID, err = app.Models.Session.Insert(r.Context(), data.Session{
+		UserID:         user.ID,
+		UserAgent:      truncate(r.UserAgent(), maxUserAgentLength),
+		IP:             app.clientIP(r),
+		MFA:            mfa,
+		OrganizationID: refresh.OrganizationID,
+		ExpiresAt:      refresh.ExpiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.Models.Token.Insert(r.Context(), *refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.tokenPair(r.Context(), user, refresh)
+}
+
+// tokenPair signs an access token for user and bundles it with an already stored
+// refresh token
+func (app *Config) tokenPair(ctx context.Context, user *data.User, refresh *data.Token) (*TokenPair, error) {
+	tokens, err := app.accessToken(ctx, user, refresh.SessionID, refresh.OrganizationID, refresh.AMR)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens.RefreshToken = refresh.PlainText
+
+	return tokens, nil
+}
+
+// accessToken signs an access token for a session of user acting in organization
+// orgID, or in none if orgID is 0 or the user has left it since
+func (app *Config) accessToken(ctx context.Context, user *data.User, sessionID, orgID int, amr []string) (*TokenPair, error) {
+	// roles are read on every login and refresh, so changes to them take effect the
+	// next time the user's access token is renewed
+	roles, permissions, err := app.Models.Role.ForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var membership *data.Membership
+	if orgID != 0 {
+		membership, err = app.Models.Organization.Membership(ctx, orgID, user.ID)
+		if err != nil && !errors.Is(err, data.ErrNotMember) {
+			return nil, err
+		}
+	}
+
+	if membership != nil {
+		permissions = mergePermissions(permissions, membership.Permissions)
+	}
+
+	access, err := app.newAccessToken(user, sessionID, roles, permissions, membership, amr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(app.JWT.AccessTTL.Seconds()),
+		User:         user,
+		Roles:        roles,
+		Organization: membership,
+	}, nil
+}
+
+// mergePermissions adds the permissions in extra that aren't already in permissions
+func mergePermissions(permissions, extra []string) []string {
+	seen := make(map[string]bool, len(permissions))
+	for _, permission := range permissions {
+		seen[permission] = true
+	}
+
+	for _, permission := range extra {
+		if !seen[permission] {
+			seen[permission] = true
+			permissions = append(permissions, permission)
+		}
+	}
+
+	return permissions
+}
+
+// parseToken checks the signature, expiry, issuer and audience of a token we signed
+// and returns its claims
+func (app *Config) parseToken(tokenString, audience string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (any, error) {
+		return app.JWT.Secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(app.JWT.Issuer),
+		jwt.WithAudience(audience),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt == nil || claims.Subject == "" {
+		return nil, errors.New("token is missing required claims")
+	}
+
+	return &claims, nil
+}
+
+// signToken signs a token for user with a short lifetime and a specific audience. It
+// is used for the single purpose tokens we hand out, like email verification links.
+// amr, if set, lists the methods the user has logged in with so far.
+func (app *Config) signToken(user *data.User, audience string, ttl time.Duration, amr []string) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		Email: user.Email,
+		AMR:   amr,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(user.ID),
+			Issuer:    app.JWT.Issuer,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(app.JWT.Secret)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/totp"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	challengeTTL      = 5 * time.Minute
+	challengeAudience = "mfa-challenge"
+	totpIssuer        = "Go Microservices"
+	recoveryCodeCount = 10
+)
+
+// mfaChallenge is what Login sends back instead of tokens for users with two factor
+// authentication enabled
+type mfaChallenge struct {
+	MFARequired    bool   `json:"mfa_required"`
+	ChallengeToken string `json:"challenge_token"`
+	ExpiresIn      int    `json:"expires_in"`
+}
+
+func (app *Config) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := app.Models.User.GetOne(r.Context(), userIDFromContext(r.Context()))
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	encrypted, err := app.encrypt([]byte(secret))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	enrolled, err := app.Models.TwoFactor.Enroll(r.Context(), user.ID, encrypted)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !enrolled {
+		app.errorJSON(w, errors.New("two factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+
+	var out struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+	out.Secret = secret
+	// the URI is also what goes in the QR code authenticator apps scan
+	out.OTPAuthURI = totp.URI(secret, totpIssuer, user.Email)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Scan the code with your authenticator app, then confirm with a code from the app",
+		Data:    out,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID := userIDFromContext(r.Context())
+
+	tf, err := app.Models.TwoFactor.GetForUser(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("two factor enrollment has not been started"), http.StatusBadRequest)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if tf.Confirmed {
+		app.errorJSON(w, errors.New("two factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+
+	counter, ok, err := app.checkTOTP(tf, requestPayload.Code)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		app.errorJSON(w, errors.New("invalid code"), http.StatusBadRequest)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.Models.TwoFactor.Confirm(r.Context(), userID, counter, codes)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Two factor authentication enabled. Store these recovery codes somewhere safe; they won't be shown again",
+		Data:    codes,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID := userIDFromContext(r.Context())
+
+	tf, err := app.Models.TwoFactor.GetForUser(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("two factor authentication is not enabled"), http.StatusBadRequest)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(r.Context(), tf, requestPayload.Code, requestPayload.RecoveryCode)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		app.errorJSON(w, errors.New("invalid code"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.Models.TwoFactor.Delete(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Two factor authentication disabled",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// LoginTwoFactor is the second step of Login for users with two factor authentication.
+// It exchanges the challenge token from Login, plus a TOTP or recovery code, for tokens.
+func (app *Config) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	claims, err := app.parseToken(requestPayload.ChallengeToken, challengeAudience)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired challenge"), http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired challenge"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+		return
+	}
+
+	// guessing codes counts against the account just like guessing passwords
+	if !app.checkThrottle(w, r, user.Email) {
+		return
+	}
+
+	tf, err := app.Models.TwoFactor.GetForUser(r.Context(), user.ID)
+	if err != nil || !tf.Confirmed {
+		app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(r.Context(), tf, requestPayload.Code, requestPayload.RecoveryCode)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		app.loginFailed(w, r, user.Email, "wrong second factor")
+		return
+	}
+
+	// the account may have been suspended since the first step
+	if !app.accountActive(w, r, user) {
+		return
+	}
+
+	app.completeLogin(w, r, user, append(claims.AMR, amrOTP))
+}
+
+// verifySecondFactor checks either a TOTP code or a recovery code, whichever was
+// given. Both kinds of code can only be used once.
+func (app *Config) verifySecondFactor(ctx context.Context, tf *data.TwoFactor, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return app.Models.TwoFactor.UseRecoveryCode(ctx, tf.UserID, recoveryCode)
+	}
+
+	counter, ok, err := app.checkTOTP(tf, code)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return app.Models.TwoFactor.UseCounter(ctx, tf.UserID, counter)
+}
+
+// checkTOTP decrypts the user's secret and validates code against it at the current
+// time. Codes at or before the last one used are rejected.
+func (app *Config) checkTOTP(tf *data.TwoFactor, code string) (int64, bool, error) {
+	secret, err := app.decrypt(tf.Secret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	counter, ok := totp.Validate(string(secret), code, app.Clock())
+	if !ok || counter <= tf.LastCounter {
+		return 0, false, nil
+	}
+
+	return counter, true, nil
+}
+
+// generateRecoveryCodes returns n random recovery codes formatted like xxxxx-xxxxx
+func generateRecoveryCodes(n int) ([]string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, n)
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	return codes, nil
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/totp"
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Config.Clock the tests move by hand
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// enrolledUser creates a user, logs them in and turns on two factor authentication
+// for them. It returns their TOTP secret and recovery codes.
+func enrolledUser(t *testing.T, app *testApp, clock *fakeClock, email string) (string, []string) {
+	t.Helper()
+
+	app.createUser(t, email)
+	token := app.login(t, email).AccessToken
+
+	status, response := app.do(t, http.MethodPost, "/2fa/enroll", token, nil)
+	if status != http.StatusAccepted {
+		t.Fatalf("enroll got %d (%s)", status, response.Message)
+	}
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	decodeData(t, response, &enrollment)
+
+	code := totpCode(t, enrollment.Secret, clock.Now())
+	status, response = app.do(t, http.MethodPost, "/2fa/confirm", token, map[string]string{"code": code})
+	if status != http.StatusAccepted {
+		t.Fatalf("confirm got %d (%s)", status, response.Message)
+	}
+
+	var recoveryCodes []string
+	decodeData(t, response, &recoveryCodes)
+
+	return enrollment.Secret, recoveryCodes
+}
+
+// challenge logs a user with two factor authentication in and returns the challenge
+// token to exchange at /login/2fa
+func challenge(t *testing.T, app *testApp, email string) string {
+	t.Helper()
+
+	status, response := app.do(t, http.MethodPost, "/login", "", map[string]string{
+		"email":    email,
+		"password": testPassword,
+	})
+	if status != http.StatusAccepted {
+		t.Fatalf("login got %d (%s)", status, response.Message)
+	}
+
+	var c mfaChallenge
+	decodeData(t, response, &c)
+	if !c.MFARequired || c.ChallengeToken == "" {
+		t.Fatalf("got %+v, want a challenge", c)
+	}
+
+	return c.ChallengeToken
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	code, err := totp.Code(secret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code
+}
+
+func newTwoFactorApp(t *testing.T) (*testApp, *fakeClock) {
+	t.Helper()
+
+	app := newTestApp(t)
+	clock := &fakeClock{now: time.Now()}
+	app.Clock = clock.Now
+
+	return app, clock
+}
+
+// enrollment returns a config running on a fake clock and a user's enrollment with a
+// fresh secret, encrypted the way EnrollTwoFactor stores it
+func enrollment(t *testing.T) (*Config, *fakeClock, string, *data.TwoFactor) {
+	t.Helper()
+
+	clock := &fakeClock{now: time.Unix(1111111111, 0)}
+	app := &Config{
+		EncryptionKey: bytes.Repeat([]byte{7}, 32),
+		Clock:         clock.Now,
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := app.encrypt([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return app, clock, secret, &data.TwoFactor{UserID: 1, Secret: encrypted}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	tests := []struct {
+		name string
+		// offset is how far the user's device clock is from ours
+		offset time.Duration
+		// lastUsed is how many periods before the current one the last code used was,
+		// or 0 if none was
+		lastUsed int64
+		ok       bool
+	}{
+		{"current code", 0, 0, true},
+		{"device a period behind", -totp.Period, 0, true},
+		{"device a period ahead", totp.Period, 0, true},
+		{"device two periods behind", -2 * totp.Period, 0, false},
+		{"device two periods ahead", 2 * totp.Period, 0, false},
+		{"code after the one used", 0, 1, true},
+		{"code used already", -totp.Period, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, clock, secret, tf := enrollment(t)
+			if tt.lastUsed > 0 {
+				tf.LastCounter = totp.Counter(clock.Now()) - tt.lastUsed
+			}
+
+			code := totpCode(t, secret, clock.Now().Add(tt.offset))
+			counter, ok, err := app.checkTOTP(tf, code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.ok {
+				t.Fatalf("got %v, want %v", ok, tt.ok)
+			}
+			if ok && counter != totp.Counter(clock.Now().Add(tt.offset)) {
+				t.Errorf("got counter %d, want %d", counter, totp.Counter(clock.Now().Add(tt.offset)))
+			}
+		})
+	}
+
+	t.Run("code expires as the clock moves", func(t *testing.T) {
+		app, clock, secret, tf := enrollment(t)
+		code := totpCode(t, secret, clock.Now())
+
+		clock.Advance(totp.Period)
+		if _, ok, _ := app.checkTOTP(tf, code); !ok {
+			t.Error("code from the last period was refused")
+		}
+
+		clock.Advance(totp.Period)
+		if _, ok, _ := app.checkTOTP(tf, code); ok {
+			t.Error("code from two periods ago was accepted")
+		}
+	})
+
+	t.Run("without an encryption key", func(t *testing.T) {
+		app, clock, secret, tf := enrollment(t)
+		app.EncryptionKey = nil
+
+		if _, _, err := app.checkTOTP(tf, totpCode(t, secret, clock.Now())); err != errNoEncryptionKey {
+			t.Errorf("got %v, want %v", err, errNoEncryptionKey)
+		}
+	})
+}
+
+func TestEnrollTwoFactor(t *testing.T) {
+	app, clock := newTwoFactorApp(t)
+	user := app.createUser(t, "user@example.com")
+	token := app.login(t, "user@example.com").AccessToken
+
+	status, response := app.do(t, http.MethodPost, "/2fa/enroll", token, nil)
+	if status != http.StatusAccepted {
+		t.Fatalf("got %d (%s)", status, response.Message)
+	}
+
+	var enrollment struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+	decodeData(t, response, &enrollment)
+	if enrollment.OTPAuthURI != totp.URI(enrollment.Secret, totpIssuer, "user@example.com") {
+		t.Errorf("got URI %s", enrollment.OTPAuthURI)
+	}
+
+	// the secret is stored encrypted
+	tf, err := app.Models.TwoFactor.GetForUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tf.Secret) == enrollment.Secret {
+		t.Error("the secret was stored in plain text")
+	}
+	if tf.Confirmed {
+		t.Error("the enrollment was confirmed before a code was given")
+	}
+
+	// enrolling again before confirming starts over with a new secret
+	status, response = app.do(t, http.MethodPost, "/2fa/enroll", token, nil)
+	if status != http.StatusAccepted {
+		t.Fatalf("second enroll got %d (%s)", status, response.Message)
+	}
+	var second struct {
+		Secret string `json:"secret"`
+	}
+	decodeData(t, response, &second)
+
+	// so codes from the first secret no longer work
+	code := totpCode(t, enrollment.Secret, clock.Now())
+	if code != totpCode(t, second.Secret, clock.Now()) {
+		status, _ = app.do(t, http.MethodPost, "/2fa/confirm", token, map[string]string{"code": code})
+		if status != http.StatusBadRequest {
+			t.Errorf("confirm with the old secret got %d, want %d", status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestConfirmTwoFactor(t *testing.T) {
+	tests := []struct {
+		name string
+		// offset is how far the user's device clock is from ours
+		offset time.Duration
+		code   string
+		status int
+	}{
+		{"current code", 0, "", http.StatusAccepted},
+		{"device a period behind", -totp.Period, "", http.StatusAccepted},
+		{"device a period ahead", totp.Period, "", http.StatusAccepted},
+		{"device two periods behind", -2 * totp.Period, "", http.StatusBadRequest},
+		{"device two periods ahead", 2 * totp.Period, "", http.StatusBadRequest},
+		{"malformed code", 0, "12345", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, clock := newTwoFactorApp(t)
+			app.createUser(t, "user@example.com")
+			token := app.login(t, "user@example.com").AccessToken
+
+			_, response := app.do(t, http.MethodPost, "/2fa/enroll", token, nil)
+			var enrollment struct {
+				Secret string `json:"secret"`
+			}
+			decodeData(t, response, &enrollment)
+
+			code := tt.code
+			if code == "" {
+				code = totpCode(t, enrollment.Secret, clock.Now().Add(tt.offset))
+			}
+
+			status, response := app.do(t, http.MethodPost, "/2fa/confirm", token, map[string]string{"code": code})
+			if status != tt.status {
+				t.Fatalf("got %d (%s), want %d", status, response.Message, tt.status)
+			}
+			if status != http.StatusAccepted {
+				return
+			}
+
+			var recoveryCodes []string
+			decodeData(t, response, &recoveryCodes)
+			if len(recoveryCodes) != recoveryCodeCount {
+				t.Errorf("got %d recovery codes, want %d", len(recoveryCodes), recoveryCodeCount)
+			}
+
+			// once confirmed there is nothing left to confirm or enroll
+			clock.Advance(totp.Period)
+			code = totpCode(t, enrollment.Secret, clock.Now())
+			status, _ = app.do(t, http.MethodPost, "/2fa/confirm", token, map[string]string{"code": code})
+			if status != http.StatusConflict {
+				t.Errorf("confirming again got %d, want %d", status, http.StatusConflict)
+			}
+			status, _ = app.do(t, http.MethodPost, "/2fa/enroll", token, nil)
+			if status != http.StatusConflict {
+				t.Errorf("enrolling again got %d, want %d", status, http.StatusConflict)
+			}
+		})
+	}
+
+	t.Run("without enrolling", func(t *testing.T) {
+		app, _ := newTwoFactorApp(t)
+		app.createUser(t, "user@example.com")
+		token := app.login(t, "user@example.com").AccessToken
+
+		status, _ := app.do(t, http.MethodPost, "/2fa/confirm", token, map[string]string{"code": "123456"})
+		if status != http.StatusBadRequest {
+			t.Errorf("got %d, want %d", status, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	tests := []struct {
+		name string
+		// advance is how far the clock moves between confirming and logging in
+		advance time.Duration
+		// code picks the second factor to send, given the secret, the recovery codes
+		// and the time
+		code   func(t *testing.T, secret string, recoveryCodes []string, now time.Time) map[string]string
+		status int
+	}{
+		{
+			name:    "next code",
+			advance: totp.Period,
+			code: func(t *testing.T, secret string, _ []string, now time.Time) map[string]string {
+				return map[string]string{"code": totpCode(t, secret, now)}
+			},
+			status: http.StatusAccepted,
+		},
+		{
+			// the code used to confirm is still within the skew window, but was used
+			name:    "code used to confirm",
+			advance: 0,
+			code: func(t *testing.T, secret string, _ []string, now time.Time) map[string]string {
+				return map[string]string{"code": totpCode(t, secret, now)}
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "code from before the one used",
+			advance: totp.Period,
+			code: func(t *testing.T, secret string, _ []string, now time.Time) map[string]string {
+				return map[string]string{"code": totpCode(t, secret, now.Add(-2*totp.Period))}
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "expired code",
+			advance: 10 * totp.Period,
+			code: func(t *testing.T, secret string, _ []string, now time.Time) map[string]string {
+				return map[string]string{"code": totpCode(t, secret, now.Add(-2*totp.Period))}
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "recovery code",
+			code: func(t *testing.T, _ string, recoveryCodes []string, _ time.Time) map[string]string {
+				return map[string]string{"recovery_code": recoveryCodes[0]}
+			},
+			status: http.StatusAccepted,
+		},
+		{
+			name: "unknown recovery code",
+			code: func(t *testing.T, _ string, _ []string, _ time.Time) map[string]string {
+				return map[string]string{"recovery_code": "aaaaa-bbbbb"}
+			},
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, clock := newTwoFactorApp(t)
+			secret, recoveryCodes := enrolledUser(t, app, clock, "user@example.com")
+			clock.Advance(tt.advance)
+
+			body := tt.code(t, secret, recoveryCodes, clock.Now())
+			body["challenge_token"] = challenge(t, app, "user@example.com")
+
+			status, response := app.do(t, http.MethodPost, "/login/2fa", "", body)
+			if status != tt.status {
+				t.Fatalf("got %d (%s), want %d", status, response.Message, tt.status)
+			}
+			if status != http.StatusAccepted {
+				return
+			}
+
+			var tokens TokenPair
+			decodeData(t, response, &tokens)
+			if tokens.AccessToken == "" {
+				t.Fatalf("got %+v, want tokens", tokens)
+			}
+
+			// the same code can't log in twice
+			body["challenge_token"] = challenge(t, app, "user@example.com")
+			status, _ = app.do(t, http.MethodPost, "/login/2fa", "", body)
+			if status != http.StatusUnauthorized {
+				t.Errorf("replayed code got %d, want %d", status, http.StatusUnauthorized)
+			}
+		})
+	}
+
+	t.Run("invalid challenge", func(t *testing.T) {
+		app, clock := newTwoFactorApp(t)
+		secret, _ := enrolledUser(t, app, clock, "user@example.com")
+		clock.Advance(totp.Period)
+
+		// an access token is signed with the same key, but isn't a challenge
+		app.createUser(t, "other@example.com")
+		access := app.login(t, "other@example.com").AccessToken
+
+		for _, token := range []string{"not a token", access} {
+			status, _ := app.do(t, http.MethodPost, "/login/2fa", "", map[string]string{
+				"challenge_token": token,
+				"code":            totpCode(t, secret, clock.Now()),
+			})
+			if status != http.StatusUnauthorized {
+				t.Errorf("got %d, want %d", status, http.StatusUnauthorized)
+			}
+		}
+	})
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' || strings.ToLower(code) != code {
+			t.Errorf("code %q isn't formatted like xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q was generated twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestPassedMFA(t *testing.T) {
+	tests := []struct {
+		amr  []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{amrPassword}, false},
+		{[]string{amrEmail}, false},
+		{[]string{amrHardwareKey}, false},
+		{[]string{amrPassword, amrOTP}, true},
+		{[]string{amrEmail, amrOTP}, true},
+		{[]string{amrHardwareKey, amrOTP}, true},
+		{[]string{amrHardwareKey, amrUser}, true},
+		{[]string{amrUser}, false},
+	}
+
+	for _, tt := range tests {
+		if got := passedMFA(tt.amr); got != tt.want {
+			t.Errorf("passedMFA(%v) = %v, want %v", tt.amr, got, tt.want)
+		}
+	}
+}
+
+func TestLoginMethods(t *testing.T) {
+	// amrOf returns the methods in the access token of a successful login response
+	amrOf := func(t *testing.T, app *testApp, response jsonResponse) (TokenPair, string) {
+		t.Helper()
+
+		var tokens TokenPair
+		decodeData(t, response, &tokens)
+		claims, err := app.parseToken(tokens.AccessToken, app.JWT.Audience)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return tokens, strings.Join(claims.AMR, " ")
+	}
+
+	// passwordLogin and magicLogin start a login the two ways a first factor can be
+	// given, returning the response
+	passwordLogin := func(t *testing.T, app *testApp) (int, jsonResponse) {
+		return app.do(t, http.MethodPost, "/login", "", map[string]string{"email": "user@example.com", "password": testPassword})
+	}
+	magicLogin := func(t *testing.T, app *testApp) (int, jsonResponse) {
+		token := app.magicLinkToken(t, "user@example.com")
+		return app.do(t, http.MethodPost, "/login/magic", "", map[string]string{"token": token})
+	}
+
+	tests := []struct {
+		name      string
+		login     func(*testing.T, *testApp) (int, jsonResponse)
+		twoFactor bool
+		want      string
+	}{
+		{"password", passwordLogin, false, "pwd"},
+		{"password and code", passwordLogin, true, "pwd otp"},
+		{"magic link", magicLogin, false, "email"},
+		{"magic link and code", magicLogin, true, "email otp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.createUser(t, "user@example.com")
+
+			var secret string
+			if tt.twoFactor {
+				secret = app.enrollTOTP(t, "user@example.com")
+			}
+
+			status, response := tt.login(t, app)
+			if status != http.StatusAccepted {
+				t.Fatalf("login got %d %q", status, response.Message)
+			}
+
+			if tt.twoFactor {
+				var c mfaChallenge
+				decodeData(t, response, &c)
+				status, response = app.do(t, http.MethodPost, "/login/2fa", "", map[string]string{
+					"challenge_token": c.ChallengeToken,
+					"code":            totpCode(t, secret, app.Clock()),
+				})
+				if status != http.StatusAccepted {
+					t.Fatalf("second factor got %d %q", status, response.Message)
+				}
+			}
+
+			tokens, amr := amrOf(t, app, response)
+			if amr != tt.want {
+				t.Errorf("logged in with %q, want %q", amr, tt.want)
+			}
+
+			// refreshed tokens still say how the user logged in
+			status, response = app.do(t, http.MethodPost, "/refresh", "", map[string]string{"refresh_token": tokens.RefreshToken})
+			if status != http.StatusAccepted {
+				t.Fatalf("refresh got %d %q", status, response.Message)
+			}
+			if _, amr = amrOf(t, app, response); amr != tt.want {
+				t.Errorf("refreshed with %q, want %q", amr, tt.want)
+			}
+		})
+	}
+}
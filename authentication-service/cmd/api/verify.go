@@ -0,0 +1,162 @@
+package main
+
+import (
+	"authentication/data"
+	"authentication/event"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	verificationTTL      = 24 * time.Hour
+	verificationAudience = "email-verification"
+
+	// errAccountInactive is the error code Login sends back for unverified accounts
+	errAccountInactive = "account_inactive"
+)
+
+func verificationKey(email string) string {
+	return "verify:" + data.FoldEmail(email)
+}
+
+// parseVerificationToken checks a verification token and returns its claims
+func (app *Config) parseVerificationToken(tokenString string) (*Claims, error) {
+	claims, err := app.parseToken(tokenString, verificationAudience)
+	if err != nil {
+		return nil, errors.New("invalid or expired verification link")
+	}
+
+	return claims, nil
+}
+
+// sendVerificationEmail mails the user a link that activates their account
+func (app *Config) sendVerificationEmail(user *data.User) error {
+	// the token carries the email address, so changing it invalidates older links
+	token, err := app.signToken(user, verificationAudience, verificationTTL, nil)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify?token=%s", app.AppURL, url.QueryEscape(token))
+	message := fmt.Sprintf("Thanks for signing up! Please confirm your email address "+
+		"by following this link within the next 24 hours: %s", link)
+
+	return app.sendMail(user.Email, "Verify your email address", message)
+}
+
+func (app *Config) Verify(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	claims, err := app.parseVerificationToken(requestPayload.Token)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired verification link"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), id)
+	if err != nil || user.Email != claims.Email {
+		app.errorJSON(w, errors.New("invalid or expired verification link"), http.StatusBadRequest)
+		return
+	}
+
+	// verifying again is harmless, and doesn't bring back a suspended account
+	if user.Status == data.StatusPendingVerification {
+		_, err = app.changeStatus(r, user, data.StatusActive, "email address verified")
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		app.audit(r, event.Event{
+			Name:   eventEmailVerified,
+			Data:   fmt.Sprintf("user %s verified their email address", user.Email),
+			UserID: user.ID,
+			Email:  user.Email,
+		})
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Verified %s", user.Email),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(requestPayload.Email) == "" {
+		app.errorJSON(w, errors.New("email is required"), http.StatusBadRequest)
+		return
+	}
+
+	if !app.throttleRequest(w, r, verificationKey(requestPayload.Email)) {
+		return
+	}
+
+	// like ForgotPassword, the account is looked up and the email sent after we
+	// respond, so neither the response nor its timing reveals whether the address is
+	// registered and unverified
+	email := requestPayload.Email
+	app.background(func() {
+		app.resendVerificationEmail(context.Background(), email)
+	})
+
+	app.writeJSON(w, http.StatusAccepted, jsonResponse{
+		Error:   false,
+		Message: "If that address is registered and unverified, a verification email has been sent",
+	})
+}
+
+// resendVerificationEmail sends a new verification link to the account registered
+// with email, if it is still waiting for one. Failures can only be logged, since the
+// caller already has its answer.
+func (app *Config) resendVerificationEmail(ctx context.Context, email string) {
+	user, err := app.Models.User.GetByEmail(ctx, email)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("Error looking up verification address:", err)
+		}
+		return
+	}
+
+	if user.Status != data.StatusPendingVerification {
+		return
+	}
+
+	err = app.sendVerificationEmail(user)
+	if err != nil {
+		log.Println("Error sending verification email:", err)
+	}
+}
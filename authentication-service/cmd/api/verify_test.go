@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// registerPending signs up an account that still has to verify its address
+func (app *testApp) registerPending(t *testing.T, email string) {
+	t.Helper()
+
+	status, response := app.do(t, http.MethodPost, "/register", "", map[string]string{
+		"email":    email,
+		"password": testPassword,
+	})
+	if status != http.StatusAccepted {
+		t.Fatalf("registering %s: got %d %q", email, status, response.Message)
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	app := newTestApp(t)
+	app.registerPending(t, "pending@example.com")
+	app.createUser(t, "verified@example.com")
+
+	var responses []jsonResponse
+	for _, email := range []string{"Pending@Example.com", "verified@example.com", "nobody@example.com"} {
+		status, response := app.do(t, http.MethodPost, "/verify/resend", "", map[string]string{"email": email})
+		if status != http.StatusAccepted {
+			t.Fatalf("%s: got status %d, want %d", email, status, http.StatusAccepted)
+		}
+		responses = append(responses, response)
+	}
+	app.tasks.Wait()
+
+	if responses[0] != responses[1] || responses[0] != responses[2] {
+		t.Errorf("addresses got different responses: %+v", responses)
+	}
+	if n := len(app.mail.to("pending@example.com")); n != 2 {
+		t.Errorf("got %d verification messages, want the one from signing up and the resent one", n)
+	}
+	if n := len(app.mail.to("verified@example.com")); n != 0 {
+		t.Errorf("sent %d messages to a verified address", n)
+	}
+}
+
+func TestResendVerificationMailFailure(t *testing.T) {
+	app := newTestApp(t)
+	app.registerPending(t, "pending@example.com")
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+	app.MailURL = failing.URL
+
+	status, response := app.do(t, http.MethodPost, "/verify/resend", "", map[string]string{"email": "pending@example.com"})
+	app.tasks.Wait()
+
+	if status != http.StatusAccepted || response.Error {
+		t.Errorf("got status %d and %+v, want the usual %d", status, response, http.StatusAccepted)
+	}
+}
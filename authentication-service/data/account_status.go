@@ -0,0 +1,204 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"userevents"
+)
+
+// the states an account moves through. Only active accounts can log in.
+const (
+	// StatusPendingVerification is a new account whose email address hasn't been verified
+	StatusPendingVerification = "pending_verification"
+	// StatusActive is an account in good standing
+	StatusActive = "active"
+	// StatusSuspended is an account an admin has shut off until they restore it
+	StatusSuspended = "suspended"
+	// StatusLocked is an account the service shut off because it looks compromised
+	StatusLocked = "locked"
+	// StatusDeleted is an erased account; nothing brings it back
+	StatusDeleted = "deleted"
+)
+
+var (
+	// ErrInvalidTransition is returned when an account can't move from its current
+	// status to the one asked for
+	ErrInvalidTransition = errors.New("invalid account status change")
+	// ErrUnknownStatus is returned for a status that isn't one of the constants above
+	ErrUnknownStatus = errors.New("unknown account status")
+)
+
+// transitions lists the statuses each status can move to
+var transitions = map[string][]string{
+	StatusPendingVerification: {StatusActive, StatusSuspended, StatusDeleted},
+	StatusActive:              {StatusSuspended, StatusLocked, StatusDeleted},
+	StatusSuspended:           {StatusActive, StatusDeleted},
+	StatusLocked:              {StatusActive, StatusSuspended, StatusDeleted},
+	StatusDeleted:             {},
+}
+
+// ValidStatus reports whether status is one of the account statuses
+func ValidStatus(status string) bool {
+	_, ok := transitions[status]
+	return ok
+}
+
+// CanTransition reports whether an account can move from one status to another
+func CanTransition(from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkTransition returns ErrInvalidTransition, with the statuses involved, when an
+// account can't move from one status to another
+func checkTransition(from, to string) error {
+	if !CanTransition(from, to) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+	}
+
+	return nil
+}
+
+// initialStatus is the status a new user starts in: the one they were given or, for
+// callers that only set Active, active or pending verification
+func initialStatus(user User) (string, error) {
+	if user.Status == "" {
+		if user.Active == 1 {
+			return StatusActive, nil
+		}
+		return StatusPendingVerification, nil
+	}
+
+	if !ValidStatus(user.Status) {
+		return "", fmt.Errorf("%w: %s", ErrUnknownStatus, user.Status)
+	}
+
+	return user.Status, nil
+}
+
+// activeFlag is the user_active value that goes with a status
+func activeFlag(status string) int {
+	if status == StatusActive {
+		return 1
+	}
+	return 0
+}
+
+// StatusChange is one move of an account from one status to another
+type StatusChange struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"user_id"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+	// ActorID is the user who made the change, or 0 when the service made it
+	ActorID   int       `json:"actor_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Transition moves a user to a new status and records why, along with a user.updated
+// event, in one transaction. The user's row is locked while the move is checked, so
+// two admins can't race each other into a transition the state machine doesn't allow.
+func (u *User) Transition(ctx context.Context, userID int, to, reason string, actorID int) (*StatusChange, error) {
+	ctx, cancel := queryContext(ctx, "User.Transition")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	change := StatusChange{
+		UserID:    userID,
+		To:        to,
+		Reason:    reason,
+		ActorID:   actorID,
+		CreatedAt: time.Now(),
+	}
+
+	before, err := selectUserForUpdate(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	change.From = before.Status
+
+	if err = checkTransition(change.From, to); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `update users set status = $1, user_active = $2, updated_at = $3 where id = $4`,
+		to, activeFlag(to), change.CreatedAt, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `insert into account_status_changes (user_id, from_status, to_status, reason, actor_id, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt, userID, change.From, to, reason, nullIfZero(actorID), change.CreatedAt).Scan(&change.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	after := *before
+	after.Status = to
+	e, _ := updatedEvent(*before, after)
+	err = addEvent(ctx, tx, userID, userevents.TypeUpdated, e)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &change, nil
+}
+
+// StatusHistory returns every status change of a user, oldest first
+func (u *User) StatusHistory(ctx context.Context, userID int) ([]*StatusChange, error) {
+	ctx, cancel := queryContext(ctx, "User.StatusHistory")
+	defer cancel()
+
+	query := `select id, user_id, from_status, to_status, reason, actor_id, created_at
+	from account_status_changes
+	where user_id = $1
+	order by created_at, id`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*StatusChange{}
+	for rows.Next() {
+		var change StatusChange
+		var actorID sql.NullInt64
+		err := rows.Scan(
+			&change.ID,
+			&change.UserID,
+			&change.From,
+			&change.To,
+			&change.Reason,
+			&actorID,
+			&change.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		change.ActorID = int(actorID.Int64)
+		changes = append(changes, &change)
+	}
+
+	return changes, rows.Err()
+}
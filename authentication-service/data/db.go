@@ -0,0 +1,144 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DefaultQueryTimeout is how long a model method may spend in the database when the
+// context it is given has no deadline of its own
+const DefaultQueryTimeout = 3 * time.Second
+
+// queryTimeout is the deadline model methods use when their context has none
+var queryTimeout = DefaultQueryTimeout
+
+// SetQueryTimeout changes the default deadline of model methods. A method called with
+// a context that already has a deadline keeps that one, so callers can give a single
+// call more or less time than this.
+func SetQueryTimeout(timeout time.Duration) {
+	queryTimeout = timeout
+}
+
+// QueryObserver is told about every query a model method runs: the method, as in
+// "User.GetByEmail", how long the query took and the error it failed with, if any.
+// It is called on the goroutine running the query, so it must be quick.
+type QueryObserver func(method string, duration time.Duration, err error)
+
+// queryObserver is called for every query; it is nil until SetQueryObserver is called
+var queryObserver QueryObserver
+
+// SetQueryObserver sets the function told about every query, for metrics or logging
+func SetQueryObserver(observer QueryObserver) {
+	queryObserver = observer
+}
+
+// methodKey is the context key queryContext stores the calling model method under
+type methodKey struct{}
+
+// queryContext is how every model method starts: it derives the context its queries
+// run in from the caller's, adding the default deadline if the caller set none, and
+// labels it with method, the model method's name like "User.GetByEmail", so queries
+// can be observed per method.
+func queryContext(ctx context.Context, method string) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(ctx, methodKey{}, method)
+
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, queryTimeout)
+}
+
+// observe reports a query that started at start to the observer
+func observe(ctx context.Context, start time.Time, err error) {
+	if queryObserver == nil {
+		return
+	}
+
+	method, _ := ctx.Value(methodKey{}).(string)
+	if method == "" {
+		method = "unknown"
+	}
+
+	queryObserver(method, time.Since(start), err)
+}
+
+// database is the connection pool the models use, with every query observed. The pgx
+// driver keeps a cache of prepared statements on each connection, so a query is only
+// parsed and planned by Postgres once per connection without any help from here.
+type database struct {
+	pool *sql.DB
+}
+
+func newDatabase(pool *sql.DB) *database {
+	return &database{pool: pool}
+}
+
+func (d *database) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	start := time.Now()
+	result, err := d.pool.ExecContext(ctx, query, args...)
+	observe(ctx, start, err)
+	return result, err
+}
+
+func (d *database) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := d.pool.QueryContext(ctx, query, args...)
+	observe(ctx, start, err)
+	return rows, err
+}
+
+func (d *database) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	start := time.Now()
+	row := d.pool.QueryRowContext(ctx, query, args...)
+	observe(ctx, start, row.Err())
+	return row
+}
+
+// BeginTx starts a transaction whose queries are observed too
+func (d *database) BeginTx(ctx context.Context, opts *sql.TxOptions) (*transaction, error) {
+	start := time.Now()
+
+	tx, err := d.pool.BeginTx(ctx, opts)
+	observe(ctx, start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transaction{tx: tx}, nil
+}
+
+// transaction is a transaction on the database, with the same query methods
+type transaction struct {
+	tx *sql.Tx
+}
+
+func (t *transaction) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	start := time.Now()
+	result, err := t.tx.ExecContext(ctx, query, args...)
+	observe(ctx, start, err)
+	return result, err
+}
+
+func (t *transaction) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := t.tx.QueryContext(ctx, query, args...)
+	observe(ctx, start, err)
+	return rows, err
+}
+
+func (t *transaction) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	start := time.Now()
+	row := t.tx.QueryRowContext(ctx, query, args...)
+	observe(ctx, start, row.Err())
+	return row
+}
+
+func (t *transaction) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *transaction) Rollback() error {
+	return t.tx.Rollback()
+}
@@ -0,0 +1,320 @@
+package data
+
+import (
+	"authentication/scim"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrGroupNotFound is returned when a group doesn't exist
+	ErrGroupNotFound = errors.New("group not found")
+	// ErrDuplicateGroup is returned when a group is saved with a display name or
+	// external id that another group already has
+	ErrDuplicateGroup = errors.New("group display name or external id already taken")
+)
+
+// groupColumns maps the SCIM attributes groups can be filtered on to their columns
+var groupColumns = map[string]scim.Column{
+	"id":                {Expr: "g.id", Type: scim.ColumnInteger},
+	"displayname":       {Expr: "g.display_name"},
+	"externalid":        {Expr: "g.external_id", CaseExact: true},
+	"meta.created":      {Expr: "g.created_at", Type: scim.ColumnDateTime},
+	"meta.lastmodified": {Expr: "g.updated_at", Type: scim.ColumnDateTime},
+}
+
+// Group is the structure which holds one group of users from the database. Groups are
+// managed by an identity provider over SCIM; ExternalID is the provider's id for it.
+type Group struct {
+	ID          int           `json:"id"`
+	DisplayName string        `json:"display_name"`
+	ExternalID  string        `json:"external_id,omitempty"`
+	Members     []GroupMember `json:"members"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
+
+// GroupMember is one user in a group
+type GroupMember struct {
+	UserID int    `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// Search returns one page of the groups matching filter, which may be nil, ordered by
+// ID, along with how many match in all. Members are only loaded when withMembers is
+// set, as large groups make for large pages.
+func (g *Group) Search(ctx context.Context, filter *scim.Filter, offset, limit int, withMembers bool) ([]*Group, int, error) {
+	ctx, cancel := queryContext(ctx, "Group.Search")
+	defer cancel()
+
+	where := ""
+	var args []any
+	if filter != nil {
+		clause, filterArgs, err := filter.SQL(groupColumns, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		where = " where " + clause
+		args = filterArgs
+	}
+
+	var total int
+	err := db.QueryRowContext(ctx, "select count(*) from groups g"+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `select g.id, g.display_name, coalesce(g.external_id, ''), g.created_at, g.updated_at
+	from groups g` + where + fmt.Sprintf(" order by g.id limit $%d offset $%d", len(args)+1, len(args)+2)
+
+	rows, err := db.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	groups := []*Group{}
+	for rows.Next() {
+		var group Group
+		err := rows.Scan(
+			&group.ID,
+			&group.DisplayName,
+			&group.ExternalID,
+			&group.CreatedAt,
+			&group.UpdatedAt,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		groups = append(groups, &group)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if withMembers {
+		for _, group := range groups {
+			group.Members, err = groupMembers(ctx, group.ID)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	return groups, total, nil
+}
+
+// GetOne returns one group by ID, with its members
+func (g *Group) GetOne(ctx context.Context, id int) (*Group, error) {
+	ctx, cancel := queryContext(ctx, "Group.GetOne")
+	defer cancel()
+
+	query := `select id, display_name, coalesce(external_id, ''), created_at, updated_at from groups where id = $1`
+
+	var group Group
+	err := db.QueryRowContext(ctx, query, id).Scan(
+		&group.ID,
+		&group.DisplayName,
+		&group.ExternalID,
+		&group.CreatedAt,
+		&group.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrGroupNotFound
+		}
+		return nil, err
+	}
+
+	group.Members, err = groupMembers(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// Insert creates a group with its members and returns its ID
+func (g *Group) Insert(ctx context.Context, group Group) (int, error) {
+	ctx, cancel := queryContext(ctx, "Group.Insert")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	stmt := `insert into groups (display_name, external_id, created_at, updated_at)
+		values ($1, nullif($2, ''), $3, $3) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt, group.DisplayName, group.ExternalID, time.Now()).Scan(&id)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, ErrDuplicateGroup
+		}
+		return 0, err
+	}
+
+	err = setGroupMembers(ctx, tx, id, group.Members)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Update saves a group's display name and external id and replaces its members with
+// group.Members
+func (g *Group) Update(ctx context.Context, group Group) error {
+	ctx, cancel := queryContext(ctx, "Group.Update")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update groups set display_name = $1, external_id = nullif($2, ''), updated_at = $3 where id = $4`
+
+	result, err := tx.ExecContext(ctx, stmt, group.DisplayName, group.ExternalID, time.Now(), group.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrDuplicateGroup
+		}
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrGroupNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from group_members where group_id = $1`, group.ID)
+	if err != nil {
+		return err
+	}
+
+	err = setGroupMembers(ctx, tx, group.ID, group.Members)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete deletes a group; its members stay
+func (g *Group) Delete(ctx context.Context, id int) error {
+	ctx, cancel := queryContext(ctx, "Group.Delete")
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from groups where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrGroupNotFound
+	}
+
+	return nil
+}
+
+// ForUser returns the groups a user belongs to, without their members
+func (g *Group) ForUser(ctx context.Context, userID int) ([]*Group, error) {
+	ctx, cancel := queryContext(ctx, "Group.ForUser")
+	defer cancel()
+
+	query := `select g.id, g.display_name, coalesce(g.external_id, ''), g.created_at, g.updated_at
+	from group_members m
+	join groups g on g.id = m.group_id
+	where m.user_id = $1
+	order by g.id`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []*Group{}
+	for rows.Next() {
+		var group Group
+		err := rows.Scan(
+			&group.ID,
+			&group.DisplayName,
+			&group.ExternalID,
+			&group.CreatedAt,
+			&group.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		groups = append(groups, &group)
+	}
+
+	return groups, rows.Err()
+}
+
+// groupMembers returns the members of a group, ordered by user ID
+func groupMembers(ctx context.Context, groupID int) ([]GroupMember, error) {
+	query := `select u.id, u.email
+	from group_members m
+	join users u on u.id = m.user_id
+	where m.group_id = $1
+	order by u.id`
+
+	rows, err := db.QueryContext(ctx, query, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []GroupMember{}
+	for rows.Next() {
+		var member GroupMember
+		err := rows.Scan(&member.UserID, &member.Email)
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// setGroupMembers adds members to a group as part of ex. Members who are already in
+// the group or whose user doesn't exist are skipped.
+func setGroupMembers(ctx context.Context, ex execer, groupID int, members []GroupMember) error {
+	stmt := `insert into group_members (group_id, user_id, created_at)
+		select $1, id, $3 from users where id = $2
+		on conflict do nothing`
+
+	for _, member := range members {
+		_, err := ex.ExecContext(ctx, stmt, groupID, member.UserID, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ThrottlePolicy decides how long a key is blocked after failed logins. The first
+// FreeAttempts failures cost nothing; after that each failure doubles the wait,
+// starting at BaseDelay and capped at MaxDelay. Once a key reaches MaxFailures it is
+// locked out for LockoutDuration. Failures older than Window are forgotten.
+type ThrottlePolicy struct {
+	FreeAttempts    int
+	MaxFailures     int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+// LoginThrottle is the structure which holds failed login attempts for one key. A key
+// is an account ("email:...") or a source address ("ip:...").
+type LoginThrottle struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LockedUntil   time.Time `json:"locked_until"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	// Locked is true when the last failure pushed the key into a full lockout
+	Locked bool `json:"locked"`
+}
+
+// fail counts a failure at now against throttle, and works out how long its key is
+// blocked for
+func (policy ThrottlePolicy) fail(throttle *LoginThrottle, now time.Time) {
+	if now.Sub(throttle.LastFailureAt) > policy.Window {
+		throttle.Failures = 0
+	}
+
+	throttle.Failures++
+	throttle.LastFailureAt = now
+	throttle.LockedUntil = time.Time{}
+	throttle.Locked = false
+
+	switch {
+	case throttle.Failures >= policy.MaxFailures:
+		throttle.LockedUntil = now.Add(policy.LockoutDuration)
+		throttle.Locked = throttle.Failures == policy.MaxFailures
+	case throttle.Failures > policy.FreeAttempts:
+		delay := policy.BaseDelay << (throttle.Failures - policy.FreeAttempts - 1)
+		if delay <= 0 || delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+		throttle.LockedUntil = now.Add(delay)
+	}
+}
+
+// BlockedUntil returns the latest time any of keys is blocked until. The zero time
+// means none of them are blocked.
+func (l *LoginThrottle) BlockedUntil(ctx context.Context, keys ...string) (time.Time, error) {
+	ctx, cancel := queryContext(ctx, "LoginThrottle.BlockedUntil")
+	defer cancel()
+
+	var until time.Time
+	for _, key := range keys {
+		var lockedUntil sql.NullTime
+		err := db.QueryRowContext(ctx, `select locked_until from login_throttles where key = $1`, key).Scan(&lockedUntil)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return time.Time{}, err
+		}
+
+		if lockedUntil.Valid && lockedUntil.Time.After(until) {
+			until = lockedUntil.Time
+		}
+	}
+
+	return until, nil
+}
+
+// RecordFailure counts a failed login against key and works out how long the key is
+// now blocked for under policy
+func (l *LoginThrottle) RecordFailure(ctx context.Context, key string, policy ThrottlePolicy) (*LoginThrottle, error) {
+	ctx, cancel := queryContext(ctx, "LoginThrottle.RecordFailure")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	_, err = tx.ExecContext(ctx, `insert into login_throttles (key, failures, last_failure_at)
+		values ($1, 0, $2) on conflict (key) do nothing`, key, now)
+	if err != nil {
+		return nil, err
+	}
+
+	throttle := LoginThrottle{Key: key}
+	var lockedUntil sql.NullTime
+	err = tx.QueryRowContext(ctx, `select failures, locked_until, last_failure_at from login_throttles
+		where key = $1 for update`, key).Scan(&throttle.Failures, &lockedUntil, &throttle.LastFailureAt)
+	if err != nil {
+		return nil, err
+	}
+
+	policy.fail(&throttle, now)
+
+	var newLockedUntil any
+	if !throttle.LockedUntil.IsZero() {
+		newLockedUntil = throttle.LockedUntil
+	}
+
+	_, err = tx.ExecContext(ctx, `update login_throttles set failures = $1, locked_until = $2, last_failure_at = $3
+		where key = $4`, throttle.Failures, newLockedUntil, throttle.LastFailureAt, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &throttle, nil
+}
+
+// Reset forgets all failed attempts for key. It is called after a successful login,
+// and by admins to unlock an account.
+func (l *LoginThrottle) Reset(ctx context.Context, key string) error {
+	ctx, cancel := queryContext(ctx, "LoginThrottle.Reset")
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `delete from login_throttles where key = $1`, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
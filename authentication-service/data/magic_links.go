@@ -0,0 +1,87 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// MagicLink is the structure which holds one passwordless login token. Like password
+// reset tokens, only the hash is kept in the database and each token can be used once.
+type MagicLink struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	PlainText string    `json:"-"`
+	Hash      []byte    `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// New creates and stores a login token for a user, valid for ttl. Links sent to the
+// user earlier stop working, so only the newest one can be used.
+func (m *MagicLink) New(ctx context.Context, userID int, ttl time.Duration) (*MagicLink, error) {
+	ctx, cancel := queryContext(ctx, "MagicLink.New")
+	defer cancel()
+
+	plainText, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	link := MagicLink{
+		UserID:    userID,
+		PlainText: plainText,
+		Hash:      hashToken(plainText),
+		ExpiresAt: time.Now().Add(ttl),
+		CreatedAt: time.Now(),
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `update magic_links set used_at = $1
+		where user_id = $2 and used_at is null`, time.Now(), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `insert into magic_links (user_id, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt, link.UserID, link.Hash, link.ExpiresAt, link.CreatedAt).Scan(&link.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &link, nil
+}
+
+// Consume marks a login token as used and returns the ID of the user it belongs to.
+// It returns ErrInvalidToken if the token is unknown, expired or spent.
+func (m *MagicLink) Consume(ctx context.Context, plainText string) (int, error) {
+	ctx, cancel := queryContext(ctx, "MagicLink.Consume")
+	defer cancel()
+
+	stmt := `update magic_links set used_at = $1
+		where token_hash = $2 and used_at is null and expires_at > $1
+		returning user_id`
+
+	var userID int
+	err := db.QueryRowContext(ctx, stmt, time.Now(), hashToken(plainText)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrInvalidToken
+		}
+		return 0, err
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"context"
+	"crypto/subtle"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryAPIKeyRepository keeps API keys in memory, for tests. Service accounts live in
+// Postgres, so the names keys are reported with come from AddServiceAccount. There is
+// no permissions table either, so scopes aren't checked.
+type MemoryAPIKeyRepository struct {
+	mu       sync.Mutex
+	keys     map[int]APIKey
+	accounts map[int]string
+	nextID   int
+	// Now returns the current time; it defaults to time.Now
+	Now func() time.Time
+}
+
+// NewMemoryAPIKeyRepository returns an empty in-memory API key store
+func NewMemoryAPIKeyRepository() *MemoryAPIKeyRepository {
+	return &MemoryAPIKeyRepository{
+		keys:     make(map[int]APIKey),
+		accounts: make(map[int]string),
+		nextID:   1,
+		Now:      time.Now,
+	}
+}
+
+// AddServiceAccount names the service account with the given ID
+func (m *MemoryAPIKeyRepository) AddServiceAccount(id int, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.accounts[id] = name
+}
+
+func (m *MemoryAPIKeyRepository) ForAccount(ctx context.Context, serviceAccountID int) ([]*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := []*APIKey{}
+	for _, key := range m.keys {
+		if key.ServiceAccountID == serviceAccountID {
+			key := listedKey(key)
+			keys = append(keys, &key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+
+	return keys, nil
+}
+
+func (m *MemoryAPIKeyRepository) Create(ctx context.Context, serviceAccountID int, name string, scopes []string, expiresAt *time.Time) (*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.keys {
+		if key.ServiceAccountID == serviceAccountID && key.Name == name {
+			return nil, ErrDuplicateName
+		}
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	key.ID = m.nextID
+	key.ServiceAccountID = serviceAccountID
+	key.Name = name
+	key.Scopes = append([]string{}, scopes...)
+	sort.Strings(key.Scopes)
+	key.ExpiresAt = expiresAt
+	key.CreatedAt = m.Now()
+
+	stored := *key
+	stored.PlainText = ""
+	m.keys[key.ID] = stored
+	m.nextID++
+
+	return key, nil
+}
+
+func (m *MemoryAPIKeyRepository) Rotate(ctx context.Context, serviceAccountID, keyID int) (*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.keys[keyID]
+	if !ok || stored.ServiceAccountID != serviceAccountID || stored.RevokedAt != nil {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	stored.Prefix = key.Prefix
+	stored.Hash = key.Hash
+	stored.LastUsedAt = nil
+	m.keys[keyID] = stored
+
+	rotated := stored
+	rotated.PlainText = key.PlainText
+	rotated.Scopes = append([]string{}, stored.Scopes...)
+
+	return &rotated, nil
+}
+
+func (m *MemoryAPIKeyRepository) Revoke(ctx context.Context, serviceAccountID, keyID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.keys[keyID]
+	if !ok || stored.ServiceAccountID != serviceAccountID || stored.RevokedAt != nil {
+		return ErrAPIKeyNotFound
+	}
+
+	now := m.Now()
+	stored.RevokedAt = &now
+	m.keys[keyID] = stored
+
+	return nil
+}
+
+func (m *MemoryAPIKeyRepository) Authenticate(ctx context.Context, plainText string) (*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix, _, found := strings.Cut(plainText, ".")
+	if !found || !strings.HasPrefix(prefix, apiKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	now := m.Now()
+	for id, key := range m.keys {
+		if key.Prefix != prefix {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare(key.Hash, hashToken(plainText)) != 1 ||
+			key.RevokedAt != nil ||
+			(key.ExpiresAt != nil && !key.ExpiresAt.After(now)) {
+			return nil, ErrInvalidAPIKey
+		}
+
+		if !usedRecently(key.LastUsedAt, now) {
+			key.LastUsedAt = &now
+			m.keys[id] = key
+		}
+
+		key.ServiceAccount = m.accounts[key.ServiceAccountID]
+		key.Scopes = append([]string{}, key.Scopes...)
+		return &key, nil
+	}
+
+	return nil, ErrInvalidAPIKey
+}
+
+// listedKey is a stored key the way ForAccount returns it, without its hash
+func listedKey(key APIKey) APIKey {
+	key.Hash = nil
+	key.Scopes = append([]string{}, key.Scopes...)
+
+	return key
+}
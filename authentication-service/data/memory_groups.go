@@ -0,0 +1,258 @@
+package data
+
+import (
+	"authentication/scim"
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryGroupRepository keeps SCIM groups in memory, for tests. Members are looked up
+// in a MemoryUserRepository, and like the foreign keys in Postgres, users that don't
+// exist can't be added and deleted users drop out of their groups.
+type MemoryGroupRepository struct {
+	mu      sync.Mutex
+	groups  map[int]Group
+	members map[int]map[int]bool
+	nextID  int
+	users   *MemoryUserRepository
+	// Now returns the time stamped on groups; it defaults to time.Now
+	Now func() time.Time
+}
+
+// NewMemoryGroupRepository returns an empty in-memory group store whose members are
+// users in users
+func NewMemoryGroupRepository(users *MemoryUserRepository) *MemoryGroupRepository {
+	return &MemoryGroupRepository{
+		groups:  make(map[int]Group),
+		members: make(map[int]map[int]bool),
+		nextID:  1,
+		users:   users,
+		Now:     time.Now,
+	}
+}
+
+func (m *MemoryGroupRepository) Search(ctx context.Context, filter *scim.Filter, offset, limit int, withMembers bool) ([]*Group, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := checkFilter(filter, groupColumns)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var matched []*Group
+	for _, id := range m.ids() {
+		group := m.groups[id]
+		if filter != nil && !filter.Match(groupResource(group)) {
+			continue
+		}
+		if withMembers {
+			group.Members = m.membersOf(ctx, id)
+		}
+		matched = append(matched, &group)
+	}
+
+	return page(matched, offset, limit), len(matched), nil
+}
+
+func (m *MemoryGroupRepository) GetOne(ctx context.Context, id int) (*Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	group, ok := m.groups[id]
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+	group.Members = m.membersOf(ctx, id)
+
+	return &group, nil
+}
+
+func (m *MemoryGroupRepository) Insert(ctx context.Context, group Group) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.taken(group) {
+		return 0, ErrDuplicateGroup
+	}
+
+	now := m.Now()
+	group.ID = m.nextID
+	group.CreatedAt = now
+	group.UpdatedAt = now
+	m.nextID++
+
+	m.setMembers(ctx, group.ID, group.Members)
+	group.Members = nil
+	m.groups[group.ID] = group
+
+	return group.ID, nil
+}
+
+func (m *MemoryGroupRepository) Update(ctx context.Context, group Group) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.groups[group.ID]
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	if m.taken(group) {
+		return ErrDuplicateGroup
+	}
+
+	stored.DisplayName = group.DisplayName
+	stored.ExternalID = group.ExternalID
+	stored.UpdatedAt = m.Now()
+	m.groups[group.ID] = stored
+
+	m.setMembers(ctx, group.ID, group.Members)
+
+	return nil
+}
+
+func (m *MemoryGroupRepository) Delete(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.groups[id]; !ok {
+		return ErrGroupNotFound
+	}
+
+	delete(m.groups, id)
+	delete(m.members, id)
+
+	return nil
+}
+
+func (m *MemoryGroupRepository) ForUser(ctx context.Context, userID int) ([]*Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	groups := []*Group{}
+	for _, id := range m.ids() {
+		if m.members[id][userID] {
+			group := m.groups[id]
+			groups = append(groups, &group)
+		}
+	}
+
+	return groups, nil
+}
+
+// removeUser takes a user out of every group
+func (m *MemoryGroupRepository) removeUser(userID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, members := range m.members {
+		delete(members, userID)
+	}
+}
+
+// taken reports whether another group has the display name or external id of group;
+// callers hold m.mu
+func (m *MemoryGroupRepository) taken(group Group) bool {
+	for _, existing := range m.groups {
+		if existing.ID == group.ID {
+			continue
+		}
+		if existing.DisplayName == group.DisplayName ||
+			(group.ExternalID != "" && existing.ExternalID == group.ExternalID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setMembers replaces the members of a group, skipping users that don't exist;
+// callers hold m.mu
+func (m *MemoryGroupRepository) setMembers(ctx context.Context, groupID int, members []GroupMember) {
+	m.members[groupID] = make(map[int]bool)
+	for _, member := range members {
+		if _, err := m.users.GetOne(ctx, member.UserID); err == nil {
+			m.members[groupID][member.UserID] = true
+		}
+	}
+}
+
+// membersOf returns the members of a group that still exist, ordered by user ID;
+// callers hold m.mu
+func (m *MemoryGroupRepository) membersOf(ctx context.Context, groupID int) []GroupMember {
+	members := []GroupMember{}
+	for userID := range m.members[groupID] {
+		user, err := m.users.GetOne(ctx, userID)
+		if err != nil {
+			continue
+		}
+		members = append(members, GroupMember{UserID: user.ID, Email: user.Email})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserID < members[j].UserID
+	})
+
+	return members
+}
+
+// ids returns the IDs of every group in order; callers hold m.mu
+func (m *MemoryGroupRepository) ids() []int {
+	ids := make([]int, 0, len(m.groups))
+	for id := range m.groups {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// groupResource is a group the way Filter.Match sees it, with the attributes in
+// groupColumns
+func groupResource(group Group) map[string]any {
+	return map[string]any{
+		"id":          strconv.Itoa(group.ID),
+		"displayName": group.DisplayName,
+		"externalId":  group.ExternalID,
+		"meta":        metaResource(group.CreatedAt, group.UpdatedAt),
+	}
+}
+
+// metaResource holds the dates of a resource the way Filter.Match sees them
+func metaResource(created, lastModified time.Time) map[string]any {
+	return map[string]any{
+		"created":      created.UTC().Format(time.RFC3339Nano),
+		"lastModified": lastModified.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// checkFilter rejects a filter Postgres would, one on attributes that aren't in
+// columns, so the in-memory stores accept the same filters
+func checkFilter(filter *scim.Filter, columns map[string]scim.Column) error {
+	if filter == nil {
+		return nil
+	}
+
+	_, _, err := filter.SQL(columns, nil)
+
+	return err
+}
+
+// page returns the items from offset on, at most limit of them, like offset and limit
+// in SQL
+func page[T any](items []T, offset, limit int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+
+	items = items[offset:]
+	if len(items) > limit {
+		items = items[:limit]
+	}
+
+	return items
+}
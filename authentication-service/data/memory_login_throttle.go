@@ -0,0 +1,63 @@
+package data
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryLoginThrottleRepository counts failed logins in memory, for tests. Failures
+// are counted the same way as in Postgres.
+type MemoryLoginThrottleRepository struct {
+	mu        sync.Mutex
+	throttles map[string]LoginThrottle
+	// Now returns the time failures are recorded at; it defaults to time.Now
+	Now func() time.Time
+}
+
+// NewMemoryLoginThrottleRepository returns an in-memory throttle with no failures
+func NewMemoryLoginThrottleRepository() *MemoryLoginThrottleRepository {
+	return &MemoryLoginThrottleRepository{
+		throttles: make(map[string]LoginThrottle),
+		Now:       time.Now,
+	}
+}
+
+func (m *MemoryLoginThrottleRepository) BlockedUntil(ctx context.Context, keys ...string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var until time.Time
+	for _, key := range keys {
+		if lockedUntil := m.throttles[key].LockedUntil; lockedUntil.After(until) {
+			until = lockedUntil
+		}
+	}
+
+	return until, nil
+}
+
+func (m *MemoryLoginThrottleRepository) RecordFailure(ctx context.Context, key string, policy ThrottlePolicy) (*LoginThrottle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.Now()
+	throttle, ok := m.throttles[key]
+	if !ok {
+		throttle = LoginThrottle{Key: key, LastFailureAt: now}
+	}
+
+	policy.fail(&throttle, now)
+	m.throttles[key] = throttle
+
+	return &throttle, nil
+}
+
+func (m *MemoryLoginThrottleRepository) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.throttles, key)
+
+	return nil
+}
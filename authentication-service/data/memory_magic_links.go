@@ -0,0 +1,78 @@
+package data
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryMagicLinkRepository keeps login link tokens in memory, for tests
+type MemoryMagicLinkRepository struct {
+	mu     sync.Mutex
+	links  map[string]memoryMagicLink
+	nextID int
+	// Now returns the current time; it defaults to time.Now
+	Now func() time.Time
+}
+
+// memoryMagicLink is a stored login token and whether it has been used
+type memoryMagicLink struct {
+	MagicLink
+	used bool
+}
+
+// NewMemoryMagicLinkRepository returns an empty in-memory login link store
+func NewMemoryMagicLinkRepository() *MemoryMagicLinkRepository {
+	return &MemoryMagicLinkRepository{
+		links:  make(map[string]memoryMagicLink),
+		nextID: 1,
+		Now:    time.Now,
+	}
+}
+
+func (m *MemoryMagicLinkRepository) New(ctx context.Context, userID int, ttl time.Duration) (*MagicLink, error) {
+	plainText, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, link := range m.links {
+		if link.UserID == userID {
+			link.used = true
+			m.links[hash] = link
+		}
+	}
+
+	now := m.Now()
+	link := MagicLink{
+		ID:        m.nextID,
+		UserID:    userID,
+		PlainText: plainText,
+		Hash:      hashToken(plainText),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	m.nextID++
+	m.links[string(link.Hash)] = memoryMagicLink{MagicLink: link}
+
+	return &link, nil
+}
+
+func (m *MemoryMagicLinkRepository) Consume(ctx context.Context, plainText string) (int, error) {
+	hash := string(hashToken(plainText))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, ok := m.links[hash]
+	if !ok || link.used || !link.ExpiresAt.After(m.Now()) {
+		return 0, ErrInvalidToken
+	}
+	link.used = true
+	m.links[hash] = link
+
+	return link.UserID, nil
+}
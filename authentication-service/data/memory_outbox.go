@@ -0,0 +1,100 @@
+package data
+
+import (
+	"context"
+	"sync"
+	"time"
+	"userevents"
+)
+
+// MemoryOutbox holds user events in memory until they are delivered, for tests. The
+// events MemoryUserRepository writes for changes to users stay with it; this only
+// gets the ones added directly, like logins.
+type MemoryOutbox struct {
+	mu     sync.Mutex
+	events []memoryEvent
+	// Now returns the time events are stamped with; it defaults to time.Now
+	Now func() time.Time
+}
+
+// memoryEvent is an event in the outbox, and when it was delivered
+type memoryEvent struct {
+	event       userevents.Envelope
+	deliveredAt *time.Time
+}
+
+// NewMemoryOutbox returns an empty in-memory outbox
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{Now: time.Now}
+}
+
+func (m *MemoryOutbox) Add(ctx context.Context, userID int, eventType string, payload any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := userevents.New(eventType, m.Now(), payload)
+	if err != nil {
+		return err
+	}
+
+	m.events = append(m.events, memoryEvent{event: e})
+
+	return nil
+}
+
+func (m *MemoryOutbox) Deliver(ctx context.Context, limit int, send func(userevents.Envelope) error) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sent := 0
+	for i := range m.events {
+		if sent == limit {
+			break
+		}
+		if m.events[i].deliveredAt != nil {
+			continue
+		}
+
+		if err := send(m.events[i].event); err != nil {
+			return sent, err
+		}
+
+		now := m.Now()
+		m.events[i].deliveredAt = &now
+		sent++
+	}
+
+	return sent, nil
+}
+
+func (m *MemoryOutbox) Purge(ctx context.Context, age time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := m.Now().Add(-age)
+	kept := m.events[:0]
+	var purged int64
+	for _, e := range m.events {
+		if e.deliveredAt != nil && e.deliveredAt.Before(cutoff) {
+			purged++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	m.events = kept
+
+	return purged, nil
+}
+
+// Events returns the events added so far, delivered or not, oldest first
+func (m *MemoryOutbox) Events() []userevents.Envelope {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	events := make([]userevents.Envelope, 0, len(m.events))
+	for _, e := range m.events {
+		events = append(events, e.event)
+	}
+
+	return events
+}
@@ -0,0 +1,103 @@
+package data
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryPasswordResetRepository keeps password reset tokens in memory, for tests. It
+// sets new passwords through the MemoryUserRepository it is built on.
+type MemoryPasswordResetRepository struct {
+	mu     sync.Mutex
+	users  *MemoryUserRepository
+	resets map[string]memoryReset
+	nextID int
+	// Now returns the current time; it defaults to time.Now
+	Now func() time.Time
+}
+
+// memoryReset is a stored reset token and whether it has been used
+type memoryReset struct {
+	PasswordReset
+	used bool
+}
+
+// NewMemoryPasswordResetRepository returns an empty in-memory password reset store
+func NewMemoryPasswordResetRepository(users *MemoryUserRepository) *MemoryPasswordResetRepository {
+	return &MemoryPasswordResetRepository{
+		users:  users,
+		resets: make(map[string]memoryReset),
+		nextID: 1,
+		Now:    time.Now,
+	}
+}
+
+func (m *MemoryPasswordResetRepository) New(ctx context.Context, userID int, ttl time.Duration) (*PasswordReset, error) {
+	plainText, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, reset := range m.resets {
+		if reset.UserID == userID {
+			reset.used = true
+			m.resets[hash] = reset
+		}
+	}
+
+	now := m.Now()
+	reset := PasswordReset{
+		ID:        m.nextID,
+		UserID:    userID,
+		PlainText: plainText,
+		Hash:      hashToken(plainText),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	m.nextID++
+	m.resets[string(reset.Hash)] = memoryReset{PasswordReset: reset}
+
+	return &reset, nil
+}
+
+func (m *MemoryPasswordResetRepository) Redeem(ctx context.Context, plainText, password string) (int, error) {
+	hash := string(hashToken(plainText))
+
+	m.mu.Lock()
+	reset, ok := m.resets[hash]
+	if !ok || reset.used || !reset.ExpiresAt.After(m.Now()) {
+		m.mu.Unlock()
+		return 0, ErrInvalidToken
+	}
+	reset.used = true
+	m.resets[hash] = reset
+	m.mu.Unlock()
+
+	if _, err := m.users.GetOne(ctx, reset.UserID); err != nil {
+		return 0, ErrInvalidToken
+	}
+
+	err := m.users.ResetPassword(ctx, reset.UserID, password)
+	if err != nil {
+		return 0, err
+	}
+
+	return reset.UserID, nil
+}
+
+func (m *MemoryPasswordResetRepository) DeleteForUser(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, reset := range m.resets {
+		if reset.UserID == userID {
+			delete(m.resets, hash)
+		}
+	}
+
+	return nil
+}
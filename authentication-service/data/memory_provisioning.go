@@ -0,0 +1,142 @@
+package data
+
+import (
+	"authentication/scim"
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryProvisioning looks users up in a MemoryUserRepository for SCIM and keeps their
+// external ids in memory, for tests. Forget takes users out of the groups in a
+// MemoryGroupRepository.
+type MemoryProvisioning struct {
+	mu sync.Mutex
+	// externalIDs holds every provisioned user, with "" for those without an id
+	externalIDs map[int]string
+	users       *MemoryUserRepository
+	groups      *MemoryGroupRepository
+}
+
+// NewMemoryProvisioning returns in-memory provisioning over users and groups
+func NewMemoryProvisioning(users *MemoryUserRepository, groups *MemoryGroupRepository) *MemoryProvisioning {
+	return &MemoryProvisioning{
+		externalIDs: make(map[int]string),
+		users:       users,
+		groups:      groups,
+	}
+}
+
+func (m *MemoryProvisioning) Users(ctx context.Context, filter *scim.Filter, offset, limit int) ([]*ProvisionedUser, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := checkFilter(filter, provisioningColumns)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	all, err := m.users.GetAll(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].ID < all[j].ID
+	})
+
+	var matched []*ProvisionedUser
+	for _, user := range all {
+		if _, ok := m.externalIDs[user.ID]; !ok || user.Status == StatusDeleted {
+			continue
+		}
+
+		provisioned := m.provisioned(user)
+		if filter != nil && !filter.Match(provisionedResource(provisioned)) {
+			continue
+		}
+		matched = append(matched, provisioned)
+	}
+
+	return page(matched, offset, limit), len(matched), nil
+}
+
+func (m *MemoryProvisioning) User(ctx context.Context, id int) (*ProvisionedUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.users.GetOne(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := m.externalIDs[id]; !ok || user.Status == StatusDeleted {
+		return nil, sql.ErrNoRows
+	}
+
+	return m.provisioned(user), nil
+}
+
+func (m *MemoryProvisioning) SetExternalID(ctx context.Context, userID int, externalID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if externalID == "" {
+		m.externalIDs[userID] = ""
+		return nil
+	}
+
+	for id, existing := range m.externalIDs {
+		if id == userID || existing != externalID {
+			continue
+		}
+		// the row of a deleted user would have gone with them
+		if _, err := m.users.GetOne(ctx, id); err == nil {
+			return ErrDuplicateExternalID
+		}
+	}
+
+	m.externalIDs[userID] = externalID
+
+	return nil
+}
+
+func (m *MemoryProvisioning) Forget(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.externalIDs, userID)
+	m.groups.removeUser(userID)
+
+	return nil
+}
+
+// provisioned returns a user with their external id; callers hold m.mu
+func (m *MemoryProvisioning) provisioned(user *User) *ProvisionedUser {
+	user.Password = ""
+
+	return &ProvisionedUser{User: *user, ExternalID: m.externalIDs[user.ID]}
+}
+
+// provisionedResource is a user the way Filter.Match sees them, with the attributes
+// in provisioningColumns
+func provisionedResource(user *ProvisionedUser) map[string]any {
+	return map[string]any{
+		"id":          strconv.Itoa(user.ID),
+		"userName":    user.Email,
+		"externalId":  user.ExternalID,
+		"displayName": strings.TrimSpace(user.FirstName + " " + user.LastName),
+		"name": map[string]any{
+			"givenName":  user.FirstName,
+			"familyName": user.LastName,
+		},
+		"emails": []any{map[string]any{
+			"value":   user.Email,
+			"type":    "work",
+			"primary": true,
+		}},
+		"active": user.Status == StatusActive,
+		"meta":   metaResource(user.CreatedAt, user.UpdatedAt),
+	}
+}
@@ -0,0 +1,396 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryRoleRepository keeps roles and the global roles granted to users in memory.
+// It starts without any roles; the migrations seed Postgres with them, so tests add
+// the ones they need with AddRole.
+type MemoryRoleRepository struct {
+	mu     sync.Mutex
+	roles  map[string]Role
+	grants map[int]map[string]bool
+	nextID int
+	// Now returns the time stamped on roles; it defaults to time.Now
+	Now func() time.Time
+}
+
+// NewMemoryRoleRepository returns an in-memory role store without any roles
+func NewMemoryRoleRepository() *MemoryRoleRepository {
+	return &MemoryRoleRepository{
+		roles:  make(map[string]Role),
+		grants: make(map[int]map[string]bool),
+		nextID: 1,
+		Now:    time.Now,
+	}
+}
+
+// AddRole defines a role with the given permissions. The scope defaults to global.
+func (m *MemoryRoleRepository) AddRole(role Role) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if role.Scope == "" {
+		role.Scope = "global"
+	}
+	role.ID = m.nextID
+	role.CreatedAt = m.Now()
+	role.Permissions = append([]string{}, role.Permissions...)
+	sort.Strings(role.Permissions)
+
+	m.roles[role.Name] = role
+	m.nextID++
+}
+
+func (m *MemoryRoleRepository) GetAll(ctx context.Context) ([]*Role, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var roles []*Role
+	for _, name := range m.names() {
+		role := m.roles[name]
+		role.Permissions = append([]string{}, role.Permissions...)
+		roles = append(roles, &role)
+	}
+
+	return roles, nil
+}
+
+func (m *MemoryRoleRepository) ForUser(ctx context.Context, userID int) ([]string, []string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roles := []string{}
+	permissions := []string{}
+	seen := make(map[string]bool)
+
+	for _, name := range m.names() {
+		if !m.grants[userID][name] {
+			continue
+		}
+
+		roles = append(roles, name)
+		for _, permission := range m.roles[name].Permissions {
+			if !seen[permission] {
+				seen[permission] = true
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+
+	return roles, permissions, nil
+}
+
+func (m *MemoryRoleRepository) Grant(ctx context.Context, userID int, roleName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hasRole(roleName, "global") {
+		return ErrRoleNotFound
+	}
+
+	if m.grants[userID] == nil {
+		m.grants[userID] = make(map[string]bool)
+	}
+	m.grants[userID][roleName] = true
+
+	return nil
+}
+
+func (m *MemoryRoleRepository) Revoke(ctx context.Context, userID int, roleName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hasRole(roleName, "global") {
+		return ErrRoleNotFound
+	}
+
+	delete(m.grants[userID], roleName)
+
+	return nil
+}
+
+func (m *MemoryRoleRepository) RevokeAll(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.grants, userID)
+
+	return nil
+}
+
+// organizationRole returns the permissions of an organization role, and false if there
+// is no such role
+func (m *MemoryRoleRepository) organizationRole(name string) ([]string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hasRole(name, "organization") {
+		return nil, false
+	}
+
+	return append([]string{}, m.roles[name].Permissions...), true
+}
+
+// hasRole reports whether a role with the name and scope exists; callers hold m.mu
+func (m *MemoryRoleRepository) hasRole(name, scope string) bool {
+	role, ok := m.roles[name]
+	return ok && role.Scope == scope
+}
+
+// names returns the names of every role, sorted; callers hold m.mu
+func (m *MemoryRoleRepository) names() []string {
+	names := make([]string, 0, len(m.roles))
+	for name := range m.roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// MemoryOrganizationRepository keeps organizations and their members in memory. Member
+// roles come from a MemoryRoleRepository and member details from a
+// MemoryUserRepository, which is also told about memberships so its pages can be
+// filtered by organization. Leaving an organization clears it from the user's sessions
+// in a MemorySessionRepository.
+type MemoryOrganizationRepository struct {
+	mu            sync.Mutex
+	organizations map[int]Organization
+	members       map[int]map[int]memoryMember
+	nextID        int
+	users         *MemoryUserRepository
+	roles         *MemoryRoleRepository
+	sessions      *MemorySessionRepository
+	// Now returns the time stamped on organizations; it defaults to time.Now
+	Now func() time.Time
+}
+
+// memoryMember is a user's role in an organization and when they joined
+type memoryMember struct {
+	role     string
+	joinedAt time.Time
+}
+
+// NewMemoryOrganizationRepository returns an empty in-memory organization store
+func NewMemoryOrganizationRepository(users *MemoryUserRepository, roles *MemoryRoleRepository, sessions *MemorySessionRepository) *MemoryOrganizationRepository {
+	return &MemoryOrganizationRepository{
+		organizations: make(map[int]Organization),
+		members:       make(map[int]map[int]memoryMember),
+		nextID:        1,
+		users:         users,
+		roles:         roles,
+		sessions:      sessions,
+		Now:           time.Now,
+	}
+}
+
+func (m *MemoryOrganizationRepository) Insert(ctx context.Context, org Organization, ownerID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.organizations {
+		if existing.Slug == org.Slug {
+			return 0, ErrDuplicateSlug
+		}
+	}
+
+	now := m.Now()
+	org.ID = m.nextID
+	org.CreatedAt = now
+	org.UpdatedAt = now
+	m.organizations[org.ID] = org
+	m.members[org.ID] = make(map[int]memoryMember)
+	m.nextID++
+
+	if _, ok := m.roles.organizationRole(OwnerRole); ok {
+		m.setMember(org.ID, ownerID, OwnerRole)
+	}
+
+	return org.ID, nil
+}
+
+func (m *MemoryOrganizationRepository) GetOne(ctx context.Context, id int) (*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	org, ok := m.organizations[id]
+	if !ok {
+		return nil, ErrOrganizationNotFound
+	}
+
+	return &org, nil
+}
+
+func (m *MemoryOrganizationRepository) ForUser(ctx context.Context, userID int) ([]*Membership, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	memberships := []*Membership{}
+	for orgID, members := range m.members {
+		if _, ok := members[userID]; ok {
+			memberships = append(memberships, m.membership(orgID, userID))
+		}
+	}
+
+	sort.Slice(memberships, func(i, j int) bool {
+		if !memberships[i].CreatedAt.Equal(memberships[j].CreatedAt) {
+			return memberships[i].CreatedAt.Before(memberships[j].CreatedAt)
+		}
+		return memberships[i].OrganizationID < memberships[j].OrganizationID
+	})
+
+	return memberships, nil
+}
+
+func (m *MemoryOrganizationRepository) Membership(ctx context.Context, orgID, userID int) (*Membership, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.members[orgID][userID]; !ok {
+		return nil, ErrNotMember
+	}
+
+	membership := m.membership(orgID, userID)
+	if permissions, ok := m.roles.organizationRole(membership.Role); ok {
+		membership.Permissions = permissions
+	}
+
+	return membership, nil
+}
+
+func (m *MemoryOrganizationRepository) IsMember(ctx context.Context, orgID, userID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.members[orgID][userID]
+
+	return ok, nil
+}
+
+func (m *MemoryOrganizationRepository) Members(ctx context.Context, orgID int) ([]*Member, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := []*Member{}
+	for userID, member := range m.members[orgID] {
+		user, err := m.users.GetOne(ctx, userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return nil, err
+		}
+		user.Password = ""
+
+		members = append(members, &Member{User: user, Role: member.role, JoinedAt: member.joinedAt})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return compareUsers("last_name", members[i].User, members[j].User) < 0
+	})
+
+	return members, nil
+}
+
+func (m *MemoryOrganizationRepository) SetMember(ctx context.Context, orgID, userID int, roleName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.roles.organizationRole(roleName); !ok {
+		return ErrRoleNotFound
+	}
+
+	if roleName != OwnerRole && m.lastOwner(orgID, userID) {
+		return ErrLastOwner
+	}
+
+	m.setMember(orgID, userID, roleName)
+
+	return nil
+}
+
+func (m *MemoryOrganizationRepository) RemoveMember(ctx context.Context, orgID, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lastOwner(orgID, userID) {
+		return ErrLastOwner
+	}
+
+	if _, ok := m.members[orgID][userID]; !ok {
+		return ErrNotMember
+	}
+
+	delete(m.members[orgID], userID)
+	m.users.removeMember(orgID, userID)
+	m.sessions.clearOrganization(orgID, userID)
+
+	return nil
+}
+
+func (m *MemoryOrganizationRepository) RemoveAllForUser(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for orgID, members := range m.members {
+		if _, ok := members[userID]; ok {
+			delete(members, userID)
+			m.users.removeMember(orgID, userID)
+		}
+	}
+
+	return nil
+}
+
+// setMember adds a user to an organization or changes their role, keeping the time
+// they joined; callers hold m.mu
+func (m *MemoryOrganizationRepository) setMember(orgID, userID int, roleName string) {
+	if m.members[orgID] == nil {
+		m.members[orgID] = make(map[int]memoryMember)
+	}
+
+	member, ok := m.members[orgID][userID]
+	if !ok {
+		member.joinedAt = m.Now()
+	}
+	member.role = roleName
+	m.members[orgID][userID] = member
+
+	m.users.AddMember(orgID, userID)
+}
+
+// membership describes a user's membership without its permissions; callers hold m.mu
+func (m *MemoryOrganizationRepository) membership(orgID, userID int) *Membership {
+	org := m.organizations[orgID]
+	member := m.members[orgID][userID]
+
+	return &Membership{
+		OrganizationID: orgID,
+		Organization:   org.Name,
+		Slug:           org.Slug,
+		UserID:         userID,
+		Role:           member.role,
+		Permissions:    []string{},
+		CreatedAt:      member.joinedAt,
+	}
+}
+
+// lastOwner reports whether userID is the only owner of an organization, like
+// keepAnOwner does in Postgres; callers hold m.mu
+func (m *MemoryOrganizationRepository) lastOwner(orgID, userID int) bool {
+	var owners []int
+	for id, member := range m.members[orgID] {
+		if member.role == OwnerRole {
+			owners = append(owners, id)
+		}
+	}
+
+	return len(owners) == 1 && owners[0] == userID
+}
@@ -0,0 +1,383 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemorySessionRepository keeps sessions in memory, along with the refresh tokens of
+// the MemoryTokenRepository built on it, since revoking one revokes the other. Like
+// the other in-memory stores it is meant for tests.
+type MemorySessionRepository struct {
+	mu       sync.Mutex
+	sessions map[int]Session
+	tokens   map[string]*memoryToken
+	nextID   int
+	// Now returns the current time; it defaults to time.Now
+	Now func() time.Time
+}
+
+// memoryToken is a stored refresh token and whether it has been revoked
+type memoryToken struct {
+	Token
+	revoked bool
+}
+
+// NewMemorySessionRepository returns an empty in-memory session store
+func NewMemorySessionRepository() *MemorySessionRepository {
+	return &MemorySessionRepository{
+		sessions: make(map[int]Session),
+		tokens:   make(map[string]*memoryToken),
+		nextID:   1,
+		Now:      time.Now,
+	}
+}
+
+func (m *MemorySessionRepository) Insert(ctx context.Context, session Session) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.insert(session), nil
+}
+
+func (m *MemorySessionRepository) ForUser(ctx context.Context, userID int) ([]*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.Now()
+	sessions := []*Session{}
+	for _, session := range m.sessions {
+		if session.UserID != userID || session.RevokedAt != nil || !session.ExpiresAt.After(now) {
+			continue
+		}
+		session := session
+		session.OrganizationID = 0
+		sessions = append(sessions, &session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastSeenAt.Equal(sessions[j].LastSeenAt) {
+			return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+
+	return sessions, nil
+}
+
+func (m *MemorySessionRepository) History(ctx context.Context, userID int) ([]*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := []*Session{}
+	for _, session := range m.sessions {
+		if session.UserID != userID {
+			continue
+		}
+		session := session
+		session.OrganizationID = 0
+		sessions = append(sessions, &session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+
+	return sessions, nil
+}
+
+func (m *MemorySessionRepository) LastSeen(ctx context.Context, id int) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.active(id)
+	if !ok {
+		return time.Time{}, ErrSessionNotFound
+	}
+
+	return session.LastSeenAt, nil
+}
+
+func (m *MemorySessionRepository) Touch(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.active(id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	session.LastSeenAt = m.Now()
+	m.sessions[id] = session
+
+	return nil
+}
+
+func (m *MemorySessionRepository) SetOrganization(ctx context.Context, userID, id, orgID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.active(id)
+	if !ok || session.UserID != userID {
+		return ErrSessionNotFound
+	}
+
+	session.OrganizationID = orgID
+	m.sessions[id] = session
+
+	return nil
+}
+
+func (m *MemorySessionRepository) Revoke(ctx context.Context, userID, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok || session.UserID != userID || session.RevokedAt != nil {
+		return ErrSessionNotFound
+	}
+
+	m.revokeSession(id)
+	for _, token := range m.tokens {
+		if token.SessionID == id {
+			token.revoked = true
+		}
+	}
+
+	return nil
+}
+
+func (m *MemorySessionRepository) RevokeOthers(ctx context.Context, userID, keepID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	revoked := 0
+	for id, session := range m.sessions {
+		if session.UserID == userID && id != keepID && session.RevokedAt == nil {
+			m.revokeSession(id)
+			revoked++
+		}
+	}
+
+	for _, token := range m.tokens {
+		if token.UserID == userID && token.SessionID != keepID {
+			token.revoked = true
+		}
+	}
+
+	return revoked, nil
+}
+
+func (m *MemorySessionRepository) RevokeAllForUser(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revokeAllForUser(userID)
+
+	return nil
+}
+
+func (m *MemorySessionRepository) Scrub(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revokeAllForUser(userID)
+	for id, session := range m.sessions {
+		if session.UserID == userID {
+			session.UserAgent = ""
+			session.IP = ""
+			m.sessions[id] = session
+		}
+	}
+
+	return nil
+}
+
+func (m *MemorySessionRepository) RevokedSince(ctx context.Context, since time.Time) ([]SessionRevocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	revocations := []SessionRevocation{}
+	for _, session := range m.sessions {
+		if session.RevokedAt != nil && session.RevokedAt.After(since) {
+			revocations = append(revocations, SessionRevocation{ID: session.ID, RevokedAt: *session.RevokedAt})
+		}
+	}
+
+	sort.Slice(revocations, func(i, j int) bool {
+		return revocations[i].RevokedAt.Before(revocations[j].RevokedAt)
+	})
+
+	return revocations, nil
+}
+
+// clearOrganization takes the sessions of a user acting in an organization out of it,
+// for when they leave it
+func (m *MemorySessionRepository) clearOrganization(orgID, userID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, session := range m.sessions {
+		if session.UserID == userID && session.OrganizationID == orgID {
+			session.OrganizationID = 0
+			m.sessions[id] = session
+		}
+	}
+}
+
+// insert stores a new session and returns its ID; callers hold m.mu
+func (m *MemorySessionRepository) insert(session Session) int {
+	now := m.Now()
+	session.ID = m.nextID
+	session.CreatedAt = now
+	session.LastSeenAt = now
+	session.RevokedAt = nil
+	m.sessions[session.ID] = session
+	m.nextID++
+
+	return session.ID
+}
+
+// active returns a session that hasn't been revoked or expired; callers hold m.mu
+func (m *MemorySessionRepository) active(id int) (Session, bool) {
+	session, ok := m.sessions[id]
+	if !ok || session.RevokedAt != nil || !session.ExpiresAt.After(m.Now()) {
+		return Session{}, false
+	}
+
+	return session, true
+}
+
+// revokeSession marks a session revoked; callers hold m.mu
+func (m *MemorySessionRepository) revokeSession(id int) {
+	session := m.sessions[id]
+	now := m.Now()
+	session.RevokedAt = &now
+	m.sessions[id] = session
+}
+
+// revokeAllForUser revokes every session and refresh token of a user; callers hold
+// m.mu
+func (m *MemorySessionRepository) revokeAllForUser(userID int) {
+	for id, session := range m.sessions {
+		if session.UserID == userID && session.RevokedAt == nil {
+			m.revokeSession(id)
+		}
+	}
+
+	for _, token := range m.tokens {
+		if token.UserID == userID {
+			token.revoked = true
+		}
+	}
+}
+
+// MemoryTokenRepository keeps refresh tokens in memory, in the sessions store it was
+// built on
+type MemoryTokenRepository struct {
+	sessions *MemorySessionRepository
+}
+
+// NewMemoryTokenRepository returns an in-memory refresh token store whose tokens
+// belong to the sessions in sessions
+func NewMemoryTokenRepository(sessions *MemorySessionRepository) *MemoryTokenRepository {
+	return &MemoryTokenRepository{sessions: sessions}
+}
+
+func (m *MemoryTokenRepository) GenerateToken(userID int, mfa bool, ttl time.Duration) (*Token, error) {
+	token, err := (&Token{}).GenerateToken(userID, mfa, ttl)
+	if err != nil {
+		return nil, err
+	}
+	token.ExpiresAt = m.sessions.Now().Add(ttl)
+
+	return token, nil
+}
+
+func (m *MemoryTokenRepository) Insert(ctx context.Context, token Token) error {
+	m.sessions.mu.Lock()
+	defer m.sessions.mu.Unlock()
+
+	token.CreatedAt = m.sessions.Now()
+	m.sessions.tokens[string(token.Hash)] = &memoryToken{Token: token}
+
+	return nil
+}
+
+func (m *MemoryTokenRepository) Rotate(ctx context.Context, plainText string, ttl time.Duration) (*Token, error) {
+	s := m.sessions
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.tokens[string(hashToken(plainText))]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	// as in Postgres, a token from a session that was logged out is simply no longer
+	// valid, while a token that was already rotated has most likely been stolen
+	session, hasSession := s.sessions[stored.SessionID]
+	if hasSession && session.RevokedAt != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if stored.revoked {
+		s.revokeAllForUser(stored.UserID)
+		return nil, ErrTokenReused
+	}
+
+	now := s.Now()
+	if now.After(stored.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+
+	stored.revoked = true
+
+	token, err := m.GenerateToken(stored.UserID, stored.MFA, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasSession {
+		session = Session{UserID: stored.UserID, MFA: stored.MFA, ExpiresAt: token.ExpiresAt}
+		session.ID = s.insert(session)
+	}
+	token.SessionID = session.ID
+	token.OrganizationID = session.OrganizationID
+	token.AMR = append([]string{}, stored.AMR...)
+	token.CreatedAt = now
+
+	s.tokens[string(token.Hash)] = &memoryToken{Token: *token}
+
+	session = s.sessions[session.ID]
+	session.LastSeenAt = now
+	session.ExpiresAt = token.ExpiresAt
+	s.sessions[session.ID] = session
+
+	return token, nil
+}
+
+func (m *MemoryTokenRepository) Revoke(ctx context.Context, plainText string) error {
+	s := m.sessions
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.tokens[string(hashToken(plainText))]
+	if !ok || stored.revoked {
+		return nil
+	}
+
+	stored.revoked = true
+	if session, ok := s.sessions[stored.SessionID]; ok && session.RevokedAt == nil {
+		s.revokeSession(session.ID)
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// MemoryTwoFactorRepository keeps TOTP enrollments and recovery codes in memory, for
+// tests. Recovery codes are kept hashed, as in Postgres.
+type MemoryTwoFactorRepository struct {
+	mu            sync.Mutex
+	enrollments   map[int]TwoFactor
+	recoveryCodes map[int]map[string]bool
+	// Now returns the time stamped on enrollments; it defaults to time.Now
+	Now func() time.Time
+}
+
+// NewMemoryTwoFactorRepository returns an empty in-memory two factor store
+func NewMemoryTwoFactorRepository() *MemoryTwoFactorRepository {
+	return &MemoryTwoFactorRepository{
+		enrollments:   make(map[int]TwoFactor),
+		recoveryCodes: make(map[int]map[string]bool),
+		Now:           time.Now,
+	}
+}
+
+func (m *MemoryTwoFactorRepository) GetForUser(ctx context.Context, userID int) (*TwoFactor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tf, ok := m.enrollments[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	tf.Secret = append([]byte{}, tf.Secret...)
+
+	return &tf, nil
+}
+
+func (m *MemoryTwoFactorRepository) Enroll(ctx context.Context, userID int, secret []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.enrollments[userID].Confirmed {
+		return false, nil
+	}
+
+	m.enrollments[userID] = TwoFactor{
+		UserID:    userID,
+		Secret:    append([]byte{}, secret...),
+		CreatedAt: m.Now(),
+	}
+
+	return true, nil
+}
+
+func (m *MemoryTwoFactorRepository) Confirm(ctx context.Context, userID int, counter int64, recoveryCodes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if tf, ok := m.enrollments[userID]; ok {
+		tf.Confirmed = true
+		tf.LastCounter = counter
+		m.enrollments[userID] = tf
+	}
+
+	codes := make(map[string]bool, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		codes[string(hashRecoveryCode(code))] = false
+	}
+	m.recoveryCodes[userID] = codes
+
+	return nil
+}
+
+func (m *MemoryTwoFactorRepository) UseCounter(ctx context.Context, userID int, counter int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tf, ok := m.enrollments[userID]
+	if !ok || tf.LastCounter >= counter {
+		return false, nil
+	}
+
+	tf.LastCounter = counter
+	m.enrollments[userID] = tf
+
+	return true, nil
+}
+
+func (m *MemoryTwoFactorRepository) UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hash := string(hashRecoveryCode(code))
+	used, ok := m.recoveryCodes[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+
+	m.recoveryCodes[userID][hash] = true
+
+	return true, nil
+}
+
+func (m *MemoryTwoFactorRepository) Delete(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.enrollments, userID)
+	delete(m.recoveryCodes, userID)
+
+	return nil
+}
@@ -0,0 +1,488 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"userevents"
+)
+
+// MemoryUserRepository keeps users in memory. It behaves like the users table: emails
+// are unique, IDs count up from 1, timestamps are set on insert and update, and
+// missing users are reported with sql.ErrNoRows. It is meant for tests and local
+// experiments, so nothing survives a restart. Organization memberships live in
+// Postgres, so Page only knows the ones given to AddMember. The user events Postgres
+// would write to the outbox are kept for Events. Nothing blocks, so contexts are
+// ignored.
+type MemoryUserRepository struct {
+	mu      sync.Mutex
+	users   map[int]User
+	members map[int]map[int]bool
+	history map[int][]StatusChange
+	events  []memoryUserEvent
+	nextID  int
+	// Now returns the time stamped on users; it defaults to time.Now
+	Now func() time.Time
+}
+
+// memoryUserEvent is a user event and the user it is about, like the user_id column
+// of outbox_events
+type memoryUserEvent struct {
+	userevents.Envelope
+	userID int
+}
+
+// NewMemoryUserRepository returns an empty in-memory user store
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{
+		users:   make(map[int]User),
+		members: make(map[int]map[int]bool),
+		history: make(map[int][]StatusChange),
+		nextID:  1,
+		Now:     time.Now,
+	}
+}
+
+func (m *MemoryUserRepository) GetAll(ctx context.Context) ([]*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users := m.all()
+	sortUsers(users, "last_name", false)
+
+	return users, nil
+}
+
+func (m *MemoryUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.users {
+		if FoldEmail(user.Email) == FoldEmail(email) {
+			return &user, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryUserRepository) GetOne(ctx context.Context, id int) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &user, nil
+}
+
+func (m *MemoryUserRepository) Page(ctx context.Context, filter UserFilter) (*UserPage, error) {
+	column, descending, err := filter.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	domain := strings.ToLower(strings.TrimPrefix(filter.EmailDomain, "@"))
+
+	var matching []*User
+	for _, user := range m.all() {
+		if filter.OrganizationID != 0 && !m.members[filter.OrganizationID][user.ID] {
+			continue
+		}
+		if filter.Active != nil && user.Active != *filter.Active {
+			continue
+		}
+		if filter.Status != "" && user.Status != filter.Status {
+			continue
+		}
+		if filter.CreatedAfter != nil && user.CreatedAt.Before(*filter.CreatedAfter) {
+			continue
+		}
+		if filter.CreatedBefore != nil && !user.CreatedAt.Before(*filter.CreatedBefore) {
+			continue
+		}
+		if domain != "" {
+			_, userDomain, _ := strings.Cut(strings.ToLower(user.Email), "@")
+			if userDomain != domain {
+				continue
+			}
+		}
+		matching = append(matching, user)
+	}
+
+	page := UserPage{Users: []*User{}, Total: len(matching), Limit: filter.Limit}
+
+	var after *cursor
+	var edge *User
+	if filter.Cursor != "" {
+		after, err = decodeCursor(filter.Cursor)
+		if err != nil || after.Sort != filter.Sort {
+			return nil, ErrInvalidCursor
+		}
+
+		edge, err = cursorUser(column, after)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	backwards := after != nil && after.Backwards
+	sortUsers(matching, column, descending != backwards)
+
+	for _, user := range matching {
+		if edge != nil {
+			cmp := compareUsers(column, user, edge)
+			if descending != backwards {
+				cmp = -cmp
+			}
+			if cmp <= 0 {
+				continue
+			}
+		}
+
+		page.Users = append(page.Users, user)
+		if len(page.Users) > filter.Limit {
+			break
+		}
+	}
+
+	page.finish(filter, column, after)
+
+	return &page, nil
+}
+
+// AddMember records that a user belongs to an organization, for filtering pages by
+// organization
+func (m *MemoryUserRepository) AddMember(orgID, userID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.members[orgID] == nil {
+		m.members[orgID] = make(map[int]bool)
+	}
+	m.members[orgID][userID] = true
+}
+
+// removeMember forgets that a user belongs to an organization
+func (m *MemoryUserRepository) removeMember(orgID, userID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.members[orgID], userID)
+}
+
+func (m *MemoryUserRepository) Insert(ctx context.Context, user User) (int, error) {
+	hashedPassword, err := HashPassword(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.emailTaken(user.Email, 0) {
+		return 0, ErrDuplicateEmail
+	}
+
+	status, err := initialStatus(user)
+	if err != nil {
+		return 0, err
+	}
+
+	now := m.Now()
+	user.ID = m.nextID
+	user.Password = hashedPassword
+	user.Status = status
+	user.Active = activeFlag(status)
+	user.CreatedAt = now
+	user.UpdatedAt = now
+
+	err = m.addEvent(user.ID, userevents.TypeCreated, userevents.Created{User: eventUser(user)})
+	if err != nil {
+		return 0, err
+	}
+
+	m.users[user.ID] = user
+	m.nextID++
+
+	return user.ID, nil
+}
+
+func (m *MemoryUserRepository) Update(ctx context.Context, user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.users[user.ID]
+	if !ok {
+		// an update that matches no rows isn't an error in Postgres either
+		return nil
+	}
+
+	if m.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+
+	before := stored
+	stored.Email = user.Email
+	stored.FirstName = user.FirstName
+	stored.LastName = user.LastName
+	stored.UpdatedAt = m.Now()
+
+	if e, changed := updatedEvent(before, stored); changed {
+		err := m.addEvent(user.ID, userevents.TypeUpdated, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.users[user.ID] = stored
+
+	return nil
+}
+
+func (m *MemoryUserRepository) DeleteByID(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[id]; ok {
+		err := m.addEvent(id, userevents.TypeDeleted, userevents.Deleted{UserID: id})
+		if err != nil {
+			return err
+		}
+	}
+
+	delete(m.users, id)
+	for _, members := range m.members {
+		delete(members, id)
+	}
+	delete(m.history, id)
+
+	return nil
+}
+
+func (m *MemoryUserRepository) ResetPassword(ctx context.Context, id int, password string) error {
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return nil
+	}
+
+	user.Password = hashedPassword
+	m.users[id] = user
+
+	return nil
+}
+
+func (m *MemoryUserRepository) Anonymize(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return nil
+	}
+
+	user.Email = ErasedEmail(id)
+	user.FirstName = ""
+	user.LastName = ""
+	user.Password = ""
+	user.Active = 0
+	user.Status = StatusDeleted
+	user.UpdatedAt = m.Now()
+
+	// undelivered events would still carry the address and names, so they go too;
+	// nothing delivers these, so that is all of them
+	events := m.events[:0]
+	for _, e := range m.events {
+		if e.userID != id {
+			events = append(events, e)
+		}
+	}
+	m.events = events
+
+	err := m.addEvent(id, userevents.TypeDeleted, userevents.Deleted{UserID: id, Erased: true})
+	if err != nil {
+		return err
+	}
+
+	m.users[id] = user
+
+	return nil
+}
+
+func (m *MemoryUserRepository) Transition(ctx context.Context, userID int, to, reason string, actorID int) (*StatusChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	if err := checkTransition(user.Status, to); err != nil {
+		return nil, err
+	}
+
+	now := m.Now()
+	change := StatusChange{
+		ID:        len(m.history[userID]) + 1,
+		UserID:    userID,
+		From:      user.Status,
+		To:        to,
+		Reason:    reason,
+		ActorID:   actorID,
+		CreatedAt: now,
+	}
+
+	before := user
+	user.Status = to
+	user.Active = activeFlag(to)
+	user.UpdatedAt = now
+
+	e, _ := updatedEvent(before, user)
+	if err := m.addEvent(userID, userevents.TypeUpdated, e); err != nil {
+		return nil, err
+	}
+
+	m.users[userID] = user
+	m.history[userID] = append(m.history[userID], change)
+
+	return &change, nil
+}
+
+func (m *MemoryUserRepository) StatusHistory(ctx context.Context, userID int) ([]*StatusChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changes := make([]*StatusChange, 0, len(m.history[userID]))
+	for _, change := range m.history[userID] {
+		change := change
+		changes = append(changes, &change)
+	}
+
+	return changes, nil
+}
+
+// Events returns the user events written so far, oldest first
+func (m *MemoryUserRepository) Events() []userevents.Envelope {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	events := make([]userevents.Envelope, len(m.events))
+	for i, e := range m.events {
+		events[i] = e.Envelope
+	}
+
+	return events
+}
+
+// addEvent records a user event; callers hold m.mu
+func (m *MemoryUserRepository) addEvent(userID int, eventType string, payload any) error {
+	e, err := userevents.New(eventType, m.Now(), payload)
+	if err != nil {
+		return err
+	}
+
+	m.events = append(m.events, memoryUserEvent{Envelope: e, userID: userID})
+
+	return nil
+}
+
+// all returns a copy of every stored user; callers hold m.mu
+func (m *MemoryUserRepository) all() []*User {
+	users := make([]*User, 0, len(m.users))
+	for _, user := range m.users {
+		user := user
+		users = append(users, &user)
+	}
+
+	return users
+}
+
+// emailTaken reports whether a user other than id has email, in any case, as the
+// unique index on lower(email) does in Postgres; callers hold m.mu
+func (m *MemoryUserRepository) emailTaken(email string, id int) bool {
+	for _, user := range m.users {
+		if FoldEmail(user.Email) == FoldEmail(email) && user.ID != id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortUsers orders users by column and then ID, the same way Page does in Postgres
+func sortUsers(users []*User, column string, descending bool) {
+	sort.Slice(users, func(i, j int) bool {
+		cmp := compareUsers(column, users[i], users[j])
+		if descending {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+}
+
+// compareUsers compares two users by column, breaking ties on ID
+func compareUsers(column string, a, b *User) int {
+	cmp := 0
+	switch column {
+	case "email":
+		cmp = strings.Compare(a.Email, b.Email)
+	case "created_at":
+		cmp = a.CreatedAt.Compare(b.CreatedAt)
+	case "id":
+	default:
+		cmp = strings.Compare(a.LastName, b.LastName)
+	}
+
+	if cmp != 0 {
+		return cmp
+	}
+
+	switch {
+	case a.ID < b.ID:
+		return -1
+	case a.ID > b.ID:
+		return 1
+	}
+
+	return 0
+}
+
+// cursorUser builds a user holding just the sort value and ID stored in c, so it can
+// be compared with the users in a page
+func cursorUser(column string, c *cursor) (*User, error) {
+	value, err := cursorValue(column, c.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{ID: c.ID}
+	switch v := value.(type) {
+	case time.Time:
+		user.CreatedAt = v
+	case string:
+		if column == "email" {
+			user.Email = v
+		} else {
+			user.LastName = v
+		}
+	}
+
+	return user, nil
+}
@@ -0,0 +1,10 @@
+create table if not exists users (
+    id serial primary key,
+    email varchar(255) not null unique,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    password text not null,
+    user_active integer not null default 0,
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now()
+);
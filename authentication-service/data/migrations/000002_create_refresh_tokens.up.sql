@@ -0,0 +1,13 @@
+-- refresh tokens handed out by /login and rotated by /refresh. mfa records whether
+-- the login that created the token passed a second factor.
+create table if not exists refresh_tokens (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    token_hash bytea not null unique,
+    mfa boolean not null default false,
+    expires_at timestamp without time zone not null,
+    revoked_at timestamp without time zone,
+    created_at timestamp without time zone not null default now()
+);
+
+create index if not exists refresh_tokens_user_id_idx on refresh_tokens (user_id);
@@ -0,0 +1,11 @@
+-- single use password reset tokens created by /password/forgot
+create table if not exists password_resets (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    token_hash bytea not null unique,
+    expires_at timestamp without time zone not null,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone not null default now()
+);
+
+create index if not exists password_resets_user_id_idx on password_resets (user_id);
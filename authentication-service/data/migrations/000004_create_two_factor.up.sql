@@ -0,0 +1,19 @@
+-- TOTP enrollment, one row per user. secret is encrypted with TOTP_ENCRYPTION_KEY.
+create table if not exists user_two_factor (
+    user_id integer primary key references users (id) on delete cascade,
+    secret bytea not null,
+    confirmed_at timestamp without time zone,
+    last_counter bigint not null default 0,
+    created_at timestamp without time zone not null default now()
+);
+
+-- single use recovery codes, stored hashed
+create table if not exists recovery_codes (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    code_hash bytea not null,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone not null default now()
+);
+
+create index if not exists recovery_codes_user_id_idx on recovery_codes (user_id);
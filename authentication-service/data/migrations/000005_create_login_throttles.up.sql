@@ -0,0 +1,7 @@
+-- failed login attempts, keyed by account ("email:...") or source address ("ip:...")
+create table if not exists login_throttles (
+    key text primary key,
+    failures integer not null default 0,
+    locked_until timestamp without time zone,
+    last_failure_at timestamp without time zone not null
+);
@@ -0,0 +1,58 @@
+-- role based access control
+create table if not exists roles (
+    id serial primary key,
+    name text not null unique,
+    description text not null default '',
+    created_at timestamp without time zone not null default now()
+);
+
+create table if not exists permissions (
+    id serial primary key,
+    name text not null unique,
+    description text not null default '',
+    created_at timestamp without time zone not null default now()
+);
+
+create table if not exists role_permissions (
+    role_id integer not null references roles (id) on delete cascade,
+    permission_id integer not null references permissions (id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table if not exists user_roles (
+    user_id integer not null references users (id) on delete cascade,
+    role_id integer not null references roles (id) on delete cascade,
+    created_at timestamp without time zone not null default now(),
+    primary key (user_id, role_id)
+);
+
+-- default roles and permissions
+insert into roles (name, description) values
+    ('admin', 'Manages users and accounts'),
+    ('user', 'Every registered user')
+on conflict (name) do nothing;
+
+insert into permissions (name, description) values
+    ('users:read', 'List and view users'),
+    ('users:write', 'Change and delete users'),
+    ('roles:manage', 'Grant and revoke roles'),
+    ('accounts:unlock', 'Clear login lockouts'),
+    ('mail:send', 'Send mail through the broker'),
+    ('logs:write', 'Write log entries through the broker')
+on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where r.name = 'admin'
+on conflict do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where r.name = 'user' and p.name in ('mail:send', 'logs:write')
+on conflict do nothing;
+
+-- every existing user gets the user role
+insert into user_roles (user_id, role_id)
+    select u.id, r.id from users u, roles r
+    where r.name = 'user'
+on conflict do nothing;
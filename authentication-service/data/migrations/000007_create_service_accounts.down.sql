@@ -0,0 +1,5 @@
+drop table if exists api_key_scopes;
+drop table if exists api_keys;
+drop table if exists service_accounts;
+
+delete from permissions where name = 'service_accounts:manage';
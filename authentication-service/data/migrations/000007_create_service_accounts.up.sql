@@ -0,0 +1,38 @@
+-- service accounts are non-human callers, like batch jobs, that authenticate with API keys
+create table if not exists service_accounts (
+    id serial primary key,
+    name text not null unique,
+    description text not null default '',
+    created_at timestamp without time zone not null default now()
+);
+
+-- only a SHA-256 hash of each key is stored; the prefix is kept in the clear so keys
+-- can be told apart and looked up
+create table if not exists api_keys (
+    id serial primary key,
+    service_account_id integer not null references service_accounts (id) on delete cascade,
+    name text not null,
+    prefix text not null unique,
+    key_hash bytea not null,
+    expires_at timestamp without time zone,
+    last_used_at timestamp without time zone,
+    revoked_at timestamp without time zone,
+    created_at timestamp without time zone not null default now(),
+    unique (service_account_id, name)
+);
+
+-- the permissions an API key may use
+create table if not exists api_key_scopes (
+    api_key_id integer not null references api_keys (id) on delete cascade,
+    permission_id integer not null references permissions (id) on delete cascade,
+    primary key (api_key_id, permission_id)
+);
+
+insert into permissions (name, description) values
+    ('service_accounts:manage', 'Create service accounts and manage their API keys')
+on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where r.name = 'admin' and p.name = 'service_accounts:manage'
+on conflict do nothing;
@@ -0,0 +1,5 @@
+alter table refresh_tokens drop column if exists session_id;
+
+drop table if exists sessions;
+
+delete from permissions where name = 'sessions:revoke';
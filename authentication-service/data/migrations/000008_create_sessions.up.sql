@@ -0,0 +1,28 @@
+-- one row per login. Refresh tokens rotate within a session; revoking the session
+-- revokes them all, and the broker stops accepting its access tokens.
+create table if not exists sessions (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    user_agent text not null default '',
+    ip text not null default '',
+    mfa boolean not null default false,
+    created_at timestamp without time zone not null default now(),
+    last_seen_at timestamp without time zone not null default now(),
+    expires_at timestamp without time zone not null,
+    revoked_at timestamp without time zone
+);
+
+create index if not exists sessions_user_id_idx on sessions (user_id);
+create index if not exists sessions_revoked_at_idx on sessions (revoked_at);
+
+alter table refresh_tokens
+    add column if not exists session_id integer references sessions (id) on delete cascade;
+
+insert into permissions (name, description) values
+    ('sessions:revoke', 'List and revoke other users'' sessions')
+on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where r.name = 'admin' and p.name = 'sessions:revoke'
+on conflict do nothing;
@@ -0,0 +1,4 @@
+drop table if exists privacy_request_steps;
+drop table if exists privacy_requests;
+
+delete from permissions where name = 'privacy:manage';
@@ -0,0 +1,35 @@
+-- the audit trail of subject access (export) and erasure requests. There is no
+-- foreign key to users: the trail has to outlive the data it describes, and holds
+-- nothing but the user's ID.
+create table if not exists privacy_requests (
+    id serial primary key,
+    user_id integer not null,
+    kind text not null check (kind in ('export', 'erase')),
+    requested_by integer not null,
+    status text not null default 'started' check (status in ('started', 'completed', 'failed')),
+    created_at timestamp without time zone not null default now(),
+    completed_at timestamp without time zone
+);
+
+create index if not exists privacy_requests_user_id_idx on privacy_requests (user_id);
+
+-- one row per step carried out for a request, in order
+create table if not exists privacy_request_steps (
+    id serial primary key,
+    request_id integer not null references privacy_requests (id) on delete cascade,
+    step text not null,
+    status text not null check (status in ('done', 'failed')),
+    detail text not null default '',
+    created_at timestamp without time zone not null default now()
+);
+
+create index if not exists privacy_request_steps_request_id_idx on privacy_request_steps (request_id);
+
+insert into permissions (name, description) values
+    ('privacy:manage', 'Export and erase users'' personal data')
+on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where r.name = 'admin' and p.name = 'privacy:manage'
+on conflict do nothing;
@@ -0,0 +1,11 @@
+-- single use login links created by /login/magic/request. Only the token hash is kept.
+create table if not exists magic_links (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    token_hash bytea not null unique,
+    expires_at timestamp without time zone not null,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone not null default now()
+);
+
+create index if not exists magic_links_user_id_idx on magic_links (user_id);
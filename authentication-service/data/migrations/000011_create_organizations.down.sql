@@ -0,0 +1,9 @@
+alter table sessions drop column if exists organization_id;
+
+drop table if exists organization_members;
+drop table if exists organizations;
+
+delete from roles where name in ('owner', 'member') and scope = 'organization';
+alter table roles drop column if exists scope;
+
+delete from permissions where name = 'organizations:manage';
@@ -0,0 +1,53 @@
+-- organizations are the customer companies using the product. Users can belong to
+-- several, with one role in each.
+create table if not exists organizations (
+    id serial primary key,
+    name text not null,
+    slug text not null unique,
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now()
+);
+
+-- global roles are granted through user_roles and apply everywhere; organization
+-- roles are held through a membership and only apply while that organization is the
+-- user's active one
+alter table roles
+    add column if not exists scope text not null default 'global' check (scope in ('global', 'organization'));
+
+create table if not exists organization_members (
+    organization_id integer not null references organizations (id) on delete cascade,
+    user_id integer not null references users (id) on delete cascade,
+    role_id integer not null references roles (id),
+    created_at timestamp without time zone not null default now(),
+    primary key (organization_id, user_id)
+);
+
+create index if not exists organization_members_user_id_idx on organization_members (user_id);
+
+-- the organization a login is acting in; it goes into the session's access tokens
+alter table sessions
+    add column if not exists organization_id integer references organizations (id) on delete set null;
+
+insert into roles (name, description, scope) values
+    ('owner', 'Manages an organization, its members and their accounts', 'organization'),
+    ('member', 'Belongs to an organization', 'organization')
+on conflict (name) do nothing;
+
+insert into permissions (name, description) values
+    ('organizations:manage', 'Create organizations and manage their members')
+on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where r.name = 'admin' and p.name = 'organizations:manage'
+on conflict do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where r.name = 'owner' and p.name in ('organizations:manage', 'users:read', 'users:write', 'mail:send', 'logs:write')
+on conflict do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where r.name = 'member' and p.name in ('mail:send', 'logs:write')
+on conflict do nothing;
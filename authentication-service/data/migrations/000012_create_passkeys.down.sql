@@ -0,0 +1,2 @@
+drop table if exists passkey_challenges;
+drop table if exists passkeys;
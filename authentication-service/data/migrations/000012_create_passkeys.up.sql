@@ -0,0 +1,31 @@
+-- WebAuthn credentials (passkeys). The public key is the COSE_Key the authenticator
+-- returned at registration; sign_count is its last reported signature counter.
+create table if not exists passkeys (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    credential_id bytea not null unique,
+    public_key bytea not null,
+    sign_count bigint not null default 0,
+    aaguid bytea not null,
+    transports text not null default '',
+    name text not null default '',
+    backup_eligible boolean not null default false,
+    created_at timestamp without time zone not null default now(),
+    last_used_at timestamp without time zone
+);
+
+create index if not exists passkeys_user_id_idx on passkeys (user_id);
+
+-- challenges handed out by /webauthn/register/begin and /login/webauthn/begin. The
+-- client gets back an opaque token to finish the ceremony with; only its hash is kept.
+-- user_id is null for sign ins that start without an email address.
+create table if not exists passkey_challenges (
+    id serial primary key,
+    user_id integer references users (id) on delete cascade,
+    token_hash bytea not null unique,
+    challenge bytea not null,
+    ceremony text not null check (ceremony in ('registration', 'authentication')),
+    expires_at timestamp without time zone not null,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone not null default now()
+);
@@ -0,0 +1,6 @@
+drop table if exists account_status_changes;
+
+drop index if exists users_status_idx;
+alter table users drop column if exists status;
+
+delete from permissions where name = 'accounts:suspend';
@@ -0,0 +1,33 @@
+-- the lifecycle state of an account. user_active is kept in step (1 when active) for
+-- anything still reading it.
+alter table users
+    add column if not exists status text not null default 'pending_verification'
+    check (status in ('pending_verification', 'active', 'suspended', 'locked', 'deleted'));
+
+update users set status = 'active' where user_active = 1;
+update users set status = 'deleted' where email like 'erased-%@erased.invalid';
+
+create index if not exists users_status_idx on users (status);
+
+-- every change of status, with why it happened and who did it. actor_id is null when
+-- the service changed the status itself.
+create table if not exists account_status_changes (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    from_status text not null,
+    to_status text not null,
+    reason text not null default '',
+    actor_id integer references users (id) on delete set null,
+    created_at timestamp without time zone not null default now()
+);
+
+create index if not exists account_status_changes_user_id_idx on account_status_changes (user_id);
+
+insert into permissions (name, description) values
+    ('accounts:suspend', 'Suspend and restore accounts')
+on conflict (name) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+    select r.id, p.id from roles r, permissions p
+    where r.name = 'admin' and p.name = 'accounts:suspend'
+on conflict do nothing;
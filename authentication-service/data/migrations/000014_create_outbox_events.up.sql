@@ -0,0 +1,16 @@
+-- user events waiting to be published to the users_topic exchange. They are written
+-- in the same transaction as the change they describe; delivered_at is set once
+-- RabbitMQ has confirmed them. user_id has no foreign key so the event for a deleted
+-- user outlives them.
+create table if not exists outbox_events (
+    id bigserial primary key,
+    event_id text not null unique,
+    event_type text not null,
+    user_id integer,
+    payload jsonb not null,
+    created_at timestamp without time zone not null default now(),
+    delivered_at timestamp without time zone
+);
+
+create index if not exists outbox_events_undelivered_idx on outbox_events (id) where delivered_at is null;
+create index if not exists outbox_events_user_id_idx on outbox_events (user_id);
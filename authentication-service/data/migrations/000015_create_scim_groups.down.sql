@@ -0,0 +1,5 @@
+drop table if exists user_external_ids;
+drop table if exists group_members;
+drop table if exists groups;
+
+delete from permissions where name = 'scim:provision';
@@ -0,0 +1,29 @@
+-- groups kept in step with an identity provider over SCIM. external_id is the
+-- provider's own id for the group.
+create table if not exists groups (
+    id serial primary key,
+    display_name text not null unique,
+    external_id text unique,
+    created_at timestamp without time zone not null default now(),
+    updated_at timestamp without time zone not null default now()
+);
+
+create table if not exists group_members (
+    group_id integer not null references groups (id) on delete cascade,
+    user_id integer not null references users (id) on delete cascade,
+    created_at timestamp without time zone not null default now(),
+    primary key (group_id, user_id)
+);
+
+create index if not exists group_members_user_id_idx on group_members (user_id);
+
+-- the identity provider's id for users it provisioned
+create table if not exists user_external_ids (
+    user_id integer primary key references users (id) on delete cascade,
+    external_id text not null unique
+);
+
+-- only service accounts get this scope; no role grants it
+insert into permissions (name, description) values
+    ('scim:provision', 'Provision users and groups over SCIM')
+on conflict (name) do nothing;
@@ -0,0 +1,3 @@
+-- addresses are looked up without regard to case, so two accounts can't have ones
+-- that differ only in case. This fails if existing accounts do; merge them first.
+create unique index if not exists users_email_lower_idx on users (lower(email));
@@ -0,0 +1 @@
+alter table refresh_tokens drop column if exists amr;
@@ -0,0 +1,5 @@
+-- the authentication methods of the login that created a refresh token, space
+-- separated, so tokens refreshed from it say how the user logged in. Older tokens
+-- could only have come from a password, with or without a second factor.
+alter table refresh_tokens add column if not exists amr text not null default 'pwd';
+update refresh_tokens set amr = 'pwd otp' where mfa;
@@ -0,0 +1,3 @@
+delete from user_external_ids where external_id is null;
+
+alter table user_external_ids alter column external_id set not null;
@@ -0,0 +1,3 @@
+-- every user created over SCIM gets a row here, with a null external_id when the
+-- identity provider didn't send one, so SCIM only reaches the users it provisioned
+alter table user_external_ids alter column external_id drop not null;
@@ -4,24 +4,37 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
+	"userevents"
 )
 
-const dbTimeout = time.Second * 3
-
-var db *sql.DB
+var db *database
 
 // New is the function used to create an instance of the data package. It returns the type
 // Model, which embeds all the types we want to be available to our application.
 func New(dbPool *sql.DB) Models {
-	db = dbPool
+	db = newDatabase(dbPool)
 
-	// For our usecase, we only have type User model
 	return Models{
-		User: User{},
+		User:             NewPostgresUserRepository(),
+		Token:            &Token{},
+		PasswordReset:    &PasswordReset{},
+		TwoFactor:        &TwoFactor{},
+		LoginThrottle:    &LoginThrottle{},
+		Role:             &Role{},
+		ServiceAccount:   ServiceAccount{},
+		APIKey:           &APIKey{},
+		Session:          &Session{},
+		PrivacyRequest:   PrivacyRequest{},
+		MagicLink:        &MagicLink{},
+		Organization:     &Organization{},
+		Passkey:          Passkey{},
+		PasskeyChallenge: PasskeyChallenge{},
+		Outbox:           &Outbox{},
+		Group:            &Group{},
+		Provisioning:     &Provisioning{},
 	}
 }
 
@@ -29,10 +42,29 @@ func New(dbPool *sql.DB) Models {
 // in this type is available to us throughout the application, anywhere that the
 // app variable is used, provided that the model is also added in the New function.
 type Models struct {
-	User User
+	// the interfaces let handlers run against the in-memory stores in tests
+	User             UserRepository
+	Token            TokenRepository
+	PasswordReset    PasswordResetRepository
+	TwoFactor        TwoFactorRepository
+	LoginThrottle    LoginThrottleRepository
+	Role             RoleRepository
+	ServiceAccount   ServiceAccount
+	APIKey           APIKeyRepository
+	Session          SessionRepository
+	PrivacyRequest   PrivacyRequest
+	MagicLink        MagicLinkRepository
+	Organization     OrganizationRepository
+	Passkey          Passkey
+	PasskeyChallenge PasskeyChallenge
+	Outbox           OutboxRepository
+	Group            GroupRepository
+	Provisioning     ProvisioningRepository
 }
 
-// User is the structure which holds one user from the database.
+// User is the structure which holds one user from the database. Active is 1 when
+// Status is StatusActive; it is kept for clients that predate Status. Change an
+// account's status with Transition.
 type User struct {
 	ID        int       `json:"id"`
 	Email     string    `json:"email"`
@@ -40,16 +72,17 @@ type User struct {
 	LastName  string    `json:"last_name,omitempty"`
 	Password  string    `json:"-"`
 	Active    int       `json:"active"`
+	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
 // GetAll returns a slice of all users, sorted by last name
-func (u *User) GetAll() ([]*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (u *User) GetAll(ctx context.Context) ([]*User, error) {
+	ctx, cancel := queryContext(ctx, "User.GetAll")
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at
+	query := `select id, email, first_name, last_name, password, user_active, status, created_at, updated_at
 	from users order by last_name`
 
 	rows, err := db.QueryContext(ctx, query)
@@ -69,6 +102,7 @@ func (u *User) GetAll() ([]*User, error) {
 			&user.LastName,
 			&user.Password,
 			&user.Active,
+			&user.Status,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		)
@@ -83,15 +117,16 @@ func (u *User) GetAll() ([]*User, error) {
 	return users, nil
 }
 
-// GetByEmail returns one user by email
-func (u *User) GetByEmail(email string) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// GetByEmail returns one user by email. Addresses match whatever their case, and
+// surrounding space is ignored.
+func (u *User) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := queryContext(ctx, "User.GetByEmail")
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where email = $1`
+	query := `select id, email, first_name, last_name, password, user_active, status, created_at, updated_at from users where lower(email) = $1`
 
 	var user User
-	row := db.QueryRowContext(ctx, query, email)
+	row := db.QueryRowContext(ctx, query, FoldEmail(email))
 
 	err := row.Scan(
 		&user.ID,
@@ -100,6 +135,7 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.Active,
+		&user.Status,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -112,11 +148,11 @@ func (u *User) GetByEmail(email string) (*User, error) {
 }
 
 // GetOne returns one user by id
-func (u *User) GetOne(id int) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (u *User) GetOne(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := queryContext(ctx, "User.GetOne")
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where id = $1`
+	query := `select id, email, first_name, last_name, password, user_active, status, created_at, updated_at from users where id = $1`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, id)
@@ -128,6 +164,7 @@ func (u *User) GetOne(id int) (*User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.Active,
+		&user.Status,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -140,25 +177,39 @@ func (u *User) GetOne(id int) (*User, error) {
 }
 
 // Update updates one user in the database, using the information
-// stored in the receiver u
-func (u *User) Update() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// stored in the receiver u. The status is left alone; it only changes through
+// Transition. A user.updated event is written if anything changed.
+func (u *User) Update(ctx context.Context) error {
+	ctx, cancel := queryContext(ctx, "User.Update")
 	defer cancel()
 
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := selectUserForUpdate(ctx, tx, u.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// an update that matches no rows isn't an error
+			return nil
+		}
+		return err
+	}
+
 	stmt := `update users set
 		email = $1,
 		first_name = $2,
 		last_name = $3,
-		user_active = $4,
-		updated_at = $5
-		where id = $6
+		updated_at = $4
+		where id = $5
 	`
 
-	_, err := db.ExecContext(ctx, stmt,
+	_, err = tx.ExecContext(ctx, stmt,
 		u.Email,
 		u.FirstName,
 		u.LastName,
-		u.Active,
 		time.Now(),
 		u.ID,
 	)
@@ -167,76 +218,141 @@ func (u *User) Update() error {
 		return err
 	}
 
-	return nil
+	after := *before
+	after.Email = u.Email
+	after.FirstName = u.FirstName
+	after.LastName = u.LastName
+	if e, changed := updatedEvent(*before, after); changed {
+		err = addEvent(ctx, tx, u.ID, userevents.TypeUpdated, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 // Delete deletes one user from the database, by User.ID
-func (u *User) Delete() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (u *User) Delete(ctx context.Context) error {
+	return u.DeleteByID(ctx, u.ID)
+}
+
+// DeleteByID deletes one user from the database, by ID, and writes a user.deleted
+// event if there was one
+func (u *User) DeleteByID(ctx context.Context, id int) error {
+	ctx, cancel := queryContext(ctx, "User.DeleteByID")
 	defer cancel()
 
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	stmt := `delete from users where id = $1`
 
-	_, err := db.ExecContext(ctx, stmt, u.ID)
+	result, err := tx.ExecContext(ctx, stmt, id)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
 
-// DeleteByID deletes one user from the database, by ID
-func (u *User) DeleteByID(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+	if deleted > 0 {
+		err = addEvent(ctx, tx, id, userevents.TypeDeleted, userevents.Deleted{UserID: id})
+		if err != nil {
+			return err
+		}
+	}
 
-	stmt := `delete from users where id = $1`
+	return tx.Commit()
+}
 
-	_, err := db.ExecContext(ctx, stmt, id)
+// selectUserForUpdate reads a user as part of tx and locks their row until it ends
+func selectUserForUpdate(ctx context.Context, tx *transaction, id int) (*User, error) {
+	query := `select id, email, first_name, last_name, status, created_at
+	from users where id = $1 for update`
+
+	var user User
+	err := tx.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Status,
+		&user.CreatedAt,
+	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &user, nil
 }
 
-// Insert inserts a new user into the database, and returns the ID of the newly inserted row
-func (u *User) Insert(user User) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// Insert inserts a new user into the database, along with a user.created event, and
+// returns the ID of the newly inserted row
+func (u *User) Insert(ctx context.Context, user User) (int, error) {
+	ctx, cancel := queryContext(ctx, "User.Insert")
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	hashedPassword, err := HashPassword(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	status, err := initialStatus(user)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, err
 	}
+	defer tx.Rollback()
 
-	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	user.Status = status
+	user.CreatedAt = time.Now()
 
-	err = db.QueryRowContext(ctx, stmt,
+	stmt := `insert into users (email, first_name, last_name, password, user_active, status, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
-		user.Active,
-		time.Now(),
-		time.Now(),
-	).Scan(&newID)
+		activeFlag(status),
+		status,
+		user.CreatedAt,
+		user.CreatedAt,
+	).Scan(&user.ID)
+
+	if err != nil {
+		return 0, err
+	}
 
+	err = addEvent(ctx, tx, user.ID, userevents.TypeCreated, userevents.Created{User: eventUser(user)})
 	if err != nil {
 		return 0, err
 	}
 
-	return newID, nil
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return user.ID, nil
 }
 
 // ResetPassword is the method we will use to change a user's password.
-func (u *User) ResetPassword(password string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (u *User) ResetPassword(ctx context.Context, password string) error {
+	ctx, cancel := queryContext(ctx, "User.ResetPassword")
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	hashedPassword, err := HashPassword(password)
 	if err != nil {
 		return err
 	}
@@ -250,20 +366,71 @@ func (u *User) ResetPassword(password string) error {
 	return nil
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
-func (u *User) PasswordMatches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plainText))
+// ErasedEmail is the placeholder address an erased user is left with. It is unique
+// per user and can never receive mail.
+func ErasedEmail(id int) string {
+	return fmt.Sprintf("erased-%d@erased.invalid", id)
+}
+
+// Anonymize strips a user of everything that identifies them: their email address is
+// replaced with ErasedEmail, their names and password are blanked and their status
+// becomes StatusDeleted. The row stays, so the ID other records refer to still resolves.
+// Events about the user hold the details being erased, so they are all deleted,
+// delivered or not, and a user.deleted event is written in their place.
+func (u *User) Anonymize(ctx context.Context, id int) error {
+	ctx, cancel := queryContext(ctx, "User.Anonymize")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			// invalid password
-			return false, nil
-		default:
-			return false, err
-		}
+		return err
 	}
+	defer tx.Rollback()
+
+	stmt := `update users set
+		email = $1,
+		first_name = '',
+		last_name = '',
+		password = '',
+		user_active = 0,
+		status = 'deleted',
+		updated_at = $2
+		where id = $3
+	`
+
+	result, err := tx.ExecContext(ctx, stmt, ErasedEmail(id), time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	erased, err := result.RowsAffected()
+	if err != nil || erased == 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from outbox_events where user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	err = addEvent(ctx, tx, id, userevents.TypeDeleted, userevents.Deleted{UserID: id, Erased: true})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PasswordMatches compares a user supplied password with the hash we have stored for
+// a given user in the database. If the password and hash match, we return true;
+// otherwise, we return false.
+func (u *User) PasswordMatches(plainText string) (bool, error) {
+	return CheckPassword(u.Password, plainText)
+}
 
-	return true, nil
+// PasswordNeedsRehash reports whether the user's password hash was made with older
+// hashing settings than we use now, and should be replaced next time we see the
+// plain text password
+func (u *User) PasswordNeedsRehash() bool {
+	return passwordHasher.NeedsRehash(u.Password)
 }
@@ -0,0 +1,395 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// roles every organization has
+const (
+	OwnerRole  = "owner"
+	MemberRole = "member"
+)
+
+var (
+	// ErrOrganizationNotFound is returned when an organization doesn't exist
+	ErrOrganizationNotFound = errors.New("organization not found")
+	// ErrDuplicateSlug is returned when an organization is created with a slug that
+	// another one already has
+	ErrDuplicateSlug = errors.New("organization slug already taken")
+	// ErrNotMember is returned when a user doesn't belong to an organization
+	ErrNotMember = errors.New("user is not a member of this organization")
+	// ErrLastOwner is returned when a change would leave an organization without an owner
+	ErrLastOwner = errors.New("an organization must keep at least one owner")
+)
+
+// Organization is the structure which holds one organization (tenant) from the database
+type Organization struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Membership is a user's place in an organization: the role they hold there and the
+// permissions it grants
+type Membership struct {
+	OrganizationID int       `json:"organization_id"`
+	Organization   string    `json:"organization"`
+	Slug           string    `json:"slug"`
+	UserID         int       `json:"user_id"`
+	Role           string    `json:"role"`
+	Permissions    []string  `json:"permissions"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Member is one user in an organization's member list
+type Member struct {
+	User     *User     `json:"user"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Insert creates an organization with ownerID as its first owner and returns its ID
+func (o *Organization) Insert(ctx context.Context, org Organization, ownerID int) (int, error) {
+	ctx, cancel := queryContext(ctx, "Organization.Insert")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	stmt := `insert into organizations (name, slug, created_at, updated_at)
+		values ($1, $2, $3, $3) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt, org.Name, org.Slug, time.Now()).Scan(&id)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, ErrDuplicateSlug
+		}
+		return 0, err
+	}
+
+	stmt = `insert into organization_members (organization_id, user_id, role_id, created_at)
+		select $1, $2, id, $4 from roles where name = $3 and scope = 'organization'`
+
+	_, err = tx.ExecContext(ctx, stmt, id, ownerID, OwnerRole, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetOne returns one organization by ID
+func (o *Organization) GetOne(ctx context.Context, id int) (*Organization, error) {
+	ctx, cancel := queryContext(ctx, "Organization.GetOne")
+	defer cancel()
+
+	query := `select id, name, slug, created_at, updated_at from organizations where id = $1`
+
+	var org Organization
+	err := db.QueryRowContext(ctx, query, id).Scan(
+		&org.ID,
+		&org.Name,
+		&org.Slug,
+		&org.CreatedAt,
+		&org.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrOrganizationNotFound
+		}
+		return nil, err
+	}
+
+	return &org, nil
+}
+
+// ForUser returns every organization a user belongs to, in the order they joined. The
+// permissions of each membership are left empty; use Membership for those.
+func (o *Organization) ForUser(ctx context.Context, userID int) ([]*Membership, error) {
+	ctx, cancel := queryContext(ctx, "Organization.ForUser")
+	defer cancel()
+
+	query := `select o.id, o.name, o.slug, m.user_id, r.name, m.created_at
+	from organization_members m
+	join organizations o on o.id = m.organization_id
+	join roles r on r.id = m.role_id
+	where m.user_id = $1
+	order by m.created_at, o.id`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []*Membership{}
+	for rows.Next() {
+		membership := Membership{Permissions: []string{}}
+		err := rows.Scan(
+			&membership.OrganizationID,
+			&membership.Organization,
+			&membership.Slug,
+			&membership.UserID,
+			&membership.Role,
+			&membership.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, &membership)
+	}
+
+	return memberships, rows.Err()
+}
+
+// Membership returns a user's membership of an organization, with the permissions
+// their role there grants
+func (o *Organization) Membership(ctx context.Context, orgID, userID int) (*Membership, error) {
+	ctx, cancel := queryContext(ctx, "Organization.Membership")
+	defer cancel()
+
+	query := `select o.id, o.name, o.slug, m.user_id, r.name, m.created_at, coalesce(p.name, '')
+	from organization_members m
+	join organizations o on o.id = m.organization_id
+	join roles r on r.id = m.role_id
+	left join role_permissions rp on rp.role_id = r.id
+	left join permissions p on p.id = rp.permission_id
+	where m.organization_id = $1 and m.user_id = $2
+	order by p.name`
+
+	rows, err := db.QueryContext(ctx, query, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var membership *Membership
+	for rows.Next() {
+		var m Membership
+		var permission string
+		err := rows.Scan(&m.OrganizationID, &m.Organization, &m.Slug, &m.UserID, &m.Role, &m.CreatedAt, &permission)
+		if err != nil {
+			return nil, err
+		}
+
+		if membership == nil {
+			m.Permissions = []string{}
+			membership = &m
+		}
+		if permission != "" {
+			membership.Permissions = append(membership.Permissions, permission)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if membership == nil {
+		return nil, ErrNotMember
+	}
+
+	return membership, nil
+}
+
+// IsMember reports whether a user belongs to an organization
+func (o *Organization) IsMember(ctx context.Context, orgID, userID int) (bool, error) {
+	ctx, cancel := queryContext(ctx, "Organization.IsMember")
+	defer cancel()
+
+	query := `select exists(select 1 from organization_members where organization_id = $1 and user_id = $2)`
+
+	var member bool
+	err := db.QueryRowContext(ctx, query, orgID, userID).Scan(&member)
+	if err != nil {
+		return false, err
+	}
+
+	return member, nil
+}
+
+// Members returns everyone in an organization, sorted by last name
+func (o *Organization) Members(ctx context.Context, orgID int) ([]*Member, error) {
+	ctx, cancel := queryContext(ctx, "Organization.Members")
+	defer cancel()
+
+	query := `select u.id, u.email, u.first_name, u.last_name, u.user_active, u.status, u.created_at, u.updated_at,
+		r.name, m.created_at
+	from organization_members m
+	join users u on u.id = m.user_id
+	join roles r on r.id = m.role_id
+	where m.organization_id = $1
+	order by u.last_name, u.id`
+
+	rows, err := db.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*Member{}
+	for rows.Next() {
+		var user User
+		var member Member
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Active,
+			&user.Status,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&member.Role,
+			&member.JoinedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		member.User = &user
+		members = append(members, &member)
+	}
+
+	return members, rows.Err()
+}
+
+// SetMember adds a user to an organization with the named role, or changes the role
+// of someone who is already a member. The role has to be an organization role.
+func (o *Organization) SetMember(ctx context.Context, orgID, userID int, roleName string) error {
+	ctx, cancel := queryContext(ctx, "Organization.SetMember")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var roleID int
+	err = tx.QueryRowContext(ctx, `select id from roles where name = $1 and scope = 'organization'`, roleName).Scan(&roleID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRoleNotFound
+		}
+		return err
+	}
+
+	if roleName != OwnerRole {
+		err = keepAnOwner(ctx, tx, orgID, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	stmt := `insert into organization_members (organization_id, user_id, role_id, created_at)
+		values ($1, $2, $3, $4)
+		on conflict (organization_id, user_id) do update set role_id = excluded.role_id`
+
+	_, err = tx.ExecContext(ctx, stmt, orgID, userID, roleID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveMember takes a user out of an organization. Their sessions acting in it carry
+// on without an active organization.
+func (o *Organization) RemoveMember(ctx context.Context, orgID, userID int) error {
+	ctx, cancel := queryContext(ctx, "Organization.RemoveMember")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = keepAnOwner(ctx, tx, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `delete from organization_members where organization_id = $1 and user_id = $2`,
+		orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotMember
+	}
+
+	_, err = tx.ExecContext(ctx, `update sessions set organization_id = null where organization_id = $1 and user_id = $2`,
+		orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveAllForUser takes a user out of every organization, even ones they are the last
+// owner of. It is meant for erasing a user, which can't wait for a new owner.
+func (o *Organization) RemoveAllForUser(ctx context.Context, userID int) error {
+	ctx, cancel := queryContext(ctx, "Organization.RemoveAllForUser")
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `delete from organization_members where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// keepAnOwner returns ErrLastOwner if userID is the only owner of an organization, so
+// taking their ownership away would leave nobody to manage it. The owners are locked
+// until tx ends, so two owners can't demote each other at the same time.
+func keepAnOwner(ctx context.Context, tx *transaction, orgID, userID int) error {
+	query := `select m.user_id
+	from organization_members m
+	join roles r on r.id = m.role_id
+	where m.organization_id = $1 and r.name = $2
+	for update of m`
+
+	rows, err := tx.QueryContext(ctx, query, orgID, OwnerRole)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var owners []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		owners = append(owners, id)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if len(owners) == 1 && owners[0] == userID {
+		return ErrLastOwner
+	}
+
+	return nil
+}
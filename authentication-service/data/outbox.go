@@ -0,0 +1,172 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+	"userevents"
+)
+
+// deliverTimeout bounds one batch of Deliver, which holds its rows locked while they
+// are published
+const deliverTimeout = time.Minute
+
+// Outbox holds user events until they have been published. Events are written in the
+// same transaction as the change they describe, so one can't happen without the
+// other, and a relay publishes them from here whenever RabbitMQ is reachable.
+type Outbox struct{}
+
+// addEvent writes an event about a user to the outbox, as part of ex
+func addEvent(ctx context.Context, ex execer, userID int, eventType string, payload any) error {
+	e, err := userevents.New(eventType, time.Now(), payload)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into outbox_events (event_id, event_type, user_id, payload, created_at)
+		values ($1, $2, $3, $4, $5)`
+
+	_, err = ex.ExecContext(ctx, stmt, e.ID, e.Type, nullIfZero(userID), body, e.OccurredAt)
+	return err
+}
+
+// Add writes an event that doesn't go with a change to the users table, like a login
+func (o *Outbox) Add(ctx context.Context, userID int, eventType string, payload any) error {
+	ctx, cancel := queryContext(ctx, "Outbox.Add")
+	defer cancel()
+
+	return addEvent(ctx, db, userID, eventType, payload)
+}
+
+// Deliver hands up to limit undelivered events to send, oldest first, and marks the
+// ones it sent as delivered. It stops at the first event send fails on, so events go
+// out in order, and returns how many were sent along with that error. Rows are locked
+// while they are sent and other relays skip them, so several instances of the service
+// can deliver at once without sending an event twice.
+func (o *Outbox) Deliver(ctx context.Context, limit int, send func(userevents.Envelope) error) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, deliverTimeout)
+	defer cancel()
+	ctx, cancel = queryContext(ctx, "Outbox.Deliver")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `select id, payload from outbox_events
+	where delivered_at is null
+	order by id
+	limit $1
+	for update skip locked`
+
+	rows, err := tx.QueryContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	type pending struct {
+		id    int64
+		event userevents.Envelope
+	}
+
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		var body []byte
+		err := rows.Scan(&p.id, &body)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		p.event, err = userevents.Parse(body)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	var sendErr error
+	for _, p := range batch {
+		if sendErr = send(p.event); sendErr != nil {
+			break
+		}
+
+		_, err = tx.ExecContext(ctx, `update outbox_events set delivered_at = $1 where id = $2`, time.Now(), p.id)
+		if err != nil {
+			return 0, err
+		}
+		sent++
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return sent, sendErr
+}
+
+// Purge deletes events that were delivered more than age ago, and returns how many
+// it deleted
+func (o *Outbox) Purge(ctx context.Context, age time.Duration) (int64, error) {
+	ctx, cancel := queryContext(ctx, "Outbox.Purge")
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from outbox_events where delivered_at < $1`, time.Now().Add(-age))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// eventUser is how a user appears in the events
+func eventUser(user User) userevents.User {
+	return userevents.User{
+		ID:        user.ID,
+		Email:     user.Email,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Status:    user.Status,
+		CreatedAt: user.CreatedAt,
+	}
+}
+
+// updatedEvent describes the change from before to after, and reports whether there
+// was one worth an event
+func updatedEvent(before, after User) (userevents.Updated, bool) {
+	e := userevents.Updated{User: eventUser(after)}
+
+	for _, field := range []struct {
+		name          string
+		before, after string
+	}{
+		{"email", before.Email, after.Email},
+		{"first_name", before.FirstName, after.FirstName},
+		{"last_name", before.LastName, after.LastName},
+		{"status", before.Status, after.Status},
+	} {
+		if field.before != field.after {
+			e.Changed = append(e.Changed, field.name)
+		}
+	}
+
+	if before.Status != after.Status {
+		e.PreviousStatus = before.Status
+	}
+
+	return e, len(e.Changed) > 0
+}
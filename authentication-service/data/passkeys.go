@@ -0,0 +1,307 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ceremonies a passkey challenge can be used for
+const (
+	PasskeyRegistration   = "registration"
+	PasskeyAuthentication = "authentication"
+)
+
+var (
+	// ErrPasskeyNotFound is returned when a passkey doesn't exist or belongs to someone else
+	ErrPasskeyNotFound = errors.New("passkey not found")
+	// ErrDuplicatePasskey is returned when a credential is registered a second time
+	ErrDuplicatePasskey = errors.New("passkey already registered")
+	// ErrSignCountReplayed is returned when a passkey is used with a signature counter
+	// that another sign in already recorded
+	ErrSignCountReplayed = errors.New("passkey signature counter already used")
+)
+
+// Passkey is the structure which holds one WebAuthn credential from the database
+type Passkey struct {
+	ID             int        `json:"id"`
+	UserID         int        `json:"user_id"`
+	CredentialID   []byte     `json:"credential_id"`
+	PublicKey      []byte     `json:"-"`
+	SignCount      uint32     `json:"-"`
+	AAGUID         []byte     `json:"aaguid"`
+	Transports     []string   `json:"transports"`
+	Name           string     `json:"name"`
+	BackupEligible bool       `json:"backup_eligible"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+}
+
+// PasskeyChallenge is a pending registration or sign in. The client holds the
+// plain text token and sends it back with the authenticator's response.
+type PasskeyChallenge struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	PlainText string    `json:"-"`
+	Challenge []byte    `json:"-"`
+	Ceremony  string    `json:"ceremony"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+const passkeyColumns = `id, user_id, credential_id, public_key, sign_count, aaguid, transports, name,
+	backup_eligible, created_at, last_used_at`
+
+// Insert stores a newly registered passkey and returns its ID
+func (p *Passkey) Insert(ctx context.Context, passkey Passkey) (int, error) {
+	ctx, cancel := queryContext(ctx, "Passkey.Insert")
+	defer cancel()
+
+	stmt := `insert into passkeys (user_id, credential_id, public_key, sign_count, aaguid, transports, name,
+		backup_eligible, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+
+	var id int
+	err := db.QueryRowContext(ctx, stmt,
+		passkey.UserID,
+		passkey.CredentialID,
+		passkey.PublicKey,
+		int64(passkey.SignCount),
+		passkey.AAGUID,
+		strings.Join(passkey.Transports, ","),
+		passkey.Name,
+		passkey.BackupEligible,
+		time.Now(),
+	).Scan(&id)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, ErrDuplicatePasskey
+		}
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// ForUser returns a user's passkeys, oldest first
+func (p *Passkey) ForUser(ctx context.Context, userID int) ([]*Passkey, error) {
+	ctx, cancel := queryContext(ctx, "Passkey.ForUser")
+	defer cancel()
+
+	query := `select ` + passkeyColumns + ` from passkeys where user_id = $1 order by created_at, id`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []*Passkey{}
+	for rows.Next() {
+		passkey, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+
+	return passkeys, rows.Err()
+}
+
+// GetByCredentialID returns the passkey with the credential ID an authenticator sent
+func (p *Passkey) GetByCredentialID(ctx context.Context, credentialID []byte) (*Passkey, error) {
+	ctx, cancel := queryContext(ctx, "Passkey.GetByCredentialID")
+	defer cancel()
+
+	query := `select ` + passkeyColumns + ` from passkeys where credential_id = $1`
+
+	passkey, err := scanPasskey(db.QueryRowContext(ctx, query, credentialID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrPasskeyNotFound
+		}
+		return nil, err
+	}
+
+	return passkey, nil
+}
+
+// Use records a successful sign in with a passkey and its new signature counter. The
+// counter only moves forward, so it returns ErrSignCountReplayed if a concurrent sign
+// in got there first.
+func (p *Passkey) Use(ctx context.Context, id int, signCount uint32) error {
+	ctx, cancel := queryContext(ctx, "Passkey.Use")
+	defer cancel()
+
+	stmt := `update passkeys set sign_count = $1, last_used_at = $2
+		where id = $3 and (sign_count < $1 or $1 = 0)`
+
+	result, err := db.ExecContext(ctx, stmt, int64(signCount), time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrSignCountReplayed
+	}
+
+	return nil
+}
+
+// Delete removes one of a user's passkeys
+func (p *Passkey) Delete(ctx context.Context, userID, id int) error {
+	ctx, cancel := queryContext(ctx, "Passkey.Delete")
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from passkeys where id = $1 and user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrPasskeyNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUser removes all of a user's passkeys and pending passkey challenges
+func (p *Passkey) DeleteAllForUser(ctx context.Context, userID int) error {
+	ctx, cancel := queryContext(ctx, "Passkey.DeleteAllForUser")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from passkeys where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from passkey_challenges where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPasskey(row rowScanner) (*Passkey, error) {
+	var passkey Passkey
+	var signCount int64
+	var transports string
+	var lastUsedAt sql.NullTime
+
+	err := row.Scan(
+		&passkey.ID,
+		&passkey.UserID,
+		&passkey.CredentialID,
+		&passkey.PublicKey,
+		&signCount,
+		&passkey.AAGUID,
+		&transports,
+		&passkey.Name,
+		&passkey.BackupEligible,
+		&passkey.CreatedAt,
+		&lastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	passkey.SignCount = uint32(signCount)
+	passkey.Transports = []string{}
+	if transports != "" {
+		passkey.Transports = strings.Split(transports, ",")
+	}
+	if lastUsedAt.Valid {
+		passkey.LastUsedAt = &lastUsedAt.Time
+	}
+
+	return &passkey, nil
+}
+
+// New stores a challenge for a ceremony, valid for ttl. userID is 0 for a sign in
+// where we don't know yet who is signing in.
+func (c *PasskeyChallenge) New(ctx context.Context, userID int, challenge []byte, ceremony string, ttl time.Duration) (*PasskeyChallenge, error) {
+	ctx, cancel := queryContext(ctx, "PasskeyChallenge.New")
+	defer cancel()
+
+	plainText, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := PasskeyChallenge{
+		UserID:    userID,
+		PlainText: plainText,
+		Challenge: challenge,
+		Ceremony:  ceremony,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	stmt := `insert into passkey_challenges (user_id, token_hash, challenge, ceremony, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err = db.QueryRowContext(ctx, stmt,
+		nullIfZero(userID),
+		hashToken(plainText),
+		challenge,
+		ceremony,
+		pending.ExpiresAt,
+		time.Now(),
+	).Scan(&pending.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pending, nil
+}
+
+// Consume marks a challenge as used and returns it. Each challenge can only be
+// answered once; it returns ErrInvalidToken if the token is unknown, expired, spent
+// or was issued for the other ceremony.
+func (c *PasskeyChallenge) Consume(ctx context.Context, plainText, ceremony string) (*PasskeyChallenge, error) {
+	ctx, cancel := queryContext(ctx, "PasskeyChallenge.Consume")
+	defer cancel()
+
+	stmt := `update passkey_challenges set used_at = $1
+		where token_hash = $2 and ceremony = $3 and used_at is null and expires_at > $1
+		returning id, user_id, challenge, ceremony, expires_at`
+
+	var pending PasskeyChallenge
+	var userID sql.NullInt64
+	err := db.QueryRowContext(ctx, stmt, time.Now(), hashToken(plainText), ceremony).Scan(
+		&pending.ID,
+		&userID,
+		&pending.Challenge,
+		&pending.Ceremony,
+		&pending.ExpiresAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	pending.UserID = int(userID.Int64)
+
+	return &pending, nil
+}
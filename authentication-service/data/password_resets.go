@@ -0,0 +1,130 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PasswordReset is the structure which holds one password reset token. Like refresh
+// tokens, only the hash is kept in the database and each token can be used once.
+type PasswordReset struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	PlainText string    `json:"-"`
+	Hash      []byte    `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// New creates and stores a password reset token for a user, valid for ttl. Any reset
+// tokens the user requested earlier stop working, so only the newest link is valid.
+func (p *PasswordReset) New(ctx context.Context, userID int, ttl time.Duration) (*PasswordReset, error) {
+	ctx, cancel := queryContext(ctx, "PasswordReset.New")
+	defer cancel()
+
+	plainText, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	reset := PasswordReset{
+		UserID:    userID,
+		PlainText: plainText,
+		Hash:      hashToken(plainText),
+		ExpiresAt: time.Now().Add(ttl),
+		CreatedAt: time.Now(),
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `update password_resets set used_at = $1
+		where user_id = $2 and used_at is null`, time.Now(), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `insert into password_resets (user_id, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt, reset.UserID, reset.Hash, reset.ExpiresAt, reset.CreatedAt).Scan(&reset.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &reset, nil
+}
+
+// Redeem spends a password reset token and sets the new password of the user it
+// belongs to, returning their ID. Both happen in one transaction, so a token is only
+// used up once the password has changed. It returns ErrInvalidToken if the token is
+// unknown, expired or spent.
+func (p *PasswordReset) Redeem(ctx context.Context, plainText, password string) (int, error) {
+	ctx, cancel := queryContext(ctx, "PasswordReset.Redeem")
+	defer cancel()
+
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `update password_resets set used_at = $1
+		where token_hash = $2 and used_at is null and expires_at > $1
+		returning user_id`
+
+	var userID int
+	err = tx.QueryRowContext(ctx, stmt, time.Now(), hashToken(plainText)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrInvalidToken
+		}
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, `update users set password = $1 where id = $2`, hashedPassword, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if updated == 0 {
+		return 0, ErrInvalidToken
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// DeleteForUser removes every password reset token a user has asked for
+func (p *PasswordReset) DeleteForUser(ctx context.Context, userID int) error {
+	ctx, cancel := queryContext(ctx, "PasswordReset.DeleteForUser")
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `delete from password_resets where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// kinds of privacy request
+const (
+	PrivacyExport = "export"
+	PrivacyErase  = "erase"
+)
+
+// statuses of a privacy request, and of each step in one
+const (
+	PrivacyStarted   = "started"
+	PrivacyCompleted = "completed"
+	PrivacyFailed    = "failed"
+	StepDone         = "done"
+	StepFailed       = "failed"
+)
+
+// PrivacyRequest is one subject access (export) or erasure request, with the steps
+// taken to carry it out. Together they are the audit trail showing how a request was
+// handled, so they refer to the user by ID only and are kept after an erasure.
+type PrivacyRequest struct {
+	ID          int           `json:"id"`
+	UserID      int           `json:"user_id"`
+	Kind        string        `json:"kind"`
+	RequestedBy int           `json:"requested_by"`
+	Status      string        `json:"status"`
+	CreatedAt   time.Time     `json:"created_at"`
+	CompletedAt *time.Time    `json:"completed_at,omitempty"`
+	Steps       []PrivacyStep `json:"steps"`
+}
+
+// PrivacyStep records one step of a privacy request
+type PrivacyStep struct {
+	Step      string    `json:"step"`
+	Status    string    `json:"status"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Start records a new privacy request of the given kind and returns it
+func (p *PrivacyRequest) Start(ctx context.Context, userID, requestedBy int, kind string) (*PrivacyRequest, error) {
+	ctx, cancel := queryContext(ctx, "PrivacyRequest.Start")
+	defer cancel()
+
+	request := PrivacyRequest{
+		UserID:      userID,
+		Kind:        kind,
+		RequestedBy: requestedBy,
+		Status:      PrivacyStarted,
+		CreatedAt:   time.Now(),
+		Steps:       []PrivacyStep{},
+	}
+
+	stmt := `insert into privacy_requests (user_id, kind, requested_by, status, created_at)
+		values ($1, $2, $3, $4, $5) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		request.UserID,
+		request.Kind,
+		request.RequestedBy,
+		request.Status,
+		request.CreatedAt,
+	).Scan(&request.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// RecordStep adds a step to a request's trail
+func (p *PrivacyRequest) RecordStep(ctx context.Context, requestID int, step, status, detail string) error {
+	ctx, cancel := queryContext(ctx, "PrivacyRequest.RecordStep")
+	defer cancel()
+
+	stmt := `insert into privacy_request_steps (request_id, step, status, detail, created_at)
+		values ($1, $2, $3, $4, $5)`
+
+	_, err := db.ExecContext(ctx, stmt, requestID, step, status, detail, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Finish marks a request completed or failed
+func (p *PrivacyRequest) Finish(ctx context.Context, requestID int, status string) error {
+	ctx, cancel := queryContext(ctx, "PrivacyRequest.Finish")
+	defer cancel()
+
+	stmt := `update privacy_requests set status = $1, completed_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, status, time.Now(), requestID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Erased reports whether a user has already been erased
+func (p *PrivacyRequest) Erased(ctx context.Context, userID int) (bool, error) {
+	ctx, cancel := queryContext(ctx, "PrivacyRequest.Erased")
+	defer cancel()
+
+	query := `select exists(select 1 from privacy_requests where user_id = $1 and kind = $2 and status = $3)`
+
+	var erased bool
+	err := db.QueryRowContext(ctx, query, userID, PrivacyErase, PrivacyCompleted).Scan(&erased)
+	if err != nil {
+		return false, err
+	}
+
+	return erased, nil
+}
+
+// ForUser returns every privacy request made for a user, newest first, with their
+// steps in the order they were taken
+func (p *PrivacyRequest) ForUser(ctx context.Context, userID int) ([]*PrivacyRequest, error) {
+	ctx, cancel := queryContext(ctx, "PrivacyRequest.ForUser")
+	defer cancel()
+
+	query := `select r.id, r.user_id, r.kind, r.requested_by, r.status, r.created_at, r.completed_at,
+		s.step, s.status, s.detail, s.created_at
+	from privacy_requests r
+	left join privacy_request_steps s on s.request_id = r.id
+	where r.user_id = $1
+	order by r.created_at desc, r.id desc, s.id`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []*PrivacyRequest{}
+	var current *PrivacyRequest
+
+	for rows.Next() {
+		var request PrivacyRequest
+		var completedAt sql.NullTime
+		var step, stepStatus, detail sql.NullString
+		var stepAt sql.NullTime
+
+		err := rows.Scan(
+			&request.ID,
+			&request.UserID,
+			&request.Kind,
+			&request.RequestedBy,
+			&request.Status,
+			&request.CreatedAt,
+			&completedAt,
+			&step,
+			&stepStatus,
+			&detail,
+			&stepAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if current == nil || current.ID != request.ID {
+			if completedAt.Valid {
+				request.CompletedAt = &completedAt.Time
+			}
+			request.Steps = []PrivacyStep{}
+			current = &request
+			requests = append(requests, current)
+		}
+
+		if step.Valid {
+			current.Steps = append(current.Steps, PrivacyStep{
+				Step:      step.String,
+				Status:    stepStatus.String,
+				Detail:    detail.String,
+				CreatedAt: stepAt.Time,
+			})
+		}
+	}
+
+	return requests, rows.Err()
+}
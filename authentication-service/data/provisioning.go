@@ -0,0 +1,180 @@
+package data
+
+import (
+	"authentication/scim"
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrDuplicateExternalID is returned when a user is given an external id that another
+// user already has
+var ErrDuplicateExternalID = errors.New("external id already taken")
+
+// provisioningColumns maps the SCIM attributes users can be filtered on to their
+// columns. A user has one email address, which is also their userName.
+var provisioningColumns = map[string]scim.Column{
+	"id":                {Expr: "u.id", Type: scim.ColumnInteger},
+	"username":          {Expr: "u.email"},
+	"externalid":        {Expr: "x.external_id", CaseExact: true},
+	"name.givenname":    {Expr: "u.first_name"},
+	"name.familyname":   {Expr: "u.last_name"},
+	"displayname":       {Expr: "trim(u.first_name || ' ' || u.last_name)"},
+	"emails":            {Expr: "u.email"},
+	"emails.value":      {Expr: "u.email"},
+	"emails.type":       {Expr: "'work'"},
+	"emails.primary":    {Expr: "true", Type: scim.ColumnBoolean},
+	"active":            {Expr: "(u.status = 'active')", Type: scim.ColumnBoolean},
+	"meta.created":      {Expr: "u.created_at", Type: scim.ColumnDateTime},
+	"meta.lastmodified": {Expr: "u.updated_at", Type: scim.ColumnDateTime},
+}
+
+// ProvisionedUser is a user as an identity provider sees them over SCIM: the account
+// and the provider's own id for it, if it set one
+type ProvisionedUser struct {
+	User
+	ExternalID string `json:"external_id,omitempty"`
+}
+
+// Provisioning looks users up for SCIM provisioning and keeps the identity provider's
+// ids for them. Only users with a row in user_external_ids are provisioned, so an
+// identity provider never sees accounts it didn't create. Erased accounts are left
+// out, as if they had been deleted. Users are created and changed through the
+// UserRepository like any other.
+type Provisioning struct{}
+
+const provisionedUserQuery = `select u.id, u.email, u.first_name, u.last_name, u.user_active, u.status,
+	u.created_at, u.updated_at, coalesce(x.external_id, '')
+	from users u
+	join user_external_ids x on x.user_id = u.id
+	where u.status <> 'deleted'`
+
+// Users returns one page of the provisioned users matching filter, which may be nil,
+// ordered by ID, along with how many match in all
+func (p *Provisioning) Users(ctx context.Context, filter *scim.Filter, offset, limit int) ([]*ProvisionedUser, int, error) {
+	ctx, cancel := queryContext(ctx, "Provisioning.Users")
+	defer cancel()
+
+	where := ""
+	var args []any
+	if filter != nil {
+		clause, filterArgs, err := filter.SQL(provisioningColumns, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		where = " and " + clause
+		args = filterArgs
+	}
+
+	var total int
+	countQuery := `select count(*) from users u
+	join user_external_ids x on x.user_id = u.id
+	where u.status <> 'deleted'` + where
+
+	err := db.QueryRowContext(ctx, countQuery, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := provisionedUserQuery + where + fmt.Sprintf(" order by u.id limit $%d offset $%d", len(args)+1, len(args)+2)
+
+	rows, err := db.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []*ProvisionedUser{}
+	for rows.Next() {
+		var user ProvisionedUser
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Active,
+			&user.Status,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.ExternalID,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+// User returns one provisioned user by ID, or sql.ErrNoRows if there is none, they
+// weren't provisioned or they were erased
+func (p *Provisioning) User(ctx context.Context, id int) (*ProvisionedUser, error) {
+	ctx, cancel := queryContext(ctx, "Provisioning.User")
+	defer cancel()
+
+	var user ProvisionedUser
+	err := db.QueryRowContext(ctx, provisionedUserQuery+" and u.id = $1", id).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Active,
+		&user.Status,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.ExternalID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// SetExternalID marks a user as provisioned and stores the identity provider's id for
+// them, or forgets the id when externalID is empty. It returns ErrDuplicateExternalID
+// if another user already has it.
+func (p *Provisioning) SetExternalID(ctx context.Context, userID int, externalID string) error {
+	ctx, cancel := queryContext(ctx, "Provisioning.SetExternalID")
+	defer cancel()
+
+	stmt := `insert into user_external_ids (user_id, external_id) values ($1, nullif($2, ''))
+		on conflict (user_id) do update set external_id = excluded.external_id`
+
+	_, err := db.ExecContext(ctx, stmt, userID, externalID)
+	if isUniqueViolation(err) {
+		return ErrDuplicateExternalID
+	}
+
+	return err
+}
+
+// Forget removes a user from every group and forgets the identity provider's id for
+// them, for an erasure
+func (p *Provisioning) Forget(ctx context.Context, userID int) error {
+	ctx, cancel := queryContext(ctx, "Provisioning.Forget")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from group_members where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_external_ids where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,190 @@
+package data
+
+import (
+	"authentication/scim"
+	"context"
+	"time"
+	"userevents"
+)
+
+// The models the login, user and SCIM handlers depend on are interfaces like
+// UserRepository, so the handlers can run against the in-memory stores in tests. The
+// Postgres models satisfy them as they are; the in-memory stores report the same errors.
+
+// TokenRepository is where refresh tokens are stored
+type TokenRepository interface {
+	// GenerateToken creates a new refresh token for a user without saving it
+	GenerateToken(userID int, mfa bool, ttl time.Duration) (*Token, error)
+	Insert(ctx context.Context, token Token) error
+	// Rotate exchanges a valid refresh token for a new one. It returns ErrInvalidToken
+	// or ErrTokenReused if the token can't be used.
+	Rotate(ctx context.Context, plainText string, ttl time.Duration) (*Token, error)
+	// Revoke revokes a refresh token and ends its session
+	Revoke(ctx context.Context, plainText string) error
+}
+
+// PasswordResetRepository is where password reset tokens are stored
+type PasswordResetRepository interface {
+	// New creates a reset token for a user, valid for ttl, and spends their older ones
+	New(ctx context.Context, userID int, ttl time.Duration) (*PasswordReset, error)
+	// Redeem spends a reset token and sets the password of the user it belongs to,
+	// returning their ID. It returns ErrInvalidToken if the token can't be used.
+	Redeem(ctx context.Context, plainText, password string) (int, error)
+	// DeleteForUser removes every reset token of a user
+	DeleteForUser(ctx context.Context, userID int) error
+}
+
+// MagicLinkRepository is where passwordless login tokens are stored
+type MagicLinkRepository interface {
+	// New creates a login token for a user, valid for ttl, and spends their older ones
+	New(ctx context.Context, userID int, ttl time.Duration) (*MagicLink, error)
+	// Consume spends a login token and returns the ID of the user it belongs to. It
+	// returns ErrInvalidToken if the token can't be used.
+	Consume(ctx context.Context, plainText string) (int, error)
+}
+
+// SessionRepository is where login sessions are stored. Sessions that don't exist,
+// belong to someone else or have ended are reported with ErrSessionNotFound.
+type SessionRepository interface {
+	// Insert starts a new session and returns its ID
+	Insert(ctx context.Context, session Session) (int, error)
+	// ForUser returns a user's active sessions, most recently seen first
+	ForUser(ctx context.Context, userID int) ([]*Session, error)
+	// History returns all of a user's sessions, most recent first
+	History(ctx context.Context, userID int) ([]*Session, error)
+	// LastSeen returns when an active session was last used
+	LastSeen(ctx context.Context, id int) (time.Time, error)
+	// Touch records that a session was just used
+	Touch(ctx context.Context, id int) error
+	// SetOrganization changes the organization a session is acting in
+	SetOrganization(ctx context.Context, userID, id, orgID int) error
+	// Revoke ends one of a user's sessions, along with its refresh tokens
+	Revoke(ctx context.Context, userID, id int) error
+	// RevokeOthers ends every session of a user except keepID
+	RevokeOthers(ctx context.Context, userID, keepID int) (int, error)
+	// RevokeAllForUser ends every session of a user and revokes their refresh tokens
+	RevokeAllForUser(ctx context.Context, userID int) error
+	// Scrub logs a user out everywhere and forgets their devices and addresses
+	Scrub(ctx context.Context, userID int) error
+	// RevokedSince returns the sessions revoked after since, oldest first
+	RevokedSince(ctx context.Context, since time.Time) ([]SessionRevocation, error)
+}
+
+// RoleRepository is where roles and the global roles granted to users are stored
+type RoleRepository interface {
+	// GetAll returns every role and its permissions, sorted by name
+	GetAll(ctx context.Context) ([]*Role, error)
+	// ForUser returns the global roles granted to a user and their permissions
+	ForUser(ctx context.Context, userID int) ([]string, []string, error)
+	// Grant gives a user a global role, or returns ErrRoleNotFound
+	Grant(ctx context.Context, userID int, roleName string) error
+	// Revoke takes a global role away from a user, or returns ErrRoleNotFound
+	Revoke(ctx context.Context, userID int, roleName string) error
+	// RevokeAll takes every role away from a user
+	RevokeAll(ctx context.Context, userID int) error
+}
+
+// TwoFactorRepository is where TOTP enrollments and recovery codes are stored
+type TwoFactorRepository interface {
+	// GetForUser returns a user's enrollment, or sql.ErrNoRows if there is none
+	GetForUser(ctx context.Context, userID int) (*TwoFactor, error)
+	// Enroll stores a new unconfirmed secret; it returns false if the user already
+	// has a confirmed one
+	Enroll(ctx context.Context, userID int, secret []byte) (bool, error)
+	// Confirm confirms a user's secret and replaces their recovery codes
+	Confirm(ctx context.Context, userID int, counter int64, recoveryCodes []string) error
+	// UseCounter returns false if the code for counter, or a later one, was used
+	UseCounter(ctx context.Context, userID int, counter int64) (bool, error)
+	// UseRecoveryCode returns false if the code is unknown or was used
+	UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error)
+	Delete(ctx context.Context, userID int) error
+}
+
+// OrganizationRepository is where organizations and their members are stored
+type OrganizationRepository interface {
+	// Insert creates an organization with its first owner, or returns ErrDuplicateSlug
+	Insert(ctx context.Context, org Organization, ownerID int) (int, error)
+	// GetOne returns an organization, or ErrOrganizationNotFound
+	GetOne(ctx context.Context, id int) (*Organization, error)
+	// ForUser returns a user's memberships in the order they joined
+	ForUser(ctx context.Context, userID int) ([]*Membership, error)
+	// Membership returns a user's membership with its permissions, or ErrNotMember
+	Membership(ctx context.Context, orgID, userID int) (*Membership, error)
+	IsMember(ctx context.Context, orgID, userID int) (bool, error)
+	// Members returns everyone in an organization, sorted by last name
+	Members(ctx context.Context, orgID int) ([]*Member, error)
+	// SetMember adds a member or changes their role; it returns ErrRoleNotFound or
+	// ErrLastOwner if it can't
+	SetMember(ctx context.Context, orgID, userID int, roleName string) error
+	// RemoveMember takes a user out of an organization; it returns ErrNotMember or
+	// ErrLastOwner if it can't
+	RemoveMember(ctx context.Context, orgID, userID int) error
+	// RemoveAllForUser takes a user out of every organization
+	RemoveAllForUser(ctx context.Context, userID int) error
+}
+
+// LoginThrottleRepository is where failed logins are counted
+type LoginThrottleRepository interface {
+	// BlockedUntil returns the latest time any of keys is blocked until
+	BlockedUntil(ctx context.Context, keys ...string) (time.Time, error)
+	// RecordFailure counts a failure against key under policy
+	RecordFailure(ctx context.Context, key string, policy ThrottlePolicy) (*LoginThrottle, error)
+	// Reset forgets the failures of key
+	Reset(ctx context.Context, key string) error
+}
+
+// OutboxRepository is where user events wait until the relay has published them
+type OutboxRepository interface {
+	// Add writes an event that doesn't go with a change to a user
+	Add(ctx context.Context, userID int, eventType string, payload any) error
+	// Deliver hands up to limit undelivered events to send, oldest first
+	Deliver(ctx context.Context, limit int, send func(userevents.Envelope) error) (int, error)
+	// Purge deletes events delivered more than age ago
+	Purge(ctx context.Context, age time.Duration) (int64, error)
+}
+
+// APIKeyRepository is where the API keys of service accounts are stored
+type APIKeyRepository interface {
+	// ForAccount returns every key of a service account, revoked ones included
+	ForAccount(ctx context.Context, serviceAccountID int) ([]*APIKey, error)
+	// Create makes a new key; it is the only time its plain text is returned
+	Create(ctx context.Context, serviceAccountID int, name string, scopes []string, expiresAt *time.Time) (*APIKey, error)
+	// Rotate replaces the secret of a key, or returns ErrAPIKeyNotFound
+	Rotate(ctx context.Context, serviceAccountID, keyID int) (*APIKey, error)
+	// Revoke stops a key from working, or returns ErrAPIKeyNotFound
+	Revoke(ctx context.Context, serviceAccountID, keyID int) error
+	// Authenticate returns the key a caller presented, or ErrInvalidAPIKey
+	Authenticate(ctx context.Context, plainText string) (*APIKey, error)
+}
+
+// GroupRepository is where the groups identity providers manage over SCIM are stored.
+// Missing groups are reported with ErrGroupNotFound, and names or external ids that
+// are taken with ErrDuplicateGroup.
+type GroupRepository interface {
+	// Search returns one page of the groups matching filter, ordered by ID, and how
+	// many match in all
+	Search(ctx context.Context, filter *scim.Filter, offset, limit int, withMembers bool) ([]*Group, int, error)
+	// GetOne returns a group with its members
+	GetOne(ctx context.Context, id int) (*Group, error)
+	Insert(ctx context.Context, group Group) (int, error)
+	// Update saves a group and replaces its members
+	Update(ctx context.Context, group Group) error
+	Delete(ctx context.Context, id int) error
+	// ForUser returns the groups a user belongs to, without their members
+	ForUser(ctx context.Context, userID int) ([]*Group, error)
+}
+
+// ProvisioningRepository looks users up for SCIM and keeps the identity provider's ids
+// for them. Only users it provisioned are seen, and erased users are left out.
+type ProvisioningRepository interface {
+	// Users returns one page of the provisioned users matching filter, ordered by
+	// ID, and how many match in all
+	Users(ctx context.Context, filter *scim.Filter, offset, limit int) ([]*ProvisionedUser, int, error)
+	// User returns one provisioned user, or sql.ErrNoRows
+	User(ctx context.Context, id int) (*ProvisionedUser, error)
+	// SetExternalID marks a user as provisioned and stores or, when empty, forgets
+	// their external id; it returns ErrDuplicateExternalID if another user has it
+	SetExternalID(ctx context.Context, userID int, externalID string) error
+	// Forget removes a user from every group and forgets their external id
+	Forget(ctx context.Context, userID int) error
+}
@@ -0,0 +1,177 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrRoleNotFound is returned when granting or revoking a role that doesn't exist
+var ErrRoleNotFound = errors.New("role not found")
+
+// Role is the structure which holds one role from the database, along with the
+// names of the permissions it grants. Scope is global for roles granted to users
+// directly, or organization for roles held through an organization membership.
+type Role struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Scope       string    `json:"scope"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// GetAll returns every role and its permissions, sorted by name
+func (r *Role) GetAll(ctx context.Context) ([]*Role, error) {
+	ctx, cancel := queryContext(ctx, "Role.GetAll")
+	defer cancel()
+
+	query := `select r.id, r.name, r.description, r.scope, r.created_at, coalesce(p.name, '')
+	from roles r
+	left join role_permissions rp on rp.role_id = r.id
+	left join permissions p on p.id = rp.permission_id
+	order by r.name, p.name`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*Role
+	var current *Role
+
+	for rows.Next() {
+		var role Role
+		var permission string
+		err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.Scope, &role.CreatedAt, &permission)
+		if err != nil {
+			return nil, err
+		}
+
+		if current == nil || current.ID != role.ID {
+			role.Permissions = []string{}
+			current = &role
+			roles = append(roles, current)
+		}
+
+		if permission != "" {
+			current.Permissions = append(current.Permissions, permission)
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+// ForUser returns the names of the global roles granted to a user, and every
+// permission those roles carry
+func (r *Role) ForUser(ctx context.Context, userID int) ([]string, []string, error) {
+	ctx, cancel := queryContext(ctx, "Role.ForUser")
+	defer cancel()
+
+	query := `select r.name, coalesce(p.name, '')
+	from user_roles ur
+	join roles r on r.id = ur.role_id
+	left join role_permissions rp on rp.role_id = r.id
+	left join permissions p on p.id = rp.permission_id
+	where ur.user_id = $1
+	order by r.name, p.name`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	permissions := []string{}
+	seenRoles := make(map[string]bool)
+	seenPermissions := make(map[string]bool)
+
+	for rows.Next() {
+		var role, permission string
+		err := rows.Scan(&role, &permission)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !seenRoles[role] {
+			seenRoles[role] = true
+			roles = append(roles, role)
+		}
+
+		if permission != "" && !seenPermissions[permission] {
+			seenPermissions[permission] = true
+			permissions = append(permissions, permission)
+		}
+	}
+
+	return roles, permissions, rows.Err()
+}
+
+// Grant gives a user the named global role. Granting a role the user already has is not
+// an error. Organization roles are given with Organization.SetMember instead.
+func (r *Role) Grant(ctx context.Context, userID int, roleName string) error {
+	ctx, cancel := queryContext(ctx, "Role.Grant")
+	defer cancel()
+
+	stmt := `insert into user_roles (user_id, role_id, created_at)
+		select $1, id, $3 from roles where name = $2 and scope = 'global'
+		on conflict (user_id, role_id) do nothing`
+
+	result, err := db.ExecContext(ctx, stmt, userID, roleName, time.Now())
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		// either the role doesn't exist or the user already had it
+		var exists bool
+		err = db.QueryRowContext(ctx, `select exists(select 1 from roles where name = $1 and scope = 'global')`, roleName).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrRoleNotFound
+		}
+	}
+
+	return nil
+}
+
+// Revoke takes the named role away from a user
+func (r *Role) Revoke(ctx context.Context, userID int, roleName string) error {
+	ctx, cancel := queryContext(ctx, "Role.Revoke")
+	defer cancel()
+
+	var roleID int
+	err := db.QueryRowContext(ctx, `select id from roles where name = $1 and scope = 'global'`, roleName).Scan(&roleID)
+	if err != nil {
+		return ErrRoleNotFound
+	}
+
+	_, err = db.ExecContext(ctx, `delete from user_roles where user_id = $1 and role_id = $2`, userID, roleID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeAll takes every role away from a user
+func (r *Role) RevokeAll(ctx context.Context, userID int) error {
+	ctx, cancel := queryContext(ctx, "Role.RevokeAll")
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `delete from user_roles where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
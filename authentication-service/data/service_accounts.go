@@ -0,0 +1,450 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+const apiKeyPrefix = "sk_"
+
+var (
+	// ErrServiceAccountNotFound is returned when a service account doesn't exist
+	ErrServiceAccountNotFound = errors.New("service account not found")
+	// ErrAPIKeyNotFound is returned when an API key doesn't exist, belongs to another
+	// service account or has been revoked
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	// ErrInvalidAPIKey is returned when a presented API key is unknown, expired or revoked
+	ErrInvalidAPIKey = errors.New("invalid or expired api key")
+	// ErrUnknownScope is returned when an API key is given a scope that isn't a permission
+	ErrUnknownScope = errors.New("unknown scope")
+	// ErrDuplicateName is returned when a service account or API key name is already taken
+	ErrDuplicateName = errors.New("name already in use")
+)
+
+// ServiceAccount is the structure which holds one service account from the database.
+// Service accounts are machine callers; they have no password and authenticate with
+// API keys instead.
+type ServiceAccount struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// APIKey is the structure which holds one API key from the database. Keys look like
+// sk_<prefix>.<secret>; the prefix is stored as is so keys can be listed and told
+// apart, and only a SHA-256 hash of the whole key is kept. PlainText is only set
+// when a key is created or rotated.
+type APIKey struct {
+	ID               int        `json:"id"`
+	ServiceAccountID int        `json:"service_account_id"`
+	ServiceAccount   string     `json:"service_account,omitempty"`
+	Name             string     `json:"name"`
+	Prefix           string     `json:"prefix"`
+	PlainText        string     `json:"key,omitempty"`
+	Hash             []byte     `json:"-"`
+	Scopes           []string   `json:"scopes"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt       *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// GetAll returns every service account, sorted by name
+func (s *ServiceAccount) GetAll(ctx context.Context) ([]*ServiceAccount, error) {
+	ctx, cancel := queryContext(ctx, "ServiceAccount.GetAll")
+	defer cancel()
+
+	query := `select id, name, description, created_at from service_accounts order by name`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*ServiceAccount{}
+	for rows.Next() {
+		var account ServiceAccount
+		err := rows.Scan(&account.ID, &account.Name, &account.Description, &account.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, &account)
+	}
+
+	return accounts, rows.Err()
+}
+
+// GetOne returns one service account by ID
+func (s *ServiceAccount) GetOne(ctx context.Context, id int) (*ServiceAccount, error) {
+	ctx, cancel := queryContext(ctx, "ServiceAccount.GetOne")
+	defer cancel()
+
+	query := `select id, name, description, created_at from service_accounts where id = $1`
+
+	var account ServiceAccount
+	err := db.QueryRowContext(ctx, query, id).Scan(&account.ID, &account.Name, &account.Description, &account.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrServiceAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// Insert creates a service account and returns its ID
+func (s *ServiceAccount) Insert(ctx context.Context, account ServiceAccount) (int, error) {
+	ctx, cancel := queryContext(ctx, "ServiceAccount.Insert")
+	defer cancel()
+
+	stmt := `insert into service_accounts (name, description, created_at) values ($1, $2, $3) returning id`
+
+	var id int
+	err := db.QueryRowContext(ctx, stmt, account.Name, account.Description, time.Now()).Scan(&id)
+	if isUniqueViolation(err) {
+		return 0, ErrDuplicateName
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Delete removes a service account along with all of its API keys
+func (s *ServiceAccount) Delete(ctx context.Context, id int) error {
+	ctx, cancel := queryContext(ctx, "ServiceAccount.Delete")
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from service_accounts where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrServiceAccountNotFound
+	}
+
+	return nil
+}
+
+// ForAccount returns every API key of a service account, revoked ones included, sorted
+// by name. Hashes and plain text keys are never returned.
+func (k *APIKey) ForAccount(ctx context.Context, serviceAccountID int) ([]*APIKey, error) {
+	ctx, cancel := queryContext(ctx, "APIKey.ForAccount")
+	defer cancel()
+
+	query := `select k.id, k.service_account_id, k.name, k.prefix, k.expires_at, k.last_used_at,
+		k.revoked_at, k.created_at, coalesce(p.name, '')
+	from api_keys k
+	left join api_key_scopes s on s.api_key_id = k.id
+	left join permissions p on p.id = s.permission_id
+	where k.service_account_id = $1
+	order by k.name, p.name`
+
+	rows, err := db.QueryContext(ctx, query, serviceAccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	var current *APIKey
+
+	for rows.Next() {
+		var key APIKey
+		var scope string
+		err := rows.Scan(
+			&key.ID,
+			&key.ServiceAccountID,
+			&key.Name,
+			&key.Prefix,
+			&key.ExpiresAt,
+			&key.LastUsedAt,
+			&key.RevokedAt,
+			&key.CreatedAt,
+			&scope,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if current == nil || current.ID != key.ID {
+			key.Scopes = []string{}
+			current = &key
+			keys = append(keys, current)
+		}
+
+		if scope != "" {
+			current.Scopes = append(current.Scopes, scope)
+		}
+	}
+
+	return keys, rows.Err()
+}
+
+// Create makes a new API key for a service account. Every scope has to be the name of
+// a permission. A nil expiresAt makes a key that never expires. The returned key is
+// the only place the plain text value appears.
+func (k *APIKey) Create(ctx context.Context, serviceAccountID int, name string, scopes []string, expiresAt *time.Time) (*APIKey, error) {
+	ctx, cancel := queryContext(ctx, "APIKey.Create")
+	defer cancel()
+
+	key, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	key.ServiceAccountID = serviceAccountID
+	key.Name = name
+	key.Scopes = scopes
+	key.ExpiresAt = expiresAt
+	key.CreatedAt = time.Now()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt := `insert into api_keys (service_account_id, name, prefix, key_hash, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		key.ServiceAccountID,
+		key.Name,
+		key.Prefix,
+		key.Hash,
+		key.ExpiresAt,
+		key.CreatedAt,
+	).Scan(&key.ID)
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicateName
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, scope := range scopes {
+		result, err := tx.ExecContext(ctx, `insert into api_key_scopes (api_key_id, permission_id)
+			select $1, id from permissions where name = $2
+			on conflict do nothing`, key.ID, scope)
+		if err != nil {
+			return nil, err
+		}
+
+		var exists bool
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			err = tx.QueryRowContext(ctx, `select exists(select 1 from permissions where name = $1)`, scope).Scan(&exists)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				return nil, ErrUnknownScope
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Rotate replaces the secret of an API key, keeping its name, scopes and expiry. The
+// old secret stops working straight away.
+func (k *APIKey) Rotate(ctx context.Context, serviceAccountID, keyID int) (*APIKey, error) {
+	ctx, cancel := queryContext(ctx, "APIKey.Rotate")
+	defer cancel()
+
+	key, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `update api_keys set prefix = $1, key_hash = $2, last_used_at = null
+		where id = $3 and service_account_id = $4 and revoked_at is null
+		returning id, service_account_id, name, expires_at, created_at`
+
+	err = db.QueryRowContext(ctx, stmt, key.Prefix, key.Hash, keyID, serviceAccountID).Scan(
+		&key.ID,
+		&key.ServiceAccountID,
+		&key.Name,
+		&key.ExpiresAt,
+		&key.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key.Scopes, err = apiKeyScopes(ctx, key.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Revoke stops an API key from working. Revoked keys stay listed so there is a record
+// of them.
+func (k *APIKey) Revoke(ctx context.Context, serviceAccountID, keyID int) error {
+	ctx, cancel := queryContext(ctx, "APIKey.Revoke")
+	defer cancel()
+
+	stmt := `update api_keys set revoked_at = $1
+		where id = $2 and service_account_id = $3 and revoked_at is null`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), keyID, serviceAccountID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// apiKeyUseInterval is how stale an API key's last used time can get before using the
+// key updates it. The broker checks a key on every request, so writing each use would
+// cost a write per request.
+const apiKeyUseInterval = time.Minute
+
+// usedRecently reports whether a key's last use was recorded less than
+// apiKeyUseInterval before now
+func usedRecently(lastUsed *time.Time, now time.Time) bool {
+	return lastUsed != nil && now.Sub(*lastUsed) < apiKeyUseInterval
+}
+
+// Authenticate looks up a presented API key, checks it hasn't expired or been revoked,
+// records that it was used at most once per apiKeyUseInterval, and returns it with its
+// service account and scopes
+func (k *APIKey) Authenticate(ctx context.Context, plainText string) (*APIKey, error) {
+	ctx, cancel := queryContext(ctx, "APIKey.Authenticate")
+	defer cancel()
+
+	prefix, _, found := strings.Cut(plainText, ".")
+	if !found || !strings.HasPrefix(prefix, apiKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	query := `select k.id, k.service_account_id, a.name, k.name, k.prefix, k.key_hash, k.expires_at,
+		k.revoked_at, k.last_used_at, k.created_at
+	from api_keys k
+	join service_accounts a on a.id = k.service_account_id
+	where k.prefix = $1`
+
+	var key APIKey
+	err := db.QueryRowContext(ctx, query, prefix).Scan(
+		&key.ID,
+		&key.ServiceAccountID,
+		&key.ServiceAccount,
+		&key.Name,
+		&key.Prefix,
+		&key.Hash,
+		&key.ExpiresAt,
+		&key.RevokedAt,
+		&key.LastUsedAt,
+		&key.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if subtle.ConstantTimeCompare(key.Hash, hashToken(plainText)) != 1 ||
+		key.RevokedAt != nil ||
+		(key.ExpiresAt != nil && !key.ExpiresAt.After(now)) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	// the last used time only needs to be roughly right, and a failed write shouldn't
+	// turn the key away
+	if !usedRecently(key.LastUsedAt, now) {
+		_, err = db.ExecContext(ctx, `update api_keys set last_used_at = $1 where id = $2`, now, key.ID)
+		if err != nil {
+			log.Println("could not record api key use:", err)
+		} else {
+			key.LastUsedAt = &now
+		}
+	}
+
+	key.Scopes, err = apiKeyScopes(ctx, key.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// apiKeyScopes returns the names of the permissions an API key may use
+func apiKeyScopes(ctx context.Context, keyID int) ([]string, error) {
+	query := `select p.name from api_key_scopes s
+	join permissions p on p.id = s.permission_id
+	where s.api_key_id = $1
+	order by p.name`
+
+	rows, err := db.QueryContext(ctx, query, keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scopes := []string{}
+	for rows.Next() {
+		var scope string
+		err := rows.Scan(&scope)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, rows.Err()
+}
+
+// generateAPIKey makes a new random key and its hash
+func generateAPIKey() (*APIKey, error) {
+	prefixBytes := make([]byte, 6)
+	_, err := rand.Read(prefixBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	key := APIKey{Prefix: apiKeyPrefix + hex.EncodeToString(prefixBytes)}
+	key.PlainText = key.Prefix + "." + secret
+	key.Hash = hashToken(key.PlainText)
+
+	return &key, nil
+}
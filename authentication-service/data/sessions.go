@@ -0,0 +1,387 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrSessionNotFound is returned when a session doesn't exist, belongs to someone else,
+// or has already been revoked or expired
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is the structure which holds one login from the database. Every refresh
+// token belongs to a session, and the session ID goes into the access tokens minted
+// from them, so revoking a session logs that device out everywhere. OrganizationID is
+// the organization the session is acting in, or 0 for none.
+type Session struct {
+	ID             int        `json:"id"`
+	UserID         int        `json:"user_id"`
+	UserAgent      string     `json:"user_agent"`
+	IP             string     `json:"ip"`
+	MFA            bool       `json:"mfa"`
+	OrganizationID int        `json:"organization_id,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastSeenAt     time.Time  `json:"last_seen_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	// Current is set when listing sessions, on the one making the request
+	Current bool `json:"current"`
+}
+
+// SessionRevocation records when a session was revoked
+type SessionRevocation struct {
+	ID        int       `json:"id"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// execer is satisfied by both the database and a transaction on it
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Insert starts a new session and returns its ID
+func (s *Session) Insert(ctx context.Context, session Session) (int, error) {
+	ctx, cancel := queryContext(ctx, "Session.Insert")
+	defer cancel()
+
+	stmt := `insert into sessions (user_id, user_agent, ip, mfa, organization_id, created_at, last_seen_at, expires_at)
+		values ($1, $2, $3, $4, $5, $6, $6, $7) returning id`
+
+	var id int
+	err := db.QueryRowContext(ctx, stmt,
+		session.UserID,
+		session.UserAgent,
+		session.IP,
+		session.MFA,
+		nullIfZero(session.OrganizationID),
+		time.Now(),
+		session.ExpiresAt,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// ForUser returns a user's active sessions, most recently seen first
+func (s *Session) ForUser(ctx context.Context, userID int) ([]*Session, error) {
+	ctx, cancel := queryContext(ctx, "Session.ForUser")
+	defer cancel()
+
+	query := `select id, user_id, user_agent, ip, mfa, created_at, last_seen_at, expires_at
+	from sessions
+	where user_id = $1 and revoked_at is null and expires_at > $2
+	order by last_seen_at desc`
+
+	rows, err := db.QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.UserAgent,
+			&session.IP,
+			&session.MFA,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.ExpiresAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// History returns all of a user's sessions, including revoked and expired ones, most
+// recent first
+func (s *Session) History(ctx context.Context, userID int) ([]*Session, error) {
+	ctx, cancel := queryContext(ctx, "Session.History")
+	defer cancel()
+
+	query := `select id, user_id, user_agent, ip, mfa, created_at, last_seen_at, expires_at, revoked_at
+	from sessions
+	where user_id = $1
+	order by created_at desc`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		var revokedAt sql.NullTime
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.UserAgent,
+			&session.IP,
+			&session.MFA,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.ExpiresAt,
+			&revokedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if revokedAt.Valid {
+			session.RevokedAt = &revokedAt.Time
+		}
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// LastSeen returns when a session was last used. It returns ErrSessionNotFound if the
+// session has been revoked or has expired, so callers can reject the request.
+func (s *Session) LastSeen(ctx context.Context, id int) (time.Time, error) {
+	ctx, cancel := queryContext(ctx, "Session.LastSeen")
+	defer cancel()
+
+	query := `select last_seen_at from sessions
+		where id = $1 and revoked_at is null and expires_at > $2`
+
+	var lastSeen time.Time
+	err := db.QueryRowContext(ctx, query, id, time.Now()).Scan(&lastSeen)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, ErrSessionNotFound
+		}
+		return time.Time{}, err
+	}
+
+	return lastSeen, nil
+}
+
+// Touch records that a session was just used. It returns ErrSessionNotFound if the
+// session has been revoked or has expired, so callers can reject the request.
+func (s *Session) Touch(ctx context.Context, id int) error {
+	ctx, cancel := queryContext(ctx, "Session.Touch")
+	defer cancel()
+
+	now := time.Now()
+	stmt := `update sessions set last_seen_at = $1
+		where id = $2 and revoked_at is null and expires_at > $1`
+
+	result, err := db.ExecContext(ctx, stmt, now, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// SetOrganization changes the organization one of a user's active sessions is acting
+// in; orgID 0 leaves it without one. Access tokens minted from the session afterwards
+// carry the new organization.
+func (s *Session) SetOrganization(ctx context.Context, userID, id, orgID int) error {
+	ctx, cancel := queryContext(ctx, "Session.SetOrganization")
+	defer cancel()
+
+	stmt := `update sessions set organization_id = $1
+		where id = $2 and user_id = $3 and revoked_at is null and expires_at > $4`
+
+	result, err := db.ExecContext(ctx, stmt, nullIfZero(orgID), id, userID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// Revoke ends one of a user's sessions, along with its refresh tokens
+func (s *Session) Revoke(ctx context.Context, userID, id int) error {
+	ctx, cancel := queryContext(ctx, "Session.Revoke")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.ExecContext(ctx, `update sessions set revoked_at = $1
+		where id = $2 and user_id = $3 and revoked_at is null`, now, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrSessionNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `update refresh_tokens set revoked_at = $1
+		where session_id = $2 and revoked_at is null`, now, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RevokeOthers ends every session of a user except keepID, and returns how many were
+// revoked
+func (s *Session) RevokeOthers(ctx context.Context, userID, keepID int) (int, error) {
+	ctx, cancel := queryContext(ctx, "Session.RevokeOthers")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.ExecContext(ctx, `update sessions set revoked_at = $1
+		where user_id = $2 and id <> $3 and revoked_at is null`, now, userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `update refresh_tokens set revoked_at = $1
+		where user_id = $2 and session_id is distinct from $3 and revoked_at is null`, now, userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rows), tx.Commit()
+}
+
+// RevokeAllForUser ends every session of a user and revokes all of their refresh
+// tokens, logging them out everywhere
+func (s *Session) RevokeAllForUser(ctx context.Context, userID int) error {
+	ctx, cancel := queryContext(ctx, "Session.RevokeAllForUser")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = revokeAllForUser(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Scrub logs a user out everywhere and blanks the device and address recorded for
+// each of their sessions. The rows themselves are kept so the broker still learns
+// about the revocations.
+func (s *Session) Scrub(ctx context.Context, userID int) error {
+	ctx, cancel := queryContext(ctx, "Session.Scrub")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = revokeAllForUser(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update sessions set user_agent = '', ip = '' where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RevokedSince returns the sessions revoked after since, oldest first
+func (s *Session) RevokedSince(ctx context.Context, since time.Time) ([]SessionRevocation, error) {
+	ctx, cancel := queryContext(ctx, "Session.RevokedSince")
+	defer cancel()
+
+	query := `select id, revoked_at from sessions where revoked_at > $1 order by revoked_at`
+
+	rows, err := db.QueryContext(ctx, query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := []SessionRevocation{}
+	for rows.Next() {
+		var revocation SessionRevocation
+		err := rows.Scan(&revocation.ID, &revocation.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, revocation)
+	}
+
+	return revocations, rows.Err()
+}
+
+// revokeAllForUser revokes every session and refresh token of a user using e, which
+// may be a transaction
+func revokeAllForUser(ctx context.Context, e execer, userID int) error {
+	now := time.Now()
+
+	_, err := e.ExecContext(ctx, `update sessions set revoked_at = $1
+		where user_id = $2 and revoked_at is null`, now, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.ExecContext(ctx, `update refresh_tokens set revoked_at = $1
+		where user_id = $2 and revoked_at is null`, now, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// nullIfZero stores an optional ID as null when it isn't set
+func nullIfZero(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
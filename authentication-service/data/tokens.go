@@ -0,0 +1,229 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned when a refresh token does not exist, has expired or
+// has already been revoked.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// ErrTokenReused is returned when a refresh token that was already rotated is
+// presented again. When this happens every refresh token for the user is revoked,
+// since the token has most likely been stolen.
+var ErrTokenReused = errors.New("refresh token reuse detected")
+
+// Token is the structure which holds one refresh token from the database. Only a
+// SHA-256 hash of the token is stored; the plain text value is handed to the client
+// once, when the token is generated. Each token belongs to the session started by the
+// login that created it.
+type Token struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	SessionID int       `json:"session_id"`
+	PlainText string    `json:"token"`
+	Hash      []byte    `json:"-"`
+	MFA       bool      `json:"mfa"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+	// AMR lists the authentication methods of the login that created the token, and
+	// is passed on to the tokens it is rotated into
+	AMR []string `json:"amr,omitempty"`
+	// OrganizationID is the organization the session is acting in. It is kept on the
+	// session, not the token, and filled in by Rotate.
+	OrganizationID int `json:"organization_id,omitempty"`
+}
+
+// GenerateToken creates a new random refresh token for the given user, valid for ttl.
+// mfa records whether the login passed a second factor. The token is not saved to the
+// database; call Insert for that.
+func (t *Token) GenerateToken(userID int, mfa bool, ttl time.Duration) (*Token, error) {
+	plainText, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	token := Token{
+		UserID:    userID,
+		PlainText: plainText,
+		Hash:      hashToken(plainText),
+		MFA:       mfa,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	return &token, nil
+}
+
+// Insert inserts a refresh token into the database
+func (t *Token) Insert(ctx context.Context, token Token) error {
+	ctx, cancel := queryContext(ctx, "Token.Insert")
+	defer cancel()
+
+	stmt := `insert into refresh_tokens (user_id, session_id, token_hash, mfa, amr, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err := db.ExecContext(ctx, stmt, token.UserID, token.SessionID, token.Hash, token.MFA,
+		strings.Join(token.AMR, " "), token.ExpiresAt, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Rotate exchanges a valid refresh token for a new one. The presented token is revoked
+// in the same transaction that inserts its replacement, so each refresh token can only
+// be used once. The session it belongs to is marked as seen and extended to the new
+// token's expiry.
+func (t *Token) Rotate(ctx context.Context, plainText string, ttl time.Duration) (*Token, error) {
+	ctx, cancel := queryContext(ctx, "Token.Rotate")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `select t.id, t.user_id, coalesce(t.session_id, 0), t.mfa, t.amr, t.expires_at, t.revoked_at,
+		s.revoked_at is not null, coalesce(s.organization_id, 0)
+	from refresh_tokens t
+	left join sessions s on s.id = t.session_id
+	where t.token_hash = $1 for update of t`
+
+	var id, userID, sessionID, orgID int
+	var mfa, sessionRevoked bool
+	var amr string
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, query, hashToken(plainText)).Scan(&id, &userID, &sessionID, &mfa, &amr, &expiresAt, &revokedAt, &sessionRevoked, &orgID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+
+	// a token from a session that was logged out is simply no longer valid; that
+	// isn't a sign of theft
+	if sessionRevoked {
+		return nil, ErrInvalidToken
+	}
+
+	if revokedAt.Valid {
+		err = revokeAllForUser(ctx, tx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrTokenReused
+	}
+
+	if time.Now().After(expiresAt) {
+		return nil, ErrInvalidToken
+	}
+
+	_, err = tx.ExecContext(ctx, `update refresh_tokens set revoked_at = $1 where id = $2`, time.Now(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := t.GenerateToken(userID, mfa, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	// tokens handed out before sessions existed get a session the first time they
+	// are used
+	if sessionID == 0 {
+		err = tx.QueryRowContext(ctx, `insert into sessions (user_id, mfa, created_at, last_seen_at, expires_at)
+			values ($1, $2, $3, $3, $4) returning id`, userID, mfa, time.Now(), token.ExpiresAt).Scan(&sessionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	token.SessionID = sessionID
+	token.OrganizationID = orgID
+	token.AMR = strings.Fields(amr)
+
+	stmt := `insert into refresh_tokens (user_id, session_id, token_hash, mfa, amr, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = tx.ExecContext(ctx, stmt, token.UserID, token.SessionID, token.Hash, token.MFA, amr, token.ExpiresAt, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `update sessions set last_seen_at = $1, expires_at = $2 where id = $3`,
+		time.Now(), token.ExpiresAt, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Revoke revokes a single refresh token and ends the session it belongs to. Revoking a
+// token that does not exist, or that is already revoked, is not an error.
+func (t *Token) Revoke(ctx context.Context, plainText string) error {
+	ctx, cancel := queryContext(ctx, "Token.Revoke")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	stmt := `update refresh_tokens set revoked_at = $1 where token_hash = $2 and revoked_at is null
+		returning session_id`
+
+	var sessionID sql.NullInt64
+	err = tx.QueryRowContext(ctx, stmt, now, hashToken(plainText)).Scan(&sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if sessionID.Valid {
+		_, err = tx.ExecContext(ctx, `update sessions set revoked_at = $1 where id = $2 and revoked_at is null`,
+			now, sessionID.Int64)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// randomToken returns 256 random bits, encoded so they are safe to put in a URL
+func randomToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// hashToken returns the SHA-256 hash of a plain text token, which is what we store
+func hashToken(plainText string) []byte {
+	hash := sha256.Sum256([]byte(plainText))
+	return hash[:]
+}
@@ -0,0 +1,174 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// TwoFactor is the structure which holds a user's TOTP enrollment. The secret is
+// stored encrypted by the caller; this package never sees the encryption key.
+type TwoFactor struct {
+	UserID      int       `json:"user_id"`
+	Secret      []byte    `json:"-"`
+	Confirmed   bool      `json:"confirmed"`
+	LastCounter int64     `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// GetForUser returns the two factor enrollment for a user, or sql.ErrNoRows if they
+// have never started enrolling
+func (t *TwoFactor) GetForUser(ctx context.Context, userID int) (*TwoFactor, error) {
+	ctx, cancel := queryContext(ctx, "TwoFactor.GetForUser")
+	defer cancel()
+
+	query := `select user_id, secret, confirmed_at, last_counter, created_at from user_two_factor where user_id = $1`
+
+	var tf TwoFactor
+	var confirmedAt sql.NullTime
+	err := db.QueryRowContext(ctx, query, userID).Scan(
+		&tf.UserID,
+		&tf.Secret,
+		&confirmedAt,
+		&tf.LastCounter,
+		&tf.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	tf.Confirmed = confirmedAt.Valid
+
+	return &tf, nil
+}
+
+// Enroll stores a new, unconfirmed, encrypted secret for a user. It replaces an
+// earlier unconfirmed secret but never a confirmed one; it returns false in that case.
+func (t *TwoFactor) Enroll(ctx context.Context, userID int, secret []byte) (bool, error) {
+	ctx, cancel := queryContext(ctx, "TwoFactor.Enroll")
+	defer cancel()
+
+	stmt := `insert into user_two_factor (user_id, secret, last_counter, created_at)
+		values ($1, $2, 0, $3)
+		on conflict (user_id) do update set secret = excluded.secret, last_counter = 0, created_at = excluded.created_at
+		where user_two_factor.confirmed_at is null`
+
+	result, err := db.ExecContext(ctx, stmt, userID, secret, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// Confirm marks a user's secret as confirmed, records the counter of the code that
+// confirmed it and replaces the user's recovery codes with the ones given
+func (t *TwoFactor) Confirm(ctx context.Context, userID int, counter int64, recoveryCodes []string) error {
+	ctx, cancel := queryContext(ctx, "TwoFactor.Confirm")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `update user_two_factor set confirmed_at = $1, last_counter = $2
+		where user_id = $3`, time.Now(), counter, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, `insert into recovery_codes (user_id, code_hash, created_at)
+			values ($1, $2, $3)`, userID, hashRecoveryCode(code), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseCounter records that the code for counter has been used. It returns false if
+// that code, or a later one, was already used, which stops codes being replayed.
+func (t *TwoFactor) UseCounter(ctx context.Context, userID int, counter int64) (bool, error) {
+	ctx, cancel := queryContext(ctx, "TwoFactor.UseCounter")
+	defer cancel()
+
+	stmt := `update user_two_factor set last_counter = $1 where user_id = $2 and last_counter < $1`
+
+	result, err := db.ExecContext(ctx, stmt, counter, userID)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// UseRecoveryCode spends one of a user's recovery codes. It returns false if the code
+// is unknown or has already been used.
+func (t *TwoFactor) UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	ctx, cancel := queryContext(ctx, "TwoFactor.UseRecoveryCode")
+	defer cancel()
+
+	stmt := `update recovery_codes set used_at = $1 where user_id = $2 and code_hash = $3 and used_at is null`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// Delete removes a user's two factor enrollment and recovery codes
+func (t *TwoFactor) Delete(ctx context.Context, userID int) error {
+	ctx, cancel := queryContext(ctx, "TwoFactor.Delete")
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_two_factor where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// hashRecoveryCode normalises a recovery code the way users tend to type it before
+// hashing it
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return hashToken(code)
+}
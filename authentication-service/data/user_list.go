@@ -0,0 +1,292 @@
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPageSize is how many users a page holds when the caller doesn't say
+	DefaultPageSize = 25
+	// MaxPageSize is the most users we return in one page
+	MaxPageSize = 100
+)
+
+// ErrInvalidCursor is returned when a page cursor can't be decoded, or was made for a
+// different sort order than the one requested
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// userSorts maps the sort names callers can use to the column we order by
+var userSorts = map[string]string{
+	"last_name":  "last_name",
+	"email":      "email",
+	"created_at": "created_at",
+	"id":         "id",
+}
+
+// UserFilter says which users to list and in what order. Sort is one of last_name,
+// email, created_at or id, optionally prefixed with "-" for descending order. When
+// OrganizationID is set only members of that organization are listed, and when Status
+// is set only accounts in that status.
+type UserFilter struct {
+	OrganizationID int
+	Active         *int
+	Status         string
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+	EmailDomain    string
+	Sort           string
+	Limit          int
+	Cursor         string
+}
+
+// UserPage is one page of users. Pass NextCursor or PrevCursor back in UserFilter to
+// move through the list; they are empty when there is nothing further that way.
+type UserPage struct {
+	Users      []*User `json:"users"`
+	Total      int     `json:"total"`
+	Limit      int     `json:"limit"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+	PrevCursor string  `json:"prev_cursor,omitempty"`
+}
+
+// cursor marks a position in a sorted list of users: the sort value and ID of the
+// row at the edge of a page, and which way to go from there
+type cursor struct {
+	Sort      string `json:"s"`
+	Value     string `json:"v"`
+	ID        int    `json:"id"`
+	Backwards bool   `json:"b,omitempty"`
+}
+
+func (c cursor) encode() string {
+	out, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+	err = json.Unmarshal(raw, &c)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// ValidUserSort reports whether sort can be used in a UserFilter
+func ValidUserSort(sort string) bool {
+	_, ok := userSorts[strings.TrimPrefix(sort, "-")]
+	return ok
+}
+
+// Page returns one page of the users matching filter, using keyset pagination on the
+// sort column and the user ID so pages stay stable as users are added
+func (u *User) Page(ctx context.Context, filter UserFilter) (*UserPage, error) {
+	ctx, cancel := queryContext(ctx, "User.Page")
+	defer cancel()
+
+	column, descending, err := filter.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	// build the filter shared by the count and the page queries
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.OrganizationID != 0 {
+		where = append(where, "id in (select user_id from organization_members where organization_id = "+arg(filter.OrganizationID)+")")
+	}
+	if filter.Active != nil {
+		where = append(where, "user_active = "+arg(*filter.Active))
+	}
+	if filter.Status != "" {
+		where = append(where, "status = "+arg(filter.Status))
+	}
+	if filter.CreatedAfter != nil {
+		where = append(where, "created_at >= "+arg(*filter.CreatedAfter))
+	}
+	if filter.CreatedBefore != nil {
+		where = append(where, "created_at < "+arg(*filter.CreatedBefore))
+	}
+	if filter.EmailDomain != "" {
+		where = append(where, "split_part(lower(email), '@', 2) = "+arg(strings.ToLower(strings.TrimPrefix(filter.EmailDomain, "@"))))
+	}
+
+	page := UserPage{Users: []*User{}, Limit: filter.Limit}
+
+	countQuery := "select count(*) from users"
+	if len(where) > 0 {
+		countQuery += " where " + strings.Join(where, " and ")
+	}
+
+	err = db.QueryRowContext(ctx, countQuery, args...).Scan(&page.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	var after *cursor
+	if filter.Cursor != "" {
+		after, err = decodeCursor(filter.Cursor)
+		if err != nil || after.Sort != filter.Sort {
+			return nil, ErrInvalidCursor
+		}
+
+		value, err := cursorValue(column, after.Value)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+
+		// walking forwards in ascending order, or backwards in descending order, means
+		// looking for rows after the cursor
+		op := ">"
+		if after.Backwards != descending {
+			op = "<"
+		}
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", column, op, arg(value), arg(after.ID)))
+	}
+
+	backwards := after != nil && after.Backwards
+	direction := "asc"
+	if descending != backwards {
+		direction = "desc"
+	}
+
+	query := `select id, email, first_name, last_name, password, user_active, status, created_at, updated_at from users`
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += fmt.Sprintf(" order by %s %s, id %s limit %s", column, direction, direction, arg(filter.Limit+1))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.Active,
+			&user.Status,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Users = append(page.Users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	page.finish(filter, column, after)
+
+	return &page, nil
+}
+
+// normalize fills in the default sort and page size, and returns the column to order
+// by and whether the order is descending
+func (filter *UserFilter) normalize() (string, bool, error) {
+	if filter.Sort == "" {
+		filter.Sort = "last_name"
+	}
+
+	column, ok := userSorts[strings.TrimPrefix(filter.Sort, "-")]
+	if !ok {
+		return "", false, fmt.Errorf("invalid sort %q", filter.Sort)
+	}
+
+	if filter.Limit < 1 {
+		filter.Limit = DefaultPageSize
+	}
+	if filter.Limit > MaxPageSize {
+		filter.Limit = MaxPageSize
+	}
+
+	return column, strings.HasPrefix(filter.Sort, "-"), nil
+}
+
+// finish takes a page holding up to filter.Limit+1 users, fetched in the direction
+// given by after, trims it to size, puts it back in sort order and sets the cursors
+func (page *UserPage) finish(filter UserFilter, column string, after *cursor) {
+	backwards := after != nil && after.Backwards
+
+	more := len(page.Users) > filter.Limit
+	if more {
+		page.Users = page.Users[:filter.Limit]
+	}
+
+	// rows fetched walking backwards come out in reverse
+	if backwards {
+		for i, j := 0, len(page.Users)-1; i < j; i, j = i+1, j-1 {
+			page.Users[i], page.Users[j] = page.Users[j], page.Users[i]
+		}
+	}
+
+	if len(page.Users) == 0 {
+		return
+	}
+
+	first, last := page.Users[0], page.Users[len(page.Users)-1]
+	hasNext := (!backwards && more) || backwards
+	hasPrev := (backwards && more) || (!backwards && after != nil)
+
+	if hasNext {
+		page.NextCursor = cursor{Sort: filter.Sort, Value: sortValue(column, last), ID: last.ID}.encode()
+	}
+	if hasPrev {
+		page.PrevCursor = cursor{Sort: filter.Sort, Value: sortValue(column, first), ID: first.ID, Backwards: true}.encode()
+	}
+}
+
+// sortValue returns the value of column for user, as it is stored in a cursor
+func sortValue(column string, user *User) string {
+	switch column {
+	case "email":
+		return user.Email
+	case "created_at":
+		return user.CreatedAt.Format(time.RFC3339Nano)
+	case "id":
+		return fmt.Sprint(user.ID)
+	default:
+		return user.LastName
+	}
+}
+
+// cursorValue turns a value stored in a cursor back into something we can compare
+// column against
+func cursorValue(column, value string) (any, error) {
+	switch column {
+	case "created_at":
+		return time.Parse(time.RFC3339Nano, value)
+	case "id":
+		var id int
+		_, err := fmt.Sscan(value, &id)
+		return id, err
+	default:
+		return value, nil
+	}
+}
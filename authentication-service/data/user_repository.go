@@ -0,0 +1,115 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgconn"
+)
+
+// FoldEmail returns the form email addresses are stored and compared in: trimmed
+// and in lower case. GetByEmail folds the address it is given, so lookups needn't.
+func FoldEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// ErrDuplicateEmail is returned when a user is saved with an email address that
+// belongs to another user
+var ErrDuplicateEmail = errors.New("email address already registered")
+
+// UserRepository is where users are stored. Lookups that find nothing return
+// sql.ErrNoRows, whichever implementation is behind it.
+type UserRepository interface {
+	// GetAll returns every user, sorted by last name
+	GetAll(ctx context.Context) ([]*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetOne(ctx context.Context, id int) (*User, error)
+	// Page returns one page of the users matching filter
+	Page(ctx context.Context, filter UserFilter) (*UserPage, error)
+	// Insert hashes the user's password, saves them and returns their new ID
+	Insert(ctx context.Context, user User) (int, error)
+	// Update saves the user's email and names
+	Update(ctx context.Context, user *User) error
+	// Transition moves a user to another status if the state machine allows it, and
+	// records the change. It returns ErrInvalidTransition if it doesn't.
+	Transition(ctx context.Context, userID int, to, reason string, actorID int) (*StatusChange, error)
+	// StatusHistory returns a user's status changes, oldest first
+	StatusHistory(ctx context.Context, userID int) ([]*StatusChange, error)
+	DeleteByID(ctx context.Context, id int) error
+	// ResetPassword hashes password and stores it for the user
+	ResetPassword(ctx context.Context, id int, password string) error
+	// Anonymize removes the user's personal details but keeps their ID
+	Anonymize(ctx context.Context, id int) error
+}
+
+// PostgresUserRepository keeps users in the users table
+type PostgresUserRepository struct{}
+
+// NewPostgresUserRepository returns the repository New puts in Models. It uses the
+// connection pool handed to New.
+func NewPostgresUserRepository() PostgresUserRepository {
+	return PostgresUserRepository{}
+}
+
+func (PostgresUserRepository) GetAll(ctx context.Context) ([]*User, error) {
+	return (&User{}).GetAll(ctx)
+}
+
+func (PostgresUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return (&User{}).GetByEmail(ctx, email)
+}
+
+func (PostgresUserRepository) GetOne(ctx context.Context, id int) (*User, error) {
+	return (&User{}).GetOne(ctx, id)
+}
+
+func (PostgresUserRepository) Page(ctx context.Context, filter UserFilter) (*UserPage, error) {
+	return (&User{}).Page(ctx, filter)
+}
+
+func (PostgresUserRepository) Insert(ctx context.Context, user User) (int, error) {
+	id, err := (&User{}).Insert(ctx, user)
+	return id, duplicateEmail(err)
+}
+
+func (PostgresUserRepository) Update(ctx context.Context, user *User) error {
+	return duplicateEmail(user.Update(ctx))
+}
+
+func (PostgresUserRepository) Transition(ctx context.Context, userID int, to, reason string, actorID int) (*StatusChange, error) {
+	return (&User{}).Transition(ctx, userID, to, reason, actorID)
+}
+
+func (PostgresUserRepository) StatusHistory(ctx context.Context, userID int) ([]*StatusChange, error) {
+	return (&User{}).StatusHistory(ctx, userID)
+}
+
+func (PostgresUserRepository) DeleteByID(ctx context.Context, id int) error {
+	return (&User{}).DeleteByID(ctx, id)
+}
+
+func (PostgresUserRepository) ResetPassword(ctx context.Context, id int, password string) error {
+	return (&User{ID: id}).ResetPassword(ctx, password)
+}
+
+func (PostgresUserRepository) Anonymize(ctx context.Context, id int) error {
+	return (&User{}).Anonymize(ctx, id)
+}
+
+// duplicateEmail turns a unique violation into ErrDuplicateEmail; email is the only
+// unique column on users that callers set
+func duplicateEmail(err error) error {
+	if isUniqueViolation(err) {
+		return ErrDuplicateEmail
+	}
+
+	return err
+}
+
+// isUniqueViolation reports whether err is Postgres rejecting a duplicate value in a
+// unique column
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
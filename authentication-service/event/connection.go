@@ -0,0 +1,115 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	publishTimeout = 5 * time.Second
+	minBackoff     = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// connection is a RabbitMQ connection with one channel in confirm mode. It is dialled
+// when first needed, and again after reset.
+type connection struct {
+	url string
+	// declare declares the exchange messages are published to
+	declare func(*amqp.Channel) error
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+}
+
+// publish sends a message and waits for RabbitMQ to confirm it
+func (c *connection) publish(exchange, key string, msg amqp.Publishing) error {
+	channel, err := c.open()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(ctx,
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory
+		false,    // immediate
+		msg,
+	)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("message was not acknowledged")
+	}
+
+	return nil
+}
+
+// open returns an open channel in confirm mode, dialling RabbitMQ if needed
+func (c *connection) open() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.channel != nil && !c.channel.IsClosed() {
+		return c.channel, nil
+	}
+
+	if c.conn == nil || c.conn.IsClosed() {
+		conn, err := amqp.Dial(c.url)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+
+	channel, err := c.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.declare(channel)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	err = channel.Confirm(false)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	c.channel = channel
+
+	return channel, nil
+}
+
+// reset throws away the connection after a failure, so the next attempt starts fresh
+func (c *connection) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.channel != nil {
+		c.channel.Close()
+		c.channel = nil
+	}
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
@@ -0,0 +1,35 @@
+package event
+
+import (
+	"userevents"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// declareExchange declares the topic exchange the listener service consumes log
+// events from. It has to match the declaration in the broker and listener.
+func declareExchange(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(
+		"logs_topic", // name
+		"topic",      // type
+		true,         // durable
+		false,        // auto-deleted
+		false,        // internal
+		false,        // no-wait
+		nil,          // arguments
+	)
+}
+
+// declareUserExchange declares the topic exchange user lifecycle events are published
+// to, described in the userevents package
+func declareUserExchange(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(
+		userevents.Exchange, // name
+		"topic",             // type
+		true,                // durable
+		false,               // auto-deleted
+		false,               // internal
+		false,               // no-wait
+		nil,                 // arguments
+	)
+}
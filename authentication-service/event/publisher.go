@@ -0,0 +1,126 @@
+package event
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// SeverityInfo is for events that are part of normal operation
+	SeverityInfo = "INFO"
+	// SeverityWarning is for events worth a second look, like failed logins
+	SeverityWarning = "WARNING"
+)
+
+// Event is an authentication event, published to the logs_topic exchange with the
+// routing key log.<severity>. Name and Data are what the listener service passes on
+// to the logger; the other fields are there for consumers that want the structure.
+type Event struct {
+	Name     string `json:"name"`
+	Data     string `json:"data"`
+	Severity string `json:"severity"`
+	// ActorID is the user who caused the event, when that isn't UserID
+	ActorID int    `json:"actor_id,omitempty"`
+	UserID  int    `json:"user_id,omitempty"`
+	Email   string `json:"email,omitempty"`
+	// OrganizationID is the organization the event happened in, if any
+	OrganizationID int               `json:"organization_id,omitempty"`
+	IP             string            `json:"ip,omitempty"`
+	OccurredAt     time.Time         `json:"occurred_at"`
+	Attributes     map[string]string `json:"attributes,omitempty"`
+}
+
+// Publisher publishes events to RabbitMQ without making callers wait. Events go into
+// a local buffer and are sent from a background goroutine, which keeps retrying with
+// backoff while RabbitMQ is unreachable, so an outage delays events instead of
+// blocking requests. When the buffer fills up new events are dropped and logged.
+type Publisher struct {
+	events chan Event
+	done   chan struct{}
+	closed sync.Once
+	conn   connection
+}
+
+// NewPublisher returns a publisher for the RabbitMQ server at url that buffers up to
+// bufferSize events. Call Run to start delivering them.
+func NewPublisher(url string, bufferSize int) *Publisher {
+	return &Publisher{
+		events: make(chan Event, bufferSize),
+		done:   make(chan struct{}),
+		conn:   connection{url: url, declare: declareExchange},
+	}
+}
+
+// Publish queues an event for delivery. It never blocks.
+func (p *Publisher) Publish(e Event) {
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = time.Now()
+	}
+	if e.Severity == "" {
+		e.Severity = SeverityInfo
+	}
+
+	select {
+	case p.events <- e:
+	default:
+		log.Printf("event buffer full, dropping %s event: %s", e.Name, e.Data)
+	}
+}
+
+// Close stops taking events and waits up to timeout for Run to deliver the ones
+// already queued. It is for short lived processes, like the import command, that
+// would otherwise exit with events still in the buffer. Publish must not be called
+// after Close.
+func (p *Publisher) Close(timeout time.Duration) {
+	p.closed.Do(func() { close(p.events) })
+
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		log.Printf("gave up delivering %d queued events", len(p.events))
+	}
+}
+
+// Run delivers queued events, one at a time and in order, until the process exits or
+// Close is called
+func (p *Publisher) Run() {
+	defer close(p.done)
+
+	for e := range p.events {
+		backoff := minBackoff
+		for {
+			err := p.send(e)
+			if err == nil {
+				break
+			}
+
+			log.Printf("could not publish %s event, retrying in %s: %v", e.Name, backoff, err)
+			p.conn.reset()
+			time.Sleep(backoff)
+
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+// send publishes one event and waits for RabbitMQ to confirm it
+func (p *Publisher) send(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return p.conn.publish("logs_topic", "log."+e.Severity, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    e.OccurredAt,
+		Body:         body,
+	})
+}
@@ -0,0 +1,102 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+	"userevents"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// relayBatchSize is how many events the relay takes from the outbox at a time
+	relayBatchSize = 100
+	// relayInterval is how often the relay looks for new events once it has caught up
+	relayInterval = time.Second
+	// purgeInterval is how often delivered events older than retention are deleted
+	purgeInterval = time.Hour
+)
+
+// Outbox is where the relay finds the user events it publishes
+type Outbox interface {
+	// Deliver hands up to limit undelivered events to send, oldest first, and marks
+	// the ones it sent as delivered
+	Deliver(ctx context.Context, limit int, send func(userevents.Envelope) error) (int, error)
+	// Purge deletes events delivered more than age ago
+	Purge(ctx context.Context, age time.Duration) (int64, error)
+}
+
+// Relay publishes user events from an outbox to the userevents exchange. An event
+// is only marked as delivered once RabbitMQ has confirmed it, so while RabbitMQ is
+// down events wait in the outbox, and one may be published twice if the relay stops
+// between the two.
+type Relay struct {
+	outbox    Outbox
+	retention time.Duration
+	conn      connection
+}
+
+// NewRelay returns a relay from outbox to the RabbitMQ server at url. Delivered
+// events are kept in the outbox for retention. Call Run to start relaying.
+func NewRelay(url string, outbox Outbox, retention time.Duration) *Relay {
+	return &Relay{
+		outbox:    outbox,
+		retention: retention,
+		conn:      connection{url: url, declare: declareUserExchange},
+	}
+}
+
+// Run relays events until the process exits
+func (r *Relay) Run() {
+	ctx := context.Background()
+	backoff := minBackoff
+	var purged time.Time
+
+	for {
+		sent, err := r.outbox.Deliver(ctx, relayBatchSize, r.send)
+		if err != nil {
+			log.Printf("could not relay user events, retrying in %s: %v", backoff, err)
+			r.conn.reset()
+			time.Sleep(backoff)
+
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+
+		if time.Since(purged) > purgeInterval {
+			_, err := r.outbox.Purge(ctx, r.retention)
+			if err != nil {
+				log.Println("could not purge delivered user events:", err)
+			}
+			purged = time.Now()
+		}
+
+		// a full batch means there are probably more waiting
+		if sent < relayBatchSize {
+			time.Sleep(relayInterval)
+		}
+	}
+}
+
+// send publishes one event and waits for RabbitMQ to confirm it
+func (r *Relay) send(e userevents.Envelope) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return r.conn.publish(userevents.Exchange, e.Type, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    e.ID,
+		Type:         e.Type,
+		Timestamp:    e.OccurredAt,
+		Body:         body,
+	})
+}
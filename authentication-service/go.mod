@@ -4,11 +4,15 @@ go 1.20
 
 require golang.org/x/crypto v0.10.0
 
+require userevents v0.0.0
+
 require (
 	github.com/go-chi/chi/v5 v5.0.8
 	github.com/go-chi/cors v1.2.1
+	github.com/golang-jwt/jwt/v5 v5.0.0
 	github.com/jackc/pgconn v1.14.0
 	github.com/jackc/pgx/v4 v4.18.1
+	github.com/rabbitmq/amqp091-go v1.8.1
 )
 
 require (
@@ -18,5 +22,9 @@ require (
 	github.com/jackc/pgproto3/v2 v2.3.2 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
 	github.com/jackc/pgtype v1.14.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
 	golang.org/x/text v0.10.0 // indirect
 )
+
+// userevents is the shared package of user event schemas, kept in this repository
+replace userevents => ../userevents
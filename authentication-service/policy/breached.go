@@ -0,0 +1,150 @@
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// prefixLength is how many hex characters of a SHA-1 hash pick the range it is
+// stored in, as in the Have I Been Pwned range API
+const prefixLength = 5
+
+//go:embed breached.txt
+var bundled []byte
+
+// BreachList tells whether a password is known from a data breach. Passwords are
+// looked up by SHA-1 hash, split into a five character prefix and the rest, so a list
+// can be sharded into ranges the same way the Have I Been Pwned k-anonymity API is.
+type BreachList interface {
+	Contains(password string) (bool, error)
+}
+
+// hashPrefix returns the upper case SHA-1 of password split into its range prefix
+// and the suffix looked up within that range
+func hashPrefix(password string) (string, string) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	return hash[:prefixLength], hash[prefixLength:]
+}
+
+// hashSet is a breach list held in memory, indexed by hash prefix
+type hashSet map[string]map[string]struct{}
+
+func (s hashSet) Contains(password string) (bool, error) {
+	prefix, suffix := hashPrefix(password)
+	_, ok := s[prefix][suffix]
+
+	return ok, nil
+}
+
+// readHashes reads a list of full SHA-1 hashes, one per line, optionally followed by
+// ":count" as in the Have I Been Pwned downloads. Blank lines and lines starting
+// with # are skipped.
+func readHashes(r io.Reader) (hashSet, error) {
+	set := make(hashSet)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		hash, _, _ := strings.Cut(text, ":")
+		if len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("line %d: expected a SHA-1 hash", line)
+		}
+
+		hash = strings.ToUpper(hash)
+		prefix, suffix := hash[:prefixLength], hash[prefixLength:]
+		if set[prefix] == nil {
+			set[prefix] = make(map[string]struct{})
+		}
+		set[prefix][suffix] = struct{}{}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// rangeDir is a breach list stored as one file per hash prefix, named like
+// 5BAA6.txt and holding "suffix:count" lines, which is what the Have I Been Pwned
+// downloader writes. Only the file for the password's prefix is read, so the full
+// list never has to fit in memory.
+type rangeDir string
+
+func (d rangeDir) Contains(password string) (bool, error) {
+	prefix, suffix := hashPrefix(password)
+
+	f, err := os.Open(filepath.Join(string(d), prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		// no file means no breached password has this prefix
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		candidate, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(candidate, suffix) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// Bundled returns the small list of very common breached passwords built into the
+// service
+func Bundled() BreachList {
+	set, err := readHashes(bytes.NewReader(bundled))
+	if err != nil {
+		panic("policy: bundled breached password list: " + err.Error())
+	}
+
+	return set
+}
+
+// LoadBreachList opens a local breached password list. If path is a directory it is
+// read as one range file per hash prefix; otherwise it is a file of full hashes,
+// which is loaded into memory.
+func LoadBreachList(path string) (BreachList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return rangeDir(path), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set, err := readHashes(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return set, nil
+}
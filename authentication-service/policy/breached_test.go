@@ -0,0 +1,159 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sha1("password") and sha1("Password1234"), split at the range prefix
+const (
+	passwordPrefix = "5BAA6"
+	passwordSuffix = "1E4C9B93F3F0682250B6CF8331B7EE68FD8"
+	otherPrefix    = "5B966"
+	otherSuffix    = "72AE7709EAB297550CAE362D5BEE468C57D"
+)
+
+func TestHashPrefix(t *testing.T) {
+	prefix, suffix := hashPrefix("password")
+	if prefix != passwordPrefix || suffix != passwordSuffix {
+		t.Errorf("got %s %s, want %s %s", prefix, suffix, passwordPrefix, passwordSuffix)
+	}
+}
+
+func TestReadHashes(t *testing.T) {
+	input := strings.Join([]string{
+		"# comment",
+		"",
+		strings.ToLower(passwordPrefix + passwordSuffix),
+		otherPrefix + otherSuffix + ":42",
+	}, "\n")
+
+	set, err := readHashes(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"Password1234", true},
+		{"Password12345", false},
+	}
+
+	for _, tt := range tests {
+		got, err := set.Contains(tt.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestReadHashesInvalid(t *testing.T) {
+	_, err := readHashes(strings.NewReader(passwordPrefix + passwordSuffix + "\nnot-a-hash\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("got %v, want an error naming line 2", err)
+	}
+}
+
+func TestBundled(t *testing.T) {
+	list := Bundled()
+
+	got, err := list.Contains("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got {
+		t.Error(`bundled list doesn't contain "password"`)
+	}
+}
+
+// writeRanges writes a range directory holding the given files
+func writeRanges(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, contents := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestRangeDir(t *testing.T) {
+	// only the prefix goes into the file name, and the file only holds suffixes
+	otherRange, _ := hashPrefix("Password12345")
+	dir := writeRanges(t, map[string]string{
+		passwordPrefix + ".txt": "0000000000000000000000000000000000A:1\r\n" + strings.ToLower(passwordSuffix) + ":3861493\r\n",
+		otherRange + ".txt":     "0000000000000000000000000000000000A:1\r\n",
+	})
+
+	tests := []struct {
+		name     string
+		password string
+		want     bool
+	}{
+		{"suffix in the range", "password", true},
+		{"no file for the prefix", "Password1234", false},
+		{"same prefix file, other suffix", "Password12345", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rangeDir(dir).Contains(tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadBreachList(t *testing.T) {
+	dir := writeRanges(t, map[string]string{
+		passwordPrefix + ".txt": passwordSuffix + ":1\n",
+		"hashes.txt":            otherPrefix + otherSuffix + "\n",
+	})
+
+	tests := []struct {
+		name     string
+		path     string
+		password string
+	}{
+		{"directory of ranges", dir, "password"},
+		{"file of full hashes", filepath.Join(dir, "hashes.txt"), "Password1234"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := LoadBreachList(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := list.Contains(tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got {
+				t.Errorf("%q not found", tt.password)
+			}
+		})
+	}
+
+	_, err := LoadBreachList(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Error("loaded a list that doesn't exist")
+	}
+}
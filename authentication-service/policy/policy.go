@@ -0,0 +1,147 @@
+// Package policy checks new passwords against a configurable policy: length limits,
+// required character classes and a list of passwords known from data breaches.
+// Every broken rule is reported, so a client can show them all at once.
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// names of the rules a password can break
+const (
+	RuleRequired  = "required"
+	RuleMinLength = "min_length"
+	RuleMaxLength = "max_length"
+	RuleLowercase = "lowercase"
+	RuleUppercase = "uppercase"
+	RuleDigit     = "digit"
+	RuleSymbol    = "symbol"
+	RuleBreached  = "breached"
+)
+
+// MaxBcryptLength is the most bytes of a password bcrypt looks at; anything after
+// that is silently ignored, so we refuse longer passwords rather than pretend to
+// use them
+const MaxBcryptLength = 72
+
+// Violation is one rule a password broke
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Violations is every rule a password broke. It is returned as an error by Check.
+type Violations []Violation
+
+func (v Violations) Error() string {
+	messages := make([]string, len(v))
+	for i, violation := range v {
+		messages[i] = violation.Message
+	}
+
+	return "password does not meet the policy: " + strings.Join(messages, "; ")
+}
+
+// Password is a password policy. The zero value accepts any non-empty password.
+type Password struct {
+	// MinLength is the fewest characters a password may have
+	MinLength int
+	// MaxLength is the most bytes a password may have; 0 means no limit
+	MaxLength int
+
+	RequireLowercase bool
+	RequireUppercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+
+	// Breached, if set, is consulted for passwords known from data breaches
+	Breached BreachList
+}
+
+// Default returns the policy used when nothing is configured: at least 12
+// characters, no more than bcrypt can use, a mix of lower case, upper case and
+// digits, and not in the bundled breached password list
+func Default() *Password {
+	return &Password{
+		MinLength:        12,
+		MaxLength:        MaxBcryptLength,
+		RequireLowercase: true,
+		RequireUppercase: true,
+		RequireDigit:     true,
+		Breached:         Bundled(),
+	}
+}
+
+// Check tests password against the policy. It returns Violations listing every rule
+// the password broke, nil if it broke none, or another error if the breached
+// password list couldn't be read.
+func (p *Password) Check(password string) error {
+	if password == "" {
+		return Violations{{Rule: RuleRequired, Message: "password is required"}}
+	}
+
+	var violations Violations
+
+	if p.MinLength > 0 && utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, Violation{
+			Rule:    RuleMinLength,
+			Message: fmt.Sprintf("password must be at least %d characters", p.MinLength),
+		})
+	}
+
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, Violation{
+			Rule:    RuleMaxLength,
+			Message: fmt.Sprintf("password must be at most %d bytes", p.MaxLength),
+		})
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+
+	if p.RequireLowercase && !lower {
+		violations = append(violations, Violation{Rule: RuleLowercase, Message: "password must contain a lower case letter"})
+	}
+	if p.RequireUppercase && !upper {
+		violations = append(violations, Violation{Rule: RuleUppercase, Message: "password must contain an upper case letter"})
+	}
+	if p.RequireDigit && !digit {
+		violations = append(violations, Violation{Rule: RuleDigit, Message: "password must contain a digit"})
+	}
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, Violation{Rule: RuleSymbol, Message: "password must contain a symbol"})
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, Violation{
+				Rule:    RuleBreached,
+				Message: "password has appeared in a data breach, choose another",
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return violations
+	}
+
+	return nil
+}
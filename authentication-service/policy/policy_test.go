@@ -0,0 +1,152 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// rules returns the names of the rules err says were broken
+func rules(t *testing.T, err error) []string {
+	t.Helper()
+
+	if err == nil {
+		return nil
+	}
+
+	var violations Violations
+	if !errors.As(err, &violations) {
+		t.Fatalf("got %v, want Violations", err)
+	}
+
+	names := make([]string, len(violations))
+	for i, violation := range violations {
+		names[i] = violation.Rule
+	}
+
+	return names
+}
+
+func TestCheck(t *testing.T) {
+	p := &Password{
+		MinLength:        8,
+		MaxLength:        16,
+		RequireLowercase: true,
+		RequireUppercase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		rules    []string
+	}{
+		{"meets every rule", "Abcdef1!", nil},
+		{"empty", "", []string{RuleRequired}},
+		{"too short", "Ab1!", []string{RuleMinLength}},
+		{"too long", "Abcdefgh12345678!", []string{RuleMaxLength}},
+		{"no lower case", "ABCDEF1!", []string{RuleLowercase}},
+		{"no upper case", "abcdef1!", []string{RuleUppercase}},
+		{"no digit", "Abcdefg!", []string{RuleDigit}},
+		{"no symbol", "Abcdefg1", []string{RuleSymbol}},
+		{"space counts as a symbol", "Abcdef 1", nil},
+		{"every class missing", "        ", []string{RuleLowercase, RuleUppercase, RuleDigit}},
+		{"short and plain", "abc", []string{RuleMinLength, RuleUppercase, RuleDigit, RuleSymbol}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rules(t, p.Check(tt.password))
+			if strings.Join(got, ",") != strings.Join(tt.rules, ",") {
+				t.Errorf("got rules %v, want %v", got, tt.rules)
+			}
+		})
+	}
+}
+
+func TestCheckLengthUnits(t *testing.T) {
+	// the minimum counts characters, the maximum counts bytes, since that is what
+	// bcrypt limits
+	p := &Password{MinLength: 4, MaxLength: 8}
+
+	// four characters, eight bytes
+	if err := p.Check("éééé"); err != nil {
+		t.Errorf("four two-byte characters: %v", err)
+	}
+
+	// three characters, six bytes
+	got := rules(t, p.Check("ééé"))
+	if strings.Join(got, ",") != RuleMinLength {
+		t.Errorf("three characters: got rules %v, want %s", got, RuleMinLength)
+	}
+
+	// five characters, ten bytes
+	got = rules(t, p.Check("ééééé"))
+	if strings.Join(got, ",") != RuleMaxLength {
+		t.Errorf("ten bytes: got rules %v, want %s", got, RuleMaxLength)
+	}
+}
+
+func TestZeroValue(t *testing.T) {
+	var p Password
+
+	if err := p.Check("a"); err != nil {
+		t.Errorf("zero value refused a password: %v", err)
+	}
+	if got := rules(t, p.Check("")); strings.Join(got, ",") != RuleRequired {
+		t.Errorf("zero value: got rules %v for an empty password", got)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	p := Default()
+
+	if p.MaxLength != MaxBcryptLength {
+		t.Errorf("default maximum is %d, want %d", p.MaxLength, MaxBcryptLength)
+	}
+	if err := p.Check("Correct-Horse-42"); err != nil {
+		t.Errorf("default policy refused a good password: %v", err)
+	}
+
+	// long enough and mixed, but in the bundled list
+	got := rules(t, p.Check("password"))
+	found := false
+	for _, rule := range got {
+		if rule == RuleBreached {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf(`"password" broke %v, want %s among them`, got, RuleBreached)
+	}
+}
+
+func TestViolationsError(t *testing.T) {
+	err := Violations{
+		{Rule: RuleMinLength, Message: "too short"},
+		{Rule: RuleDigit, Message: "no digit"},
+	}
+
+	want := "password does not meet the policy: too short; no digit"
+	if err.Error() != want {
+		t.Errorf("got %q, want %q", err.Error(), want)
+	}
+}
+
+// failingList is a breach list that can't be read
+type failingList struct{}
+
+func (failingList) Contains(string) (bool, error) {
+	return false, errors.New("list unavailable")
+}
+
+func TestCheckBreachListError(t *testing.T) {
+	p := &Password{Breached: failingList{}}
+
+	err := p.Check("anything")
+	var violations Violations
+	if err == nil || errors.As(err, &violations) {
+		t.Errorf("got %v, want the list's error", err)
+	}
+}
@@ -0,0 +1,756 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// the comparison operators of a filter
+const (
+	OpEqual          = "eq"
+	OpNotEqual       = "ne"
+	OpContains       = "co"
+	OpStartsWith     = "sw"
+	OpEndsWith       = "ew"
+	OpGreater        = "gt"
+	OpGreaterOrEqual = "ge"
+	OpLess           = "lt"
+	OpLessOrEqual    = "le"
+	OpPresent        = "pr"
+)
+
+// the logical operators of a filter, and OpValuePath for a filter on the values of a
+// multi-valued attribute, like emails[type eq "work"]
+const (
+	OpAnd       = "and"
+	OpOr        = "or"
+	OpNot       = "not"
+	OpValuePath = "[]"
+)
+
+// maxFilterDepth stops filters nested deeply enough to exhaust the stack
+const maxFilterDepth = 32
+
+// Path names an attribute, as in "userName", "name.givenName" or, in PATCH requests,
+// "members[value eq \"2\"]" and "emails[type eq \"work\"].value"
+type Path struct {
+	// URI is the schema the attribute was qualified with, if any
+	URI  string
+	Name string
+	Sub  string
+	// Filter picks values of a multi-valued attribute
+	Filter *Filter
+}
+
+// Key is the path in lower case without its schema or filter, as in "name.givenname"
+func (p Path) Key() string {
+	if p.Sub == "" {
+		return strings.ToLower(p.Name)
+	}
+	return strings.ToLower(p.Name + "." + p.Sub)
+}
+
+func (p Path) String() string {
+	s := p.Name
+	if p.Filter != nil {
+		s += "[" + p.Filter.String() + "]"
+	}
+	if p.Sub != "" {
+		s += "." + p.Sub
+	}
+	return s
+}
+
+// Filter is a parsed filter expression
+type Filter struct {
+	// Op is one of the Op constants
+	Op string
+	// Left and Right are the operands of and and or; Left is also the operand of not,
+	// and the filter on the values of Attr for OpValuePath
+	Left, Right *Filter
+	// Attr is the attribute compared, or the one whose values are filtered
+	Attr Path
+	// Value is a string, float64, bool or nil, for null
+	Value any
+}
+
+func (f *Filter) String() string {
+	switch f.Op {
+	case OpAnd, OpOr:
+		return "(" + f.Left.String() + " " + f.Op + " " + f.Right.String() + ")"
+	case OpNot:
+		return "not (" + f.Left.String() + ")"
+	case OpValuePath:
+		return f.Attr.Name + "[" + f.Left.String() + "]"
+	case OpPresent:
+		return f.Attr.String() + " pr"
+	}
+
+	value, _ := json.Marshal(f.Value)
+	return f.Attr.String() + " " + f.Op + " " + string(value)
+}
+
+// ParseFilter parses a filter, as in the filter query parameter
+func ParseFilter(s string) (*Filter, error) {
+	p, err := newParser(s)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.done() {
+		return nil, badRequest(ErrorInvalidFilter, "unexpected %q in filter", p.peek().text)
+	}
+
+	return f, nil
+}
+
+// ParsePath parses an attribute path from a PATCH operation
+func ParsePath(s string) (Path, error) {
+	p, err := newParser(s)
+	if err != nil {
+		return Path{}, asPathError(err)
+	}
+
+	path, err := p.parsePath(0, true)
+	if err != nil {
+		return Path{}, asPathError(err)
+	}
+
+	if !p.done() {
+		return Path{}, badRequest(ErrorInvalidPath, "unexpected %q in path", p.peek().text)
+	}
+
+	return path, nil
+}
+
+// asPathError turns a parse error into the one for a bad PATCH path
+func asPathError(err error) error {
+	if e, ok := err.(*Error); ok {
+		e.ScimType = ErrorInvalidPath
+	}
+	return err
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenOpen
+	tokenClose
+	tokenOpenBracket
+	tokenCloseBracket
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// parser is a recursive descent parser over the tokens of a filter, with the
+// precedence of RFC 7644: not, then and, then or
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func newParser(s string) (*parser, error) {
+	var tokens []token
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenOpen, "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenClose, ")"})
+			i++
+		case c == '[':
+			tokens = append(tokens, token{tokenOpenBracket, "["})
+			i++
+		case c == ']':
+			tokens = append(tokens, token{tokenCloseBracket, "]"})
+			i++
+		case c == '"':
+			// strings are JSON strings, escapes and all
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, badRequest(ErrorInvalidFilter, "unterminated string in filter")
+			}
+
+			var value string
+			err := json.Unmarshal([]byte(s[i:end+1]), &value)
+			if err != nil {
+				return nil, badRequest(ErrorInvalidFilter, "invalid string %s in filter", s[i:end+1])
+			}
+			tokens = append(tokens, token{tokenString, value})
+			i = end + 1
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t\r\n()[]\"", rune(s[end])) {
+				end++
+			}
+			tokens = append(tokens, token{tokenWord, s[i:end]})
+			i = end
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, badRequest(ErrorInvalidFilter, "empty filter")
+	}
+
+	return &parser{tokens: tokens}, nil
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{kind: -1}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// keyword reports whether the next token is the word w, in any case, and consumes it
+// if it is
+func (p *parser) keyword(w string) bool {
+	t := p.peek()
+	if t.kind == tokenWord && strings.EqualFold(t.text, w) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, what string) error {
+	if p.next().kind != kind {
+		return badRequest(ErrorInvalidFilter, "expected %s in filter", what)
+	}
+	return nil
+}
+
+func (p *parser) parseOr(depth int) (*Filter, error) {
+	if depth > maxFilterDepth {
+		return nil, badRequest(ErrorInvalidFilter, "filter is nested too deeply")
+	}
+
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword(OpOr) {
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &Filter{Op: OpOr, Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd(depth int) (*Filter, error) {
+	left, err := p.parseNot(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword(OpAnd) {
+		right, err := p.parseNot(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &Filter{Op: OpAnd, Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseNot(depth int) (*Filter, error) {
+	// "not" is only an operator in front of a parenthesis; otherwise it could be an
+	// attribute
+	if t := p.peek(); t.kind == tokenWord && strings.EqualFold(t.text, OpNot) &&
+		p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].kind == tokenOpen {
+		p.pos += 2
+
+		f, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(tokenClose, ")"); err != nil {
+			return nil, err
+		}
+
+		return &Filter{Op: OpNot, Left: f}, nil
+	}
+
+	return p.parseAttribute(depth)
+}
+
+func (p *parser) parseAttribute(depth int) (*Filter, error) {
+	if p.peek().kind == tokenOpen {
+		p.next()
+
+		f, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(tokenClose, ")"); err != nil {
+			return nil, err
+		}
+
+		return f, nil
+	}
+
+	path, err := p.parsePath(depth, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if path.Filter != nil {
+		return &Filter{Op: OpValuePath, Attr: Path{URI: path.URI, Name: path.Name}, Left: path.Filter}, nil
+	}
+
+	op := p.next()
+	if op.kind != tokenWord {
+		return nil, badRequest(ErrorInvalidFilter, "expected an operator after %s", path)
+	}
+
+	f := &Filter{Op: strings.ToLower(op.text), Attr: path}
+	switch f.Op {
+	case OpPresent:
+		return f, nil
+	case OpEqual, OpNotEqual, OpContains, OpStartsWith, OpEndsWith,
+		OpGreater, OpGreaterOrEqual, OpLess, OpLessOrEqual:
+	default:
+		return nil, badRequest(ErrorInvalidFilter, "unknown operator %q", op.text)
+	}
+
+	value := p.next()
+	switch value.kind {
+	case tokenString:
+		f.Value = value.text
+	case tokenWord:
+		switch strings.ToLower(value.text) {
+		case "true":
+			f.Value = true
+		case "false":
+			f.Value = false
+		case "null":
+			f.Value = nil
+		default:
+			n, err := strconv.ParseFloat(value.text, 64)
+			if err != nil {
+				return nil, badRequest(ErrorInvalidFilter, "invalid value %q", value.text)
+			}
+			f.Value = n
+		}
+	default:
+		return nil, badRequest(ErrorInvalidFilter, "expected a value after %s %s", path, f.Op)
+	}
+
+	return f, nil
+}
+
+// parsePath reads an attribute path. A filter in brackets is always allowed, but a
+// sub-attribute after it only in PATCH paths.
+func (p *parser) parsePath(depth int, patch bool) (Path, error) {
+	t := p.next()
+	if t.kind != tokenWord || t.text == "" {
+		return Path{}, badRequest(ErrorInvalidFilter, "expected an attribute name")
+	}
+
+	path, err := splitPath(t.text)
+	if err != nil {
+		return Path{}, err
+	}
+
+	if p.peek().kind != tokenOpenBracket {
+		return path, nil
+	}
+	if path.Sub != "" {
+		return Path{}, badRequest(ErrorInvalidFilter, "a filter must come before the sub-attribute in %s", t.text)
+	}
+
+	p.next()
+	path.Filter, err = p.parseOr(depth + 1)
+	if err != nil {
+		return Path{}, err
+	}
+	if err = p.expect(tokenCloseBracket, "]"); err != nil {
+		return Path{}, err
+	}
+
+	// emails[type eq "work"].value
+	if t := p.peek(); patch && t.kind == tokenWord && strings.HasPrefix(t.text, ".") {
+		p.next()
+		path.Sub = t.text[1:]
+		if !validName(path.Sub) {
+			return Path{}, badRequest(ErrorInvalidFilter, "invalid attribute name %q", path.Sub)
+		}
+	}
+
+	return path, nil
+}
+
+// splitPath splits an attribute path like
+// "urn:ietf:params:scim:schemas:core:2.0:User:name.givenName" into its parts
+func splitPath(s string) (Path, error) {
+	var path Path
+
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		path.URI, s = s[:i], s[i+1:]
+	}
+
+	path.Name, path.Sub, _ = strings.Cut(s, ".")
+	if !validName(path.Name) || (path.Sub != "" && !validName(path.Sub)) {
+		return Path{}, badRequest(ErrorInvalidFilter, "invalid attribute name %q", s)
+	}
+
+	return path, nil
+}
+
+// validName reports whether s is an attribute name: a letter followed by letters,
+// digits, hyphens and underscores. $ref is allowed too.
+func validName(s string) bool {
+	if s == "$ref" {
+		return true
+	}
+	if s == "" || !unicode.IsLetter(rune(s[0])) {
+		return false
+	}
+
+	for _, c := range s {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Match reports whether a resource, decoded from JSON into a map, matches the filter.
+// Strings are compared without regard to case.
+func (f *Filter) Match(resource map[string]any) bool {
+	switch f.Op {
+	case OpAnd:
+		return f.Left.Match(resource) && f.Right.Match(resource)
+	case OpOr:
+		return f.Left.Match(resource) || f.Right.Match(resource)
+	case OpNot:
+		return !f.Left.Match(resource)
+	case OpValuePath:
+		_, values, _ := lookup(resource, f.Attr.Name)
+		for _, value := range asList(values) {
+			if element, ok := value.(map[string]any); ok && f.Left.Match(element) {
+				return true
+			}
+		}
+		return false
+	}
+
+	candidates := attributeValues(resource, f.Attr)
+	if f.Op == OpPresent {
+		for _, c := range candidates {
+			if c != nil && c != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(candidates) == 0 {
+		// a missing attribute is null
+		candidates = []any{nil}
+	}
+	for _, c := range candidates {
+		if compare(f.Op, c, f.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// attributeValues returns the values path refers to in resource. For a multi-valued
+// attribute there is one value per element: its sub-attribute, or its "value" when
+// the path has none.
+func attributeValues(resource map[string]any, path Path) []any {
+	_, value, ok := lookup(resource, path.Name)
+	if !ok {
+		return nil
+	}
+
+	var values []any
+	for _, v := range asList(value) {
+		element, isMap := v.(map[string]any)
+		switch {
+		case path.Sub != "" && isMap:
+			if sub, ok := lookupValue(element, path.Sub); ok {
+				values = append(values, sub)
+			}
+		case path.Sub == "" && isMap:
+			if sub, ok := lookupValue(element, "value"); ok {
+				values = append(values, sub)
+			}
+		case path.Sub == "":
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// compare applies a comparison operator to an attribute's value and a filter value
+func compare(op string, value, operand any) bool {
+	if operand == nil || value == nil {
+		switch op {
+		case OpEqual:
+			return value == nil && operand == nil
+		case OpNotEqual:
+			return (value == nil) != (operand == nil)
+		}
+		return false
+	}
+
+	switch v := value.(type) {
+	case string:
+		o, ok := operand.(string)
+		if !ok {
+			return false
+		}
+		v, o = strings.ToLower(v), strings.ToLower(o)
+
+		switch op {
+		case OpEqual:
+			return v == o
+		case OpNotEqual:
+			return v != o
+		case OpContains:
+			return strings.Contains(v, o)
+		case OpStartsWith:
+			return strings.HasPrefix(v, o)
+		case OpEndsWith:
+			return strings.HasSuffix(v, o)
+		}
+		return ordered(op, strings.Compare(v, o))
+	case float64:
+		o, ok := operand.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case v < o:
+			return ordered(op, -1)
+		case v > o:
+			return ordered(op, 1)
+		}
+		return ordered(op, 0)
+	case bool:
+		o, ok := operand.(bool)
+		if !ok {
+			return false
+		}
+		switch op {
+		case OpEqual:
+			return v == o
+		case OpNotEqual:
+			return v != o
+		}
+	}
+
+	return false
+}
+
+// ordered applies an operator to the result of comparing two values
+func ordered(op string, cmp int) bool {
+	switch op {
+	case OpEqual:
+		return cmp == 0
+	case OpNotEqual:
+		return cmp != 0
+	case OpGreater:
+		return cmp > 0
+	case OpGreaterOrEqual:
+		return cmp >= 0
+	case OpLess:
+		return cmp < 0
+	case OpLessOrEqual:
+		return cmp <= 0
+	}
+	return false
+}
+
+// ColumnType is the type of a Column
+type ColumnType int
+
+// the column types filters can compare
+const (
+	ColumnString ColumnType = iota
+	ColumnBoolean
+	ColumnDateTime
+	ColumnInteger
+)
+
+// Column is how an attribute is stored, for SQL
+type Column struct {
+	// Expr is the SQL expression for the attribute
+	Expr string
+	Type ColumnType
+	// CaseExact strings are compared with their case; others without
+	CaseExact bool
+}
+
+// SQL turns the filter into a Postgres condition over columns, which maps the Key of
+// each attribute path filters may use to how it is stored. Values are passed as
+// parameters, numbered on from the ones already in args, and returned with them.
+// Attributes that aren't in columns are an invalidFilter error.
+func (f *Filter) SQL(columns map[string]Column, args []any) (string, []any, error) {
+	return f.sql(columns, args, "")
+}
+
+func (f *Filter) sql(columns map[string]Column, args []any, prefix string) (string, []any, error) {
+	switch f.Op {
+	case OpAnd, OpOr:
+		left, args, err := f.Left.sql(columns, args, prefix)
+		if err != nil {
+			return "", nil, err
+		}
+		right, args, err := f.Right.sql(columns, args, prefix)
+		if err != nil {
+			return "", nil, err
+		}
+		return "(" + left + " " + f.Op + " " + right + ")", args, nil
+	case OpNot:
+		inner, args, err := f.Left.sql(columns, args, prefix)
+		if err != nil {
+			return "", nil, err
+		}
+		return "not coalesce(" + inner + ", false)", args, nil
+	case OpValuePath:
+		// emails[type eq "work"] becomes emails.type eq "work"
+		return f.Left.sql(columns, args, strings.ToLower(f.Attr.Name)+".")
+	}
+
+	key := prefix + f.Attr.Key()
+	column, ok := columns[key]
+	if !ok {
+		return "", nil, badRequest(ErrorInvalidFilter, "filtering on %s is not supported", strings.TrimSuffix(prefix, ".")+f.Attr.String())
+	}
+
+	if f.Op == OpPresent {
+		if column.Type == ColumnString {
+			return "coalesce(" + column.Expr + ", '') <> ''", args, nil
+		}
+		return column.Expr + " is not null", args, nil
+	}
+
+	if f.Value == nil {
+		switch f.Op {
+		case OpEqual:
+			return column.Expr + " is null", args, nil
+		case OpNotEqual:
+			return column.Expr + " is not null", args, nil
+		}
+		return "", nil, badRequest(ErrorInvalidFilter, "%s can't be compared with null", f.Op)
+	}
+
+	placeholder := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	sqlOps := map[string]string{
+		OpEqual: "=", OpNotEqual: "<>", OpGreater: ">", OpGreaterOrEqual: ">=", OpLess: "<", OpLessOrEqual: "<=",
+	}
+
+	switch column.Type {
+	case ColumnString:
+		value, ok := f.Value.(string)
+		if !ok {
+			return "", nil, badRequest(ErrorInvalidFilter, "%s must be compared with a string", f.Attr)
+		}
+
+		expr := column.Expr
+		if !column.CaseExact {
+			expr = "lower(" + expr + ")"
+			value = strings.ToLower(value)
+		}
+
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+		switch f.Op {
+		case OpContains:
+			return expr + " like " + placeholder("%"+escaped+"%"), args, nil
+		case OpStartsWith:
+			return expr + " like " + placeholder(escaped+"%"), args, nil
+		case OpEndsWith:
+			return expr + " like " + placeholder("%"+escaped), args, nil
+		}
+		return expr + " " + sqlOps[f.Op] + " " + placeholder(value), args, nil
+
+	case ColumnBoolean:
+		value, ok := f.Value.(bool)
+		if !ok || (f.Op != OpEqual && f.Op != OpNotEqual) {
+			return "", nil, badRequest(ErrorInvalidFilter, "%s can only be compared with true or false using eq or ne", f.Attr)
+		}
+		return column.Expr + " " + sqlOps[f.Op] + " " + placeholder(value), args, nil
+
+	case ColumnDateTime:
+		s, _ := f.Value.(string)
+		value, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil || sqlOps[f.Op] == "" {
+			return "", nil, badRequest(ErrorInvalidFilter, "%s must be compared with a date and time, like \"2023-07-01T00:00:00Z\"", f.Attr)
+		}
+		return column.Expr + " " + sqlOps[f.Op] + " " + placeholder(value), args, nil
+
+	case ColumnInteger:
+		// ids are strings in SCIM, but numbers here
+		var value int64
+		switch v := f.Value.(type) {
+		case float64:
+			value = int64(v)
+		case string:
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				// no row has an id that isn't a number
+				return "false", args, nil
+			}
+			value = n
+		default:
+			return "", nil, badRequest(ErrorInvalidFilter, "%s must be compared with a number", f.Attr)
+		}
+		if sqlOps[f.Op] == "" {
+			return "", nil, badRequest(ErrorInvalidFilter, "%s can't be compared with %s", f.Attr, f.Op)
+		}
+		return column.Expr + " " + sqlOps[f.Op] + " " + placeholder(value), args, nil
+	}
+
+	return "", nil, fmt.Errorf("unknown column type %d", column.Type)
+}
@@ -0,0 +1,271 @@
+package scim
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	// String puts back the parentheses precedence leaves out
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{`userName eq "ada@example.com"`, `userName eq "ada@example.com"`},
+		{`userName EQ "ada"`, `userName eq "ada"`},
+		{`title pr`, `title pr`},
+		{`active eq true`, `active eq true`},
+		{`externalId eq null`, `externalId eq null`},
+		{`meta.lastModified gt "2024-01-01T00:00:00Z"`, `meta.lastModified gt "2024-01-01T00:00:00Z"`},
+		{`id eq 42`, `id eq 42`},
+		{`name.givenName sw "A\"da"`, `name.givenName sw "A\"da"`},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "ada"`, `userName eq "ada"`},
+		{`a eq "1" or b eq "2" and c eq "3"`, `(a eq "1" or (b eq "2" and c eq "3"))`},
+		{`(a eq "1" or b eq "2") and c eq "3"`, `((a eq "1" or b eq "2") and c eq "3")`},
+		{`not (a eq "1") and b pr`, `(not (a eq "1") and b pr)`},
+		{`not eq "x"`, `not eq "x"`},
+		{`emails[type eq "work" and value co "@example.com"]`, `emails[(type eq "work" and value co "@example.com")]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			f, err := ParseFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+	}{
+		{"empty", "  "},
+		{"unterminated string", `userName eq "ada`},
+		{"invalid escape", `userName eq "\q"`},
+		{"no operator", `userName`},
+		{"unknown operator", `userName is "ada"`},
+		{"no value", `userName eq`},
+		{"bare word value", `userName eq ada`},
+		{"invalid attribute name", `1name eq "ada"`},
+		{"unclosed parenthesis", `(userName eq "ada"`},
+		{"unclosed bracket", `emails[type eq "work"`},
+		{"left over", `userName eq "ada" )`},
+		{"sub-attribute after a filter", `emails[type eq "work"].value eq "ada"`},
+		{"sub-attribute before a filter", `name.givenName[value eq "x"]`},
+		{"nested too deeply", strings.Repeat("(", maxFilterDepth+2) + `a pr` + strings.Repeat(")", maxFilterDepth+2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseFilter(tt.filter)
+
+			var scimErr *Error
+			if !errors.As(err, &scimErr) {
+				t.Fatalf("got %v, want a SCIM error", err)
+			}
+			if scimErr.Code != http.StatusBadRequest || scimErr.ScimType != ErrorInvalidFilter {
+				t.Errorf("got %d %s, want %d %s", scimErr.Code, scimErr.ScimType, http.StatusBadRequest, ErrorInvalidFilter)
+			}
+		})
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		key  string
+	}{
+		{"displayName", "displayName", "displayname"},
+		{"name.familyName", "name.familyName", "name.familyname"},
+		{`members[value eq "2"]`, `members[value eq "2"]`, "members"},
+		{`emails[type eq "work"].value`, `emails[type eq "work"].value`, "emails.value"},
+		{"urn:ietf:params:scim:schemas:core:2.0:User:name.givenName", "name.givenName", "name.givenname"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			path, err := ParsePath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path.String() != tt.want || path.Key() != tt.key {
+				t.Errorf("got %s with key %s, want %s with key %s", path, path.Key(), tt.want, tt.key)
+			}
+		})
+	}
+
+	for _, path := range []string{"", "name..x", `emails[type eq "work"`, "userName extra"} {
+		_, err := ParsePath(path)
+
+		var scimErr *Error
+		if !errors.As(err, &scimErr) || scimErr.ScimType != ErrorInvalidPath {
+			t.Errorf("%q: got %v, want an %s error", path, err, ErrorInvalidPath)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	user := map[string]any{
+		"userName": "Ada@Example.com",
+		"name":     map[string]any{"givenName": "Ada", "familyName": "Byron"},
+		"emails": []any{
+			map[string]any{"value": "ada@example.com", "type": "work"},
+			map[string]any{"value": "ada@home.example", "type": "home"},
+		},
+		"active": true,
+		"logins": 3.0,
+		"title":  "",
+	}
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`userName eq "ada@example.com"`, true},
+		{`USERNAME eq "ada@example.com"`, true},
+		{`userName ne "ada@example.com"`, false},
+		{`userName co "EXAMPLE"`, true},
+		{`userName sw "ada@"`, true},
+		{`userName ew ".org"`, false},
+		{`userName gt "ab"`, true},
+		{`userName lt "ab"`, false},
+		{`name.familyName eq "byron"`, true},
+		{`name.middleName eq "x"`, false},
+		{`emails eq "ada@home.example"`, true},
+		{`emails.type eq "home"`, true},
+		{`emails[type eq "work" and value ew "@example.com"]`, true},
+		{`emails[type eq "home" and value ew "@example.com"]`, false},
+		{`active eq true`, true},
+		{`active eq "true"`, false},
+		{`logins ge 3`, true},
+		{`logins gt 3`, false},
+		{`title pr`, false},
+		{`name.givenName pr`, true},
+		{`nickName pr`, false},
+		{`nickName eq null`, true},
+		{`userName eq null`, false},
+		{`userName ne null`, true},
+		{`not (active eq true) or logins lt 1`, false},
+		{`not (active eq false) and name.givenName eq "Ada"`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			f, err := ParseFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Match(user); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterSQL(t *testing.T) {
+	columns := map[string]Column{
+		"id":           {Expr: "u.id", Type: ColumnInteger},
+		"username":     {Expr: "u.email"},
+		"externalid":   {Expr: "x.external_id", CaseExact: true},
+		"emails.value": {Expr: "u.email"},
+		"active":       {Expr: "u.active", Type: ColumnBoolean},
+		"meta.created": {Expr: "u.created_at", Type: ColumnDateTime},
+	}
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		filter string
+		want   string
+		args   []any
+	}{
+		{`userName eq "Ada"`, "lower(u.email) = $2", []any{"ada"}},
+		{`externalId eq "Ada"`, "x.external_id = $2", []any{"Ada"}},
+		{`userName co "50%_off\\"`, `lower(u.email) like $2`, []any{`%50\%\_off\\%`}},
+		{`userName sw "a"`, "lower(u.email) like $2", []any{"a%"}},
+		{`userName ew "a"`, "lower(u.email) like $2", []any{"%a"}},
+		{`userName pr`, "coalesce(u.email, '') <> ''", nil},
+		{`active pr`, "u.active is not null", nil},
+		{`externalId eq null`, "x.external_id is null", nil},
+		{`externalId ne null`, "x.external_id is not null", nil},
+		{`active ne false`, "u.active <> $2", []any{false}},
+		{`id eq "7"`, "u.id = $2", []any{int64(7)}},
+		{`id eq 7`, "u.id = $2", []any{int64(7)}},
+		{`id eq "x"`, "false", nil},
+		{`meta.created ge "2024-01-01T00:00:00Z"`, "u.created_at >= $2", []any{created}},
+		{`emails[value eq "a"]`, "lower(u.email) = $2", []any{"a"}},
+		{`userName eq "a" or not (active eq true)`, "(lower(u.email) = $2 or not coalesce(u.active = $3, false))", []any{"a", true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			f, err := ParseFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// values are numbered on from the arguments already there
+			got, args, err := f.SQL(columns, []any{"first"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if want := append([]any{"first"}, tt.args...); !reflect.DeepEqual(args, want) {
+				t.Errorf("got args %v, want %v", args, want)
+			}
+		})
+	}
+}
+
+func TestFilterSQLErrors(t *testing.T) {
+	columns := map[string]Column{
+		"username":     {Expr: "u.email"},
+		"active":       {Expr: "u.active", Type: ColumnBoolean},
+		"meta.created": {Expr: "u.created_at", Type: ColumnDateTime},
+		"id":           {Expr: "u.id", Type: ColumnInteger},
+	}
+
+	tests := []struct {
+		name   string
+		filter string
+	}{
+		{"unknown attribute", `title eq "x"`},
+		{"unknown attribute in a value filter", `emails[type eq "work"]`},
+		{"string with a number", `userName eq 1`},
+		{"ordering null", `userName gt null`},
+		{"boolean with a string", `active eq "true"`},
+		{"ordering booleans", `active gt false`},
+		{"date that isn't one", `meta.created gt "yesterday"`},
+		{"substring of a date", `meta.created co "2024"`},
+		{"number with a boolean", `id eq true`},
+		{"substring of a number", `id co "1"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = f.SQL(columns, nil)
+
+			var scimErr *Error
+			if !errors.As(err, &scimErr) || scimErr.ScimType != ErrorInvalidFilter {
+				t.Errorf("got %v, want an %s error", err, ErrorInvalidFilter)
+			}
+		})
+	}
+}
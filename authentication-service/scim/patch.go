@@ -0,0 +1,331 @@
+package scim
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// maxPatchOperations is the most operations one PATCH request may have
+const maxPatchOperations = 1000
+
+// PatchRequest is the body of a PATCH request
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+// PatchOperation is one change in a PATCH request. Op is add, remove or replace, in
+// any case.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// readOnly lists the attributes a PATCH can't change
+var readOnly = map[string]bool{"id": true, "meta": true, "schemas": true, "groups": true}
+
+// Apply makes the changes in the request to a resource decoded from JSON into a map,
+// in order. It follows RFC 7644 section 3.5.2: add appends to multi-valued
+// attributes and merges into complex ones, replace overwrites, and remove deletes
+// the attribute or the values its filter picks. Decoding the map again gives the
+// changed resource.
+func (p PatchRequest) Apply(resource map[string]any) error {
+	if !HasSchema(p.Schemas, SchemaPatchOp) {
+		return badRequest(ErrorInvalidSyntax, "PATCH requests must have the schema %s", SchemaPatchOp)
+	}
+	if len(p.Operations) == 0 {
+		return badRequest(ErrorInvalidSyntax, "PATCH request has no Operations")
+	}
+	if len(p.Operations) > maxPatchOperations {
+		return badRequest(ErrorTooMany, "a PATCH request can have at most %d operations", maxPatchOperations)
+	}
+
+	for _, operation := range p.Operations {
+		err := operation.apply(resource)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o PatchOperation) apply(resource map[string]any) error {
+	op := strings.ToLower(o.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return badRequest(ErrorInvalidSyntax, "unknown PATCH operation %q", o.Op)
+	}
+
+	var value any
+	if len(o.Value) > 0 {
+		err := json.Unmarshal(o.Value, &value)
+		if err != nil {
+			return badRequest(ErrorInvalidSyntax, "invalid value in %s operation", o.Op)
+		}
+	}
+
+	if o.Path == "" {
+		// without a path the value is an object of attributes to change
+		if op == "remove" {
+			return badRequest(ErrorNoTarget, "remove operations need a path")
+		}
+
+		attributes, ok := value.(map[string]any)
+		if !ok {
+			return badRequest(ErrorInvalidValue, "%s operations without a path need an object as their value", o.Op)
+		}
+
+		for name, value := range attributes {
+			path, err := ParsePath(name)
+			if err != nil {
+				return err
+			}
+			err = applyPath(resource, op, path, value)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	path, err := ParsePath(o.Path)
+	if err != nil {
+		return err
+	}
+
+	if op != "remove" && len(o.Value) == 0 {
+		return badRequest(ErrorInvalidValue, "%s operations need a value", o.Op)
+	}
+
+	return applyPath(resource, op, path, value)
+}
+
+// applyPath makes one change at path
+func applyPath(resource map[string]any, op string, path Path, value any) error {
+	if readOnly[strings.ToLower(path.Name)] {
+		return badRequest(ErrorMutability, "%s can't be changed", path.Name)
+	}
+
+	key, current, exists := lookup(resource, path.Name)
+	if !exists {
+		key = path.Name
+	}
+
+	// emails[type eq "work"].value or members[value eq "2"]
+	if path.Filter != nil {
+		elements := asList(current)
+
+		matched := false
+		for i, element := range elements {
+			e, ok := element.(map[string]any)
+			if !ok || !path.Filter.Match(e) {
+				continue
+			}
+			matched = true
+
+			switch {
+			case op == "remove" && path.Sub == "":
+				elements[i] = nil
+			case op == "remove":
+				subKey, _, _ := lookup(e, path.Sub)
+				delete(e, subKey)
+			case path.Sub != "":
+				setKey(e, path.Sub, value)
+			default:
+				replacement, ok := value.(map[string]any)
+				if !ok {
+					return badRequest(ErrorInvalidValue, "%s needs an object as its value", path)
+				}
+				for k, v := range replacement {
+					setKey(e, k, v)
+				}
+			}
+		}
+
+		// nothing to remove is fine, but a value set on a filter that matches nothing
+		// is a new element, like a work email for a user who had none
+		if !matched && op != "remove" {
+			element := elementFromFilter(path.Filter)
+			if element == nil {
+				return badRequest(ErrorNoTarget, "%s matches no values", path)
+			}
+			if path.Sub != "" {
+				element[path.Sub] = value
+			} else if replacement, ok := value.(map[string]any); ok {
+				for k, v := range replacement {
+					element[k] = v
+				}
+			}
+			elements = append(elements, element)
+		}
+
+		resource[key] = compact(elements)
+		return nil
+	}
+
+	// name.givenName
+	if path.Sub != "" {
+		if op == "remove" {
+			if parent, ok := current.(map[string]any); ok {
+				subKey, _, _ := lookup(parent, path.Sub)
+				delete(parent, subKey)
+			}
+			return nil
+		}
+
+		parent, ok := current.(map[string]any)
+		if !ok {
+			if exists && current != nil {
+				return badRequest(ErrorInvalidPath, "%s has no sub-attributes", path.Name)
+			}
+			parent = map[string]any{}
+			resource[key] = parent
+		}
+		setKey(parent, path.Sub, value)
+		return nil
+	}
+
+	switch op {
+	case "remove":
+		delete(resource, key)
+	case "add":
+		switch existing := current.(type) {
+		case []any:
+			// add appends to a multi-valued attribute, skipping values it already has
+			for _, v := range asList(value) {
+				if !containsValue(existing, v) {
+					existing = append(existing, v)
+				}
+			}
+			resource[key] = existing
+		case map[string]any:
+			additions, ok := value.(map[string]any)
+			if !ok {
+				return badRequest(ErrorInvalidValue, "%s needs an object as its value", path.Name)
+			}
+			for k, v := range additions {
+				setKey(existing, k, v)
+			}
+		default:
+			resource[key] = value
+		}
+	case "replace":
+		if existing, ok := current.(map[string]any); ok {
+			if replacement, ok := value.(map[string]any); ok {
+				for k, v := range replacement {
+					setKey(existing, k, v)
+				}
+				return nil
+			}
+		}
+		resource[key] = value
+	}
+
+	return nil
+}
+
+// elementFromFilter builds the element a filter like type eq "work" describes, or
+// returns nil if the filter isn't made of equality tests joined by and
+func elementFromFilter(f *Filter) map[string]any {
+	switch f.Op {
+	case OpEqual:
+		if f.Attr.Sub != "" {
+			return nil
+		}
+		return map[string]any{f.Attr.Name: f.Value}
+	case OpAnd:
+		left, right := elementFromFilter(f.Left), elementFromFilter(f.Right)
+		if left == nil || right == nil {
+			return nil
+		}
+		for k, v := range right {
+			left[k] = v
+		}
+		return left
+	}
+
+	return nil
+}
+
+// lookup finds an attribute in a map regardless of case, as SCIM attribute names are
+// case insensitive, and returns the key it is stored under
+func lookup(m map[string]any, name string) (string, any, bool) {
+	if v, ok := m[name]; ok {
+		return name, v, true
+	}
+
+	for k, v := range m {
+		if strings.EqualFold(k, name) {
+			return k, v, true
+		}
+	}
+
+	return "", nil, false
+}
+
+// lookupValue is lookup without the key
+func lookupValue(m map[string]any, name string) (any, bool) {
+	_, v, ok := lookup(m, name)
+	return v, ok
+}
+
+// setKey sets an attribute, replacing it under whatever case it already has
+func setKey(m map[string]any, name string, value any) {
+	if key, _, ok := lookup(m, name); ok {
+		name = key
+	}
+	m[name] = value
+}
+
+// asList returns the values of an attribute that may or may not be multi-valued
+func asList(value any) []any {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []any:
+		return v
+	}
+	return []any{value}
+}
+
+// compact drops the elements remove set to nil
+func compact(elements []any) []any {
+	kept := elements[:0]
+	for _, e := range elements {
+		if e != nil {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// containsValue reports whether values has v. Complex values with a "value", like
+// group members, are the same if their "value" is.
+func containsValue(values []any, v any) bool {
+	id, hasID := idOf(v)
+
+	for _, existing := range values {
+		if hasID {
+			if other, ok := idOf(existing); ok && other == id {
+				return true
+			}
+			continue
+		}
+		if reflect.DeepEqual(existing, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func idOf(v any) (any, bool) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return lookupValue(m, "value")
+}
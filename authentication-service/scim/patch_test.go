@@ -0,0 +1,175 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// patchUser is the resource the PATCH tests start from
+const patchUser = `{
+	"id": "1",
+	"userName": "ada@example.com",
+	"name": {"givenName": "Ada", "familyName": "Byron"},
+	"emails": [{"value": "ada@example.com", "type": "work"}],
+	"members": [{"value": "1"}, {"value": "2"}]
+}`
+
+// patch applies operations, given as the JSON of the Operations array, to patchUser
+func patch(t *testing.T, operations string) (map[string]any, error) {
+	t.Helper()
+
+	var resource map[string]any
+	if err := json.Unmarshal([]byte(patchUser), &resource); err != nil {
+		t.Fatal(err)
+	}
+
+	request := PatchRequest{Schemas: []string{SchemaPatchOp}}
+	if err := json.Unmarshal([]byte(operations), &request.Operations); err != nil {
+		t.Fatal(err)
+	}
+
+	return resource, request.Apply(resource)
+}
+
+// decode turns JSON into the values Apply works with
+func decode(t *testing.T, s string) any {
+	t.Helper()
+
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestPatchApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		operations string
+		attribute  string
+		want       string
+	}{
+		{"replace a simple attribute",
+			`[{"op": "replace", "path": "userName", "value": "lovelace@example.com"}]`,
+			"userName", `"lovelace@example.com"`},
+		{"op and path in any case",
+			`[{"op": "Replace", "path": "USERNAME", "value": "lovelace@example.com"}]`,
+			"userName", `"lovelace@example.com"`},
+		{"replace a sub-attribute",
+			`[{"op": "replace", "path": "name.familyName", "value": "King"}]`,
+			"name", `{"givenName": "Ada", "familyName": "King"}`},
+		{"add a sub-attribute to a missing parent",
+			`[{"op": "add", "path": "address.locality", "value": "London"}]`,
+			"address", `{"locality": "London"}`},
+		{"replace merges into a complex attribute",
+			`[{"op": "replace", "path": "name", "value": {"familyName": "King"}}]`,
+			"name", `{"givenName": "Ada", "familyName": "King"}`},
+		{"add merges into a complex attribute",
+			`[{"op": "add", "path": "name", "value": {"middleName": "Augusta"}}]`,
+			"name", `{"givenName": "Ada", "familyName": "Byron", "middleName": "Augusta"}`},
+		{"add appends new values only",
+			`[{"op": "add", "path": "members", "value": [{"value": "2"}, {"value": "3"}]}]`,
+			"members", `[{"value": "1"}, {"value": "2"}, {"value": "3"}]`},
+		{"replace a multi-valued attribute",
+			`[{"op": "replace", "path": "members", "value": [{"value": "3"}]}]`,
+			"members", `[{"value": "3"}]`},
+		{"remove values a filter picks",
+			`[{"op": "remove", "path": "members[value eq \"1\"]"}]`,
+			"members", `[{"value": "2"}]`},
+		{"remove values a filter picks, none matching",
+			`[{"op": "remove", "path": "members[value eq \"9\"]"}]`,
+			"members", `[{"value": "1"}, {"value": "2"}]`},
+		{"replace a sub-attribute of filtered values",
+			`[{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "lovelace@example.com"}]`,
+			"emails", `[{"value": "lovelace@example.com", "type": "work"}]`},
+		{"add a value a filter describes",
+			`[{"op": "add", "path": "emails[type eq \"home\"].value", "value": "ada@home.example"}]`,
+			"emails", `[{"value": "ada@example.com", "type": "work"}, {"value": "ada@home.example", "type": "home"}]`},
+		{"remove a sub-attribute of filtered values",
+			`[{"op": "remove", "path": "emails[type eq \"work\"].type"}]`,
+			"emails", `[{"value": "ada@example.com"}]`},
+		{"without a path",
+			`[{"op": "replace", "value": {"userName": "lovelace@example.com", "name.givenName": "Augusta"}}]`,
+			"name", `{"givenName": "Augusta", "familyName": "Byron"}`},
+		{"operations apply in order",
+			`[{"op": "remove", "path": "members"}, {"op": "add", "path": "members", "value": [{"value": "5"}]}]`,
+			"members", `[{"value": "5"}]`},
+		{"remove an attribute",
+			`[{"op": "remove", "path": "name"}]`,
+			"name", `null`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resource, err := patch(t, tt.operations)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := resource[tt.attribute]
+			if want := decode(t, tt.want); !reflect.DeepEqual(got, want) {
+				out, _ := json.Marshal(got)
+				t.Errorf("got %s %s, want %s", tt.attribute, out, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatchApplyErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		operations string
+		scimType   string
+	}{
+		{"no operations", `[]`, ErrorInvalidSyntax},
+		{"unknown operation", `[{"op": "move", "path": "userName", "value": "x"}]`, ErrorInvalidSyntax},
+		{"remove without a path", `[{"op": "remove"}]`, ErrorNoTarget},
+		{"no path and no object", `[{"op": "replace", "value": "x"}]`, ErrorInvalidValue},
+		{"no value", `[{"op": "replace", "path": "userName"}]`, ErrorInvalidValue},
+		{"read-only attribute", `[{"op": "replace", "path": "id", "value": "2"}]`, ErrorMutability},
+		{"read-only attribute without a path", `[{"op": "replace", "value": {"meta": {}}}]`, ErrorMutability},
+		{"invalid path", `[{"op": "replace", "path": "emails[type eq", "value": "x"}]`, ErrorInvalidPath},
+		{"filter that describes no value", `[{"op": "add", "path": "emails[type eq \"home\" or type eq \"other\"]", "value": {"value": "x"}}]`, ErrorNoTarget},
+		{"sub-attribute of a simple attribute", `[{"op": "replace", "path": "userName.first", "value": "x"}]`, ErrorInvalidPath},
+		{"filtered values need an object", `[{"op": "replace", "path": "emails[type eq \"work\"]", "value": "x"}]`, ErrorInvalidValue},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := patch(t, tt.operations)
+
+			var scimErr *Error
+			if !errors.As(err, &scimErr) || scimErr.ScimType != tt.scimType {
+				t.Errorf("got %v, want a %s error", err, tt.scimType)
+			}
+		})
+	}
+}
+
+func TestPatchRequestLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  PatchRequest
+		scimType string
+	}{
+		{"no schema", PatchRequest{Operations: []PatchOperation{{Op: "remove", Path: "name"}}}, ErrorInvalidSyntax},
+		{"too many operations", PatchRequest{
+			Schemas:    []string{SchemaPatchOp},
+			Operations: make([]PatchOperation, maxPatchOperations+1),
+		}, ErrorTooMany},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.request.Apply(map[string]any{})
+
+			var scimErr *Error
+			if !errors.As(err, &scimErr) || scimErr.ScimType != tt.scimType {
+				t.Errorf("got %v, want a %s error", err, tt.scimType)
+			}
+		})
+	}
+}
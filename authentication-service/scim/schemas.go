@@ -0,0 +1,254 @@
+package scim
+
+// Supported is a feature a service provider does or doesn't support
+type Supported struct {
+	Supported bool `json:"supported"`
+}
+
+// FilterSupport says whether filters are supported and how many results a query
+// returns at most
+type FilterSupport struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+// BulkSupport says whether bulk requests are supported
+type BulkSupport struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+// AuthenticationScheme is a way clients can authenticate
+type AuthenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Primary     bool   `json:"primary,omitempty"`
+}
+
+// ServiceProviderConfig describes which parts of SCIM a service provider supports
+type ServiceProviderConfig struct {
+	Schemas               []string               `json:"schemas"`
+	DocumentationURI      string                 `json:"documentationUri,omitempty"`
+	Patch                 Supported              `json:"patch"`
+	Bulk                  BulkSupport            `json:"bulk"`
+	Filter                FilterSupport          `json:"filter"`
+	ChangePassword        Supported              `json:"changePassword"`
+	Sort                  Supported              `json:"sort"`
+	ETag                  Supported              `json:"etag"`
+	AuthenticationSchemes []AuthenticationScheme `json:"authenticationSchemes"`
+	Meta                  *Meta                  `json:"meta,omitempty"`
+}
+
+// NewServiceProviderConfig describes what this package supports: filters returning
+// up to maxResults resources, PATCH and ETags, with bearer token authentication
+func NewServiceProviderConfig(maxResults int) ServiceProviderConfig {
+	return ServiceProviderConfig{
+		Schemas:        []string{SchemaServiceProviderConfig},
+		Patch:          Supported{true},
+		Filter:         FilterSupport{Supported: true, MaxResults: maxResults},
+		ChangePassword: Supported{false},
+		Sort:           Supported{false},
+		ETag:           Supported{true},
+		AuthenticationSchemes: []AuthenticationScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "Bearer token",
+			Description: "An API key of a service account with the scim:provision scope, sent as a bearer token",
+			Primary:     true,
+		}},
+		Meta: &Meta{ResourceType: "ServiceProviderConfig"},
+	}
+}
+
+// ResourceType describes an endpoint and the schema of its resources
+type ResourceType struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Endpoint    string   `json:"endpoint"`
+	Description string   `json:"description"`
+	Schema      string   `json:"schema"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+// ResourceTypes are the resource types this package describes
+var ResourceTypes = []ResourceType{
+	{
+		Schemas:     []string{SchemaResourceType},
+		ID:          "User",
+		Name:        "User",
+		Endpoint:    "/Users",
+		Description: "User accounts",
+		Schema:      SchemaUser,
+		Meta:        &Meta{ResourceType: "ResourceType"},
+	},
+	{
+		Schemas:     []string{SchemaResourceType},
+		ID:          "Group",
+		Name:        "Group",
+		Endpoint:    "/Groups",
+		Description: "Groups of users",
+		Schema:      SchemaGroup,
+		Meta:        &Meta{ResourceType: "ResourceType"},
+	},
+}
+
+// Attribute describes one attribute of a schema
+type Attribute struct {
+	Name            string      `json:"name"`
+	Type            string      `json:"type"`
+	MultiValued     bool        `json:"multiValued"`
+	Description     string      `json:"description,omitempty"`
+	Required        bool        `json:"required"`
+	CaseExact       bool        `json:"caseExact"`
+	Mutability      string      `json:"mutability"`
+	Returned        string      `json:"returned"`
+	Uniqueness      string      `json:"uniqueness"`
+	ReferenceTypes  []string    `json:"referenceTypes,omitempty"`
+	SubAttributes   []Attribute `json:"subAttributes,omitempty"`
+	CanonicalValues []string    `json:"canonicalValues,omitempty"`
+}
+
+// Schema describes the attributes of a resource
+type Schema struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Attributes  []Attribute `json:"attributes"`
+	Meta        *Meta       `json:"meta,omitempty"`
+}
+
+// attribute returns a single valued, optional, read-write attribute that is returned
+// by default, which is what most attributes are
+func attribute(name, attrType, description string) Attribute {
+	return Attribute{
+		Name:        name,
+		Type:        attrType,
+		Description: description,
+		Mutability:  "readWrite",
+		Returned:    "default",
+		Uniqueness:  "none",
+	}
+}
+
+// Schemas are the schemas of the resources this package describes, with the
+// attributes we keep
+var Schemas = []Schema{
+	{
+		Schemas:     []string{SchemaSchema},
+		ID:          SchemaUser,
+		Name:        "User",
+		Description: "User account",
+		Attributes: []Attribute{
+			func() Attribute {
+				a := attribute("userName", "string", "The user's email address, which they log in with")
+				a.Required = true
+				a.Uniqueness = "server"
+				return a
+			}(),
+			func() Attribute {
+				a := attribute("name", "complex", "The user's name")
+				a.SubAttributes = []Attribute{
+					attribute("formatted", "string", "The full name"),
+					attribute("givenName", "string", "The first name"),
+					attribute("familyName", "string", "The last name"),
+				}
+				return a
+			}(),
+			func() Attribute {
+				a := attribute("displayName", "string", "The name to show for the user, made from their given and family names")
+				a.Mutability = "readOnly"
+				return a
+			}(),
+			func() Attribute {
+				a := attribute("emails", "complex", "The user's email address; it is always their userName")
+				a.MultiValued = true
+				a.Mutability = "readOnly"
+				a.SubAttributes = []Attribute{
+					attribute("value", "string", "The email address"),
+					func() Attribute {
+						a := attribute("type", "string", "The kind of address")
+						a.CanonicalValues = []string{"work"}
+						return a
+					}(),
+					attribute("primary", "boolean", "Whether this is the primary address"),
+				}
+				return a
+			}(),
+			attribute("active", "boolean", "Whether the user can log in"),
+			func() Attribute {
+				a := attribute("groups", "complex", "The groups the user belongs to")
+				a.MultiValued = true
+				a.Mutability = "readOnly"
+				a.SubAttributes = []Attribute{
+					attribute("value", "string", "The id of the group"),
+					func() Attribute {
+						a := attribute("$ref", "reference", "The URI of the group")
+						a.ReferenceTypes = []string{"Group"}
+						return a
+					}(),
+					attribute("display", "string", "The name of the group"),
+				}
+				return a
+			}(),
+		},
+		Meta: &Meta{ResourceType: "Schema"},
+	},
+	{
+		Schemas:     []string{SchemaSchema},
+		ID:          SchemaGroup,
+		Name:        "Group",
+		Description: "Group of users",
+		Attributes: []Attribute{
+			func() Attribute {
+				a := attribute("displayName", "string", "The name of the group")
+				a.Required = true
+				a.Uniqueness = "server"
+				return a
+			}(),
+			func() Attribute {
+				a := attribute("members", "complex", "The users in the group")
+				a.MultiValued = true
+				a.SubAttributes = []Attribute{
+					func() Attribute {
+						a := attribute("value", "string", "The id of the user")
+						a.Mutability = "immutable"
+						return a
+					}(),
+					func() Attribute {
+						a := attribute("$ref", "reference", "The URI of the user")
+						a.Mutability = "immutable"
+						a.ReferenceTypes = []string{"User"}
+						return a
+					}(),
+					func() Attribute {
+						a := attribute("display", "string", "The user's email address")
+						a.Mutability = "readOnly"
+						return a
+					}(),
+					func() Attribute {
+						a := attribute("type", "string", "The kind of member; only users can be members")
+						a.Mutability = "immutable"
+						a.CanonicalValues = []string{"User"}
+						return a
+					}(),
+				}
+				return a
+			}(),
+		},
+		Meta: &Meta{ResourceType: "Schema"},
+	},
+}
+
+// FindSchema returns the schema with the given URN
+func FindSchema(id string) (Schema, bool) {
+	for _, schema := range Schemas {
+		if schema.ID == id {
+			return schema, true
+		}
+	}
+
+	return Schema{}, false
+}
@@ -0,0 +1,409 @@
+// Package scim implements the parts of SCIM 2.0 (RFC 7643 and RFC 7644) that don't
+// depend on where users and groups are kept: the resource types, filters, PATCH
+// operations, ETags and error responses. The handlers in cmd/api put them together
+// over the users table and the groups model.
+package scim
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentType is the media type of SCIM requests and responses
+const ContentType = "application/scim+json"
+
+// the schema URNs resources and messages are tagged with
+const (
+	SchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SchemaResourceType          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	SchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	SchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SchemaPatchOp               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SchemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// the scimType of errors, from RFC 7644 section 3.12
+const (
+	ErrorInvalidFilter = "invalidFilter"
+	ErrorTooMany       = "tooMany"
+	ErrorUniqueness    = "uniqueness"
+	ErrorMutability    = "mutability"
+	ErrorInvalidSyntax = "invalidSyntax"
+	ErrorInvalidPath   = "invalidPath"
+	ErrorNoTarget      = "noTarget"
+	ErrorInvalidValue  = "invalidValue"
+)
+
+// Error is a SCIM error response. The functions in this package return one for
+// requests that are at fault, so handlers can send it as is.
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+	// Code is Status as a number
+	Code int `json:"-"`
+}
+
+// NewError returns an error response with an HTTP status, a scimType (which may be
+// empty) and a description
+func NewError(status int, scimType, detail string) *Error {
+	return &Error{
+		Schemas:  []string{SchemaError},
+		Status:   fmt.Sprint(status),
+		ScimType: scimType,
+		Detail:   detail,
+		Code:     status,
+	}
+}
+
+func (e *Error) Error() string {
+	if e.ScimType != "" {
+		return e.ScimType + ": " + e.Detail
+	}
+	return e.Detail
+}
+
+// badRequest is the error for a request that breaks a rule of the protocol
+func badRequest(scimType, format string, args ...any) *Error {
+	return NewError(http.StatusBadRequest, scimType, fmt.Sprintf(format, args...))
+}
+
+// Bool is a boolean that also accepts "true" and "false" as strings, which some
+// identity providers send
+type Bool bool
+
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	var v any
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case bool:
+		*b = Bool(v)
+	case string:
+		switch strings.ToLower(v) {
+		case "true":
+			*b = true
+		case "false":
+			*b = false
+		default:
+			return badRequest(ErrorInvalidValue, "%q is not a boolean", v)
+		}
+	default:
+		return badRequest(ErrorInvalidValue, "%s is not a boolean", data)
+	}
+
+	return nil
+}
+
+// Meta describes a resource. The discovery resources have no dates.
+type Meta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location,omitempty"`
+	Version      string     `json:"version,omitempty"`
+}
+
+// User is the core User resource, with the attributes we keep
+type User struct {
+	Schemas     []string   `json:"schemas"`
+	ID          string     `json:"id,omitempty"`
+	ExternalID  string     `json:"externalId,omitempty"`
+	UserName    string     `json:"userName"`
+	Name        *Name      `json:"name,omitempty"`
+	DisplayName string     `json:"displayName,omitempty"`
+	Emails      []Email    `json:"emails,omitempty"`
+	Active      *Bool      `json:"active,omitempty"`
+	Groups      []GroupRef `json:"groups,omitempty"`
+	Meta        *Meta      `json:"meta,omitempty"`
+}
+
+// Name is the name of a user
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// Email is one of a user's email addresses
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary Bool   `json:"primary,omitempty"`
+}
+
+// GroupRef is a group a user belongs to
+type GroupRef struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+// Group is the core Group resource
+type Group struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	ExternalID  string   `json:"externalId,omitempty"`
+	DisplayName string   `json:"displayName"`
+	Members     []Member `json:"members,omitempty"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+// Member is a member of a group. Value is the member's id.
+type Member struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+}
+
+// ListResponse is the response to a query
+type ListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []any    `json:"Resources"`
+}
+
+// NewListResponse returns one page of the results of a query
+func NewListResponse(total, startIndex int, resources []any) ListResponse {
+	return ListResponse{
+		Schemas:      []string{SchemaListResponse},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
+
+// HasSchema reports whether schemas, from a request, includes schema
+func HasSchema(schemas []string, schema string) bool {
+	for _, s := range schemas {
+		if strings.EqualFold(s, schema) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ETag returns a weak entity tag for a resource, a hash of its JSON form. Build the
+// resource with an empty meta.version, take its ETag and then set meta.version to it.
+func ETag(resource any) (string, error) {
+	body, err := json.Marshal(resource)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(body)
+
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// MatchesETag reports whether an If-Match or If-None-Match header names etag. "*"
+// matches any resource, and the weak and strong forms of a tag are treated alike.
+func MatchesETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Requested reports whether an attribute is wanted in a response, given the
+// attributes and excludedAttributes query parameters. Handlers use it to skip loading
+// attributes that would be thrown away, like the members of a group.
+func Requested(attributes, excludedAttributes, name string) bool {
+	if attributes != "" {
+		return listsAttribute(attributes, name)
+	}
+
+	return !listsAttribute(excludedAttributes, name)
+}
+
+// listsAttribute reports whether a comma separated list of attribute paths names
+// name or one of its sub-attributes
+func listsAttribute(list, name string) bool {
+	for _, item := range strings.Split(list, ",") {
+		path, err := ParsePath(strings.TrimSpace(item))
+		if err == nil && strings.EqualFold(path.Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Project applies the attributes and excludedAttributes query parameters to a
+// resource, as described in RFC 7644 section 3.9. With attributes only the listed
+// ones are kept, along with id and schemas, which are always returned; otherwise the
+// excluded ones are dropped. The resource is returned unchanged when neither is set.
+func Project(resource any, attributes, excludedAttributes string) (any, error) {
+	if attributes == "" && excludedAttributes == "" {
+		return resource, nil
+	}
+
+	body, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]any
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	if attributes != "" {
+		kept := map[string]any{}
+		for _, name := range []string{"schemas", "id"} {
+			if v, ok := m[name]; ok {
+				kept[name] = v
+			}
+		}
+
+		for _, item := range strings.Split(attributes, ",") {
+			path, err := ParsePath(strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			keep(kept, m, path)
+		}
+
+		return kept, nil
+	}
+
+	for _, item := range strings.Split(excludedAttributes, ",") {
+		path, err := ParsePath(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		drop(m, path)
+	}
+
+	return m, nil
+}
+
+// keep copies the attribute at path from resource to kept
+func keep(kept, resource map[string]any, path Path) {
+	key, value, ok := lookup(resource, path.Name)
+	if !ok {
+		return
+	}
+
+	if path.Sub == "" {
+		kept[key] = value
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		subKey, subValue, ok := lookup(v, path.Sub)
+		if !ok {
+			return
+		}
+		parent, ok := kept[key].(map[string]any)
+		if !ok {
+			parent = map[string]any{}
+			kept[key] = parent
+		}
+		parent[subKey] = subValue
+	case []any:
+		// emails.value keeps the value of every email
+		elements, ok := kept[key].([]any)
+		if !ok {
+			elements = make([]any, len(v))
+			for i := range elements {
+				elements[i] = map[string]any{}
+			}
+			kept[key] = elements
+		}
+		for i, element := range v {
+			e, ok := element.(map[string]any)
+			if !ok {
+				continue
+			}
+			target, ok := elements[i].(map[string]any)
+			if !ok {
+				continue
+			}
+			if subKey, subValue, ok := lookup(e, path.Sub); ok {
+				target[subKey] = subValue
+			}
+		}
+	}
+}
+
+// drop removes the attribute at path from resource. id and schemas are always
+// returned, so they stay.
+func drop(resource map[string]any, path Path) {
+	if strings.EqualFold(path.Name, "id") || strings.EqualFold(path.Name, "schemas") {
+		return
+	}
+
+	key, value, ok := lookup(resource, path.Name)
+	if !ok {
+		return
+	}
+
+	if path.Sub == "" {
+		delete(resource, key)
+		return
+	}
+
+	for _, element := range asList(value) {
+		if e, ok := element.(map[string]any); ok {
+			subKey, _, _ := lookup(e, path.Sub)
+			delete(e, subKey)
+		}
+	}
+}
+
+// Page reads the startIndex and count query parameters. startIndex counts from 1 and
+// values below it are treated as 1; count defaults to defaultCount and is capped at
+// maxCount.
+func Page(startIndex, count string, defaultCount, maxCount int) (int, int, error) {
+	start := 1
+	if startIndex != "" {
+		n, err := strconv.Atoi(startIndex)
+		if err != nil {
+			return 0, 0, badRequest(ErrorInvalidValue, "startIndex must be a number")
+		}
+		if n > 1 {
+			start = n
+		}
+	}
+
+	size := defaultCount
+	if count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return 0, 0, badRequest(ErrorInvalidValue, "count must be a number")
+		}
+		size = n
+	}
+	if size < 0 {
+		size = 0
+	}
+	if size > maxCount {
+		size = maxCount
+	}
+
+	return start, size, nil
+}
@@ -0,0 +1,146 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from the test vectors in RFC 6238, "12345678901234567890"
+// base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// the RFC gives 8 digit codes; ours are their last 6 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		code, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("at %d got %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Counter(now)
+
+	tests := []struct {
+		name    string
+		offset  time.Duration
+		ok      bool
+		counter int64
+	}{
+		{"current period", 0, true, current},
+		{"one period behind", -Period, true, current - 1},
+		{"one period ahead", Period, true, current + 1},
+		{"two periods behind", -2 * Period, false, 0},
+		{"two periods ahead", 2 * Period, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the code the user's device shows when its clock is off by offset
+			code, err := Code(rfcSecret, now.Add(tt.offset))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			counter, ok := Validate(rfcSecret, code, now)
+			if ok != tt.ok || counter != tt.counter {
+				t.Errorf("got %d %v, want %d %v", counter, ok, tt.counter, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		ok     bool
+	}{
+		{"valid", rfcSecret, "050471", true},
+		{"surrounding spaces", rfcSecret, " 050471 ", true},
+		{"lower case secret with spaces", strings.ToLower("GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ"), "050471", true},
+		{"wrong code", rfcSecret, "050472", false},
+		{"too short", rfcSecret, "50471", false},
+		{"eight digits", rfcSecret, "14050471", false},
+		{"invalid secret", "not base32!", "050471", false},
+		{"empty secret", "", "050471", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := Validate(tt.secret, tt.code, now); ok != tt.ok {
+				t.Errorf("got %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
+
+// Validate accepts a code for as long as it is within the skew window, so callers keep
+// the counter it returns and refuse codes at or before it; this is what lets them.
+func TestValidateReplay(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	code, err := Code(rfcSecret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used, ok := Validate(rfcSecret, code, now)
+	if !ok {
+		t.Fatal("code wasn't accepted")
+	}
+
+	// the same code a period later still matches, at the counter already used
+	counter, ok := Validate(rfcSecret, code, now.Add(Period))
+	if !ok || counter != used {
+		t.Errorf("got %d %v, want %d true", counter, ok, used)
+	}
+
+	// while the next code matches a later counter
+	next, err := Code(rfcSecret, now.Add(Period))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter, ok = Validate(rfcSecret, next, now.Add(Period))
+	if !ok || counter <= used {
+		t.Errorf("got %d %v, want a counter after %d", counter, ok, used)
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := decodeSecret(secret)
+	if err != nil || len(key) != 20 {
+		t.Errorf("got a %d byte key (%v), want 20 bytes", len(key), err)
+	}
+
+	other, _ := GenerateSecret()
+	if other == secret {
+		t.Error("two secrets were the same")
+	}
+}
@@ -0,0 +1,185 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// ErrNoCredential is returned by Authenticator when it holds no credential the
+// request allows
+var ErrNoCredential = errors.New("authenticator has no matching credential")
+
+// Authenticator is a software authenticator holding ES256 passkeys in memory. It plays
+// the part of both the browser and the security key, so registration and sign in can
+// be exercised from Go tests without either.
+type Authenticator struct {
+	// Origin is the page origin the simulated browser reports
+	Origin string
+	// UserVerified sets the UV flag, as if the user entered a PIN or used a biometric
+	UserVerified bool
+	// AAGUID identifies the authenticator model; it defaults to all zeros
+	AAGUID []byte
+
+	credentials []*softCredential
+}
+
+type softCredential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+// NewAuthenticator returns an empty software authenticator that reports origin and
+// verifies the user
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, UserVerified: true}
+}
+
+// Create makes a new credential in response to options, as
+// navigator.credentials.create would
+func (a *Authenticator) Create(options CreationOptions) (RegistrationResponse, error) {
+	var resp RegistrationResponse
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return resp, err
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return resp, err
+	}
+
+	cred := &softCredential{
+		id:         id,
+		rpID:       options.RP.ID,
+		userHandle: options.User.ID,
+		key:        key,
+	}
+
+	publicKey, err := encodeCBOR(map[any]any{
+		coseKty: ktyEC2,
+		coseAlg: AlgES256,
+		coseCrv: crvP256,
+		coseX:   key.X.FillBytes(make([]byte, 32)),
+		coseY:   key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		return resp, err
+	}
+
+	aaguid := a.AAGUID
+	if len(aaguid) != 16 {
+		aaguid = make([]byte, 16)
+	}
+	attested := append(append([]byte{}, aaguid...), binary.BigEndian.AppendUint16(nil, uint16(len(id)))...)
+	attested = append(append(attested, id...), publicKey...)
+
+	authData := a.authenticatorData(cred, flagAttestedData)
+	authData = append(authData, attested...)
+
+	attestation, err := encodeCBOR(map[any]any{
+		"fmt":      "none",
+		"attStmt":  map[any]any{},
+		"authData": authData,
+	})
+	if err != nil {
+		return resp, err
+	}
+
+	clientData, err := a.clientData(ceremonyCreate, options.Challenge)
+	if err != nil {
+		return resp, err
+	}
+
+	a.credentials = append(a.credentials, cred)
+
+	resp.ID = base64.RawURLEncoding.EncodeToString(id)
+	resp.RawID = id
+	resp.Type = publicKeyType
+	resp.Response.ClientDataJSON = clientData
+	resp.Response.AttestationObject = attestation
+	resp.Response.Transports = []string{"internal"}
+	return resp, nil
+}
+
+// Get signs in with a credential in response to options, as navigator.credentials.get
+// would. With an empty allow list it uses the most recently created credential for the
+// relying party, like picking a discoverable credential.
+func (a *Authenticator) Get(options RequestOptions) (AssertionResponse, error) {
+	var resp AssertionResponse
+
+	cred := a.find(options)
+	if cred == nil {
+		return resp, ErrNoCredential
+	}
+
+	cred.signCount++
+	authData := a.authenticatorData(cred, 0)
+
+	clientData, err := a.clientData(ceremonyGet, options.Challenge)
+	if err != nil {
+		return resp, err
+	}
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, cred.key, digest[:])
+	if err != nil {
+		return resp, err
+	}
+
+	resp.ID = base64.RawURLEncoding.EncodeToString(cred.id)
+	resp.RawID = cred.id
+	resp.Type = publicKeyType
+	resp.Response.ClientDataJSON = clientData
+	resp.Response.AuthenticatorData = authData
+	resp.Response.Signature = signature
+	resp.Response.UserHandle = cred.userHandle
+	return resp, nil
+}
+
+func (a *Authenticator) find(options RequestOptions) *softCredential {
+	for i := len(a.credentials) - 1; i >= 0; i-- {
+		cred := a.credentials[i]
+		if cred.rpID != options.RPID {
+			continue
+		}
+		if len(options.AllowCredentials) == 0 {
+			return cred
+		}
+		for _, allowed := range options.AllowCredentials {
+			if string(allowed.ID) == string(cred.id) {
+				return cred
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *Authenticator) authenticatorData(cred *softCredential, flags byte) []byte {
+	flags |= flagUserPresent
+	if a.UserVerified {
+		flags |= flagUserVerified
+	}
+
+	rpIDHash := sha256.Sum256([]byte(cred.rpID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, cred.signCount)
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge []byte) ([]byte, error) {
+	return json.Marshal(clientData{
+		Type:      ceremony,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    a.Origin,
+	})
+}
@@ -0,0 +1,251 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// maxCBORDepth limits how deeply nested the CBOR we accept can be. Attestation
+// objects and COSE keys are only a few levels deep.
+const maxCBORDepth = 16
+
+var errCBOR = errors.New("malformed cbor")
+
+// decodeCBOR decodes the first CBOR data item in b and returns it along with the
+// bytes after it. It covers the subset of CBOR that WebAuthn uses: integers come back
+// as int64, byte strings as []byte, text as string, arrays as []any and maps as
+// map[any]any keyed by int64 or string. Indefinite lengths and floats are rejected,
+// since authenticators have to use the canonical encoding.
+func decodeCBOR(b []byte) (any, []byte, error) {
+	return decodeItem(b, 0)
+}
+
+func decodeItem(b []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deeply", errCBOR)
+	}
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end of data", errCBOR)
+	}
+
+	major := b[0] >> 5
+	info := b[0] & 0x1f
+	b = b[1:]
+
+	// simple values carry their meaning in info rather than in an argument
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		}
+		return nil, nil, fmt.Errorf("%w: unsupported simple value %d", errCBOR, info)
+	}
+
+	arg, b, err := readArgument(info, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return int64(arg), b, nil
+
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return -1 - int64(arg), b, nil
+
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, fmt.Errorf("%w: string longer than data", errCBOR)
+		}
+		s := b[:arg]
+		if major == 3 {
+			return string(s), b[arg:], nil
+		}
+		return append([]byte(nil), s...), b[arg:], nil
+
+	case 4:
+		// every item takes at least a byte, which bounds the allocation
+		if arg > uint64(len(b)) {
+			return nil, nil, fmt.Errorf("%w: array longer than data", errCBOR)
+		}
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item any
+			item, b, err = decodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, b, nil
+
+	case 5:
+		if arg > uint64(len(b))/2 {
+			return nil, nil, fmt.Errorf("%w: map longer than data", errCBOR)
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value any
+			key, b, err = decodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key", errCBOR)
+			}
+			if _, ok := m[key]; ok {
+				return nil, nil, fmt.Errorf("%w: duplicate map key", errCBOR)
+			}
+			value, b, err = decodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, b, nil
+
+	case 6:
+		// tags don't change how we read the value they wrap
+		return decodeItem(b, depth+1)
+	}
+
+	return nil, nil, fmt.Errorf("%w: unknown major type %d", errCBOR, major)
+}
+
+// readArgument reads the argument that follows an initial byte with additional
+// information info
+func readArgument(info byte, b []byte) (uint64, []byte, error) {
+	var size int
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, nil, fmt.Errorf("%w: indefinite or reserved length", errCBOR)
+	}
+
+	if len(b) < size {
+		return 0, nil, fmt.Errorf("%w: unexpected end of data", errCBOR)
+	}
+
+	var arg uint64
+	switch size {
+	case 1:
+		arg = uint64(b[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(b))
+	case 8:
+		arg = binary.BigEndian.Uint64(b)
+	}
+
+	return arg, b[size:], nil
+}
+
+// encodeCBOR encodes v in canonical CBOR. It takes the same types decodeCBOR returns,
+// plus int, and sorts map keys the way CTAP2 requires: integers before strings, and
+// shorter encodings first.
+func encodeCBOR(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case int:
+		return encodeInt(int64(v)), nil
+	case int64:
+		return encodeInt(v), nil
+	case []byte:
+		return append(encodeHead(2, uint64(len(v))), v...), nil
+	case string:
+		return append(encodeHead(3, uint64(len(v))), v...), nil
+	case bool:
+		if v {
+			return []byte{0xf5}, nil
+		}
+		return []byte{0xf4}, nil
+	case []any:
+		out := encodeHead(4, uint64(len(v)))
+		for _, item := range v {
+			b, err := encodeCBOR(item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, b...)
+		}
+		return out, nil
+	case map[any]any:
+		type pair struct{ key, value []byte }
+		pairs := make([]pair, 0, len(v))
+		for key, value := range v {
+			k, err := encodeCBOR(key)
+			if err != nil {
+				return nil, err
+			}
+			val, err := encodeCBOR(value)
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, pair{k, val})
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			a, b := pairs[i].key, pairs[j].key
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return bytes.Compare(a, b) < 0
+		})
+
+		out := encodeHead(5, uint64(len(v)))
+		for _, p := range pairs {
+			out = append(out, p.key...)
+			out = append(out, p.value...)
+		}
+		return out, nil
+	}
+
+	return nil, fmt.Errorf("cbor: can't encode %T", v)
+}
+
+func encodeInt(n int64) []byte {
+	if n < 0 {
+		return encodeHead(1, uint64(-1-n))
+	}
+	return encodeHead(0, uint64(n))
+}
+
+// encodeHead encodes the initial byte and argument of an item of the given major type
+func encodeHead(major byte, arg uint64) []byte {
+	major <<= 5
+	switch {
+	case arg < 24:
+		return []byte{major | byte(arg)}
+	case arg <= math.MaxUint8:
+		return []byte{major | 24, byte(arg)}
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16([]byte{major | 25}, uint16(arg))
+	case arg <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32([]byte{major | 26}, uint32(arg))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major | 27}, arg)
+}
@@ -0,0 +1,487 @@
+// Package webauthn implements the relying party side of WebAuthn (passkey)
+// registration and authentication ceremonies. It is stateless: callers generate and
+// keep track of challenges, store the credentials VerifyRegistration returns, and
+// pass them back in to VerifyAssertion. Only "none" attestation is requested, so
+// attestation statements are not checked.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// ChallengeSize is the number of random bytes in a challenge
+	ChallengeSize = 32
+	// Timeout is how long the browser gives the user to complete a ceremony
+	Timeout = 5 * time.Minute
+
+	ceremonyCreate = "webauthn.create"
+	ceremonyGet    = "webauthn.get"
+
+	publicKeyType = "public-key"
+)
+
+// authenticator data flags
+const (
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagBackupEligible = 0x08
+	flagBackedUp       = 0x10
+	flagAttestedData   = 0x40
+	flagExtensions     = 0x80
+)
+
+var (
+	// ErrInvalidResponse is returned when a response from the browser can't be parsed
+	ErrInvalidResponse = errors.New("invalid webauthn response")
+	// ErrChallengeMismatch is returned when a response wasn't made for the challenge
+	// we issued
+	ErrChallengeMismatch = errors.New("webauthn challenge does not match")
+	// ErrOriginMismatch is returned when a response came from an origin we don't serve
+	ErrOriginMismatch = errors.New("webauthn origin not allowed")
+	// ErrRPIDMismatch is returned when a credential is scoped to another relying party
+	ErrRPIDMismatch = errors.New("webauthn relying party does not match")
+	// ErrUserNotPresent is returned when the authenticator didn't test for user presence
+	ErrUserNotPresent = errors.New("user presence was not confirmed")
+	// ErrUserNotVerified is returned when user verification is required but the
+	// authenticator didn't perform it
+	ErrUserNotVerified = errors.New("user verification was not performed")
+	// ErrBadSignature is returned when an assertion signature doesn't verify
+	ErrBadSignature = errors.New("webauthn signature is invalid")
+	// ErrClonedAuthenticator is returned when a signature counter goes backwards, which
+	// means the credential's private key has probably been copied
+	ErrClonedAuthenticator = errors.New("authenticator signature counter went backwards")
+)
+
+// Bytes is binary data that is base64url encoded in JSON, the way browsers encode
+// ArrayBuffers when serializing credentials
+type Bytes []byte
+
+// MarshalJSON encodes b as unpadded base64url
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON decodes base64url, with or without padding
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	decoded, err := decodeBase64URL(s)
+	if err != nil {
+		return err
+	}
+
+	*b = decoded
+	return nil
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	s = string(bytes.TrimRight([]byte(s), "="))
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// RelyingParty describes the site credentials are registered with
+type RelyingParty struct {
+	// ID is the domain credentials are scoped to, such as "example.com"
+	ID string
+	// Name is shown to the user by the authenticator
+	Name string
+	// Origins are the exact origins, such as "https://example.com", that ceremonies
+	// may come from
+	Origins []string
+	// RequireUserVerification rejects responses where the authenticator didn't
+	// verify the user with a PIN or biometric
+	RequireUserVerification bool
+}
+
+// NewChallenge returns a new random challenge
+func NewChallenge() (Bytes, error) {
+	challenge := make([]byte, ChallengeSize)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+// RPEntity identifies the relying party in creation options
+type RPEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// UserEntity identifies the account a credential is being created for. ID is an
+// opaque handle the authenticator returns with discoverable credentials.
+type UserEntity struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// CredentialParameter is one algorithm we accept
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// CredentialDescriptor points at an existing credential
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         Bytes    `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// AuthenticatorSelection states what kind of authenticator we want
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions is passed to navigator.credentials.create as the publicKey option
+type CreationOptions struct {
+	Challenge              Bytes                  `json:"challenge"`
+	RP                     RPEntity               `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions is passed to navigator.credentials.get as the publicKey option
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CreationOptions returns the options for registering a new credential for user.
+// exclude lists the user's existing credentials so the same authenticator isn't
+// registered twice.
+func (rp *RelyingParty) CreationOptions(challenge Bytes, user UserEntity, exclude []CredentialDescriptor) CreationOptions {
+	params := make([]CredentialParameter, 0, len(SupportedAlgorithms))
+	for _, alg := range SupportedAlgorithms {
+		params = append(params, CredentialParameter{Type: publicKeyType, Alg: alg})
+	}
+
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+
+	return CreationOptions{
+		Challenge:          challenge,
+		RP:                 RPEntity{ID: rp.ID, Name: rp.Name},
+		User:               user,
+		PubKeyCredParams:   params,
+		Timeout:            Timeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: rp.userVerification(),
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions returns the options for signing in. allow lists the credentials
+// that may be used; leave it empty to let the user pick any discoverable credential
+// they have for this site.
+func (rp *RelyingParty) RequestOptions(challenge Bytes, allow []CredentialDescriptor) RequestOptions {
+	if allow == nil {
+		allow = []CredentialDescriptor{}
+	}
+
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          Timeout.Milliseconds(),
+		RPID:             rp.ID,
+		AllowCredentials: allow,
+		UserVerification: rp.userVerification(),
+	}
+}
+
+func (rp *RelyingParty) userVerification() string {
+	if rp.RequireUserVerification {
+		return "required"
+	}
+	return "preferred"
+}
+
+// RegistrationResponse is the PublicKeyCredential returned by
+// navigator.credentials.create, serialized as JSON
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes    `json:"clientDataJSON"`
+		AttestationObject Bytes    `json:"attestationObject"`
+		Transports        []string `json:"transports,omitempty"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the PublicKeyCredential returned by navigator.credentials.get,
+// serialized as JSON
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AuthenticatorData Bytes `json:"authenticatorData"`
+		Signature         Bytes `json:"signature"`
+		UserHandle        Bytes `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// Credential is a newly registered credential, ready to be stored
+type Credential struct {
+	ID []byte
+	// PublicKey is the credential public key in COSE form
+	PublicKey      []byte
+	Algorithm      int
+	SignCount      uint32
+	AAGUID         []byte
+	Transports     []string
+	UserVerified   bool
+	BackupEligible bool
+	BackedUp       bool
+}
+
+// Assertion is the outcome of a successful sign in
+type Assertion struct {
+	// SignCount is the authenticator's new signature counter, to be stored with the
+	// credential
+	SignCount    uint32
+	UserVerified bool
+	BackedUp     bool
+}
+
+// VerifyRegistration checks a response to CreationOptions made with challenge and
+// returns the new credential
+func (rp *RelyingParty) VerifyRegistration(challenge []byte, resp RegistrationResponse) (*Credential, error) {
+	if resp.Type != publicKeyType {
+		return nil, fmt.Errorf("%w: credential type %q", ErrInvalidResponse, resp.Type)
+	}
+
+	err := rp.verifyClientData(resp.Response.ClientDataJSON, ceremonyCreate, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	item, rest, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: attestation object", ErrInvalidResponse)
+	}
+	attestation, ok := item.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: attestation object", ErrInvalidResponse)
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing authenticator data", ErrInvalidResponse)
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err = rp.checkAuthenticatorData(authData); err != nil {
+		return nil, err
+	}
+	if authData.credentialID == nil {
+		return nil, fmt.Errorf("%w: no attested credential", ErrInvalidResponse)
+	}
+	if len(resp.RawID) > 0 && !bytes.Equal(resp.RawID, authData.credentialID) {
+		return nil, fmt.Errorf("%w: credential id does not match", ErrInvalidResponse)
+	}
+
+	key, err := parsePublicKey(authData.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:             authData.credentialID,
+		PublicKey:      authData.publicKey,
+		Algorithm:      key.alg,
+		SignCount:      authData.signCount,
+		AAGUID:         authData.aaguid,
+		Transports:     resp.Response.Transports,
+		UserVerified:   authData.flags&flagUserVerified != 0,
+		BackupEligible: authData.flags&flagBackupEligible != 0,
+		BackedUp:       authData.flags&flagBackedUp != 0,
+	}, nil
+}
+
+// VerifyAssertion checks a response to RequestOptions made with challenge, against the
+// stored public key and signature counter of the credential it names. Callers look
+// the credential up by resp.RawID.
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, publicKey []byte, signCount uint32, resp AssertionResponse) (*Assertion, error) {
+	if resp.Type != publicKeyType {
+		return nil, fmt.Errorf("%w: credential type %q", ErrInvalidResponse, resp.Type)
+	}
+
+	err := rp.verifyClientData(resp.Response.ClientDataJSON, ceremonyGet, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	authData, err := parseAuthenticatorData(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	if err = rp.checkAuthenticatorData(authData); err != nil {
+		return nil, err
+	}
+
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(append([]byte{}, resp.Response.AuthenticatorData...), clientDataHash[:]...)
+	if !key.verify(signed, resp.Response.Signature) {
+		return nil, ErrBadSignature
+	}
+
+	// authenticators that don't keep a counter always report zero
+	if (authData.signCount != 0 || signCount != 0) && authData.signCount <= signCount {
+		return nil, ErrClonedAuthenticator
+	}
+
+	return &Assertion{
+		SignCount:    authData.signCount,
+		UserVerified: authData.flags&flagUserVerified != 0,
+		BackedUp:     authData.flags&flagBackedUp != 0,
+	}, nil
+}
+
+// clientData is the browser's record of what it asked the authenticator to sign
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+func (rp *RelyingParty) verifyClientData(raw []byte, ceremony string, challenge []byte) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("%w: client data", ErrInvalidResponse)
+	}
+
+	if data.Type != ceremony {
+		return fmt.Errorf("%w: ceremony %q", ErrInvalidResponse, data.Type)
+	}
+
+	got, err := decodeBase64URL(data.Challenge)
+	if err != nil || len(challenge) == 0 || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return ErrChallengeMismatch
+	}
+
+	if data.CrossOrigin {
+		return ErrOriginMismatch
+	}
+	for _, origin := range rp.Origins {
+		if data.Origin == origin {
+			return nil
+		}
+	}
+
+	return ErrOriginMismatch
+}
+
+// authenticatorData is the parsed form of the authenticator's signed statement
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// set when flagAttestedData is
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidResponse)
+	}
+
+	data := &authenticatorData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	rest := b[37:]
+
+	if data.flags&flagAttestedData != 0 {
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidResponse)
+		}
+		data.aaguid = append([]byte(nil), rest[:16]...)
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength == 0 || idLength > 1023 || len(rest) < idLength {
+			return nil, fmt.Errorf("%w: bad credential id length", ErrInvalidResponse)
+		}
+		data.credentialID = append([]byte(nil), rest[:idLength]...)
+		rest = rest[idLength:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: credential public key", ErrInvalidResponse)
+		}
+		data.publicKey = append([]byte(nil), rest[:len(rest)-len(after)]...)
+		rest = after
+	}
+
+	if data.flags&flagExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: extensions", ErrInvalidResponse)
+		}
+		rest = after
+	}
+
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing authenticator data", ErrInvalidResponse)
+	}
+
+	return data, nil
+}
+
+func (rp *RelyingParty) checkAuthenticatorData(data *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(data.rpIDHash, rpIDHash[:]) != 1 {
+		return ErrRPIDMismatch
+	}
+
+	if data.flags&flagUserPresent == 0 {
+		return ErrUserNotPresent
+	}
+
+	if rp.RequireUserVerification && data.flags&flagUserVerified == 0 {
+		return ErrUserNotVerified
+	}
+
+	return nil
+}
@@ -0,0 +1,318 @@
+package webauthn
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const testOrigin = "https://example.com"
+
+func testRelyingParty() *RelyingParty {
+	return &RelyingParty{
+		ID:                      "example.com",
+		Name:                    "Example",
+		Origins:                 []string{testOrigin},
+		RequireUserVerification: true,
+	}
+}
+
+func newChallenge(t *testing.T) Bytes {
+	t.Helper()
+
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return challenge
+}
+
+// throughJSON sends v the way the browser would, as JSON, and decodes it into out
+func throughJSON(t *testing.T, v, out any) {
+	t.Helper()
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// register runs a registration ceremony between rp and a, and returns the credential
+// rp would store
+func register(t *testing.T, rp *RelyingParty, a *Authenticator) *Credential {
+	t.Helper()
+
+	challenge := newChallenge(t)
+	var options CreationOptions
+	throughJSON(t, rp.CreationOptions(challenge, UserEntity{ID: []byte{1}, Name: "user@example.com"}, nil), &options)
+
+	resp, err := a.Create(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received RegistrationResponse
+	throughJSON(t, resp, &received)
+
+	credential, err := rp.VerifyRegistration(challenge, received)
+	if err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+
+	return credential
+}
+
+// assert asks a to sign in to rp and returns the challenge and the response
+func assert(t *testing.T, rp *RelyingParty, a *Authenticator, credential *Credential) (Bytes, AssertionResponse) {
+	t.Helper()
+
+	challenge := newChallenge(t)
+	var options RequestOptions
+	throughJSON(t, rp.RequestOptions(challenge, []CredentialDescriptor{{Type: publicKeyType, ID: credential.ID}}), &options)
+
+	resp, err := a.Get(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received AssertionResponse
+	throughJSON(t, resp, &received)
+
+	return challenge, received
+}
+
+func TestCeremonies(t *testing.T) {
+	rp := testRelyingParty()
+	a := NewAuthenticator(testOrigin)
+
+	credential := register(t, rp, a)
+	if credential.Algorithm != AlgES256 || !credential.UserVerified || credential.SignCount != 0 {
+		t.Errorf("got credential %+v", credential)
+	}
+
+	// each sign in moves the counter on, and the new count is what gets stored
+	signCount := credential.SignCount
+	for i := 0; i < 3; i++ {
+		challenge, resp := assert(t, rp, a, credential)
+		if string(resp.RawID) != string(credential.ID) {
+			t.Fatalf("signed in with credential %x, want %x", resp.RawID, credential.ID)
+		}
+
+		assertion, err := rp.VerifyAssertion(challenge, credential.PublicKey, signCount, resp)
+		if err != nil {
+			t.Fatalf("sign in %d failed: %v", i+1, err)
+		}
+		if assertion.SignCount <= signCount || !assertion.UserVerified {
+			t.Fatalf("got assertion %+v after count %d", assertion, signCount)
+		}
+		signCount = assertion.SignCount
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup returns the authenticator and the options it is given
+		setup func(t *testing.T, rp *RelyingParty, challenge Bytes) (*Authenticator, CreationOptions)
+		// challenge is the one we check against; nil means the one we issued
+		challenge Bytes
+		want      error
+	}{
+		{
+			name: "wrong origin",
+			setup: func(t *testing.T, rp *RelyingParty, challenge Bytes) (*Authenticator, CreationOptions) {
+				return NewAuthenticator("https://example.com.evil.test"), rp.CreationOptions(challenge, UserEntity{ID: []byte{1}}, nil)
+			},
+			want: ErrOriginMismatch,
+		},
+		{
+			name: "wrong relying party",
+			setup: func(t *testing.T, rp *RelyingParty, challenge Bytes) (*Authenticator, CreationOptions) {
+				options := rp.CreationOptions(challenge, UserEntity{ID: []byte{1}}, nil)
+				options.RP.ID = "evil.test"
+				return NewAuthenticator(testOrigin), options
+			},
+			want: ErrRPIDMismatch,
+		},
+		{
+			name: "response to another challenge",
+			setup: func(t *testing.T, rp *RelyingParty, challenge Bytes) (*Authenticator, CreationOptions) {
+				return NewAuthenticator(testOrigin), rp.CreationOptions(challenge, UserEntity{ID: []byte{1}}, nil)
+			},
+			challenge: Bytes("a challenge issued for some other ceremony"),
+			want:      ErrChallengeMismatch,
+		},
+		{
+			name: "user not verified",
+			setup: func(t *testing.T, rp *RelyingParty, challenge Bytes) (*Authenticator, CreationOptions) {
+				a := NewAuthenticator(testOrigin)
+				a.UserVerified = false
+				return a, rp.CreationOptions(challenge, UserEntity{ID: []byte{1}}, nil)
+			},
+			want: ErrUserNotVerified,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := testRelyingParty()
+			challenge := newChallenge(t)
+			a, options := tt.setup(t, rp, challenge)
+
+			resp, err := a.Create(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := challenge
+			if tt.challenge != nil {
+				expected = tt.challenge
+			}
+
+			_, err = rp.VerifyRegistration(expected, resp)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssertionRejected(t *testing.T) {
+	rp := testRelyingParty()
+	a := NewAuthenticator(testOrigin)
+	credential := register(t, rp, a)
+
+	tests := []struct {
+		name string
+		// verify signs in with a and checks the response the way the test needs
+		verify func(t *testing.T) error
+		want   error
+	}{
+		{
+			name: "wrong origin",
+			verify: func(t *testing.T) error {
+				a.Origin = "https://evil.test"
+				defer func() { a.Origin = testOrigin }()
+
+				challenge, resp := assert(t, rp, a, credential)
+				_, err := rp.VerifyAssertion(challenge, credential.PublicKey, 0, resp)
+				return err
+			},
+			want: ErrOriginMismatch,
+		},
+		{
+			// a relying party on another domain passing on a response it got for itself
+			name: "wrong relying party",
+			verify: func(t *testing.T) error {
+				other := testRelyingParty()
+				other.ID = "evil.test"
+				otherCredential := register(t, other, a)
+
+				challenge, resp := assert(t, other, a, otherCredential)
+				_, err := rp.VerifyAssertion(challenge, otherCredential.PublicKey, 0, resp)
+				return err
+			},
+			want: ErrRPIDMismatch,
+		},
+		{
+			// the caller only keeps the latest challenge, so a response recorded for an
+			// earlier one can't be played back
+			name: "reused challenge",
+			verify: func(t *testing.T) error {
+				_, recorded := assert(t, rp, a, credential)
+				_, err := rp.VerifyAssertion(newChallenge(t), credential.PublicKey, 0, recorded)
+				return err
+			},
+			want: ErrChallengeMismatch,
+		},
+		{
+			name: "signature over other data",
+			verify: func(t *testing.T) error {
+				challenge, resp := assert(t, rp, a, credential)
+				resp.Response.AuthenticatorData[len(resp.Response.AuthenticatorData)-1]++
+				_, err := rp.VerifyAssertion(challenge, credential.PublicKey, 0, resp)
+				return err
+			},
+			want: ErrBadSignature,
+		},
+		{
+			name: "another credential's key",
+			verify: func(t *testing.T) error {
+				other := register(t, rp, NewAuthenticator(testOrigin))
+
+				challenge, resp := assert(t, rp, a, credential)
+				_, err := rp.VerifyAssertion(challenge, other.PublicKey, 0, resp)
+				return err
+			},
+			want: ErrBadSignature,
+		},
+		{
+			name: "registration response",
+			verify: func(t *testing.T) error {
+				challenge := newChallenge(t)
+				created, err := a.Create(rp.CreationOptions(challenge, UserEntity{ID: []byte{1}}, nil))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var resp AssertionResponse
+				resp.Type = created.Type
+				resp.Response.ClientDataJSON = created.Response.ClientDataJSON
+				_, err = rp.VerifyAssertion(challenge, credential.PublicKey, 0, resp)
+				return err
+			},
+			want: ErrInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.verify(t); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// A copied private key has its own counter, which falls behind the real one; the first
+// time the copy is used it reports a count we have already seen.
+func TestClonedAuthenticator(t *testing.T) {
+	rp := testRelyingParty()
+	a := NewAuthenticator(testOrigin)
+	credential := register(t, rp, a)
+
+	clone := NewAuthenticator(testOrigin)
+	copied := *a.credentials[0]
+	clone.credentials = append(clone.credentials, &copied)
+
+	signCount := credential.SignCount
+	for i := 0; i < 2; i++ {
+		challenge, resp := assert(t, rp, a, credential)
+		assertion, err := rp.VerifyAssertion(challenge, credential.PublicKey, signCount, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signCount = assertion.SignCount
+	}
+
+	challenge, resp := assert(t, rp, clone, credential)
+	_, err := rp.VerifyAssertion(challenge, credential.PublicKey, signCount, resp)
+	if !errors.Is(err, ErrClonedAuthenticator) {
+		t.Errorf("got %v, want %v", err, ErrClonedAuthenticator)
+	}
+
+	// the same goes for replaying a response with the count we just stored
+	challenge, resp = assert(t, rp, a, credential)
+	assertion, err := rp.VerifyAssertion(challenge, credential.PublicKey, signCount, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rp.VerifyAssertion(challenge, credential.PublicKey, assertion.SignCount, resp)
+	if !errors.Is(err, ErrClonedAuthenticator) {
+		t.Errorf("replay got %v, want %v", err, ErrClonedAuthenticator)
+	}
+}
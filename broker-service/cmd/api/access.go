@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// accessRule describes who may perform an action. A public rule lets anyone through,
+// otherwise the caller has to be authenticated and hold every permission listed. Rules
+// with mfa set also need the caller to have passed a second factor at login.
+type accessRule struct {
+	public      bool
+	permissions []string
+	mfa         bool
+}
+
+var (
+	public        = accessRule{public: true}
+	authenticated = accessRule{}
+)
+
+// requirePermission returns a rule for actions that need the given permissions. The
+// authentication service works out which permissions a user has from their roles.
+func requirePermission(permissions ...string) accessRule {
+	return accessRule{permissions: permissions}
+}
+
+// withMFA returns a copy of the rule that also requires a second factor
+func (rule accessRule) withMFA() accessRule {
+	rule.mfa = true
+	return rule
+}
+
+// actionRules holds the access rule for every action HandleSubmission knows about.
+// Actions missing from this map are treated as requiring authentication.
+var actionRules = map[string]accessRule{
+	"register":            public,
+	"login":               public,
+	"refresh":             public,
+	"logout":              public,
+	"forgotPassword":      public,
+	"resetPassword":       public,
+	"verifyEmail":         public,
+	"resendVerification":  public,
+	"verifyTwoFactor":     public,
+	"requestMagicLink":    public,
+	"magicLinkLogin":      public,
+	"beginPasskeyLogin":   public,
+	"finishPasskeyLogin":  public,
+	"enrollTwoFactor":     authenticated,
+	"confirmTwoFactor":    authenticated,
+	"disableTwoFactor":    authenticated,
+	"listSessions":        authenticated,
+	"revokeSession":       authenticated,
+	"revokeOtherSessions": authenticated,
+	"listOrganizations":   authenticated,
+	"switchOrganization":  authenticated,
+	"log":                 requirePermission("logs:write"),
+	"mail":                requirePermission("mail:send"),
+	// passkeys, managed by each user for their own account like two factor enrollment
+	"beginPasskeyRegistration":  authenticated,
+	"finishPasskeyRegistration": authenticated,
+	"listPasskeys":              authenticated,
+	"deletePasskey":             authenticated,
+	// admin actions also need two factor authentication
+	"getAllUsers":   requirePermission("users:read").withMFA(),
+	"getUser":       requirePermission("users:read").withMFA(),
+	"updateUser":    requirePermission("users:write").withMFA(),
+	"deleteUser":    requirePermission("users:write").withMFA(),
+	"importUsers":   requirePermission("users:write").withMFA(),
+	"exportUsers":   requirePermission("users:read").withMFA(),
+	"unlockAccount": requirePermission("accounts:unlock").withMFA(),
+	"listRoles":     requirePermission("roles:manage").withMFA(),
+	"getUserRoles":  requirePermission("roles:manage").withMFA(),
+	"grantRole":     requirePermission("roles:manage").withMFA(),
+	"revokeRole":    requirePermission("roles:manage").withMFA(),
+	// sessions
+	"getUserSessions": requirePermission("sessions:revoke").withMFA(),
+	"forceLogout":     requirePermission("sessions:revoke").withMFA(),
+	// account status
+	"suspendUser":          requirePermission("accounts:suspend").withMFA(),
+	"restoreUser":          requirePermission("accounts:suspend").withMFA(),
+	"getUserStatusHistory": requirePermission("accounts:suspend").withMFA(),
+	// service accounts
+	"listServiceAccounts":  requirePermission("service_accounts:manage").withMFA(),
+	"createServiceAccount": requirePermission("service_accounts:manage").withMFA(),
+	"deleteServiceAccount": requirePermission("service_accounts:manage").withMFA(),
+	"listApiKeys":          requirePermission("service_accounts:manage").withMFA(),
+	"createApiKey":         requirePermission("service_accounts:manage").withMFA(),
+	"rotateApiKey":         requirePermission("service_accounts:manage").withMFA(),
+	"revokeApiKey":         requirePermission("service_accounts:manage").withMFA(),
+	// organizations
+	"createOrganization": requirePermission("organizations:manage").withMFA(),
+	"listMembers":        requirePermission("organizations:manage").withMFA(),
+	"setMember":          requirePermission("organizations:manage").withMFA(),
+	"removeMember":       requirePermission("organizations:manage").withMFA(),
+	// privacy requests
+	"exportUser":          requirePermission("privacy:manage").withMFA(),
+	"eraseUser":           requirePermission("privacy:manage").withMFA(),
+	"listPrivacyRequests": requirePermission("privacy:manage").withMFA(),
+}
+
+// authorize checks the principal on the request against the rule for action. It
+// returns the status code to send back along with the error when access is denied.
+func (app *Config) authorize(r *http.Request, action string) (int, error) {
+	rule, ok := actionRules[action]
+	if !ok {
+		rule = authenticated
+	}
+
+	if rule.public {
+		return http.StatusOK, nil
+	}
+
+	principal := principalFromContext(r.Context())
+	if principal == nil {
+		return http.StatusUnauthorized, errors.New("authentication required")
+	}
+
+	for _, permission := range rule.permissions {
+		if !principal.HasPermission(permission) {
+			return http.StatusForbidden, errors.New("you are not allowed to perform this action")
+		}
+	}
+
+	if rule.mfa && !principal.MFA {
+		return http.StatusForbidden, errors.New("two factor authentication is required for this action")
+	}
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// authService stands in for the authentication service: it answers API key checks
+// for the keys it knows, and any relayed request with 202
+type authService struct {
+	mu      sync.Mutex
+	keys    map[string][]string
+	secrets []string
+	status  int
+}
+
+func (s *authService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path != "/api-keys/verify" {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"error": false, "message": "ok"}`))
+		return
+	}
+
+	s.secrets = append(s.secrets, r.Header.Get(internalSecretHeader))
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+
+	var payload struct {
+		Key string `json:"key"`
+	}
+	json.NewDecoder(r.Body).Decode(&payload)
+
+	scopes, ok := s.keys[payload.Key]
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{
+		"data": map[string]any{
+			"service_account_id": 1,
+			"service_account":    "ci",
+			"scopes":             scopes,
+		},
+	})
+}
+
+// newTestApp returns a broker that trusts tokens signed with "test-secret" and checks
+// API keys against auth
+func newTestApp(t *testing.T, auth *authService) *Config {
+	t.Helper()
+
+	server := httptest.NewServer(auth)
+	t.Cleanup(server.Close)
+
+	return &Config{
+		JWT: JWTConfig{
+			Secret:   []byte("test-secret"),
+			Issuer:   "authentication-service",
+			Audience: "broker-service",
+		},
+		Sessions:       NewRevokedSessions("internal-secret"),
+		InternalSecret: "internal-secret",
+		AuthURL:        server.URL,
+	}
+}
+
+// signToken returns an access token like the authentication service issues, which
+// edit can change before it is signed
+func signToken(t *testing.T, app *Config, edit func(*Claims)) string {
+	t.Helper()
+
+	claims := Claims{
+		Email:       "user@example.com",
+		Roles:       []string{"user"},
+		Permissions: []string{"logs:write"},
+		AMR:         []string{"pwd"},
+		SessionID:   "7",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "1",
+			Issuer:    app.JWT.Issuer,
+			Audience:  jwt.ClaimStrings{app.JWT.Audience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
+		},
+	}
+	if edit != nil {
+		edit(&claims)
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(app.JWT.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestAuthorize(t *testing.T) {
+	user := &Principal{UserID: "1", Permissions: []string{"logs:write"}}
+	admin := &Principal{UserID: "2", Permissions: []string{"users:read", "users:write"}}
+	mfaAdmin := &Principal{UserID: "2", Permissions: []string{"users:read", "users:write"}, MFA: true}
+	serviceAccount := &Principal{ServiceAccountID: 1, Permissions: []string{"mail:send"}}
+
+	tests := []struct {
+		name      string
+		action    string
+		principal *Principal
+		status    int
+	}{
+		{"public action anonymously", "login", nil, http.StatusOK},
+		{"authenticated action anonymously", "listSessions", nil, http.StatusUnauthorized},
+		{"authenticated action", "listSessions", user, http.StatusOK},
+		{"unknown action anonymously", "noSuchAction", nil, http.StatusUnauthorized},
+		{"unknown action", "noSuchAction", user, http.StatusOK},
+		{"permission held", "log", user, http.StatusOK},
+		{"permission missing", "mail", user, http.StatusForbidden},
+		{"admin action without a second factor", "getAllUsers", admin, http.StatusForbidden},
+		{"admin action with a second factor", "getAllUsers", mfaAdmin, http.StatusOK},
+		{"admin action without the permission", "grantRole", mfaAdmin, http.StatusForbidden},
+		{"api key scope held", "mail", serviceAccount, http.StatusOK},
+		{"api key scope missing", "log", serviceAccount, http.StatusForbidden},
+		{"api key on an admin action", "getAllUsers", &Principal{ServiceAccountID: 1, Permissions: []string{"users:read"}}, http.StatusForbidden},
+	}
+
+	app := &Config{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/handle", nil)
+			if tt.principal != nil {
+				r = r.WithContext(context.WithValue(r.Context(), principalKey, tt.principal))
+			}
+
+			status, err := app.authorize(r, tt.action)
+			if status != tt.status {
+				t.Errorf("got status %d (%v), want %d", status, err, tt.status)
+			}
+			if (err == nil) != (tt.status == http.StatusOK) {
+				t.Errorf("got error %v with status %d", err, status)
+			}
+		})
+	}
+}
+
+// every action that needs a permission is an admin action, and needs a second factor
+// too, except for the ones ordinary users and service accounts are granted
+func TestAdminActionsNeedMFA(t *testing.T) {
+	withoutMFA := map[string]bool{"log": true, "mail": true}
+
+	for action, rule := range actionRules {
+		if len(rule.permissions) > 0 && !withoutMFA[action] && !rule.mfa {
+			t.Errorf("%s needs %v but not a second factor", action, rule.permissions)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth := &authService{keys: map[string][]string{"good-key": {"mail:send"}}}
+	app := newTestApp(t, auth)
+	app.Sessions.revoked["13"] = time.Now()
+
+	tests := []struct {
+		name          string
+		header        string
+		status        int
+		wantPrincipal bool
+		mfa           bool
+	}{
+		{"no credentials", "", http.StatusOK, false, false},
+		{"password login", "Bearer " + signToken(t, app, nil), http.StatusOK, true, false},
+		{"second factor", "Bearer " + signToken(t, app, func(c *Claims) { c.AMR = []string{"pwd", "otp"} }), http.StatusOK, true, true},
+		{"magic link", "Bearer " + signToken(t, app, func(c *Claims) { c.AMR = []string{"email"} }), http.StatusOK, true, false},
+		{"magic link and code", "Bearer " + signToken(t, app, func(c *Claims) { c.AMR = []string{"email", "otp"} }), http.StatusOK, true, true},
+		{"passkey", "Bearer " + signToken(t, app, func(c *Claims) { c.AMR = []string{"hwk"} }), http.StatusOK, true, false},
+		{"verified passkey", "Bearer " + signToken(t, app, func(c *Claims) { c.AMR = []string{"hwk", "user"} }), http.StatusOK, true, true},
+		{"wrong audience", "Bearer " + signToken(t, app, func(c *Claims) { c.Audience = jwt.ClaimStrings{"someone-else"} }), http.StatusUnauthorized, false, false},
+		{"expired", "Bearer " + signToken(t, app, func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }), http.StatusUnauthorized, false, false},
+		{"no session", "Bearer " + signToken(t, app, func(c *Claims) { c.SessionID = "" }), http.StatusUnauthorized, false, false},
+		{"revoked session", "Bearer " + signToken(t, app, func(c *Claims) { c.SessionID = "13" }), http.StatusUnauthorized, false, false},
+		{"garbage token", "Bearer not-a-token", http.StatusUnauthorized, false, false},
+		{"unknown scheme", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, false, false},
+		{"valid api key", "ApiKey good-key", http.StatusOK, true, false},
+		{"unknown api key", "ApiKey bad-key", http.StatusUnauthorized, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var principal *Principal
+			handler := app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				principal = principalFromContext(r.Context())
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/handle", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			if (principal != nil) != tt.wantPrincipal {
+				t.Fatalf("got principal %+v, want one: %v", principal, tt.wantPrincipal)
+			}
+			if principal != nil && principal.MFA != tt.mfa {
+				t.Errorf("got MFA %v, want %v", principal.MFA, tt.mfa)
+			}
+		})
+	}
+
+	for _, secret := range auth.secrets {
+		if secret != "internal-secret" {
+			t.Errorf("api key check sent secret %q", secret)
+		}
+	}
+}
+
+func TestAuthenticateAPIKeyServiceDown(t *testing.T) {
+	app := newTestApp(t, &authService{status: http.StatusInternalServerError})
+
+	handler := app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request got through")
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/handle", nil)
+	r.Header.Set("Authorization", "ApiKey good-key")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestAPIKeyPrincipal(t *testing.T) {
+	app := newTestApp(t, &authService{keys: map[string][]string{"good-key": {"mail:send"}}})
+
+	principal, err := app.verifyAPIKey("good-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if principal.ServiceAccountID != 1 || principal.ServiceAccount != "ci" {
+		t.Errorf("got service account %d %q", principal.ServiceAccountID, principal.ServiceAccount)
+	}
+	if !principal.HasPermission("mail:send") || principal.HasPermission("logs:write") {
+		t.Errorf("got permissions %v, want the key's scopes", principal.Permissions)
+	}
+	if principal.UserID != "" || principal.MFA {
+		t.Errorf("an api key is not a user who passed a second factor: %+v", principal)
+	}
+}
+
+func TestRequireAction(t *testing.T) {
+	app := newTestApp(t, &authService{keys: map[string][]string{"mail-key": {"mail:send"}}})
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"user with the permission", "Bearer " + signToken(t, app, nil), http.StatusAccepted},
+		{"user without the permission", "Bearer " + signToken(t, app, func(c *Claims) { c.Permissions = nil }), http.StatusForbidden},
+		{"api key without the scope", "ApiKey mail-key", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := app.authenticate(app.requireAction("log")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+			})))
+
+			r := httptest.NewRequest(http.MethodPost, "/log-grpc", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestHandleSubmissionAccess(t *testing.T) {
+	app := newTestApp(t, &authService{})
+	handler := app.routes()
+
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		status int
+	}{
+		{"public action is relayed", "", `{"action": "login", "login": {"email": "a@example.com", "password": "x"}}`, http.StatusAccepted},
+		{"admin action anonymously", "", `{"action": "getAllUsers"}`, http.StatusUnauthorized},
+		{"admin action without a second factor", "Bearer " + signToken(t, app, func(c *Claims) { c.Permissions = []string{"users:read"} }), `{"action": "getAllUsers"}`, http.StatusForbidden},
+		{"admin action with a second factor", "Bearer " + signToken(t, app, func(c *Claims) {
+			c.Permissions = []string{"users:read"}
+			c.AMR = []string{"pwd", "otp"}
+		}), `{"action": "getAllUsers"}`, http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/handle", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d (%s), want %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+}
@@ -7,9 +7,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/rpc"
+	"net/url"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc"
@@ -17,11 +21,29 @@ import (
 )
 
 type RequestPayload struct {
-	Action   string          `json:"action"`
-	Register RegisterPayload `json:"register,omitempty"`
-	Login    LoginPayload    `json:"login,omitempty"`
-	Log      LogPayload      `json:"log,omitempty"`
-	Mail     MailPayload     `json:"mail,omitempty"`
+	Action    string           `json:"action"`
+	Register  RegisterPayload  `json:"register,omitempty"`
+	Login     LoginPayload     `json:"login,omitempty"`
+	Refresh   RefreshPayload   `json:"refresh,omitempty"`
+	Password  PasswordPayload  `json:"password,omitempty"`
+	Verify    VerifyPayload    `json:"verify,omitempty"`
+	TwoFactor TwoFactorPayload `json:"twoFactor,omitempty"`
+	MagicLink MagicLinkPayload `json:"magicLink,omitempty"`
+	Unlock    UnlockPayload    `json:"unlock,omitempty"`
+	Session   SessionPayload   `json:"session,omitempty"`
+	Role      RolePayload      `json:"role,omitempty"`
+	User      UserPayload      `json:"user,omitempty"`
+	Users     UserListPayload  `json:"users,omitempty"`
+	// ServiceAccount and APIKey are used by the service account actions
+	ServiceAccount ServiceAccountPayload `json:"serviceAccount,omitempty"`
+	APIKey         APIKeyPayload         `json:"apiKey,omitempty"`
+	Privacy        PrivacyPayload        `json:"privacy,omitempty"`
+	AccountStatus  AccountStatusPayload  `json:"accountStatus,omitempty"`
+	Organization   OrganizationPayload   `json:"organization,omitempty"`
+	Passkey        PasskeyPayload        `json:"passkey,omitempty"`
+	Bulk           BulkPayload           `json:"bulk,omitempty"`
+	Log            LogPayload            `json:"log,omitempty"`
+	Mail           MailPayload           `json:"mail,omitempty"`
 }
 
 type RegisterPayload struct {
@@ -36,16 +58,192 @@ type LoginPayload struct {
 	Password string `json:"password"`
 }
 
+type RefreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// PasswordPayload is used by both forgotPassword (email) and resetPassword (token and password)
+type PasswordPayload struct {
+	Email    string `json:"email,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// VerifyPayload is used by verifyEmail (token) and resendVerification (email)
+type VerifyPayload struct {
+	Token string `json:"token,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// TwoFactorPayload carries a TOTP or recovery code, plus the challenge token from
+// login when finishing a two step login
+type TwoFactorPayload struct {
+	ChallengeToken string `json:"challenge_token,omitempty"`
+	Code           string `json:"code,omitempty"`
+	RecoveryCode   string `json:"recovery_code,omitempty"`
+}
+
+// MagicLinkPayload is used by requestMagicLink (email) and magicLinkLogin (token)
+type MagicLinkPayload struct {
+	Email string `json:"email,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+// PasskeyPayload is used by the passkey actions. The begin actions return a session
+// token and options for navigator.credentials; the finish actions send back that token
+// and the resulting credential, serialized as JSON, unchanged. ID names the passkey
+// deletePasskey removes.
+type PasskeyPayload struct {
+	ID         int             `json:"id,omitempty"`
+	Email      string          `json:"email,omitempty"`
+	Session    string          `json:"session,omitempty"`
+	Name       string          `json:"name,omitempty"`
+	Credential json.RawMessage `json:"credential,omitempty"`
+}
+
+// SessionPayload names the session to revoke, or the user whose sessions an admin
+// wants to see or end
+type SessionPayload struct {
+	ID     int `json:"id,omitempty"`
+	UserID int `json:"user_id,omitempty"`
+}
+
+// UnlockPayload names the account and/or client address an admin wants to unlock
+type UnlockPayload struct {
+	Email string `json:"email,omitempty"`
+	IP    string `json:"ip,omitempty"`
+}
+
+// RolePayload names a user and, when granting or revoking, a role
+type RolePayload struct {
+	UserID int    `json:"user_id"`
+	Role   string `json:"role,omitempty"`
+}
+
+// UserPayload identifies a user and, for updateUser, carries the fields to change.
+// Fields left out of an update keep their current values.
+type UserPayload struct {
+	ID        int     `json:"id"`
+	Email     *string `json:"email,omitempty"`
+	FirstName *string `json:"first_name,omitempty"`
+	LastName  *string `json:"last_name,omitempty"`
+	Active    *int    `json:"active,omitempty"`
+}
+
+// UserListPayload pages through, filters and sorts getAllUsers. Every field is optional.
+type UserListPayload struct {
+	Limit         int    `json:"limit,omitempty"`
+	Cursor        string `json:"cursor,omitempty"`
+	Sort          string `json:"sort,omitempty"`
+	Active        *int   `json:"active,omitempty"`
+	Status        string `json:"status,omitempty"`
+	CreatedAfter  string `json:"created_after,omitempty"`
+	CreatedBefore string `json:"created_before,omitempty"`
+	EmailDomain   string `json:"email_domain,omitempty"`
+}
+
+// query turns the payload into the query string the authentication service expects
+func (p UserListPayload) query() string {
+	v := url.Values{}
+	if p.Limit > 0 {
+		v.Set("limit", fmt.Sprint(p.Limit))
+	}
+	if p.Active != nil {
+		v.Set("active", fmt.Sprint(*p.Active))
+	}
+
+	for name, value := range map[string]string{
+		"cursor":         p.Cursor,
+		"sort":           p.Sort,
+		"status":         p.Status,
+		"created_after":  p.CreatedAfter,
+		"created_before": p.CreatedBefore,
+		"email_domain":   p.EmailDomain,
+	} {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+
+	return v.Encode()
+}
+
+// ServiceAccountPayload identifies a service account and, for createServiceAccount,
+// names and describes it
+type ServiceAccountPayload struct {
+	ID          int    `json:"id,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// APIKeyPayload identifies an API key of a service account and, for createApiKey,
+// carries its name, scopes and optional expiry
+type APIKeyPayload struct {
+	ServiceAccountID int        `json:"service_account_id"`
+	ID               int        `json:"id,omitempty"`
+	Name             string     `json:"name,omitempty"`
+	Scopes           []string   `json:"scopes,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+}
+
+// PrivacyPayload names the user an export or erasure is for. Format is json (the
+// default) or zip, for exportUser.
+type PrivacyPayload struct {
+	UserID int    `json:"user_id"`
+	Format string `json:"format,omitempty"`
+}
+
+// AccountStatusPayload names the user to suspend or restore, and why. Reason isn't
+// needed for getUserStatusHistory.
+type AccountStatusPayload struct {
+	UserID int    `json:"user_id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// BulkPayload is used by importUsers and exportUsers. Format is csv or ndjson; for an
+// import Data holds the file itself, so it has to fit in a broker request.
+type BulkPayload struct {
+	Format string `json:"format"`
+	DryRun bool   `json:"dry_run,omitempty"`
+	Data   string `json:"data,omitempty"`
+}
+
+// query turns the payload into the query string the authentication service expects
+func (p BulkPayload) query() string {
+	v := url.Values{}
+	v.Set("format", p.Format)
+	if p.DryRun {
+		v.Set("dry_run", "true")
+	}
+
+	return v.Encode()
+}
+
+// OrganizationPayload names an organization and, depending on the action, the
+// organization to create, the member to change or the role to give them
+type OrganizationPayload struct {
+	ID      int    `json:"id,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Slug    string `json:"slug,omitempty"`
+	OwnerID int    `json:"owner_id,omitempty"`
+	UserID  int    `json:"user_id,omitempty"`
+	Role    string `json:"role,omitempty"`
+}
+
+// LogPayload and MailPayload carry the caller's organization on to the logger and mail
+// services. It is always taken from the caller's token, never from the request.
 type LogPayload struct {
-	Name string `json:"name"`
-	Data string `json:"data"`
+	Name           string `json:"name"`
+	Data           string `json:"data"`
+	OrganizationID int    `json:"organization_id,omitempty"`
 }
 
 type MailPayload struct {
-	From    string `json:"from"`
-	To      string `json:"to"`
-	Subject string `json:"subject"`
-	Message string `json:"message"`
+	From           string `json:"from"`
+	To             string `json:"to"`
+	Subject        string `json:"subject"`
+	Message        string `json:"message"`
+	OrganizationID int    `json:"organization_id,omitempty"`
 }
 
 func (app *Config) Broker(w http.ResponseWriter, r *http.Request) {
@@ -72,6 +270,16 @@ func (app *Config) HandleSubmission(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	status, err := app.authorize(r, requestPayload.Action)
+	if err != nil {
+		app.errorJSON(w, err, status)
+		return
+	}
+
+	// the organization a caller acts in comes from their token, not from what they send
+	requestPayload.Log.OrganizationID = organizationFromContext(r.Context())
+	requestPayload.Mail.OrganizationID = organizationFromContext(r.Context())
+
 	switch requestPayload.Action {
 	case "log":
 		// app.logItem(w, requestPayload.Log)
@@ -80,9 +288,113 @@ func (app *Config) HandleSubmission(w http.ResponseWriter, r *http.Request) {
 	case "register":
 		app.register(w, requestPayload.Register)
 	case "login":
-		app.login(w, requestPayload.Login)
+		app.relayToAuth(w, r, "POST", "/login", requestPayload.Login, "Authenticated!")
+	case "refresh":
+		app.relayToAuth(w, r, "POST", "/refresh", requestPayload.Refresh, "Refreshed!")
+	case "logout":
+		app.relayToAuth(w, r, "POST", "/logout", requestPayload.Refresh, "Logged out!")
+	case "forgotPassword":
+		app.relayToAuth(w, r, "POST", "/password/forgot", requestPayload.Password, "Password reset requested!")
+	case "resetPassword":
+		app.relayToAuth(w, r, "POST", "/password/reset", requestPayload.Password, "Password reset!")
+	case "verifyEmail":
+		app.relayToAuth(w, r, "POST", "/verify", requestPayload.Verify, "Email verified!")
+	case "resendVerification":
+		app.relayToAuth(w, r, "POST", "/verify/resend", requestPayload.Verify, "Verification email requested!")
+	case "verifyTwoFactor":
+		app.relayToAuth(w, r, "POST", "/login/2fa", requestPayload.TwoFactor, "Authenticated!")
+	case "requestMagicLink":
+		app.relayToAuth(w, r, "POST", "/login/magic/request", requestPayload.MagicLink, "Login link requested!")
+	case "magicLinkLogin":
+		app.relayToAuth(w, r, "POST", "/login/magic", requestPayload.MagicLink, "Authenticated!")
+	case "beginPasskeyLogin":
+		app.relayToAuth(w, r, "POST", "/login/webauthn/begin", requestPayload.Passkey, "Passkey login started!")
+	case "finishPasskeyLogin":
+		app.relayToAuth(w, r, "POST", "/login/webauthn/finish", requestPayload.Passkey, "Authenticated!")
+	case "enrollTwoFactor":
+		app.relayToAuth(w, r, "POST", "/2fa/enroll", nil, "Two factor enrollment started!")
+	case "confirmTwoFactor":
+		app.relayToAuth(w, r, "POST", "/2fa/confirm", requestPayload.TwoFactor, "Two factor authentication enabled!")
+	case "disableTwoFactor":
+		app.relayToAuth(w, r, "POST", "/2fa/disable", requestPayload.TwoFactor, "Two factor authentication disabled!")
+	case "beginPasskeyRegistration":
+		app.relayToAuth(w, r, "POST", "/webauthn/register/begin", nil, "Passkey registration started!")
+	case "finishPasskeyRegistration":
+		app.relayToAuth(w, r, "POST", "/webauthn/register/finish", requestPayload.Passkey, "Passkey added!")
+	case "listPasskeys":
+		app.relayToAuth(w, r, "GET", "/webauthn/credentials", nil, "Passkeys")
+	case "deletePasskey":
+		app.relayToAuth(w, r, "DELETE", fmt.Sprintf("/webauthn/credentials/%d", requestPayload.Passkey.ID), nil, "Passkey removed!")
+	case "unlockAccount":
+		app.relayToAuth(w, r, "POST", "/admin/unlock", requestPayload.Unlock, "Unlocked!")
+	case "listRoles":
+		app.relayToAuth(w, r, "GET", "/admin/roles", nil, "All roles")
+	case "getUserRoles":
+		app.relayToAuth(w, r, "GET", fmt.Sprintf("/admin/users/%d/roles", requestPayload.Role.UserID), nil, "User roles")
+	case "grantRole":
+		app.relayToAuth(w, r, "POST", fmt.Sprintf("/admin/users/%d/roles", requestPayload.Role.UserID), requestPayload.Role, "Role granted!")
+	case "revokeRole":
+		app.relayToAuth(w, r, "DELETE", fmt.Sprintf("/admin/users/%d/roles/%s", requestPayload.Role.UserID, url.PathEscape(requestPayload.Role.Role)), nil, "Role revoked!")
 	case "getAllUsers":
-		app.getAllUsers(w)
+		app.relayToAuth(w, r, "GET", "/user?"+requestPayload.Users.query(), nil, "All users")
+	case "getUser":
+		app.relayToAuth(w, r, "GET", fmt.Sprintf("/user/%d", requestPayload.User.ID), nil, "User")
+	case "updateUser":
+		app.relayToAuth(w, r, "PUT", fmt.Sprintf("/user/%d", requestPayload.User.ID), requestPayload.User, "User updated!")
+	case "importUsers":
+		app.relayBodyToAuth(w, r, "POST", "/user/import?"+requestPayload.Bulk.query(), strings.NewReader(requestPayload.Bulk.Data), "text/plain", "Users imported!")
+	case "exportUsers":
+		app.relayToAuth(w, r, "GET", "/user/export?"+requestPayload.Bulk.query(), nil, "Users exported!")
+	case "deleteUser":
+		app.relayToAuth(w, r, "DELETE", fmt.Sprintf("/user/%d", requestPayload.User.ID), nil, "User deleted!")
+	case "listSessions":
+		app.relayToAuth(w, r, "GET", "/sessions", nil, "Active sessions")
+	case "revokeSession":
+		app.relayToAuth(w, r, "DELETE", fmt.Sprintf("/sessions/%d", requestPayload.Session.ID), nil, "Session revoked!")
+	case "revokeOtherSessions":
+		app.relayToAuth(w, r, "POST", "/sessions/revoke-others", nil, "Other sessions revoked!")
+	case "getUserSessions":
+		app.relayToAuth(w, r, "GET", fmt.Sprintf("/admin/users/%d/sessions", requestPayload.Session.UserID), nil, "User sessions")
+	case "forceLogout":
+		app.relayToAuth(w, r, "POST", fmt.Sprintf("/admin/users/%d/logout", requestPayload.Session.UserID), nil, "User logged out everywhere!")
+	case "suspendUser":
+		app.relayToAuth(w, r, "POST", fmt.Sprintf("/admin/users/%d/suspend", requestPayload.AccountStatus.UserID), requestPayload.AccountStatus, "User suspended!")
+	case "restoreUser":
+		app.relayToAuth(w, r, "POST", fmt.Sprintf("/admin/users/%d/restore", requestPayload.AccountStatus.UserID), requestPayload.AccountStatus, "User restored!")
+	case "getUserStatusHistory":
+		app.relayToAuth(w, r, "GET", fmt.Sprintf("/admin/users/%d/status-history", requestPayload.AccountStatus.UserID), nil, "User status history")
+	case "listServiceAccounts":
+		app.relayToAuth(w, r, "GET", "/admin/service-accounts", nil, "All service accounts")
+	case "createServiceAccount":
+		app.relayToAuth(w, r, "POST", "/admin/service-accounts", requestPayload.ServiceAccount, "Service account created!")
+	case "deleteServiceAccount":
+		app.relayToAuth(w, r, "DELETE", fmt.Sprintf("/admin/service-accounts/%d", requestPayload.ServiceAccount.ID), nil, "Service account deleted!")
+	case "listApiKeys":
+		app.relayToAuth(w, r, "GET", fmt.Sprintf("/admin/service-accounts/%d/keys", requestPayload.APIKey.ServiceAccountID), nil, "API keys")
+	case "createApiKey":
+		app.relayToAuth(w, r, "POST", fmt.Sprintf("/admin/service-accounts/%d/keys", requestPayload.APIKey.ServiceAccountID), requestPayload.APIKey, "API key created!")
+	case "rotateApiKey":
+		app.relayToAuth(w, r, "POST", fmt.Sprintf("/admin/service-accounts/%d/keys/%d/rotate", requestPayload.APIKey.ServiceAccountID, requestPayload.APIKey.ID), nil, "API key rotated!")
+	case "revokeApiKey":
+		app.relayToAuth(w, r, "DELETE", fmt.Sprintf("/admin/service-accounts/%d/keys/%d", requestPayload.APIKey.ServiceAccountID, requestPayload.APIKey.ID), nil, "API key revoked!")
+	case "exportUser":
+		app.relayToAuth(w, r, "GET", fmt.Sprintf("/admin/users/%d/export?format=%s", requestPayload.Privacy.UserID, url.QueryEscape(requestPayload.Privacy.Format)), nil, "User exported!")
+	case "eraseUser":
+		app.relayToAuth(w, r, "POST", fmt.Sprintf("/admin/users/%d/erase", requestPayload.Privacy.UserID), nil, "User erased!")
+	case "listPrivacyRequests":
+		app.relayToAuth(w, r, "GET", fmt.Sprintf("/admin/users/%d/privacy-requests", requestPayload.Privacy.UserID), nil, "Privacy requests")
+	case "listOrganizations":
+		app.relayToAuth(w, r, "GET", "/organizations", nil, "Your organizations")
+	case "createOrganization":
+		app.relayToAuth(w, r, "POST", "/organizations", requestPayload.Organization, "Organization created!")
+	case "switchOrganization":
+		app.relayToAuth(w, r, "POST", "/organizations/switch", map[string]int{"organization_id": requestPayload.Organization.ID}, "Switched organization!")
+	case "listMembers":
+		app.relayToAuth(w, r, "GET", fmt.Sprintf("/organizations/%d/members", requestPayload.Organization.ID), nil, "Organization members")
+	case "setMember":
+		app.relayToAuth(w, r, "PUT", fmt.Sprintf("/organizations/%d/members/%d", requestPayload.Organization.ID, requestPayload.Organization.UserID), requestPayload.Organization, "Member updated!")
+	case "removeMember":
+		app.relayToAuth(w, r, "DELETE", fmt.Sprintf("/organizations/%d/members/%d", requestPayload.Organization.ID, requestPayload.Organization.UserID), nil, "Member removed!")
 	case "mail":
 		app.sendMail(w, requestPayload.Mail)
 	default:
@@ -163,8 +475,15 @@ func (app *Config) register(w http.ResponseWriter, registerPayload RegisterPaylo
 		return
 	}
 
+	// pass errors on as they are, so the client sees which password rules were broken
 	if jsonFromService.Error {
-		app.errorJSON(w, err, http.StatusUnauthorized)
+		out := jsonResponse{
+			Error:   true,
+			Code:    jsonFromService.Code,
+			Message: jsonFromService.Message,
+			Data:    jsonFromService.Data,
+		}
+		app.writeJSON(w, response.StatusCode, out)
 		return
 	}
 
@@ -178,65 +497,37 @@ func (app *Config) register(w http.ResponseWriter, registerPayload RegisterPaylo
 
 }
 
-func (app *Config) login(w http.ResponseWriter, loginPayload LoginPayload) {
-	// Create some json we'll send to the auth microservice
-	jsonData, _ := json.MarshalIndent(loginPayload, "", "\t")
-
-	// Call the service
-	request, err := http.NewRequest("POST", "http://authentication-service/login", bytes.NewBuffer(jsonData))
-	if err != nil {
-		app.errorJSON(w, err)
-		return
+// relayToAuth sends payload to the authentication service and relays its response
+// back to the client. Errors keep the status code, error code and data the
+// authentication service sent. The caller's Authorization header is passed on so the
+// authentication service can tell who is asking.
+func (app *Config) relayToAuth(w http.ResponseWriter, r *http.Request, method, path string, payload any, message string) {
+	var body io.Reader
+	if payload != nil {
+		jsonData, _ := json.Marshal(payload)
+		body = bytes.NewBuffer(jsonData)
 	}
 
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		app.errorJSON(w, err)
-		return
-	}
-	defer response.Body.Close()
-	log.Default().Println("STATUS CODE: ", response.StatusCode)
-	// make sure we get back the correct status code
-	if response.StatusCode == http.StatusUnauthorized {
-		app.errorJSON(w, errors.New("invalid credentials"))
-		return
-	} else if response.StatusCode != http.StatusAccepted {
-		app.errorJSON(w, errors.New("error calling authentication service"))
-		return
-	}
-
-	// create a variable we'll read the response.Body into
-	var jsonFromService jsonResponse
+	app.relayBodyToAuth(w, r, method, path, body, "application/json", message)
+}
 
-	// decode the json from the auth service
-	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+// relayBodyToAuth is relayToAuth for a request body that is already encoded, like a
+// CSV file
+func (app *Config) relayBodyToAuth(w http.ResponseWriter, r *http.Request, method, path string, body io.Reader, contentType, message string) {
+	request, err := http.NewRequest(method, app.authService(path), body)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
-
-	if jsonFromService.Error {
-		app.errorJSON(w, err, http.StatusUnauthorized)
-		return
+	request.Header.Set("Content-Type", contentType)
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		request.Header.Set("Authorization", auth)
 	}
-
-	// We have valid login if we reach here. Send the response back to the client
-	var payload jsonResponse
-	payload.Error = false
-	payload.Message = "Authenticated!"
-	payload.Data = jsonFromService.Data
-
-	app.writeJSON(w, http.StatusAccepted, payload)
-	// log.Default().Println(payload.Data)
-}
-
-func (app *Config) getAllUsers(w http.ResponseWriter) {
-	// Call the service
-	request, err := http.NewRequest("GET", "http://authentication-service/user", nil)
-	if err != nil {
-		app.errorJSON(w, err)
-		return
+	// the authentication service records the device and address of each session
+	request.Header.Set("User-Agent", r.UserAgent())
+	// the authentication service throttles logins per client address
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		request.Header.Set("X-Real-IP", ip)
 	}
 
 	client := &http.Client{}
@@ -247,9 +538,12 @@ func (app *Config) getAllUsers(w http.ResponseWriter) {
 	}
 	defer response.Body.Close()
 
-	// make sure we get back the correct status code
-	if response.StatusCode != http.StatusAccepted {
-		app.errorJSON(w, errors.New("error calling authentication service"))
+	// files, like a user export, are passed through untouched
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", response.Header.Get("Content-Disposition"))
+		w.WriteHeader(response.StatusCode)
+		io.Copy(w, response.Body)
 		return
 	}
 
@@ -259,22 +553,31 @@ func (app *Config) getAllUsers(w http.ResponseWriter) {
 	// decode the json from the auth service
 	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, errors.New("error calling authentication service"))
 		return
 	}
 
 	if jsonFromService.Error {
-		app.errorJSON(w, err, http.StatusUnauthorized)
+		if retryAfter := response.Header.Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+
+		out := jsonResponse{
+			Error:   true,
+			Code:    jsonFromService.Code,
+			Message: jsonFromService.Message,
+			Data:    jsonFromService.Data,
+		}
+		app.writeJSON(w, response.StatusCode, out)
 		return
 	}
 
-	// We have valid login if we reach here. Send the response back to the client
-	var payload jsonResponse
-	payload.Error = false
-	payload.Message = "Authenticated!"
-	payload.Data = jsonFromService.Data
+	var out jsonResponse
+	out.Error = false
+	out.Message = message
+	out.Data = jsonFromService.Data
 
-	app.writeJSON(w, http.StatusAccepted, payload)
+	app.writeJSON(w, http.StatusAccepted, out)
 }
 
 func (app *Config) sendMail(w http.ResponseWriter, mailPayload MailPayload) {
@@ -351,8 +654,9 @@ func (app *Config) sendMail(w http.ResponseWriter, mailPayload MailPayload) {
 
 // has to exactly match the server side type
 type RPCPayload struct {
-	Name string
-	Data string
+	Name           string
+	Data           string
+	OrganizationID int
 }
 
 func (app *Config) logItemViaRPC(w http.ResponseWriter, logPayload LogPayload) {
@@ -363,8 +667,9 @@ func (app *Config) logItemViaRPC(w http.ResponseWriter, logPayload LogPayload) {
 	}
 
 	logP := LogPayload{
-		Name: logPayload.Name,
-		Data: logPayload.Data,
+		Name:           logPayload.Name,
+		Data:           logPayload.Data,
+		OrganizationID: logPayload.OrganizationID,
 	}
 
 	rpcPayload := RPCPayload(logP)
@@ -413,6 +718,8 @@ func (app *Config) LogViaGRPC(w http.ResponseWriter, r *http.Request) {
 			Name: requestPayload.Log.Name,
 			Data: requestPayload.Log.Data,
 		},
+		// as in HandleSubmission, the organization comes from the caller's token
+		OrganizationId: int64(organizationFromContext(r.Context())),
 	})
 	if err != nil {
 		app.errorJSON(w, err)
@@ -11,6 +11,8 @@ import (
 
 type jsonResponse struct {
 	Error bool `json:"error"`
+	// Code is a machine readable reason for an error, passed on from the services we call
+	Code string `json:"code,omitempty"`
 	Message string `json:"message"`
 	Data any `json:"data,omitempty"`
 }
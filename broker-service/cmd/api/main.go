@@ -16,6 +16,15 @@ const webPort = "8080"
 type Config struct {
 	// rabbitMQ connection
 	Rabbit *amqp.Connection
+	// used to verify access tokens issued by the authentication service
+	JWT JWTConfig
+	// sessions revoked before their access tokens expired
+	Sessions *RevokedSessions
+	// shared with the authentication service, which wants it on the routes only we
+	// may call
+	InternalSecret string
+	// where the authentication service is; empty means authServiceURL
+	AuthURL string
 }
 
 // Want this to accept JSON payload, do something with it, and return a JSON response
@@ -29,10 +38,27 @@ func main() {
 	}
 	defer rabbitConn.Close()
 	
+	internalSecret := os.Getenv("INTERNAL_API_SECRET")
+
 	app := Config{
-		Rabbit: rabbitConn,
+		Rabbit:         rabbitConn,
+		JWT:            createJWTConfig(),
+		Sessions:       NewRevokedSessions(internalSecret),
+		InternalSecret: internalSecret,
+	}
+
+	if len(app.JWT.Secret) == 0 {
+		log.Println("JWT_SECRET must be set")
+		os.Exit(1)
 	}
 
+	if app.InternalSecret == "" {
+		log.Println("INTERNAL_API_SECRET must be set")
+		os.Exit(1)
+	}
+
+	go app.Sessions.Watch(sessionSyncInterval())
+
 	log.Printf("Starting broker service on port %s\n", webPort)
 
 	// define http server
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type contextKey string
+
+const principalKey contextKey = "principal"
+
+var errInvalidAPIKey = errors.New("invalid or expired api key")
+
+// JWTConfig holds what we need to verify access tokens signed by the authentication service
+type JWTConfig struct {
+	Secret   []byte
+	Issuer   string
+	Audience string
+}
+
+// Claims has to match the claims the authentication service puts in its access tokens
+type Claims struct {
+	Email       string   `json:"email"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions,omitempty"`
+	AMR         []string `json:"amr,omitempty"`
+	SessionID   string   `json:"sid,omitempty"`
+	// OrganizationID is the organization the user is acting in, and OrganizationRole
+	// their role there
+	OrganizationID   int    `json:"org_id,omitempty"`
+	OrganizationRole string `json:"org_role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Principal is the authenticated caller of a request: either a user with a bearer
+// token, or a service account with an API key
+type Principal struct {
+	UserID string   `json:"user_id,omitempty"`
+	Email  string   `json:"email,omitempty"`
+	Roles  []string `json:"roles"`
+	// Permissions holds what the user's roles grant, or for a service account the
+	// scopes of its API key
+	Permissions []string `json:"permissions"`
+	// MFA is true when the caller passed a second factor at login
+	MFA bool `json:"mfa"`
+	// ServiceAccountID and ServiceAccount are set for callers using an API key
+	ServiceAccountID int    `json:"service_account_id,omitempty"`
+	ServiceAccount   string `json:"service_account,omitempty"`
+	// OrganizationID is the organization a user is acting in, if any. It is passed on
+	// to the logger and mail services so their records can be kept per tenant.
+	OrganizationID   int    `json:"organization_id,omitempty"`
+	OrganizationRole string `json:"organization_role,omitempty"`
+}
+
+// HasRole reports whether the principal has been granted role
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasPermission reports whether any of the principal's roles grant permission
+func (p *Principal) HasPermission(permission string) bool {
+	for _, granted := range p.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authServiceURL is where the authentication service is unless Config.AuthURL says
+// otherwise; the host comes from docker-compose.yml
+const authServiceURL = "http://authentication-service"
+
+// authService returns the URL of path on the authentication service
+func (app *Config) authService(path string) string {
+	if app.AuthURL != "" {
+		return app.AuthURL + path
+	}
+
+	return authServiceURL + path
+}
+
+// internalSecretHeader carries INTERNAL_API_SECRET on the authentication service's
+// routes that only we may call
+const internalSecretHeader = "X-Internal-Secret"
+
+func createJWTConfig() JWTConfig {
+	return JWTConfig{
+		Secret:   []byte(os.Getenv("JWT_SECRET")),
+		Issuer:   "authentication-service",
+		Audience: "broker-service",
+	}
+}
+
+// authenticate checks the bearer token or API key on the request, if there is one, and
+// puts the caller's identity into the request context. Requests without an
+// Authorization header are let through anonymously so public actions keep working;
+// each action decides whether it needs a principal. Credentials that are present but
+// invalid are always rejected.
+func (app *Config) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme, token, found := strings.Cut(header, " ")
+		if !found {
+			app.errorJSON(w, errors.New("invalid authorization header"), http.StatusUnauthorized)
+			return
+		}
+
+		var principal *Principal
+		var err error
+
+		switch {
+		case strings.EqualFold(scheme, "Bearer"):
+			principal, err = app.verifyToken(strings.TrimSpace(token))
+			if err != nil {
+				app.errorJSON(w, errors.New("invalid or expired token"), http.StatusUnauthorized)
+				return
+			}
+
+		case strings.EqualFold(scheme, "ApiKey"):
+			principal, err = app.verifyAPIKey(strings.TrimSpace(token))
+			if errors.Is(err, errInvalidAPIKey) {
+				app.errorJSON(w, err, http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				log.Println("could not verify api key:", err)
+				app.errorJSON(w, errors.New("could not verify api key"), http.StatusBadGateway)
+				return
+			}
+
+		default:
+			app.errorJSON(w, errors.New("invalid authorization header"), http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalKey, principal)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireAction applies the access rule of an action to a route that performs it
+// outside HandleSubmission, so the route is no easier to use than the action
+func (app *Config) requireAction(action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status, err := app.authorize(r, action)
+			if err != nil {
+				app.errorJSON(w, err, status)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// verifyToken checks the signature, expiry, issuer and audience of an access token, and
+// that its session hasn't been revoked
+func (app *Config) verifyToken(tokenString string) (*Principal, error) {
+	if len(app.JWT.Secret) == 0 {
+		return nil, errors.New("token verification key is not configured")
+	}
+
+	var claims Claims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (any, error) {
+		return app.JWT.Secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(app.JWT.Issuer),
+		jwt.WithAudience(app.JWT.Audience),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt == nil || claims.Subject == "" || claims.SessionID == "" {
+		return nil, errors.New("token is missing required claims")
+	}
+
+	if app.Sessions != nil && app.Sessions.IsRevoked(claims.SessionID) {
+		return nil, errors.New("session has been revoked")
+	}
+
+	principal := &Principal{
+		UserID:           claims.Subject,
+		Email:            claims.Email,
+		Roles:            claims.Roles,
+		Permissions:      claims.Permissions,
+		OrganizationID:   claims.OrganizationID,
+		OrganizationRole: claims.OrganizationRole,
+	}
+
+	principal.MFA = passedMFA(claims.AMR)
+
+	return principal, nil
+}
+
+// passedMFA reports whether a login with the authentication methods in amr used a
+// second factor: a one time code ("otp") after the first factor, or a passkey ("hwk")
+// that also verified the user ("user"). A password ("pwd"), an emailed link ("email")
+// or a passkey alone is one factor.
+func passedMFA(amr []string) bool {
+	var hardwareKey, user bool
+	for _, method := range amr {
+		switch method {
+		case "otp":
+			return true
+		case "hwk":
+			hardwareKey = true
+		case "user":
+			user = true
+		}
+	}
+
+	return hardwareKey && user
+}
+
+// verifyAPIKey asks the authentication service which service account an API key
+// belongs to and what it is allowed to do. Keys aren't cached, so a revoked key stops
+// working at once.
+func (app *Config) verifyAPIKey(key string) (*Principal, error) {
+	jsonData, _ := json.Marshal(map[string]string{"key": key})
+
+	request, err := http.NewRequest("POST", app.authService("/api-keys/verify"), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(internalSecretHeader, app.InternalSecret)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return nil, errInvalidAPIKey
+	}
+	if response.StatusCode != http.StatusAccepted {
+		return nil, fmt.Errorf("authentication service returned %d", response.StatusCode)
+	}
+
+	var jsonFromService struct {
+		Data struct {
+			ServiceAccountID int      `json:"service_account_id"`
+			ServiceAccount   string   `json:"service_account"`
+			Scopes           []string `json:"scopes"`
+		} `json:"data"`
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		return nil, err
+	}
+
+	principal := &Principal{
+		Roles:            []string{},
+		Permissions:      jsonFromService.Data.Scopes,
+		ServiceAccountID: jsonFromService.Data.ServiceAccountID,
+		ServiceAccount:   jsonFromService.Data.ServiceAccount,
+	}
+
+	return principal, nil
+}
+
+// principalFromContext returns the authenticated caller, or nil for anonymous requests
+func principalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey).(*Principal)
+	return principal
+}
+
+// organizationFromContext returns the organization the caller is acting in, or 0 for
+// anonymous callers, service accounts and users without one
+func organizationFromContext(ctx context.Context) int {
+	if principal := principalFromContext(ctx); principal != nil {
+		return principal.OrganizationID
+	}
+
+	return 0
+}
@@ -25,9 +25,13 @@ func (app *Config) routes() http.Handler {
 	// built into chi, will allow to check if service is alive by checking its heartbeat
 	router.Use(middleware.Heartbeat("/ping"))
 
+	// verify bearer tokens and put the caller into the request context
+	router.Use(app.authenticate)
+
 	router.Post("/", app.Broker)
 
-	router.Post("/log-grpc", app.LogViaGRPC)
+	// writes a log entry like the "log" action, so it has the same rule
+	router.With(app.requireAction("log")).Post("/log-grpc", app.LogViaGRPC)
 
 	// Handles all requests
 	router.Post("/handle", app.HandleSubmission)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// syncOverlap is how far back each poll for revoked sessions reaches before the last
+// one, so a revocation committed just as we polled is still picked up
+const syncOverlap = 30 * time.Second
+
+// RevokedSessions keeps the IDs of recently revoked sessions, which it learns by
+// polling the authentication service. Access tokens are checked locally, so without
+// this a revoked session's access token would keep working until it expired.
+type RevokedSessions struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time
+	// retain is how long a revocation matters: the lifetime of an access token
+	retain time.Duration
+	// since is the authentication service's clock at the last successful poll
+	since time.Time
+	// secret is sent in internalSecretHeader, as the authentication service requires
+	secret string
+}
+
+// NewRevokedSessions returns an empty set of revoked sessions, which polls with the
+// secret shared with the authentication service
+func NewRevokedSessions(secret string) *RevokedSessions {
+	return &RevokedSessions{
+		revoked: make(map[string]time.Time),
+		retain:  time.Hour,
+		secret:  secret,
+	}
+}
+
+// IsRevoked reports whether the session with the given ID has been revoked
+func (s *RevokedSessions) IsRevoked(sessionID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.revoked[sessionID]
+	return ok
+}
+
+// Watch polls for revoked sessions every interval, until the process exits
+func (s *RevokedSessions) Watch(interval time.Duration) {
+	for {
+		err := s.sync()
+		if err != nil {
+			log.Println("could not sync revoked sessions:", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// sync fetches the sessions revoked since the last poll and forgets revocations old
+// enough that their access tokens have expired anyway
+func (s *RevokedSessions) sync() error {
+	s.mu.RLock()
+	since := s.since
+	s.mu.RUnlock()
+
+	serviceURL := "http://authentication-service/sessions/revoked"
+	if !since.IsZero() {
+		serviceURL += "?since=" + url.QueryEscape(since.Add(-syncOverlap).Format(time.RFC3339Nano))
+	}
+
+	request, err := http.NewRequest("GET", serviceURL, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set(internalSecretHeader, s.secret)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("authentication service returned %d", response.StatusCode)
+	}
+
+	var jsonFromService struct {
+		Data struct {
+			Revoked []struct {
+				ID        int       `json:"id"`
+				RevokedAt time.Time `json:"revoked_at"`
+			} `json:"revoked"`
+			Now           time.Time `json:"now"`
+			RetainSeconds int       `json:"retain_seconds"`
+		} `json:"data"`
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, revocation := range jsonFromService.Data.Revoked {
+		s.revoked[strconv.Itoa(revocation.ID)] = revocation.RevokedAt
+	}
+
+	if jsonFromService.Data.RetainSeconds > 0 {
+		s.retain = time.Duration(jsonFromService.Data.RetainSeconds) * time.Second
+	}
+	s.since = jsonFromService.Data.Now
+
+	for id, revokedAt := range s.revoked {
+		if s.since.Sub(revokedAt) > s.retain {
+			delete(s.revoked, id)
+		}
+	}
+
+	return nil
+}
+
+// sessionSyncInterval reads SESSION_SYNC_SECONDS, how often we poll for revoked
+// sessions. It bounds how long a revoked session's access tokens keep working here.
+func sessionSyncInterval() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("SESSION_SYNC_SECONDS")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return 5 * time.Second
+}
@@ -6,6 +6,7 @@ require (
 	github.com/go-chi/chi v1.5.4
 	github.com/go-chi/chi/v5 v5.0.8
 	github.com/go-chi/cors v1.2.1
+	github.com/golang-jwt/jwt/v5 v5.0.0
 	github.com/rabbitmq/amqp091-go v1.8.1
 	google.golang.org/grpc v1.56.1
 	google.golang.org/protobuf v1.30.0
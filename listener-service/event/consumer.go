@@ -46,6 +46,13 @@ func (consumer *Consumer) setup() error {
 type Payload struct {
 	Name string `json:"name"`
 	Data string `json:"data"`
+	// set on authentication events, so the logger can find a user's entries
+	UserID int    `json:"user_id,omitempty"`
+	Email  string `json:"email,omitempty"`
+	// set on events that happened within an organization
+	OrganizationID int `json:"organization_id,omitempty"`
+	// extra details some events carry, such as the old and new status of an account
+	Attributes map[string]string `json:"attributes,omitempty"`
 }
 
 func (consumer *Consumer) Listen(topics []string) error {
@@ -121,6 +128,19 @@ func handlePayload(payload Payload) {
 			log.Println(err)
 		}
 
+	case "auth.account.status_changed":
+		// keep it in the log, and tell the user when their account was shut off or
+		// given back to them
+		err := logEvent(payload)
+		if err != nil {
+			log.Println(err)
+		}
+
+		err = notifyStatusChange(payload)
+		if err != nil {
+			log.Println(err)
+		}
+
 	case "auth":
 		// authenticate
 
@@ -163,3 +183,74 @@ func logEvent(entry Payload) error {
 
 	return nil
 }
+
+// statusNotices are the emails sent to users when their account moves to a status
+var statusNotices = map[string]struct{ subject, message string }{
+	"suspended": {
+		subject: "Your account has been suspended",
+		message: "Your account has been suspended by an administrator and you have been logged out. Reason: %s\n\nContact support if you think this is a mistake.",
+	},
+	"locked": {
+		subject: "Your account has been locked",
+		message: "We locked your account because it looks like someone else may have access to it, and you have been logged out. Reason: %s\n\nContact support to get it restored.",
+	},
+	"active": {
+		subject: "Your account has been restored",
+		message: "Your account is active again and you can log in. Reason: %s",
+	},
+}
+
+// notifyStatusChange emails the user about their account's new status. Accounts that
+// become active after verifying their email address, and changes we have no notice
+// for, such as erasure, send nothing.
+func notifyStatusChange(entry Payload) error {
+	from, to := entry.Attributes["from"], entry.Attributes["to"]
+	if entry.Email == "" || (to == "active" && from == "pending_verification") {
+		return nil
+	}
+
+	notice, ok := statusNotices[to]
+	if !ok {
+		return nil
+	}
+
+	return sendMail(entry.Email, entry.OrganizationID, notice.subject, fmt.Sprintf(notice.message, entry.Attributes["reason"]))
+}
+
+// sendMail asks the mail service to deliver a message from its configured address
+func sendMail(to string, organizationID int, subject, message string) error {
+	var msg struct {
+		To             string `json:"to"`
+		Subject        string `json:"subject"`
+		Message        string `json:"message"`
+		OrganizationID int    `json:"organization_id,omitempty"`
+	}
+
+	msg.To = to
+	msg.Subject = subject
+	msg.Message = message
+	msg.OrganizationID = organizationID
+
+	jsonData, _ := json.Marshal(msg)
+
+	mailServiceURL := "http://mailer-service/send"
+
+	request, err := http.NewRequest("POST", mailServiceURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("mail service returned %d", response.StatusCode)
+	}
+
+	return nil
+}
@@ -21,8 +21,9 @@ func (l *LogServer) WriteLog(ctx context.Context, req *logs.LogRequest) (*logs.L
 
 	// write the log
 	logEntry := data.LogEntry{
-		Name:      input.Name,
-		Data:      input.Data,
+		Name:           input.Name,
+		Data:           input.Data,
+		OrganizationID: int(req.GetOrganizationId()),
 	}
 
 	err := l.Models.LogEntry.Insert(logEntry)
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"log-service/data"
 	"net/http"
+	"strconv"
 )
 
 type JSONPayload struct {
 	Name string `json:"name"`
 	Data string `json:"data"`
+	// UserID and Email are optional and say who the entry is about
+	UserID int    `json:"user_id,omitempty"`
+	Email  string `json:"email,omitempty"`
+	// OrganizationID is optional and says which tenant the entry belongs to
+	OrganizationID int `json:"organization_id,omitempty"`
 }
 
 func (app *Config) WriteLog(w http.ResponseWriter, r *http.Request) {
@@ -26,8 +34,11 @@ func (app *Config) WriteLog(w http.ResponseWriter, r *http.Request) {
 
 	// insert data
 	event := data.LogEntry{
-		Name: requestPayload.Name,
-		Data: requestPayload.Data,
+		Name:           requestPayload.Name,
+		Data:           requestPayload.Data,
+		UserID:         requestPayload.UserID,
+		Email:          requestPayload.Email,
+		OrganizationID: requestPayload.OrganizationID,
 	}
 
 	err = app.Models.LogEntry.Insert(event)
@@ -43,3 +54,88 @@ func (app *Config) WriteLog(w http.ResponseWriter, r *http.Request) {
 
 	app.writeJSON(w, http.StatusAccepted, resp)
 }
+
+// SubjectLogs returns every entry about the user named by the user_id and/or email
+// query parameters, for a subject access request
+func (app *Config) SubjectLogs(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.URL.Query().Get("user_id"))
+	email := r.URL.Query().Get("email")
+
+	if userID <= 0 && email == "" {
+		app.errorJSON(w, errors.New("user_id or email is required"))
+		return
+	}
+
+	entries, err := app.Models.LogEntry.ForSubject(userID, email)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d log entries", len(entries)),
+		Data:    entries,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// OrganizationLogs returns the entries of the organization named by the
+// organization_id query parameter
+func (app *Config) OrganizationLogs(w http.ResponseWriter, r *http.Request) {
+	orgID, _ := strconv.Atoi(r.URL.Query().Get("organization_id"))
+	if orgID <= 0 {
+		app.errorJSON(w, errors.New("organization_id is required"))
+		return
+	}
+
+	entries, err := app.Models.LogEntry.ForOrganization(orgID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d log entries", len(entries)),
+		Data:    entries,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// RedactLogs blanks every entry about a user, for an erasure request
+func (app *Config) RedactLogs(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		UserID int    `json:"user_id"`
+		Email  string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if requestPayload.UserID <= 0 && requestPayload.Email == "" {
+		app.errorJSON(w, errors.New("user_id or email is required"))
+		return
+	}
+
+	redacted, err := app.Models.LogEntry.Redact(requestPayload.UserID, requestPayload.Email)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("redacted %d log entries for user %d", redacted, requestPayload.UserID)
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("redacted %d log entries", redacted),
+		Data:    redacted,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
@@ -25,6 +26,9 @@ var client *mongo.Client
 
 type Config struct {
 	Models data.Models
+	// InternalSecret is shared with the authentication service, the only caller
+	// allowed to read or redact entries about people
+	InternalSecret []byte
 }
 
 func main() {
@@ -49,7 +53,11 @@ func main() {
 
 	// set up config
 	app := Config{
-		Models: data.New(client),
+		Models:         data.New(client),
+		InternalSecret: []byte(os.Getenv("INTERNAL_API_SECRET")),
+	}
+	if len(app.InternalSecret) == 0 {
+		log.Println("INTERNAL_API_SECRET is not set; subject access and erasure requests will be refused")
 	}
 
 	// Register the RPC Server
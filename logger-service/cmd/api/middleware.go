@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+// internalSecretHeader carries INTERNAL_API_SECRET, which the authentication service
+// sends on the routes that read or redact what we hold about people
+const internalSecretHeader = "X-Internal-Secret"
+
+// requireInternal only lets requests through that carry the shared secret in
+// internalSecretHeader. Without a secret configured, every request is refused.
+func (app *Config) requireInternal(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := []byte(r.Header.Get(internalSecretHeader))
+		if len(app.InternalSecret) == 0 || subtle.ConstantTimeCompare(secret, app.InternalSecret) != 1 {
+			app.errorJSON(w, errors.New("authentication required"), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -27,5 +27,15 @@ func (app *Config) routes() http.Handler {
 
 	router.Post("/log", app.WriteLog)
 
+	// these hand out or remove what we hold about people, so only the authentication
+	// service may call them
+	router.Group(func(r chi.Router) {
+		r.Use(app.requireInternal)
+
+		r.Get("/logs/subject", app.SubjectLogs)
+		r.Get("/logs/organization", app.OrganizationLogs)
+		r.Post("/logs/redact", app.RedactLogs)
+	})
+
 	return router
 }
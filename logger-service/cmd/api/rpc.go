@@ -10,18 +10,27 @@ import (
 type RPCServer struct{}
 
 type RPCPayload struct {
-	Name string
-	Data string
+	Name           string
+	Data           string
+	OrganizationID int
 }
 
 func (r *RPCServer) LogInfo(payload RPCPayload, resp *string) error {
 	// the json is writing to collection log_entries
 	collection := client.Database("logs").Collection("rpc_logs")
-	_, err := collection.InsertOne(context.TODO(), data.LogEntry{
-		Name:      payload.Name,
-		Data:      payload.Data,
-		CreatedAt: time.Now(),
-	})
+
+	entry := data.LogEntry{
+		Name:           payload.Name,
+		Data:           payload.Data,
+		OrganizationID: payload.OrganizationID,
+		CreatedAt:      time.Now(),
+	}
+	err := entry.RedactIfErased(&entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.InsertOne(context.TODO(), entry)
 	log.Println("INSERTING")
 	if err != nil {
 		log.Println("Error inserting log entry to mongo: ", err)
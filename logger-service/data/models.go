@@ -2,7 +2,12 @@ package data
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"log"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -25,13 +30,18 @@ type Models struct {
 	LogEntry LogEntry
 }
 
-// bson is what is used in mongo(binary json)
+// bson is what is used in mongo(binary json). UserID and Email name the person an
+// entry is about, when the sender says so, and OrganizationID the tenant it belongs to.
 type LogEntry struct {
-	ID        string    `bson:"_id,omitempty" json:"id,omitempty"`
-	Name      string    `bson:"name" json:"name"`
-	Data      string    `bson:"data" json:"data"`
-	CreatedAt time.Time `bson:"created_at" json:"created_at"`
-	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	ID             string    `bson:"_id,omitempty" json:"id,omitempty"`
+	Name           string    `bson:"name" json:"name"`
+	Data           string    `bson:"data" json:"data"`
+	UserID         int       `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	Email          string    `bson:"email,omitempty" json:"email,omitempty"`
+	OrganizationID int       `bson:"organization_id,omitempty" json:"organization_id,omitempty"`
+	Redacted       bool      `bson:"redacted,omitempty" json:"redacted,omitempty"`
+	CreatedAt      time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time `bson:"updated_at" json:"updated_at"`
 }
 
 // These are all database function for communicating with our MongoDB
@@ -39,11 +49,20 @@ type LogEntry struct {
 func (l *LogEntry) Insert(entry LogEntry) error {
 	collection := client.Database("logs").Collection("log_entries")
 
-	_, err := collection.InsertOne(context.TODO(), LogEntry{
-		Name:      entry.Name,
-		Data:      entry.Data,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+	err := l.RedactIfErased(&entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.InsertOne(context.TODO(), LogEntry{
+		Name:           entry.Name,
+		Data:           entry.Data,
+		UserID:         entry.UserID,
+		Email:          entry.Email,
+		OrganizationID: entry.OrganizationID,
+		Redacted:       entry.Redacted,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
 	})
 	if err != nil {
 		log.Println("Error inserting log entry: ", err)
@@ -151,3 +170,239 @@ func (l *LogEntry) Update() (*mongo.UpdateResult, error) {
 
 	return result, nil
 }
+
+// subjectCollections are the collections entries about a person can be in: the ones
+// sent over HTTP, gRPC and RabbitMQ, and the ones sent over RPC
+var subjectCollections = []string{"log_entries", "rpc_logs"}
+
+// addressChars are the characters that can come right before or after an email
+// address without ending it
+const addressChars = `A-Za-z0-9._%+-`
+
+// mentionPattern matches email where it appears as a whole address in free text, so
+// bob@example.com doesn't match jimbob@example.com or bob@example.com.au. A full stop
+// right after the address still ends it, as at the end of a sentence.
+func mentionPattern(email string) string {
+	return `(^|[^` + addressChars + `])` + regexp.QuoteMeta(email) + `($|[^` + addressChars + `]|\.($|[^A-Za-z0-9]))`
+}
+
+// subjectFilter matches the entries about a person: those tagged with their user ID
+// or email address, and older ones that only mention the address in their data.
+// Addresses are compared without regard to case.
+func subjectFilter(userID int, email string) bson.M {
+	var or bson.A
+	if userID > 0 {
+		or = append(or, bson.M{"user_id": userID})
+	}
+	if email != "" {
+		or = append(or,
+			bson.M{"email": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(email) + "$", Options: "i"}},
+			bson.M{"data": primitive.Regex{Pattern: mentionPattern(email), Options: "i"}},
+		)
+	}
+
+	return bson.M{"$or": or}
+}
+
+// ForSubject returns every entry about a user from all of subjectCollections, oldest
+// first, for a subject access request. At least one of userID and email must be set.
+func (l *LogEntry) ForSubject(userID int, email string) ([]*LogEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "created_at", Value: 1}})
+
+	logEntries := []*LogEntry{}
+	for _, name := range subjectCollections {
+		collection := client.Database("logs").Collection(name)
+
+		cursor, err := collection.Find(ctx, subjectFilter(userID, email), opts)
+		if err != nil {
+			log.Println("Error finding log entries: ", err)
+			return nil, err
+		}
+
+		for cursor.Next(ctx) {
+			var logEntry LogEntry
+			err := cursor.Decode(&logEntry)
+			if err != nil {
+				cursor.Close(ctx)
+				log.Println("Error decoding log entry: ", err)
+				return nil, err
+			}
+			logEntries = append(logEntries, &logEntry)
+		}
+
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(logEntries, func(i, j int) bool {
+		return logEntries[i].CreatedAt.Before(logEntries[j].CreatedAt)
+	})
+
+	return logEntries, nil
+}
+
+// erasedSubject records a user whose entries were redacted, so entries about them
+// that arrive later, such as audit events still queued when they were erased, are
+// redacted as they are written. The address is kept only as a hash.
+type erasedSubject struct {
+	UserID    int    `bson:"user_id,omitempty"`
+	EmailHash string `bson:"email_hash,omitempty"`
+}
+
+// hashEmail is how an address is stored in erased_subjects. Addresses are compared
+// without regard to case, so it is folded first.
+func hashEmail(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+// addressPattern finds what look like email addresses in free text, bounded the same
+// way as in mentionPattern
+var addressPattern = regexp.MustCompile(`[` + addressChars + `]+@[` + addressChars + `]+`)
+
+// mentionedAddresses returns the addresses that appear in data, without a full stop
+// that ends a sentence after one
+func mentionedAddresses(data string) []string {
+	var addresses []string
+	for _, address := range addressPattern.FindAllString(data, -1) {
+		addresses = append(addresses, strings.TrimRight(address, "."))
+	}
+
+	return addresses
+}
+
+// RedactIfErased blanks entry the same way Redact does if it is about a user who has
+// been erased: tagged with their user ID or address, or mentioning the address in its
+// data.
+func (l *LogEntry) RedactIfErased(entry *LogEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	var hashes bson.A
+	if entry.Email != "" {
+		hashes = append(hashes, hashEmail(entry.Email))
+	}
+	for _, address := range mentionedAddresses(entry.Data) {
+		hashes = append(hashes, hashEmail(address))
+	}
+
+	var or bson.A
+	if entry.UserID > 0 {
+		or = append(or, bson.M{"user_id": entry.UserID})
+	}
+	if len(hashes) > 0 {
+		or = append(or, bson.M{"email_hash": bson.M{"$in": hashes}})
+	}
+	if len(or) == 0 {
+		return nil
+	}
+
+	collection := client.Database("logs").Collection("erased_subjects")
+
+	count, err := collection.CountDocuments(ctx, bson.M{"$or": or}, options.Count().SetLimit(1))
+	if err != nil {
+		log.Println("Error checking erased subjects: ", err)
+		return err
+	}
+
+	if count > 0 {
+		entry.Data = "[redacted]"
+		entry.Email = ""
+		entry.Redacted = true
+	}
+
+	return nil
+}
+
+// Redact blanks the data and email address of every entry about a user in all of
+// subjectCollections, keeping the entry's name and time so the log still shows that
+// something happened. It returns how many entries were changed. The user is
+// remembered in erased_subjects, so entries about them written later are redacted
+// too. At least one of userID and email must be set.
+func (l *LogEntry) Redact(userID int, email string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// remembered first, so nothing written while the existing entries are redacted
+	// slips through
+	subject := erasedSubject{UserID: userID}
+	if email != "" {
+		subject.EmailHash = hashEmail(email)
+	}
+	_, err := client.Database("logs").Collection("erased_subjects").UpdateOne(
+		ctx,
+		subject,
+		bson.M{"$set": subject},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Println("Error recording erased subject: ", err)
+		return 0, err
+	}
+
+	var redacted int64
+	for _, name := range subjectCollections {
+		collection := client.Database("logs").Collection(name)
+
+		result, err := collection.UpdateMany(
+			ctx,
+			subjectFilter(userID, email),
+			bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: "data", Value: "[redacted]"},
+					{Key: "redacted", Value: true},
+					{Key: "updated_at", Value: time.Now()},
+				}},
+				{Key: "$unset", Value: bson.D{
+					{Key: "email", Value: ""},
+				}},
+			},
+		)
+		if err != nil {
+			log.Println("Error redacting log entries: ", err)
+			return redacted, err
+		}
+
+		redacted += result.ModifiedCount
+	}
+
+	return redacted, nil
+}
+
+// ForOrganization returns the entries of one organization, newest first
+func (l *LogEntry) ForOrganization(orgID int) ([]*LogEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	collection := client.Database("logs").Collection("log_entries")
+
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "created_at", Value: -1}})
+
+	cursor, err := collection.Find(ctx, bson.M{"organization_id": orgID}, opts)
+	if err != nil {
+		log.Println("Error finding log entries: ", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	logEntries := []*LogEntry{}
+	for cursor.Next(ctx) {
+		var logEntry LogEntry
+		err := cursor.Decode(&logEntry)
+		if err != nil {
+			log.Println("Error decoding log entry: ", err)
+			return nil, err
+		}
+		logEntries = append(logEntries, &logEntry)
+	}
+
+	return logEntries, cursor.Err()
+}
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMentionPattern(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{"bob@example.com", true},
+		{"password reset for bob@example.com", true},
+		{"login by bob@example.com.", true},
+		{"to: <bob@example.com>, cc: ann@example.com", true},
+		{"BOB@Example.com logged in", true},
+		{"jimbob@example.com logged in", false},
+		{"bob@example.com.au logged in", false},
+		{"bob@example.community logged in", false},
+		{"x.bob@example.com logged in", false},
+		{"bob@example.com-mail.org logged in", false},
+	}
+
+	pattern := regexp.MustCompile("(?i)" + mentionPattern("bob@example.com"))
+	for _, tt := range tests {
+		if got := pattern.MatchString(tt.data); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestMentionedAddresses(t *testing.T) {
+	tests := []struct {
+		data string
+		want []string
+	}{
+		{"", nil},
+		{"no address here", nil},
+		{"password reset for bob@example.com", []string{"bob@example.com"}},
+		{"login by bob@example.com.", []string{"bob@example.com"}},
+		{"to: <bob@example.com>, cc: Ann@Example.com", []string{"bob@example.com", "Ann@Example.com"}},
+	}
+
+	for _, tt := range tests {
+		got := mentionedAddresses(tt.data)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%q: got %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestHashEmailFoldsCase(t *testing.T) {
+	if hashEmail("Bob@Example.com") != hashEmail(" bob@example.com") {
+		t.Error("addresses differing only in case and spaces hash differently")
+	}
+	if hashEmail("bob@example.com") == hashEmail("jimbob@example.com") {
+		t.Error("different addresses hash the same")
+	}
+}
@@ -8,6 +8,8 @@ func (app *Config) SendMail(w http.ResponseWriter, r *http.Request) {
 		To string `json:"to"`
 		Subject string `json:"subject"`
 		Message string `json:"message"`
+		// OrganizationID is the tenant the message is sent for, if any
+		OrganizationID int `json:"organization_id,omitempty"`
 	}
 
 	var requestPayload mailMessage
@@ -23,6 +25,7 @@ func (app *Config) SendMail(w http.ResponseWriter, r *http.Request) {
 		To: requestPayload.To,
 		Subject: requestPayload.Subject,
 		Data: requestPayload.Message,
+		OrganizationID: requestPayload.OrganizationID,
 	}
 
 	err = app.Mailer.SendSMTPMessage(msg)
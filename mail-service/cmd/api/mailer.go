@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"html/template"
+	"strconv"
 	"time"
 
 	"github.com/vanng822/go-premailer/premailer"
@@ -28,6 +29,8 @@ type Message struct {
 	Attachments []string
 	Data        any
 	DataMap     map[string]any
+	// OrganizationID tags the message with the tenant it was sent for
+	OrganizationID int
 }
 
 func (m *Mail) SendSMTPMessage(msg Message) error {
@@ -80,6 +83,10 @@ func (m *Mail) SendSMTPMessage(msg Message) error {
 		AddTo(msg.To).
 		SetSubject(msg.Subject)
 
+	if msg.OrganizationID != 0 {
+		email.AddHeader("X-Organization-ID", strconv.Itoa(msg.OrganizationID))
+	}
+
 	email.SetBody(mail.TextPlain, plainMessage)
 	email.AddAlternative(mail.TextHTML, formmattedMessage)
 
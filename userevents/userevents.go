@@ -0,0 +1,159 @@
+// Package userevents describes the user lifecycle events the authentication service
+// publishes, for services that want to react to users being created, changed, deleted
+// or logging in.
+//
+// Every event is an Envelope, sent as JSON to the Exchange topic exchange with the
+// event type as its routing key: bind a queue to "user.*" to get all of them, or to a
+// single type. The payload in Data depends on the type:
+//
+//	user.created  Created
+//	user.updated  Updated (this includes a new user verifying their email address,
+//	              which changes their status to active)
+//	user.deleted  Deleted
+//	user.login    Login
+//
+// Events are written to an outbox in the same transaction as the change they describe
+// and relayed from there, so they survive RabbitMQ being down. Delivery is at least
+// once: consumers should skip IDs they have already handled.
+package userevents
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Exchange is the durable topic exchange user events are published to
+const Exchange = "users_topic"
+
+// Version is the schema version of the events in this package. Fields may be added
+// to a payload without a new version; removing, renaming or retyping one needs a new
+// version, so consumers can tell which shape they have been sent.
+const Version = 1
+
+// the event types, which are also the routing keys
+const (
+	TypeCreated = "user.created"
+	TypeUpdated = "user.updated"
+	TypeDeleted = "user.deleted"
+	TypeLogin   = "user.login"
+)
+
+// ErrUnknownVersion is returned by Decode for events newer than this package
+var ErrUnknownVersion = errors.New("unknown user event version")
+
+// Envelope is what is published for every event
+type Envelope struct {
+	// ID is unique to the event, and is also the message ID of the AMQP message
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Version    int       `json:"version"`
+	OccurredAt time.Time `json:"occurred_at"`
+	// Data is the payload for Type, one of the structs below
+	Data json.RawMessage `json:"data"`
+}
+
+// User is a user as it is after the event
+type User struct {
+	ID        int    `json:"id"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	// Status is one of pending_verification, active, suspended, locked and deleted
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Created is the payload of user.created
+type Created struct {
+	User User `json:"user"`
+}
+
+// Updated is the payload of user.updated. Changed names the fields of User that
+// changed: email, first_name, last_name or status.
+type Updated struct {
+	User    User     `json:"user"`
+	Changed []string `json:"changed"`
+	// PreviousStatus is set when the status changed
+	PreviousStatus string `json:"previous_status,omitempty"`
+}
+
+// Deleted is the payload of user.deleted. Erased users have had their personal
+// details removed but keep their ID, so records that refer to it still resolve; other
+// deleted users are gone altogether.
+type Deleted struct {
+	UserID int  `json:"user_id"`
+	Erased bool `json:"erased"`
+}
+
+// Login is the payload of user.login, sent when a user is given a session
+type Login struct {
+	UserID int `json:"user_id"`
+	// MFA is true when the login was also checked with a second factor
+	MFA bool `json:"mfa"`
+	// OrganizationID is the organization the session was opened in, if any
+	OrganizationID int `json:"organization_id,omitempty"`
+}
+
+// New wraps data in an envelope for an event of the given type, with a new ID
+func New(eventType string, occurredAt time.Time, data any) (Envelope, error) {
+	id, err := newID()
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		ID:         id,
+		Type:       eventType,
+		Version:    Version,
+		OccurredAt: occurredAt.UTC(),
+		Data:       body,
+	}, nil
+}
+
+// Parse reads an envelope from the body of a message
+func Parse(body []byte) (Envelope, error) {
+	var e Envelope
+	err := json.Unmarshal(body, &e)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	if e.ID == "" || e.Type == "" {
+		return Envelope{}, errors.New("user event is missing its id or type")
+	}
+
+	return e, nil
+}
+
+// Decode reads the envelope's payload into v, which should be the payload struct for
+// its type. It returns ErrUnknownVersion for events of a version this package
+// doesn't describe.
+func (e Envelope) Decode(v any) error {
+	if e.Version < 1 || e.Version > Version {
+		return fmt.Errorf("%w: %s version %d", ErrUnknownVersion, e.Type, e.Version)
+	}
+
+	return json.Unmarshal(e.Data, v)
+}
+
+// newID returns a random version 4 UUID
+func newID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}